@@ -17,6 +17,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sourcegraph/go-diff/diff"
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/internal/goroutine"
+	searcherclient "github.com/sourcegraph/sourcegraph/cmd/searcher/client"
 	"github.com/sourcegraph/sourcegraph/internal/env"
 	"github.com/sourcegraph/sourcegraph/internal/errcode"
 	"github.com/sourcegraph/sourcegraph/internal/lazyregexp"
@@ -282,7 +283,8 @@ func callCodemodInRepo(ctx context.Context, repoRevs *search.RepositoryRevisions
 		if err != nil {
 			return nil, err
 		}
-		return nil, errors.WithStack(&searcherError{StatusCode: resp.StatusCode, Message: string(body)})
+		// The replacer responds with the status codes of searcher.
+		return nil, errors.WithStack(&searcherclient.Error{StatusCode: resp.StatusCode, Message: string(body)})
 	}
 
 	scanner := bufio.NewScanner(resp.Body)
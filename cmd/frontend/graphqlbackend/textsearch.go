@@ -2,9 +2,8 @@ package graphqlbackend
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -19,12 +18,14 @@ import (
 	"github.com/sourcegraph/sourcegraph/internal/metrics"
 
 	"github.com/opentracing-contrib/go-stdlib/nethttp"
-	"github.com/opentracing/opentracing-go"
 	otlog "github.com/opentracing/opentracing-go/log"
 
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/types"
+	searcherclient "github.com/sourcegraph/sourcegraph/cmd/searcher/client"
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
 	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/endpoint"
+	"github.com/sourcegraph/sourcegraph/internal/env"
 	"github.com/sourcegraph/sourcegraph/internal/errcode"
 	"github.com/sourcegraph/sourcegraph/internal/gitserver"
 	"github.com/sourcegraph/sourcegraph/internal/mutablelimiter"
@@ -41,13 +42,15 @@ var (
 
 	requestCounter = metrics.NewRequestMeter("textsearch", "Total number of requests sent to the textsearch API.")
 
+	searchTransport = &http.Transport{
+		// Default is 2, but we can send many concurrent requests
+		MaxIdleConnsPerHost: 500,
+	}
+
 	searchHTTPClient = &http.Client{
 		// nethttp.Transport will propagate opentracing spans
 		Transport: &nethttp.Transport{
-			RoundTripper: requestCounter.Transport(&http.Transport{
-				// Default is 2, but we can send many concurrent requests
-				MaxIdleConnsPerHost: 500,
-			}, func(u *url.URL) string {
+			RoundTripper: requestCounter.Transport(searchTransport, func(u *url.URL) string {
 				// TODO(uwedeportivo): remove once codemod has its own client
 				if strings.Contains(u.String(), "replacer") {
 					return "replace"
@@ -56,8 +59,30 @@ var (
 			}),
 		},
 	}
+
+	searcherAuthToken = env.Get("SEARCHER_AUTH_TOKEN", "", "the shared secret sent to searchers configured with SEARCHER_AUTH_TOKEN")
+	searcherCertFile  = env.Get("SEARCHER_CLIENT_CERT_FILE", "", "if set with SEARCHER_CLIENT_KEY_FILE, the PEM encoded client certificate presented to searchers served over TLS")
+	searcherKeyFile   = env.Get("SEARCHER_CLIENT_KEY_FILE", "", "the PEM encoded private key of SEARCHER_CLIENT_CERT_FILE")
+	searcherAuthzKey  = env.Get("SEARCHER_AUTHZ_KEY", "", "if set, searches are sent with claims to read the repository they search signed with this key, for searchers configured with the same SEARCHER_AUTHZ_KEY")
+	searcherCAFile    = env.Get("SEARCHER_CA_FILE", "", "if set, the PEM encoded CA certificates searchers served over TLS are verified with instead of the system ones")
+
+	searcherInsecureSkipVerify, _ = strconv.ParseBool(env.Get("SEARCHER_TLS_INSECURE_SKIP_VERIFY", "false", "if true, the certificates of searchers served over TLS are not verified, eg because they are self-signed (see SEARCHER_TLS_SELF_SIGNED)"))
 )
 
+func init() {
+	if searcherCertFile == "" && searcherKeyFile == "" && searcherCAFile == "" && !searcherInsecureSkipVerify {
+		return
+	}
+	config, err := searcherclient.TLSConfig(searcherCertFile, searcherKeyFile, searcherCAFile)
+	if err != nil {
+		log.Fatalf("invalid searcher TLS configuration: %s", err)
+	}
+	config.InsecureSkipVerify = searcherInsecureSkipVerify
+	searchTransport.TLSClientConfig = config
+	// A custom TLSClientConfig otherwise disables HTTP/2.
+	searchTransport.ForceAttemptHTTP2 = true
+}
+
 // A light wrapper around the search service. We implement the service here so
 // that we can unmarshal the result directly into graphql resolvers.
 
@@ -190,173 +215,72 @@ func textSearch(ctx context.Context, searcherURLs *endpoint.Map, repo gitserver.
 		return mockTextSearch(ctx, repo, commit, p, fetchTimeout)
 	}
 
-	tr, ctx := trace.New(ctx, "searcher.client", fmt.Sprintf("%s@%s", repo.Name, commit))
+	tr, ctx := trace.New(ctx, "textSearch", fmt.Sprintf("%s@%s", repo.Name, commit))
 	defer func() {
 		tr.SetError(err)
 		tr.Finish()
 	}()
 
-	q := url.Values{
-		"Repo":            []string{string(repo.Name)},
-		"URL":             []string{repo.URL},
-		"Commit":          []string{string(commit)},
-		"Pattern":         []string{p.Pattern},
-		"ExcludePattern":  []string{p.ExcludePattern},
-		"IncludePatterns": p.IncludePatterns,
-		"FetchTimeout":    []string{fetchTimeout.String()},
-		"Languages":       p.Languages,
-		"CombyRule":       []string{p.CombyRule},
-	}
-	if deadline, ok := ctx.Deadline(); ok {
-		t, err := deadline.MarshalText()
-		if err != nil {
-			return nil, false, err
-		}
-		q.Set("Deadline", string(t))
-	}
-	q.Set("FileMatchLimit", strconv.FormatInt(int64(p.FileMatchLimit), 10))
-	if p.IsRegExp {
-		q.Set("IsRegExp", "true")
-	}
-	if p.IsStructuralPat {
-		q.Set("IsStructuralPat", "true")
-	}
-	if p.IsWordMatch {
-		q.Set("IsWordMatch", "true")
-	}
-	if p.IsCaseSensitive {
-		q.Set("IsCaseSensitive", "true")
-	}
-	if p.PathPatternsAreRegExps {
-		q.Set("PathPatternsAreRegExps", "true")
-	}
-	if p.PathPatternsAreCaseSensitive {
-		q.Set("PathPatternsAreCaseSensitive", "true")
+	req := &protocol.Request{
+		Repo:   repo.Name,
+		URL:    repo.URL,
+		Commit: commit,
+		PatternInfo: protocol.PatternInfo{
+			Pattern:                      p.Pattern,
+			IsRegExp:                     p.IsRegExp,
+			IsStructuralPat:              p.IsStructuralPat,
+			IsWordMatch:                  p.IsWordMatch,
+			IsCaseSensitive:              p.IsCaseSensitive,
+			ExcludePattern:               p.ExcludePattern,
+			IncludePatterns:              p.IncludePatterns,
+			PathPatternsAreRegExps:       p.PathPatternsAreRegExps,
+			PathPatternsAreCaseSensitive: p.PathPatternsAreCaseSensitive,
+			FileMatchLimit:               int(p.FileMatchLimit),
+			PatternMatchesContent:        p.PatternMatchesContent,
+			PatternMatchesPath:           p.PatternMatchesPath,
+			Languages:                    p.Languages,
+			CombyRule:                    p.CombyRule,
+		},
+		FetchTimeout: fetchTimeout.String(),
 	}
-	// TEMP BACKCOMPAT: always set even if false so that searcher can distinguish new frontends that send
-	// these fields from old frontends that do not (and provide a default in the latter case).
-	q.Set("PatternMatchesContent", strconv.FormatBool(p.PatternMatchesContent))
-	q.Set("PatternMatchesPath", strconv.FormatBool(p.PatternMatchesPath))
-	rawQuery := q.Encode()
-
-	// Searcher caches the file contents for repo@commit since it is
-	// relatively expensive to fetch from gitserver. So we use consistent
-	// hashing to increase cache hits.
-	consistentHashKey := string(repo.Name) + "@" + string(commit)
-	tr.LazyPrintf("%s", consistentHashKey)
-
-	var (
-		// When we retry do not use a host we already tried.
-		excludedSearchURLs = map[string]bool{}
-		attempt            = 0
-		maxAttempts        = 2
-	)
-	for {
-		attempt++
-
-		searcherURL, err := searcherURLs.Get(consistentHashKey, excludedSearchURLs)
-		if err != nil {
-			return nil, false, err
-		}
-
-		// Fallback to a bad host if nothing is left
-		if searcherURL == "" {
-			tr.LazyPrintf("failed to find endpoint, trying again without excludes")
-			searcherURL, err = searcherURLs.Get(consistentHashKey, nil)
-			if err != nil {
-				return nil, false, err
-			}
-		}
-
-		url := searcherURL + "?" + rawQuery
-		tr.LazyPrintf("attempt %d: %s", attempt, url)
-		matches, limitHit, err = textSearchURL(ctx, url)
-		// Useful trace for debugging:
-		//
-		// tr.LazyPrintf("%d matches, limitHit=%v, err=%v, ctx.Err()=%v", len(matches), limitHit, err, ctx.Err())
-		if err == nil || errcode.IsTimeout(err) {
-			return matches, limitHit, err
-		}
-
-		// If we are canceled, return that error.
-		if err := ctx.Err(); err != nil {
-			return nil, false, err
-		}
-
-		// If not temporary or our last attempt then don't try again.
-		if !errcode.IsTemporary(err) || attempt == maxAttempts {
-			return nil, false, err
-		}
 
-		tr.LazyPrintf("transient error %s", err.Error())
-		// Retry search on another searcher instance (if possible)
-		excludedSearchURLs[searcherURL] = true
+	c := searcherclient.New(searcherURLs)
+	c.HTTPClient = searchHTTPClient
+	c.AuthToken = searcherAuthToken
+	if searcherAuthzKey != "" {
+		// The repositories searched are those the user may read.
+		c.Authorization = searcherclient.SignedClaims([]byte(searcherAuthzKey), time.Minute)
 	}
-}
-
-func textSearchURL(ctx context.Context, url string) ([]*FileMatchResolver, bool, error) {
-	req, err := http.NewRequest("GET", url, nil)
+	resp, err := c.Search(ctx, req)
 	if err != nil {
 		return nil, false, err
 	}
-	req = req.WithContext(ctx)
-
-	req, ht := nethttp.TraceRequest(opentracing.GlobalTracer(), req,
-		nethttp.OperationName("Searcher Client"),
-		nethttp.ClientTrace(false))
-	defer ht.Finish()
-
-	// Do not lose the context returned by TraceRequest
-	ctx = req.Context()
 
-	resp, err := searchHTTPClient.Do(req)
-	if err != nil {
-		// If we failed due to cancellation or timeout (with no partial results in the response
-		// body), return just that.
-		if ctx.Err() != nil {
-			err = ctx.Err()
-		}
-		return nil, false, errors.Wrap(err, "searcher request failed")
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, false, err
+	matches = make([]*FileMatchResolver, 0, len(resp.Matches))
+	for _, fm := range resp.Matches {
+		lineMatches := make([]*lineMatch, 0, len(fm.LineMatches))
+		for _, lm := range fm.LineMatches {
+			offsetAndLengths := make([][2]int32, 0, len(lm.OffsetAndLengths))
+			for _, ol := range lm.OffsetAndLengths {
+				offsetAndLengths = append(offsetAndLengths, [2]int32{int32(ol[0]), int32(ol[1])})
+			}
+			lineMatches = append(lineMatches, &lineMatch{
+				JPreview:          lm.Preview,
+				JOffsetAndLengths: offsetAndLengths,
+				JLineNumber:       int32(lm.LineNumber),
+				JLimitHit:         lm.LimitHit,
+			})
 		}
-		return nil, false, errors.WithStack(&searcherError{StatusCode: resp.StatusCode, Message: string(body)})
+		matches = append(matches, &FileMatchResolver{
+			JPath:        fm.Path,
+			JLineMatches: lineMatches,
+			JLimitHit:    fm.LimitHit,
+		})
 	}
-
-	r := struct {
-		Matches     []*FileMatchResolver
-		LimitHit    bool
-		DeadlineHit bool
-	}{}
-	err = json.NewDecoder(resp.Body).Decode(&r)
-	if err != nil {
-		return nil, false, errors.Wrap(err, "searcher response invalid")
-	}
-	if r.DeadlineHit {
+	if resp.DeadlineHit {
 		err = context.DeadlineExceeded
 	}
-	return r.Matches, r.LimitHit, err
-}
-
-type searcherError struct {
-	StatusCode int
-	Message    string
-}
-
-func (e *searcherError) BadRequest() bool {
-	return e.StatusCode == http.StatusBadRequest
-}
-
-func (e *searcherError) Temporary() bool {
-	return e.StatusCode == http.StatusServiceUnavailable
-}
-
-func (e *searcherError) Error() string {
-	return e.Message
+	return matches, resp.LimitHit, err
 }
 
 var mockSearchFilesInRepo func(ctx context.Context, repo *types.Repo, gitserverRepo gitserver.Repo, rev string, info *search.TextPatternInfo, fetchTimeout time.Duration) (matches []*FileMatchResolver, limitHit bool, err error)
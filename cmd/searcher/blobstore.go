@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	sgstore "github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// newBlobStore returns the store.BlobStore for rawurl, which is one of
+//
+//	s3://bucket/prefix
+//	s3://bucket/prefix?endpoint=http://minio:9000 (MinIO or another S3 compatible store)
+//	gs://bucket/prefix
+//
+// Credentials are read from the environment as usual for each SDK.
+func newBlobStore(ctx context.Context, rawurl string) (sgstore.BlobStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no bucket in %q", rawurl)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "s3":
+		cfg, err := external.LoadDefaultAWSConfig()
+		if err != nil {
+			return nil, err
+		}
+		endpoint := u.Query().Get("endpoint")
+		if endpoint != "" {
+			cfg.EndpointResolver = aws.ResolveWithEndpointURL(endpoint)
+		}
+		client := s3.New(cfg)
+		// MinIO and most other S3 compatible stores don't support virtual
+		// hosted buckets.
+		client.ForcePathStyle = endpoint != ""
+		return &s3BlobStore{client: client, bucket: u.Host, prefix: prefix}, nil
+	case "gs":
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &gcsBlobStore{bucket: client.Bucket(u.Host), prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("unsupported blob store scheme %q (must be s3 or gs)", u.Scheme)
+}
+
+type s3BlobStore struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func (b *s3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := b.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(path.Join(b.prefix, key)),
+	}).Send(ctx)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *s3BlobStore) Put(ctx context.Context, key string, r io.ReadSeeker, size int64) error {
+	_, err := b.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:        aws.String(b.bucket),
+		Key:           aws.String(path.Join(b.prefix, key)),
+		Body:          r,
+		ContentLength: aws.Int64(size),
+	}).Send(ctx)
+	return err
+}
+
+type gcsBlobStore struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func (b *gcsBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	r, err := b.bucket.Object(path.Join(b.prefix, key)).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, nil
+	}
+	return r, err
+}
+
+func (b *gcsBlobStore) Put(ctx context.Context, key string, r io.ReadSeeker, size int64) error {
+	w := b.bucket.Object(path.Join(b.prefix, key)).NewWriter(ctx)
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
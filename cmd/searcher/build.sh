@@ -16,7 +16,7 @@ export GOARCH=amd64
 export GOOS=linux
 export CGO_ENABLED=0
 
-for pkg in github.com/sourcegraph/sourcegraph/cmd/searcher; do
+for pkg in github.com/sourcegraph/sourcegraph/cmd/searcher github.com/sourcegraph/sourcegraph/cmd/searcher/cmd/searcher-query; do
     go build -trimpath -ldflags "-X github.com/sourcegraph/sourcegraph/internal/version.version=$VERSION" -buildmode exe -tags dist -o $OUTPUT/$(basename $pkg) $pkg
 done
 
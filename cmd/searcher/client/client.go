@@ -0,0 +1,476 @@
+// Package client is a typed client for the searcher service. It owns the
+// wire protocol (encoding a protocol.Request, decoding a protocol.Response)
+// so that callers do not need to hand-roll HTTP requests against searcher.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/schema"
+	"github.com/opentracing-contrib/go-stdlib/nethttp"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/endpoint"
+	"github.com/sourcegraph/sourcegraph/internal/errcode"
+	"github.com/sourcegraph/sourcegraph/internal/trace"
+)
+
+// DefaultHTTPClient is the http.Client used when Client.HTTPClient is nil.
+var DefaultHTTPClient = &http.Client{
+	// nethttp.Transport will propagate opentracing spans
+	Transport: &nethttp.Transport{
+		RoundTripper: &http.Transport{
+			// Default is 2, but we can send many concurrent requests
+			MaxIdleConnsPerHost: 500,
+		},
+	},
+}
+
+// Client is a searcher service client.
+type Client struct {
+	// Endpoints is the consistent hash map of searcher replicas.
+	Endpoints *endpoint.Map
+
+	// HTTPClient is the client to use. If nil, DefaultHTTPClient is used.
+	HTTPClient *http.Client
+
+	// MaxAttempts is the number of searcher replicas a request is sent to
+	// when it fails with a temporary error. It defaults to 2.
+	MaxAttempts int
+
+	// AuthToken if non-empty is sent in protocol.AuthHeader, for searchers
+	// which require a shared secret.
+	AuthToken string
+
+	// Authorization if non-nil returns the credentials sent in
+	// protocol.AuthzHeader with requests reading repo, for searchers which
+	// authorize requests per repository (eg SignedClaims).
+	Authorization func(ctx context.Context, repo api.RepoName) (string, error)
+}
+
+// New returns a Client which sends requests to endpoints.
+func New(endpoints *endpoint.Map) *Client {
+	return &Client{Endpoints: endpoints}
+}
+
+var encoder = schema.NewEncoder()
+
+// Search searches p.Repo@p.Commit and returns the response once all matches
+// have been received.
+//
+// If the searcher hit the request deadline, the partial response is returned
+// with DeadlineHit set and a nil error.
+func (c *Client) Search(ctx context.Context, p *protocol.Request) (*protocol.Response, error) {
+	var matches []protocol.FileMatch
+	resp, err := c.SearchStream(ctx, p, func(fm protocol.FileMatch) {
+		matches = append(matches, fm)
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Matches = matches
+	return resp, nil
+}
+
+// SearchStream is like Search, but calls onMatch for each FileMatch as it is
+// decoded from the response instead of buffering them. The returned
+// Response does not contain any Matches.
+func (c *Client) SearchStream(ctx context.Context, p *protocol.Request, onMatch func(protocol.FileMatch)) (resp *protocol.Response, err error) {
+	tr, ctx := trace.New(ctx, "searcher.client", fmt.Sprintf("%s@%s", p.Repo, p.Commit))
+	defer func() {
+		tr.SetError(err)
+		tr.Finish()
+	}()
+
+	// Send both PatternType and the flags it replaces, so that searchers
+	// which predate PatternType interpret the request the same way.
+	normalized := *p
+	if err := normalized.PatternInfo.Normalize(); err != nil {
+		return nil, errors.WithStack(&Error{StatusCode: http.StatusBadRequest, Message: err.Error()})
+	}
+	q := url.Values{}
+	if err := encoder.Encode(&normalized, q); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok && p.Deadline == "" {
+		t, err := deadline.MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		q.Set("Deadline", string(t))
+	}
+	rawQuery := q.Encode()
+
+	// Searcher caches the file contents for repo@commit since it is
+	// relatively expensive to fetch from gitserver. So we use consistent
+	// hashing on the repo to increase cache hits.
+	consistentHashKey := protocol.RoutingKey(p.Repo)
+	tr.LazyPrintf("%s", consistentHashKey)
+
+	maxAttempts := c.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 2
+	}
+
+	var (
+		// When we retry do not use a host we already tried.
+		excludedSearchURLs = map[string]bool{}
+		attempt            = 0
+	)
+	for {
+		attempt++
+
+		searcherURL, err := c.Endpoints.Get(consistentHashKey, excludedSearchURLs)
+		if err != nil {
+			return nil, err
+		}
+
+		// Fallback to a bad host if nothing is left
+		if searcherURL == "" {
+			tr.LazyPrintf("failed to find endpoint, trying again without excludes")
+			searcherURL, err = c.Endpoints.Get(consistentHashKey, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		url := searcherURL + "?" + rawQuery
+		tr.LazyPrintf("attempt %d: %s", attempt, url)
+		resp, err = c.do(ctx, url, p.Repo, onMatch)
+		if err == nil || errcode.IsTimeout(err) {
+			return resp, err
+		}
+
+		// If we are canceled, return that error.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// If not temporary or our last attempt then don't try again.
+		if !errcode.IsTemporary(err) || attempt == maxAttempts {
+			return nil, err
+		}
+
+		tr.LazyPrintf("transient error %s", err.Error())
+		// Retry search on another searcher instance (if possible)
+		excludedSearchURLs[searcherURL] = true
+
+		// An overloaded searcher tells us how long to back off for. We
+		// add jitter so that the clients it rejected don't all come back
+		// at once.
+		if wait := retryAfter(err); wait > 0 {
+			wait = wait/2 + time.Duration(rand.Int63n(int64(wait)))
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+				return nil, err
+			}
+			tr.LazyPrintf("waiting %s before retrying", wait)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, url string, repo api.RepoName, onMatch func(protocol.FileMatch)) (*protocol.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(protocol.RoutingKeyHeader, protocol.RoutingKey(repo))
+	// Searchers which predate version negotiation ignore the header. They
+	// speak version 1, which the request is also valid for since we send
+	// the legacy pattern flags.
+	req.Header.Set(protocol.VersionHeader, strconv.Itoa(protocol.Version))
+	if err := c.setAuth(ctx, req, repo); err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	req, ht := nethttp.TraceRequest(opentracing.GlobalTracer(), req,
+		nethttp.OperationName("Searcher Client"),
+		nethttp.ClientTrace(false))
+	defer ht.Finish()
+
+	// Do not lose the context returned by TraceRequest
+	ctx = req.Context()
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = DefaultHTTPClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		// If we failed due to cancellation or timeout (with no partial results in the response
+		// body), return just that.
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, errors.Wrap(err, "searcher request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.WithStack(&Error{
+			StatusCode: resp.StatusCode,
+			Message:    string(body),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		})
+	}
+
+	r, err := decodeResponse(resp.Body, onMatch)
+	if err != nil {
+		return nil, errors.Wrap(err, "searcher response invalid")
+	}
+	return r, nil
+}
+
+// Endpoint returns the URL of the searcher replica which requests about repo
+// are sent to. Other services which talk to searcher directly should use it
+// so that their requests land on the replica which has the repository's
+// archives cached.
+func (c *Client) Endpoint(repo api.RepoName) (string, error) {
+	return c.Endpoints.Get(protocol.RoutingKey(repo), nil)
+}
+
+// CacheStatus describes an archive in a searcher's cache.
+type CacheStatus struct {
+	// Cached is true if the archive is cached. The other fields are only
+	// set if it is.
+	Cached bool
+
+	// Size is the size of the cached archive in bytes.
+	Size int64
+
+	// LastUsed is when the cached archive was last used.
+	LastUsed time.Time
+}
+
+// Cached reports whether the searcher replica which Search would send a
+// request for repo@commit to has the archive of repo at commit cached. It
+// can be used to estimate the latency of searching it.
+func (c *Client) Cached(ctx context.Context, repo api.RepoName, commit api.CommitID) (*CacheStatus, error) {
+	searcherURL, err := c.Endpoint(repo)
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{"repo": {string(repo)}, "commit": {string(commit)}}
+	req, err := http.NewRequest("HEAD", strings.TrimSuffix(searcherURL, "/")+"/cached?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(protocol.RoutingKeyHeader, protocol.RoutingKey(repo))
+	if err := c.setAuth(ctx, req, repo); err != nil {
+		return nil, err
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = DefaultHTTPClient
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "searcher request failed")
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return &CacheStatus{}, nil
+	default:
+		return nil, errors.WithStack(&Error{StatusCode: resp.StatusCode, Message: resp.Status})
+	}
+	status := &CacheStatus{Cached: true}
+	if status.Size, err = strconv.ParseInt(resp.Header.Get("X-Archive-Size"), 10, 64); err != nil {
+		return nil, errors.Wrap(err, "searcher response invalid")
+	}
+	if status.LastUsed, err = http.ParseTime(resp.Header.Get("Last-Modified")); err != nil {
+		return nil, errors.Wrap(err, "searcher response invalid")
+	}
+	return status, nil
+}
+
+// decodeResponse decodes a JSON encoded protocol.Response from r, calling
+// onMatch for each element of Matches as soon as it is decoded.
+func decodeResponse(r io.Reader, onMatch func(protocol.FileMatch)) (*protocol.Response, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	// Every field other than Matches is small, so we collect them and
+	// unmarshal them in one go once the object has been read.
+	rest := map[string]json.RawMessage{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, errors.Errorf("unexpected token %v", tok)
+		}
+
+		if key != "Matches" {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, err
+			}
+			rest[key] = raw
+			continue
+		}
+
+		tok, err = dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if tok == nil {
+			// Matches is null
+			continue
+		}
+		if tok != json.Delim('[') {
+			return nil, errors.Errorf("expected [ for Matches, got %v", tok)
+		}
+		for dec.More() {
+			var fm protocol.FileMatch
+			if err := dec.Decode(&fm); err != nil {
+				return nil, err
+			}
+			onMatch(fm)
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return nil, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(rest)
+	if err != nil {
+		return nil, err
+	}
+	var resp protocol.Response
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return errors.Errorf("expected %v, got %v", want, tok)
+	}
+	return nil
+}
+
+// Error is returned by Client when searcher responds with a non-200 status
+// code. It implements the BadRequest and Temporary predicates used by
+// errcode, and NotCached for searches with NoFetch set.
+type Error struct {
+	StatusCode int
+	Message    string
+
+	// RetryAfter is how long searcher asked us to wait before retrying,
+	// or zero if it did not.
+	RetryAfter time.Duration
+}
+
+func (e *Error) BadRequest() bool {
+	return e.StatusCode == http.StatusBadRequest
+}
+
+// Temporary reports whether the request may succeed if retried, including
+// when searcher shed it because it was overloaded (429).
+func (e *Error) Temporary() bool {
+	return e.StatusCode == http.StatusServiceUnavailable || e.StatusCode == http.StatusTooManyRequests
+}
+
+// NotCached returns true if searcher did not search because the archive was
+// not cached and fetching it was not allowed.
+func (e *Error) NotCached() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// retryAfter returns the RetryAfter of err if it is an *Error.
+func retryAfter(err error) time.Duration {
+	if e, ok := errors.Cause(err).(*Error); ok {
+		return e.RetryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP date. It returns zero if v is empty or
+// invalid.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// setAuth sets the credentials of c for reading repo on req.
+func (c *Client) setAuth(ctx context.Context, req *http.Request, repo api.RepoName) error {
+	if c.AuthToken != "" {
+		req.Header.Set(protocol.AuthHeader, c.AuthToken)
+	}
+	if c.Authorization != nil {
+		credentials, err := c.Authorization(ctx, repo)
+		if err != nil {
+			return errors.Wrap(err, "searcher authorization")
+		}
+		req.Header.Set(protocol.AuthzHeader, credentials)
+	}
+	return nil
+}
+
+// SignedClaims returns a Client.Authorization sending protocol.Claims
+// signed with key, which are valid for ttl, for searchers configured with
+// the same key (see search.ClaimsAuthorizer). Clients using it must check
+// that the user may read the repositories they search themselves.
+func SignedClaims(key []byte, ttl time.Duration) func(ctx context.Context, repo api.RepoName) (string, error) {
+	return func(ctx context.Context, repo api.RepoName) (string, error) {
+		return protocol.SignClaims(key, protocol.Claims{
+			Repos:  []api.RepoName{repo},
+			Expiry: time.Now().Add(ttl).Unix(),
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/endpoint"
+	"github.com/sourcegraph/sourcegraph/internal/errcode"
+)
+
+func TestDecodeResponse(t *testing.T) {
+	cases := map[string]struct {
+		body string
+		want protocol.Response
+	}{
+		"matches": {
+			body: `{"Matches":[{"Path":"a.go","LineMatches":[{"Preview":"foo","LineNumber":1,"OffsetAndLengths":[[0,3]]}]},{"Path":"b.go"}],"LimitHit":true,"DeadlineHit":false}`,
+			want: protocol.Response{
+				Matches: []protocol.FileMatch{
+					{Path: "a.go", LineMatches: []protocol.LineMatch{{Preview: "foo", LineNumber: 1, OffsetAndLengths: [][2]int{{0, 3}}}}},
+					{Path: "b.go"},
+				},
+				LimitHit: true,
+			},
+		},
+		"null matches": {
+			body: `{"Matches":null,"DeadlineHit":true}`,
+			want: protocol.Response{DeadlineHit: true},
+		},
+		"unknown fields": {
+			body: `{"Unknown":{"a":[1,2]},"Matches":[]}`,
+			want: protocol.Response{},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var matches []protocol.FileMatch
+			got, err := decodeResponse(strings.NewReader(tc.body), func(fm protocol.FileMatch) {
+				matches = append(matches, fm)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got.Matches = matches
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Errorf("got %+v, want %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	var gotQuery map[string][]string
+	var gotHeader http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query()
+		gotHeader = r.Header
+		_, _ = w.Write([]byte(`{"Matches":[{"Path":"main.go"}],"LimitHit":false}`))
+	}))
+	defer ts.Close()
+
+	c := New(endpoint.Static(ts.URL))
+	c.AuthToken = "secret"
+	resp, err := c.Search(context.Background(), &protocol.Request{
+		Repo:   "foo",
+		Commit: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo: protocol.PatternInfo{
+			Pattern:         "main",
+			IsRegExp:        true,
+			IncludePatterns: []string{"a", "b"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Matches) != 1 || resp.Matches[0].Path != "main.go" {
+		t.Errorf("unexpected matches %+v", resp.Matches)
+	}
+
+	if got := gotHeader.Get(protocol.RoutingKeyHeader); got != "foo" {
+		t.Errorf("got routing key header %q, want %q", got, "foo")
+	}
+	if got, want := gotHeader.Get(protocol.VersionHeader), strconv.Itoa(protocol.Version); got != want {
+		t.Errorf("got protocol version header %q, want %q", got, want)
+	}
+	if got := gotHeader.Get(protocol.AuthHeader); got != "secret" {
+		t.Errorf("got auth header %q, want %q", got, "secret")
+	}
+
+	for k, want := range map[string][]string{
+		"Repo":                  {"foo"},
+		"Pattern":               {"main"},
+		"PatternType":           {"regexp"},
+		"IsRegExp":              {"true"},
+		"IncludePatterns":       {"a", "b"},
+		"PatternMatchesContent": {"false"},
+	} {
+		if got := gotQuery[k]; !reflect.DeepEqual(got, want) {
+			t.Errorf("query param %s: got %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestSearch_repoAffinity(t *testing.T) {
+	hits := map[string]int{}
+	var urls []string
+	for i := 0; i < 5; i++ {
+		var ts *httptest.Server
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[ts.URL]++
+			_, _ = w.Write([]byte(`{"Matches":[]}`))
+		}))
+		defer ts.Close()
+		urls = append(urls, ts.URL)
+	}
+
+	c := New(endpoint.Static(urls...))
+	for _, commit := range []api.CommitID{"1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222", "3333333333333333333333333333333333333333"} {
+		if _, err := c.Search(context.Background(), &protocol.Request{Repo: "foo", Commit: commit}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := c.Endpoint("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hits, map[string]int{want: 3}) {
+		t.Errorf("expected every commit to be searched on %s, got hits %v", want, hits)
+	}
+}
+
+func TestSearch_errors(t *testing.T) {
+	attempts := 0
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	c := New(endpoint.Static(unavailable.URL))
+	c.MaxAttempts = 3
+	_, err := c.Search(context.Background(), &protocol.Request{Repo: "foo"})
+	if !errcode.IsTemporary(err) {
+		t.Errorf("expected temporary error, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+
+	attempts = 0
+	badRequest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		http.Error(w, "bad", http.StatusBadRequest)
+	}))
+	defer badRequest.Close()
+
+	c = New(endpoint.Static(badRequest.URL))
+	_, err = c.Search(context.Background(), &protocol.Request{Repo: "foo"})
+	if !errcode.IsBadRequest(err) {
+		t.Errorf("expected bad request error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected bad request to not be retried, got %d attempts", attempts)
+	}
+}
+
+func TestSearch_retryAfter(t *testing.T) {
+	var attempts []time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts = append(attempts, time.Now())
+		if len(attempts) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "overloaded", http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(`{"Matches":[]}`))
+	}))
+	defer ts.Close()
+
+	c := New(endpoint.Static(ts.URL))
+	if _, err := c.Search(context.Background(), &protocol.Request{Repo: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(attempts))
+	}
+	// Retry-After is 1s, jittered to between 0.5s and 1.5s.
+	if wait := attempts[1].Sub(attempts[0]); wait < 500*time.Millisecond {
+		t.Errorf("expected the retry to wait at least 500ms, waited %s", wait)
+	}
+
+	// We give up rather than wait past our deadline.
+	attempts = nil
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := c.Search(ctx, &protocol.Request{Repo: "foo"})
+	if !errcode.IsTemporary(err) {
+		t.Errorf("expected temporary error, got %v", err)
+	}
+	if len(attempts) != 1 {
+		t.Errorf("expected 1 attempt, got %d", len(attempts))
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":        0,
+		"3":       3 * time.Second,
+		"-1":      0,
+		"garbage": 0,
+		time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat): 0,
+	}
+	for v, want := range tests {
+		if got := parseRetryAfter(v); got != want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", v, got, want)
+		}
+	}
+	if got := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("expected an HTTP date an hour from now to parse to about 1h, got %s", got)
+	}
+}
+
+func TestCached(t *testing.T) {
+	lastUsed := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" || r.URL.Path != "/cached" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		if r.URL.Query().Get("repo") != "cached" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Archive-Size", "1234")
+		w.Header().Set("Last-Modified", lastUsed.Format(http.TimeFormat))
+	}))
+	defer ts.Close()
+
+	c := New(endpoint.Static(ts.URL))
+	for repo, want := range map[api.RepoName]CacheStatus{
+		"cached":   {Cached: true, Size: 1234, LastUsed: lastUsed},
+		"uncached": {},
+	} {
+		got, err := c.Cached(context.Background(), repo, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("%s: got %+v, want %+v", repo, *got, want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Command searcher-query sends a single search request to a running searcher
+// and prints the results. It is intended for operators debugging a searcher
+// instance directly, without going through the frontend.
+//
+// Example:
+//
+//	searcher-query -repo github.com/gorilla/mux -commit 599cba5e7b6137d46ddf58fb1765f5d928e69604 -regexp 'func \w+Router'
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/client"
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/endpoint"
+)
+
+var (
+	searcherURL     = flag.String("url", "http://127.0.0.1:3181", "searcher URL")
+	repo            = flag.String("repo", "", "name of the repository to search (required)")
+	commit          = flag.String("commit", "", "absolute commit ID to search (required)")
+	patternType     = flag.String("type", "", "how to interpret the pattern: literal, regexp, structural or standard")
+	isRegExp        = flag.Bool("regexp", false, "treat the pattern as a regular expression (same as -type regexp)")
+	isWordMatch     = flag.Bool("word", false, "only match the pattern at word boundaries")
+	isCaseSensitive = flag.Bool("case", false, "match case sensitively")
+	matchPath       = flag.Bool("path", false, "also match the pattern against file paths")
+	matchContent    = flag.Bool("content", true, "match the pattern against file contents. Use -content=false -path to only match paths")
+	invertMatch     = flag.Bool("invert", false, "list the files whose content does not match the pattern")
+	query           = flag.String("query", "", `JSON encoded query tree to evaluate instead of a pattern. eg {"And":[{"Content":{"Pattern":"foo"}},{"Not":{"Content":{"Pattern":"bar"}}}]}`)
+	replacement     = flag.String("replace", "", "print matching lines with the matches replaced by this template ($1 refers to the first capture)")
+	countOnly       = flag.Bool("count", false, "print the number of matches in each file instead of the matching lines, like grep -c")
+	showDiffs       = flag.Bool("diff", false, "print a unified diff of replacing the matches with the -replace template instead of the matching lines")
+	excludePattern  = flag.String("exclude", "", "glob that may not match the returned files' paths")
+	fileMatchLimit  = flag.Int("limit", 0, "maximum number of files with matches to return")
+	paginate        = flag.Bool("paginate", false, "return files in the order they are searched, and print a cursor for the next page if -limit is hit")
+	cursor          = flag.String("cursor", "", "resume a paginated search from the cursor it printed")
+	fetchTimeout    = flag.Duration("fetch-timeout", 30*time.Second, "how long to wait for the archive to be fetched")
+	timeout         = flag.Duration("timeout", time.Minute, "deadline for the whole request")
+	outputJSON      = flag.Bool("json", false, "print the raw JSON response instead of grep-style output")
+	authToken       = flag.String("auth-token", "", "shared secret of a searcher configured with SEARCHER_AUTH_TOKEN (defaults to $SEARCHER_AUTH_TOKEN)")
+	certFile        = flag.String("cert", "", "PEM encoded client certificate presented to a searcher served over TLS (defaults to $SEARCHER_CLIENT_CERT_FILE)")
+	keyFile         = flag.String("key", "", "PEM encoded private key of -cert (defaults to $SEARCHER_CLIENT_KEY_FILE)")
+	caFile          = flag.String("ca", "", "PEM encoded CA certificates the certificate of a searcher served over TLS is verified with instead of the system ones (defaults to $SEARCHER_CA_FILE)")
+	insecure        = flag.Bool("insecure-skip-verify", envBool("SEARCHER_TLS_INSECURE_SKIP_VERIFY"), "don't verify the certificate of a searcher served over TLS, eg because it is self-signed (defaults to $SEARCHER_TLS_INSECURE_SKIP_VERIFY)")
+
+	includePatterns stringSlice
+)
+
+func main() {
+	flag.Var(&includePatterns, "include", "glob that must match the returned files' paths (may be repeated)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] pattern\n       %s [flags] -query tree\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+	// Like frontend, read credentials from the environment, so they don't
+	// have to be on the command line.
+	defaultFromEnv(authToken, "SEARCHER_AUTH_TOKEN")
+	defaultFromEnv(certFile, "SEARCHER_CLIENT_CERT_FILE")
+	defaultFromEnv(keyFile, "SEARCHER_CLIENT_KEY_FILE")
+	defaultFromEnv(caFile, "SEARCHER_CA_FILE")
+
+	if *repo == "" || *commit == "" || flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	p := &protocol.Request{
+		Repo:   api.RepoName(*repo),
+		Commit: api.CommitID(*commit),
+		PatternInfo: protocol.PatternInfo{
+			Pattern:               flag.Arg(0),
+			PatternType:           protocol.PatternType(*patternType),
+			IsRegExp:              *isRegExp,
+			IsWordMatch:           *isWordMatch,
+			IsCaseSensitive:       *isCaseSensitive,
+			ExcludePattern:        *excludePattern,
+			IncludePatterns:       includePatterns,
+			FileMatchLimit:        *fileMatchLimit,
+			PatternMatchesContent: *matchContent,
+			PatternMatchesPath:    *matchPath,
+			InvertMatch:           *invertMatch,
+			CountOnly:             *countOnly,
+		},
+		Query:               *query,
+		FetchTimeout:        fetchTimeout.String(),
+		IncludeReplacements: *replacement != "" && !*showDiffs,
+		IncludeDiffs:        *showDiffs,
+		Replacement:         *replacement,
+		Paginate:            *paginate,
+		Cursor:              *cursor,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	c := client.New(endpoint.Static(*searcherURL))
+	c.AuthToken = *authToken
+	if *certFile != "" || *keyFile != "" || *caFile != "" || *insecure {
+		config, err := client.TLSConfig(*certFile, *keyFile, *caFile)
+		if err != nil {
+			log.Fatalf("searcher-query: %s", err)
+		}
+		config.InsecureSkipVerify = *insecure
+		c.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: config, ForceAttemptHTTP2: true}}
+	}
+
+	resp, err := c.Search(ctx, p)
+	if err != nil {
+		log.Fatalf("searcher-query: %s", err)
+	}
+
+	if *outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(resp); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	for _, fm := range resp.Matches {
+		if p.IncludeDiffs {
+			fmt.Print(fm.Diff)
+			continue
+		}
+		if p.CountOnly {
+			fmt.Printf("%s:%d\n", fm.Path, fm.MatchCount)
+			continue
+		}
+		if len(fm.LineMatches) == 0 {
+			fmt.Println(fm.Path)
+		}
+		for _, lm := range fm.LineMatches {
+			// LineNumber is 0-based, but grep output is 1-based.
+			preview := lm.Preview
+			if p.IncludeReplacements {
+				preview = applyReplacements(lm)
+			}
+			fmt.Printf("%s:%d:%s\n", fm.Path, lm.LineNumber+1, strings.TrimSuffix(preview, "\n"))
+		}
+	}
+	if resp.Cursor != "" {
+		log.Printf("searcher-query: limit hit, continue with -cursor %s", resp.Cursor)
+	} else if resp.LimitHit {
+		log.Println("searcher-query: limit hit, results may be incomplete")
+	}
+	if resp.DeadlineHit {
+		log.Println("searcher-query: deadline hit, results may be incomplete")
+	}
+}
+
+// applyReplacements returns the Preview of lm with every range replaced by
+// its replacement.
+func applyReplacements(lm protocol.LineMatch) string {
+	preview := []rune(lm.Preview)
+	var b strings.Builder
+	last := 0
+	for i, ol := range lm.OffsetAndLengths {
+		start, end := ol[0], ol[0]+ol[1]
+		if start < last || end > len(preview) || i >= len(lm.Replacements) {
+			continue
+		}
+		b.WriteString(string(preview[last:start]))
+		b.WriteString(lm.Replacements[i])
+		last = end
+	}
+	b.WriteString(string(preview[last:]))
+	return b.String()
+}
+
+// defaultFromEnv sets the flag value v to the environment variable name if
+// the flag wasn't given.
+func defaultFromEnv(v *string, name string) {
+	if *v == "" {
+		*v = os.Getenv(name)
+	}
+}
+
+// envBool returns the boolean value of the environment variable name, or
+// false if it isn't one.
+func envBool(name string) bool {
+	b, _ := strconv.ParseBool(os.Getenv(name))
+	return b
+}
+
+// stringSlice is a flag.Value which collects every occurrence of a flag.
+type stringSlice []string
+
+func (s *stringSlice) String() string { return strings.Join(*s, ",") }
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
@@ -3,7 +3,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -12,23 +15,79 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/opentracing-contrib/go-stdlib/nethttp"
 	opentracing "github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	log15 "gopkg.in/inconshreveable/log15.v2"
 
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
 	"github.com/sourcegraph/sourcegraph/cmd/searcher/search"
 	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/ctags"
 	"github.com/sourcegraph/sourcegraph/internal/debugserver"
+	"github.com/sourcegraph/sourcegraph/internal/endpoint"
 	"github.com/sourcegraph/sourcegraph/internal/env"
 	"github.com/sourcegraph/sourcegraph/internal/gitserver"
+	"github.com/sourcegraph/sourcegraph/internal/profiler"
 	"github.com/sourcegraph/sourcegraph/internal/store"
 	"github.com/sourcegraph/sourcegraph/internal/tracer"
+	"github.com/sourcegraph/sourcegraph/internal/vcs/git"
 )
 
 var cacheDir = env.Get("CACHE_DIR", "/tmp", "directory to store cached archives.")
 var cacheSizeMB = env.Get("SEARCHER_CACHE_SIZE_MB", "100000", "maximum size of the on disk cache in megabytes")
+var cacheSize = env.Get("SEARCHER_CACHE_SIZE", "", "if set, overrides SEARCHER_CACHE_SIZE_MB. Either a size in megabytes, or a percentage (eg 80%) of the space on the cache volume which is not used by other files, recomputed periodically")
+var cacheEvictPolicy = env.Get("SEARCHER_CACHE_EVICT_POLICY", "lru", "the order archives are evicted from the on disk cache in: lru (least recently used first), lfu (least frequently used first) or ttl (like lru, but archives unused for SEARCHER_CACHE_TTL are evicted even if the cache is not full)")
+var cacheTTL = env.Get("SEARCHER_CACHE_TTL", "24h", "with SEARCHER_CACHE_EVICT_POLICY=ttl, how long an unused archive stays in the cache")
+var cacheMinFreeMB = env.Get("SEARCHER_CACHE_MIN_FREE_MB", "0", "if positive, the free space in megabytes kept on the cache volume, which other files may fill. Below it archives are evicted even if the cache is not full, and fetches fail if that doesn't free enough")
+var cacheRetainRepos = env.Get("SEARCHER_CACHE_RETAIN_REPOS", "", "comma separated patterns of repositories (eg github.com/org/monorepo or github.com/org/*) whose archives are only evicted once no other archive can be")
+var maxFileSize = env.Get("SEARCHER_MAX_FILE_SIZE", "1048576", "size in bytes above which the content of files is not cached or searched (unless they match the search.largeFiles site configuration), so they only match by their path")
+var defaultTimeout = env.Get("SEARCHER_DEFAULT_TIMEOUT", "1m", "how long a search request without a deadline may run for")
+var maxTimeout = env.Get("SEARCHER_MAX_TIMEOUT", "10m", "the longest a search request may run for, regardless of its deadline")
+var fallbackRegexpTimeout = env.Get("SEARCHER_FALLBACK_REGEXP_TIMEOUT", "0", "if positive, regexps using features RE2 does not support (eg lookaround) are matched by a backtracking engine for at most this long per file. eg 1s")
+var structuralFileTimeout = env.Get("SEARCHER_STRUCTURAL_FILE_TIMEOUT", "3s", "the longest structural search spends matching a single file, which is then skipped")
+
+var prefetchConcurrency = env.Get("SEARCHER_PREFETCH_CONCURRENCY", "4", "maximum number of archives prefetch jobs fetch concurrently")
+var prefetchConcurrencyPerGitserver = env.Get("SEARCHER_PREFETCH_CONCURRENCY_PER_GITSERVER", "2", "maximum number of archives prefetch jobs fetch concurrently from a single gitserver")
+var noFetch = env.Get("SEARCHER_NO_FETCH", "false", "if true, only serve archives which are already cached and never fetch from gitserver")
+var faults = env.Get("SEARCHER_INJECT_FAULTS", "", "for testing only: faults to inject into fetching and caching archives. eg fetch_error=0.1,read_delay=10ms,write_error=0.05")
+var shadowURL = env.Get("SEARCHER_SHADOW_URL", "", "URL of a canary searcher to mirror a sample of search requests to. Its responses are ignored")
+var shadowRate = env.Get("SEARCHER_SHADOW_RATE", "0.01", "fraction of search requests mirrored to SEARCHER_SHADOW_URL")
+var adminToken = env.Get("SEARCHER_ADMIN_TOKEN", "", "if set, enables the /admin endpoints for requests sending it as a bearer token")
+var authToken = env.Get("SEARCHER_AUTH_TOKEN", "", "if set, the shared secret requests other than health checks must send in the X-Searcher-Auth header (or gRPC metadata). Frontend sends it when configured with the same SEARCHER_AUTH_TOKEN")
+var authzKey = env.Get("SEARCHER_AUTHZ_KEY", "", "if set, requests reading a repository must send claims to read it signed with this key in the X-Searcher-Authorization header. Frontend signs them when configured with the same SEARCHER_AUTHZ_KEY")
+var authzURL = env.Get("SEARCHER_AUTHZ_URL", "", "if set, the URL of a service asked whether the client of requests reading a repository may read it, eg https://authz/check. It is sent GET requests with the repo parameter and the X-Searcher-Authorization header of the client, and allows them with a 200 response")
+var peerToken = env.Get("SEARCHER_PEER_TOKEN", "", "if set, the secret replicas send each other in the X-Searcher-Peer-Auth header to share cached archives without per-repository authorization. It must differ from SEARCHER_AUTH_TOKEN and not be given to frontend")
+var tlsCertFile = env.Get("SEARCHER_TLS_CERT_FILE", "", "if set with SEARCHER_TLS_KEY_FILE, the PEM encoded certificate the HTTP and gRPC APIs are served over TLS with. HTTPS clients may use HTTP/2")
+var tlsKeyFile = env.Get("SEARCHER_TLS_KEY_FILE", "", "the PEM encoded private key of SEARCHER_TLS_CERT_FILE")
+var tlsSelfSigned = env.Get("SEARCHER_TLS_SELF_SIGNED", "false", "if true and SEARCHER_TLS_CERT_FILE is not set, the HTTP and gRPC APIs are served over TLS with a self-signed certificate generated on startup. Clients must skip verifying it (eg SEARCHER_TLS_INSECURE_SKIP_VERIFY on frontend)")
+var tlsClientCAFile = env.Get("SEARCHER_TLS_CLIENT_CA_FILE", "", "if set, requests other than health checks must present a client certificate signed by one of the PEM encoded CA certificates in this file. Requires SEARCHER_TLS_CERT_FILE")
+var peers = env.Get("SEARCHER_PEERS", "", "if set, the searcher replicas to copy archives missing from the cache from before fetching them from gitserver. It has the same format as SEARCHER_URL, eg k8s+http://searcher:3181")
+var blobStoreURL = env.Get("SEARCHER_BLOBSTORE_URL", "", "if set, a bucket archives are shared through with other replicas before fetching them from gitserver. eg s3://bucket/prefix, s3://bucket/prefix?endpoint=http://minio:9000 or gs://bucket/prefix")
+var gitserverProbeInterval = env.Get("SEARCHER_GITSERVER_PROBE_INTERVAL", "10s", "how often the gitservers are pinged to report their reachability in /readyz and metrics")
+var trigramIndexThreshold = env.Get("SEARCHER_TRIGRAM_INDEX_THRESHOLD", "3", "if positive, the number of searches of an archive after which a trigram index is built to skip files which can't match")
+var compressionLevel = env.Get("SEARCHER_CACHE_COMPRESSION_LEVEL", "0", "if positive, the zstd level (eg 3) the files of cached archives are compressed with. Compressed archives use less disk but are decompressed into memory when searched. Archives already cached are not rewritten")
+var maxDecompressedMB = env.Get("SEARCHER_CACHE_MAX_DECOMPRESSED_MB", "1000", "the maximum size in megabytes of the files of an archive stored compressed. Larger archives are stored uncompressed, so they are not decompressed into memory when searched")
+var maxFetchesPerRepo = env.Get("SEARCHER_MAX_CONCURRENT_FETCHES_PER_REPO", "4", "if positive, the maximum number of archives of the same repository fetched concurrently")
+var maxRunningSearches = env.Get("SEARCHER_MAX_RUNNING_SEARCHES", "0", "if positive, the maximum number of concurrent search requests. Further requests wait up to SEARCHER_MAX_QUEUE_WAIT and are then rejected with 429 and a Retry-After header")
+var maxRunningSearchesPerClient = env.Get("SEARCHER_MAX_RUNNING_SEARCHES_PER_CLIENT", "0", "if positive, the maximum number of concurrent search requests of a client, identified by the X-Searcher-Client header or else its address. Further requests are queued like those beyond SEARCHER_MAX_RUNNING_SEARCHES")
+var maxRunningBatchSearches = env.Get("SEARCHER_MAX_RUNNING_BATCH_SEARCHES", "0", "if positive, the maximum number of concurrent search requests with Priority batch, eg of code insights. Further ones are queued like those beyond SEARCHER_MAX_RUNNING_SEARCHES")
+var maxQueueWait = env.Get("SEARCHER_MAX_QUEUE_WAIT", "0s", "how long search requests beyond the concurrency limits wait for a running request to finish before being rejected")
+var maxQueuedSearches = env.Get("SEARCHER_MAX_QUEUED_SEARCHES", "0", "if positive, the maximum number of search requests waiting at once. Further requests are rejected immediately")
+var workersPerRequest = env.Get("SEARCHER_WORKERS_PER_REQUEST", "0", "number of files a search request searches concurrently. If zero, GOMAXPROCS")
+var maxWorkers = env.Get("SEARCHER_MAX_WORKERS", "0", "number of files searched concurrently by all search requests together. If zero, GOMAXPROCS")
+var maxHeapMB = env.Get("SEARCHER_MAX_HEAP_MB", "0", "if positive, search requests are rejected with a Retry-After header while the heap is larger than this many megabytes")
+var logSampleRate = env.Get("SEARCHER_LOG_SAMPLE_RATE", "0.01", "fraction of successful search requests which are logged. Failed and slow requests are always logged")
+var slowRequestThreshold = env.Get("SEARCHER_SLOW_REQUEST_THRESHOLD", "5s", "search requests taking longer than this are always logged, with all their parameters, the time spent in each phase and their trace ID")
+var listenAddr = env.Get("SEARCHER_ADDR", "", "address the HTTP API listens on: host:port, or unix:///path/to/socket for a Unix domain socket, eg for sidecar deployments which don't expose a TCP port. Defaults to port 3181")
+var grpcPort = env.Get("SEARCHER_GRPC_PORT", "3182", "port the gRPC API listens on. If empty, the gRPC API is disabled")
+var drainTimeout = env.Get("SEARCHER_DRAIN_TIMEOUT", "30s", "how long searcher waits on SIGTERM or SIGINT for running searches and archive fetches to finish before exiting")
+var ctagsProcesses = env.Get("SEARCHER_CTAGS_PROCESSES", "2", "number of ctags child processes used to find the enclosing scopes of matches")
 
 const port = "3181"
 
@@ -37,63 +96,408 @@ func main() {
 	env.HandleHelpFlag()
 	log.SetFlags(0)
 	tracer.Init()
-
-	go debugserver.Start()
+	profiler.Init("searcher")
 
 	var cacheSizeBytes int64
-	if i, err := strconv.ParseInt(cacheSizeMB, 10, 64); err != nil {
+	var cacheSizePercent float64
+	if strings.HasSuffix(cacheSize, "%") {
+		f, err := strconv.ParseFloat(strings.TrimSuffix(cacheSize, "%"), 64)
+		if err != nil || f <= 0 || f > 100 {
+			log.Fatalf("invalid percentage %q for SEARCHER_CACHE_SIZE", cacheSize)
+		}
+		cacheSizePercent = f
+	} else if cacheSize != "" {
+		i, err := strconv.ParseInt(cacheSize, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid int %q for SEARCHER_CACHE_SIZE: %s", cacheSize, err)
+		}
+		cacheSizeBytes = i * 1000 * 1000
+	} else if i, err := strconv.ParseInt(cacheSizeMB, 10, 64); err != nil {
 		log.Fatalf("invalid int %q for SEARCHER_CACHE_SIZE_MB: %s", cacheSizeMB, err)
 	} else {
 		cacheSizeBytes = i * 1000 * 1000
 	}
 
+	evictPolicy := store.EvictPolicy(cacheEvictPolicy)
+	if !evictPolicy.Valid() {
+		log.Fatalf("invalid eviction policy %q for SEARCHER_CACHE_EVICT_POLICY", cacheEvictPolicy)
+	}
+	var retainRepos []string
+	for _, pattern := range strings.Split(cacheRetainRepos, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			retainRepos = append(retainRepos, pattern)
+		}
+	}
+
+	parseDuration := func(name, value string) time.Duration {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("invalid duration %q for %s: %s", value, name, err)
+		}
+		return d
+	}
+	parseInt := func(name, value string) int {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("invalid int %q for %s: %s", value, name, err)
+		}
+		return i
+	}
+	parseUint := func(name, value string) uint64 {
+		i, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid non-negative int %q for %s: %s", value, name, err)
+		}
+		return i
+	}
+	parseFloat := func(name, value string) float64 {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Fatalf("invalid float %q for %s: %s", value, name, err)
+		}
+		return f
+	}
+	parseBool := func(name, value string) bool {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Fatalf("invalid bool %q for %s: %s", value, name, err)
+		}
+		return b
+	}
+
 	service := &search.Service{
 		Store: &store.Store{
 			FetchTar: func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
 				return gitserver.DefaultClient.Archive(ctx, repo, gitserver.ArchiveOptions{Treeish: string(commit), Format: "tar"})
 			},
-			Path:              filepath.Join(cacheDir, "searcher-archives"),
-			MaxCacheSizeBytes: cacheSizeBytes,
+			FetchTarPaths: func(ctx context.Context, repo gitserver.Repo, commit api.CommitID, paths []string) (io.ReadCloser, error) {
+				return gitserver.DefaultClient.Archive(ctx, repo, gitserver.ArchiveOptions{Treeish: string(commit), Format: "tar", Paths: paths})
+			},
+			Path:                filepath.Join(cacheDir, "searcher-archives"),
+			MaxCacheSizeBytes:   cacheSizeBytes,
+			MaxCacheSizePercent: cacheSizePercent,
+			EvictPolicy:         evictPolicy,
+			CacheTTL:            parseDuration("SEARCHER_CACHE_TTL", cacheTTL),
+			RetainRepos:         retainRepos,
+			MinFreeDiskBytes:    int64(parseInt("SEARCHER_CACHE_MIN_FREE_MB", cacheMinFreeMB)) * 1000 * 1000,
+
+			MaxConcurrentFetchesPerRepo: parseInt("SEARCHER_MAX_CONCURRENT_FETCHES_PER_REPO", maxFetchesPerRepo),
+			TrigramIndexThreshold:       parseInt("SEARCHER_TRIGRAM_INDEX_THRESHOLD", trigramIndexThreshold),
+			CompressionLevel:            parseInt("SEARCHER_CACHE_COMPRESSION_LEVEL", compressionLevel),
+			MaxDecompressedBytes:        int64(parseInt("SEARCHER_CACHE_MAX_DECOMPRESSED_MB", maxDecompressedMB)) * 1000 * 1000,
+			MaxFileSize:                 int64(parseInt("SEARCHER_MAX_FILE_SIZE", maxFileSize)),
 		},
-		Log: log15.Root(),
+		Log:                  log15.Root(),
+		LogSampleRate:        parseFloat("SEARCHER_LOG_SAMPLE_RATE", logSampleRate),
+		SlowRequestThreshold: parseDuration("SEARCHER_SLOW_REQUEST_THRESHOLD", slowRequestThreshold),
+		ChangedFiles:         changedFiles,
+		Blame:                blame,
+		FetchLFS:             fetchLFS,
+
+		DefaultTimeout:        parseDuration("SEARCHER_DEFAULT_TIMEOUT", defaultTimeout),
+		MaxTimeout:            parseDuration("SEARCHER_MAX_TIMEOUT", maxTimeout),
+		FallbackRegexpTimeout: parseDuration("SEARCHER_FALLBACK_REGEXP_TIMEOUT", fallbackRegexpTimeout),
+		StructuralFileTimeout: parseDuration("SEARCHER_STRUCTURAL_FILE_TIMEOUT", structuralFileTimeout),
+
+		PrefetchConcurrency:             parseInt("SEARCHER_PREFETCH_CONCURRENCY", prefetchConcurrency),
+		PrefetchConcurrencyPerGitserver: parseInt("SEARCHER_PREFETCH_CONCURRENCY_PER_GITSERVER", prefetchConcurrencyPerGitserver),
+		GitserverAddr:                   gitserver.DefaultClient.AddrForRepo,
+
+		NoFetch: parseBool("SEARCHER_NO_FETCH", noFetch),
+
+		ShadowURL:  shadowURL,
+		ShadowRate: parseFloat("SEARCHER_SHADOW_RATE", shadowRate),
+
+		MaxRunningSearches:          parseInt("SEARCHER_MAX_RUNNING_SEARCHES", maxRunningSearches),
+		MaxRunningSearchesPerClient: parseInt("SEARCHER_MAX_RUNNING_SEARCHES_PER_CLIENT", maxRunningSearchesPerClient),
+		MaxRunningBatchSearches:     parseInt("SEARCHER_MAX_RUNNING_BATCH_SEARCHES", maxRunningBatchSearches),
+		MaxQueueWait:                parseDuration("SEARCHER_MAX_QUEUE_WAIT", maxQueueWait),
+		MaxQueuedSearches:           parseInt("SEARCHER_MAX_QUEUED_SEARCHES", maxQueuedSearches),
+		WorkersPerRequest:           parseInt("SEARCHER_WORKERS_PER_REQUEST", workersPerRequest),
+		MaxWorkers:                  parseInt("SEARCHER_MAX_WORKERS", maxWorkers),
+		MaxHeapBytes:                parseUint("SEARCHER_MAX_HEAP_MB", maxHeapMB) * 1000 * 1000,
+
+		AdminToken:        adminToken,
+		AuthToken:         authToken,
+		RequireClientCert: tlsClientCAFile != "",
+		PeerToken:         peerToken,
+
+		Gitservers: &search.GitserverProber{
+			Addrs:    gitserver.DefaultClient.Addrs,
+			Ping:     gitserver.DefaultClient.Ping,
+			Interval: parseDuration("SEARCHER_GITSERVER_PROBE_INTERVAL", gitserverProbeInterval),
+		},
+	}
+	selfSigned := parseBool("SEARCHER_TLS_SELF_SIGNED", tlsSelfSigned) && tlsCertFile == "" && tlsKeyFile == ""
+	tlsConfig, err := serverTLSConfig(selfSigned)
+	if err != nil {
+		log.Fatalf("invalid TLS configuration: %s", err)
 	}
+	switch {
+	case authzKey != "" && authzURL != "":
+		log.Fatal("only one of SEARCHER_AUTHZ_KEY and SEARCHER_AUTHZ_URL may be set")
+	case authzKey != "":
+		service.Authorize = search.ClaimsAuthorizer([]byte(authzKey))
+	case authzURL != "":
+		service.Authorize = search.HTTPAuthorizer(authzURL, nil)
+	}
+	if peerToken != "" && peerToken == authToken {
+		log.Fatal("SEARCHER_PEER_TOKEN must differ from SEARCHER_AUTH_TOKEN")
+	}
+	if service.Authorize != nil && peers != "" && peerToken == "" {
+		log15.Warn("searcher: SEARCHER_PEER_TOKEN is not set, so replicas can't share archives while requests are authorized per repository")
+	}
+	go service.Gitservers.Run(context.Background())
 	service.Store.SetMaxConcurrentFetchTar(10)
+	if peers != "" {
+		service.Store.FetchPeerZip = (&search.Peers{
+			Endpoints: endpoint.New(peers),
+			Client:    peerClient(tlsConfig, selfSigned),
+			AuthToken: authToken,
+			PeerToken: peerToken,
+		}).FetchZip
+	}
+	if blobStoreURL != "" {
+		blobs, err := newBlobStore(context.Background(), blobStoreURL)
+		if err != nil {
+			log.Fatalf("invalid SEARCHER_BLOBSTORE_URL: %s", err)
+		}
+		service.Store.Blobs = blobs
+	}
+	if ctags.IsCommandAvailable() {
+		pool := ctags.NewPool(parseInt("SEARCHER_CTAGS_PROCESSES", ctagsProcesses), func() (ctags.Parser, error) {
+			return ctags.NewParser(ctags.GetCommand())
+		})
+		service.ParseSymbols = pool.Parse
+	} else {
+		log.Println("ctags command not found, enclosing scopes of matches and /symbols are disabled")
+	}
+	if f, err := store.ParseFaults(faults); err != nil {
+		log.Fatalf("invalid SEARCHER_INJECT_FAULTS: %s", err)
+	} else if f != nil {
+		log.Printf("WARNING: injecting faults into the store: %+v", *f)
+		service.Store.Faults = f
+	}
 	service.Store.Start()
+
+	go debugserver.Start(debugserver.Endpoint{
+		Name: "Cache",
+		Path: "/cache",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entries, err := service.Store.CacheEntries(api.RepoName(r.URL.Query().Get("repo")))
+			if err != nil {
+				http.Error(w, "failed to list cache: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			d, err := json.MarshalIndent(entries, "", "  ")
+			if err != nil {
+				http.Error(w, "failed to marshal cache entries: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(d)
+		}),
+	})
+
 	handler := nethttp.Middleware(opentracing.GlobalTracer(), service)
 
 	host := ""
 	if env.InsecureDev {
 		host = "127.0.0.1"
 	}
-	addr := net.JoinHostPort(host, port)
+	addr := listenAddr
+	if addr == "" {
+		addr = net.JoinHostPort(host, port)
+	}
+	l, err := listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
 	server := &http.Server{
-		Addr: addr,
+		Addr:      addr,
+		TLSConfig: tlsConfig,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// For cluster liveness and readiness probes
-			if r.URL.Path == "/healthz" {
-				w.WriteHeader(200)
-				_, _ = w.Write([]byte("ok"))
+			// For cluster liveness and readiness probes, which need not
+			// be traced.
+			if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+				service.ServeHTTP(w, r)
 				return
 			}
 			handler.ServeHTTP(w, r)
 		}),
 	}
-	go shutdownOnSIGINT(server)
+	var grpcServer *grpc.Server
+	if grpcPort != "" {
+		var opts []grpc.ServerOption
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		grpcServer = grpc.NewServer(opts...)
+		service.RegisterGRPC(grpcServer)
+		grpcAddr := net.JoinHostPort(host, grpcPort)
+		l, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log15.Info("searcher: gRPC listening", "addr", grpcAddr)
+		go func() {
+			if err := grpcServer.Serve(l); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	drained := make(chan struct{})
+	go func() {
+		shutdownOnSignal(service, server, grpcServer, parseDuration("SEARCHER_DRAIN_TIMEOUT", drainTimeout))
+		close(drained)
+	}()
 
-	log15.Info("searcher: listening", "addr", server.Addr)
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+	log15.Info("searcher: listening", "addr", server.Addr, "tls", tlsConfig != nil)
+	serve := func() error { return server.Serve(l) }
+	if tlsConfig != nil {
+		// The certificate is already in TLSConfig.
+		serve = func() error { return server.ServeTLS(l, "", "") }
+	}
+	if err := serve(); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	// Serve returns as soon as shutting down starts.
+	<-drained
 }
 
-func shutdownOnSIGINT(s *http.Server) {
+// listen returns a listener on addr, which is either host:port or the path
+// of a Unix domain socket as unix:///path/to/socket. A socket left behind by
+// a previous process is replaced.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix://") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix://")
+	if path == "" {
+		return nil, fmt.Errorf("invalid SEARCHER_ADDR %q: the socket path is empty", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// changedFiles returns the paths of the files which differ between base and
+// head in repo, as reported by git diff on gitserver.
+func changedFiles(ctx context.Context, repo gitserver.Repo, base, head string) ([]string, error) {
+	// Deleted files can't match, and would fail fetching an archive of the
+	// changed files.
+	cmd := gitserver.DefaultClient.Command("git", "diff", "--name-only", "--no-renames", "--diff-filter=d", "-z", base, head, "--")
+	cmd.Repo = repo
+	stdout, stderr, err := cmd.DividedOutput(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.ExitStatus != 0 {
+		return nil, fmt.Errorf("git diff exited with status %d: %s", cmd.ExitStatus, bytes.TrimSpace(stderr))
+	}
+	var paths []string
+	for _, path := range bytes.Split(stdout, []byte{0}) {
+		if len(path) > 0 {
+			paths = append(paths, string(path))
+		}
+	}
+	return paths, nil
+}
+
+// fetchLFS returns the content of the Git LFS object which path in repo at
+// commit points to. It relies on git-lfs (and git 2.40 or later for
+// --attr-source) being installed on gitserver, which the gitserver image
+// does. The filter is configured explicitly since gitserver clones do not
+// run "git lfs install", and the attributes are read from commit since
+// gitserver clones are bare.
+func fetchLFS(ctx context.Context, repo gitserver.Repo, commit api.CommitID, path string) ([]byte, error) {
+	cmd := gitserver.DefaultClient.Command("git",
+		"--attr-source", string(commit),
+		"-c", "filter.lfs.process=git-lfs filter-process",
+		"-c", "filter.lfs.required=true",
+		"cat-file", "--filters", string(commit)+":"+path)
+	cmd.Repo = repo
+	stdout, stderr, err := cmd.DividedOutput(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.ExitStatus != 0 {
+		return nil, fmt.Errorf("git cat-file exited with status %d: %s", cmd.ExitStatus, bytes.TrimSpace(stderr))
+	}
+	return stdout, nil
+}
+
+// blame returns the blame hunks for the 1-based lines [startLine, endLine]
+// of path in repo at commit.
+func blame(ctx context.Context, repo gitserver.Repo, commit api.CommitID, path string, startLine, endLine int) ([]search.BlameHunk, error) {
+	hunks, err := git.BlameFile(ctx, repo, path, &git.BlameOptions{
+		NewestCommit: commit,
+		StartLine:    startLine,
+		EndLine:      endLine,
+	})
+	if err != nil {
+		return nil, err
+	}
+	blameHunks := make([]search.BlameHunk, 0, len(hunks))
+	for _, h := range hunks {
+		blameHunks = append(blameHunks, search.BlameHunk{
+			StartLine: h.StartLine,
+			EndLine:   h.EndLine,
+			LineBlame: protocol.LineBlame{
+				Commit:      h.CommitID,
+				AuthorName:  h.Author.Name,
+				AuthorEmail: h.Author.Email,
+				AuthorDate:  h.Author.Date,
+			},
+		})
+	}
+	return blameHunks, nil
+}
+
+// shutdownOnSignal waits for SIGTERM or SIGINT, then stops accepting
+// requests and waits up to timeout for running searches and archive fetches
+// to finish. Whatever still runs after timeout is aborted.
+func shutdownOnSignal(service *search.Service, s *http.Server, g *grpc.Server, timeout time.Duration) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+	log15.Info("searcher: draining", "signal", sig, "timeout", timeout)
+	service.Drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	err := s.Shutdown(ctx)
-	if err != nil {
-		log.Fatal("graceful server shutdown failed, will exit:", err)
+	if g != nil {
+		// GracefulStop waits for running searches, so it is bounded by the
+		// same timeout as the HTTP server.
+		go func() {
+			<-ctx.Done()
+			g.Stop()
+		}()
+	}
+	go func() {
+		// A second signal aborts draining.
+		<-c
+		cancel()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		if g != nil {
+			g.GracefulStop()
+		}
+		close(done)
+	}()
+	if err := s.Shutdown(ctx); err != nil {
+		log15.Warn("searcher: aborting running searches", "error", err)
+		s.Close()
+	}
+	<-done
+	// Fetches continue in the background once the searches which started
+	// them are done, and are worth keeping in the cache.
+	if err := service.Store.WaitPrepared(ctx); err != nil {
+		log15.Warn("searcher: aborting running archive fetches", "error", err)
 	}
 }
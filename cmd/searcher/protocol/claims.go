@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
+
+// Claims assert that a client may read Repos until Expiry. A client which
+// is trusted to check permissions, like frontend, signs them with a key it
+// shares with searcher (see SignClaims), so that other clients can't read
+// private repositories by guessing their names.
+type Claims struct {
+	Repos  []api.RepoName `json:"repos"`
+	Expiry int64          `json:"exp"` // Unix time
+}
+
+// Allows reports whether c allows reading repo at now.
+func (c *Claims) Allows(repo api.RepoName, now time.Time) bool {
+	if now.Unix() >= c.Expiry {
+		return false
+	}
+	for _, r := range c.Repos {
+		if r == repo {
+			return true
+		}
+	}
+	return false
+}
+
+// SignClaims returns c signed with key. The result is the base64 encoded
+// JSON of c and its HMAC-SHA256, separated by a ".".
+func SignClaims(key []byte, c Claims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(claimsMAC(key, payload)), nil
+}
+
+// VerifyClaims returns the claims signed with key in token (see
+// SignClaims).
+func VerifyClaims(key []byte, token string) (*Claims, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return nil, errors.New("malformed claims")
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(token[:i])
+	if err != nil {
+		return nil, errors.New("malformed claims")
+	}
+	mac, err := enc.DecodeString(token[i+1:])
+	if err != nil {
+		return nil, errors.New("malformed claims")
+	}
+	if !hmac.Equal(mac, claimsMAC(key, payload)) {
+		return nil, errors.New("invalid claims signature")
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, errors.New("malformed claims")
+	}
+	return &c, nil
+}
+
+func claimsMAC(key, payload []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write(payload)
+	return h.Sum(nil)
+}
@@ -3,7 +3,10 @@ package protocol
 
 import (
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/gitserver"
@@ -42,27 +45,143 @@ type Request struct {
 	// The deadline for the search request.
 	// It is parsed with time.Time.UnmarshalText.
 	Deadline string
+
+	// Priority is the lane the request is scheduled in. Background jobs
+	// (eg code insights or campaigns) should use PriorityBatch, so that
+	// they don't delay searches users are waiting for.
+	Priority Priority
+
+	// ChangedSinceCommit if non-empty restricts the search to files which
+	// differ between ChangedSinceCommit and Commit. eg the commit indexed
+	// by zoekt, whose results for the other files are merged upstream.
+	// Unless the archive of Commit is cached, only the changed files are
+	// fetched.
+	ChangedSinceCommit api.CommitID
+
+	// ChangedInLastCommits if positive restricts the search to files which
+	// were changed by the last ChangedInLastCommits commits leading up to
+	// Commit. It is ignored if ChangedSinceCommit is set.
+	ChangedInLastCommits int
+
+	// IncludeBlame if true sets Blame on every returned LineMatch. It is
+	// computed only for the returned (limited) set of matches.
+	IncludeBlame bool
+
+	// ResolveLFS if true searches the content of Git LFS objects instead of
+	// the pointer files which stand in for them in the archive. Only
+	// objects below a size limit are resolved; larger ones are skipped like
+	// large files. If some objects are not resolved the search hits
+	// LimitLFSObjects, and if none could be fetched it fails.
+	ResolveLFS bool
+
+	// WantContent if true sets Content on every returned FileMatch to the
+	// full content of the file. Files larger than a size limit are returned
+	// with ContentOmitted set instead.
+	WantContent bool
+
+	// NoFetch if true only searches the archive if it is already cached.
+	// If it is not, searcher responds with 404 Not Found rather than
+	// fetching it from gitserver.
+	NoFetch bool
+
+	// Query if non-empty is a JSON encoded QueryNode to evaluate against
+	// every file instead of Pattern, which must then be empty. The path
+	// filters of PatternInfo still apply.
+	Query string
+
+	// IncludeEnclosingScope if true sets EnclosingScope on every returned
+	// LineMatch for which searcher finds one. It is computed with ctags for
+	// the returned (limited) set of matches.
+	IncludeEnclosingScope bool
+
+	// ContextBefore and ContextAfter are the number of lines before and
+	// after every returned LineMatch to set as its Before and After, like
+	// grep -B and -A. They are at most MaxContextLines, and are not
+	// supported with ResolveLFS.
+	ContextBefore, ContextAfter int
+
+	// IncludeReplacements if true sets Replacements on every returned
+	// LineMatch by expanding Replacement for each match. It requires a
+	// non-structural Pattern.
+	IncludeReplacements bool
+
+	// IncludeRanges if true sets Ranges on every returned LineMatch to the
+	// exact positions of its matches in the file, including byte offsets.
+	// It is not supported with ResolveLFS.
+	IncludeRanges bool
+
+	// IncludeDiffs if true sets Diff on every returned FileMatch to the
+	// unified diff of replacing all matches in the file with Replacement,
+	// eg to preview a find-and-replace. It requires a non-structural
+	// Pattern.
+	IncludeDiffs bool
+
+	// Replacement is the template the matches are replaced with when
+	// IncludeReplacements or IncludeDiffs is set. Captures of a regexp Pattern are
+	// referenced as $1 or ${name}, and $0 is the whole match. Use $$ for a
+	// literal $. eg "fmt.Errorf(${1})"
+	Replacement string
+
+	// Refines if non-empty is the RefinementToken of a previous response
+	// which this request refines, eg as the user types. If the previous
+	// request is still remembered and its results include every file this
+	// request can match, only those files are searched. Otherwise it is
+	// ignored. Tokens are only known to the replica which returned them.
+	Refines string
+
+	// Paginate if true returns the matches in the order the files are
+	// searched, and a Cursor in the response if FileMatchLimit or
+	// MaxMatches stopped the search. The next page is requested by
+	// repeating the request with that Cursor.
+	Paginate bool
+
+	// Cursor if non-empty is the Cursor of a previous response, and
+	// resumes its search where it stopped rather than from the first file.
+	// Other than the limits, the request must be the same as the previous
+	// one. It implies Paginate. MaxLineMatchesPerFile counts the matches
+	// of a file returned by previous pages.
+	Cursor string
 }
 
 // GitserverRepo returns the repository information necessary to perform gitserver requests.
 func (r Request) GitserverRepo() gitserver.Repo { return gitserver.Repo{Name: r.Repo} }
 
+// MaxContextLines is the largest ContextBefore and ContextAfter a Request
+// may ask for.
+const MaxContextLines = 50
+
 // PatternInfo describes a search request on a repo. Most of the fields
 // are based on PatternInfo used in vscode.
 type PatternInfo struct {
-	// Pattern is the search query. It is a regular expression if IsRegExp
-	// is true, otherwise a fixed string. eg "route variable"
+	// Pattern is the search query. How it is interpreted depends on
+	// PatternType. eg "route variable"
 	Pattern string
 
-	// IsRegExp if true will treat the Pattern as a regular expression.
+	// PatternType is how Pattern is interpreted. If empty, it is derived
+	// from IsRegExp and IsStructuralPat. See Normalize.
+	PatternType PatternType
+
+	// IsRegExp if true will treat the Pattern as a regular expression. New
+	// clients should set PatternType instead.
 	IsRegExp bool
 
-	// IsStructuralPat if true will treat the pattern as a Comby structural search pattern.
+	// IsStructuralPat if true will treat the pattern as a Comby structural
+	// search pattern. New clients should set PatternType instead.
 	IsStructuralPat bool
 
-	// IsWordMatch if true will only match the pattern at word boundaries.
+	// IsWordMatch if true only matches whole words: matches may not be
+	// preceded or followed by a letter, digit or underscore (in any
+	// script) continuing them. A match which starts or ends with another
+	// character, eg "foo(", is a whole word at that end.
 	IsWordMatch bool
 
+	// Multiline if true lets "." in regular expressions match newlines, so
+	// a pattern can span lines, eg "func.*\n.*return". Anchors always match
+	// at line boundaries. Each match is also returned in full as a
+	// MultilineMatch. It is not supported for structural search or with
+	// Query.
+	Multiline bool
+
 	// IsCaseSensitive if false will ignore the case of text and pattern
 	// when finding matches.
 	IsCaseSensitive bool
@@ -92,21 +211,300 @@ type PatternInfo struct {
 	// FileMatchLimit limits the number of files with matches that are returned.
 	FileMatchLimit int
 
-	// PatternMatchesPath is whether the pattern should be matched against the content
+	// MaxLineMatchesPerFile if positive limits the number of LineMatches
+	// returned per file, at most to the default of 100. FileMatch.LimitHit
+	// is set for files with more matches.
+	MaxLineMatchesPerFile int
+
+	// MaxMatches if positive limits the total number of LineMatches
+	// returned (or matches counted with CountOnly). Files matched only by
+	// their path count as one match.
+	MaxMatches int
+
+	// MaxBytesScanned if positive stops the search once the content of
+	// searched files exceeds this many bytes.
+	MaxBytesScanned int64
+
+	// MaxFileSize if positive skips the content of files larger than this
+	// many bytes, so they are only matched by their path. Files larger
+	// than the limit of searcher (SEARCHER_MAX_FILE_SIZE) are always
+	// skipped. Skipped files are reported in Stats.
+	MaxFileSize int64
+
+	// PatternMatchesContent is whether the pattern should be matched against the content
 	// of files.
 	PatternMatchesContent bool
 
 	// PatternMatchesPath is whether a file whose path matches Pattern (but whose contents don't) should be
 	// considered a match.
+	//
+	// Setting only one of PatternMatchesContent and PatternMatchesPath
+	// matches only file contents or only file paths respectively. If
+	// neither is set, file contents are matched, since older clients don't
+	// send them.
 	PatternMatchesPath bool
 
 	// Languages is the languages passed via the lang filters (e.g., "lang:c")
+	//
+	// Except for structural search, which uses the first to pick how
+	// patterns are matched, only files in one of Languages are searched.
+	// A file is in every language its extension is used by (eg .h is C,
+	// C++ and Objective-C), like the extension globs of a lang filter. A
+	// file without a known extension is in the language detected from its
+	// name and content.
 	Languages []string
 
+	// ExcludeLanguages is the languages passed via negated lang filters
+	// (e.g., "-lang:c"). Files in any of them are not searched. The
+	// language of a file with an ambiguous extension is detected from its
+	// content. It is not supported for structural search.
+	ExcludeLanguages []string
+
 	// CombyRule is a rule that constrains matching for structural search. It only applies when IsStructuralPat is true.
 	CombyRule string
+
+	// TestFiles restricts the searched files based on whether their path
+	// looks like a test file (eg "_test.go", "*.spec.ts" or a file inside a
+	// "tests/" directory). The default is to search all files. It is not
+	// supported for structural search.
+	TestFiles TestFileFilter
+
+	// GeneratedFiles and VendoredFiles restrict the searched files based
+	// on whether .gitattributes marks them linguist-generated or
+	// linguist-vendored, eg to exclude them like GitHub search does. Their
+	// values are those of TestFiles, and the default is to search all
+	// files. They are not supported for structural search.
+	GeneratedFiles TestFileFilter
+	VendoredFiles  TestFileFilter
+
+	// Scope restricts content matches to comments, string literals or code
+	// (everything else). It uses lightweight per-language lexing, so when it
+	// is set files in languages searcher can't lex are not searched.
+	Scope SyntaxScope
+
+	// InvertMatch if true returns the files whose content does NOT match
+	// Pattern, without line matches. It is useful to find files missing
+	// something, eg a license header. To combine negated patterns with
+	// others (eg "foo -content:bar") use a Query with Not nodes instead.
+	InvertMatch bool
+
+	// FirstMatchOnly if true stops searching a file after its first match,
+	// so at most one LineMatch with one range is returned per file. It is
+	// sufficient for queries which only care whether files match. LimitHit
+	// is not set for files which may have further matches.
+	FirstMatchOnly bool
+
+	// RankBy orders the returned files, most relevant first. Except with
+	// RankMatches, files are also searched in that order, so that when a
+	// limit is hit the results are the most relevant files rather than
+	// those which happen to come first in the archive. It is not
+	// supported for structural search.
+	RankBy RankBy
+
+	// PriorityPatterns are path patterns (like IncludePatterns) of files
+	// to return before all others, in the order of the first pattern they
+	// match, eg ["src/**", "lib/**"]. Files matching none of them follow,
+	// ordered by RankBy. They are not supported for structural search.
+	PriorityPatterns []string
+
+	// CountOnly if true returns the number of matches in each file as
+	// FileMatch.MatchCount, and their total as MatchCount of the response,
+	// instead of LineMatches. Every match is counted, regardless of
+	// MaxLineMatchesPerFile. It is not supported for structural search or
+	// with Query, InvertMatch, Multiline or the options which add to
+	// LineMatches, eg ContextBefore or IncludeReplacements.
+	CountOnly bool
+
+	// SearchBinary if true also searches the content of binary files,
+	// which are otherwise only matched by their path. Their matches have
+	// no line content (see FileMatch.Binary). It is not supported with
+	// Query.
+	SearchBinary bool
+
+	// OwnedBy if non-empty only searches files owned by this user, team or
+	// email according to the repository's CODEOWNERS file, eg
+	// "@org/team". Files no CODEOWNERS rule applies to have no owner.
+	OwnedBy string
+
+	// NotOwnedBy if non-empty only searches files which are not owned by
+	// this user, team or email according to the repository's CODEOWNERS
+	// file.
+	NotOwnedBy string
+
+	// PathSpec if non-empty restricts the search to this directory (or
+	// file) of the repository, eg "src/frontend". Unless the archive of the
+	// whole repository is cached, only the directory is fetched, which is
+	// much cheaper in large monorepos.
+	PathSpec string
+
+	// Files if non-empty restricts the search to these paths. A path may be
+	// followed by line ranges (see FileRange), eg "main.go:10-20,35", in
+	// which case only matches starting on those lines are returned.
+	Files []string
+}
+
+// QueryNode is a node of a structured query. Exactly one field is set. A
+// file matches a leaf (Content, Path, Lang or Predicate) if:
+//
+//   - Content: its content matches the pattern. The matching lines are
+//     returned, unless the leaf is negated.
+//   - Path: its path matches the pattern.
+//   - Lang: it is in the language, given as in a lang: filter (eg "go").
+//     The language is determined from the file extension.
+//   - Predicate: it satisfies the named predicate. "test" matches test
+//     files (see TestFileFilter), "vendor" vendored files and "lfs" Git
+//     LFS pointer files.
+type QueryNode struct {
+	And []QueryNode `json:",omitempty"`
+	Or  []QueryNode `json:",omitempty"`
+	Not *QueryNode  `json:",omitempty"`
+
+	Content   *QueryPattern `json:",omitempty"`
+	Path      *QueryPattern `json:",omitempty"`
+	Lang      string        `json:",omitempty"`
+	Predicate string        `json:",omitempty"`
+}
+
+// QueryPattern is a pattern in a QueryNode. The fields have the same
+// meaning as in PatternInfo.
+type QueryPattern struct {
+	Pattern         string
+	IsRegExp        bool `json:",omitempty"`
+	IsWordMatch     bool `json:",omitempty"`
+	IsCaseSensitive bool `json:",omitempty"`
+}
+
+// PatternType is how the Pattern of a PatternInfo is interpreted.
+type PatternType string
+
+const (
+	// PatternTypeLiteral matches Pattern as a fixed string.
+	PatternTypeLiteral PatternType = "literal"
+
+	// PatternTypeRegexp matches Pattern as a regular expression.
+	PatternTypeRegexp PatternType = "regexp"
+
+	// PatternTypeStructural matches Pattern as a Comby structural search
+	// pattern.
+	PatternTypeStructural PatternType = "structural"
+
+	// PatternTypeStandard matches Pattern as a regular expression if it is
+	// delimited by slashes (eg "/foo.*bar/"), otherwise as a fixed string.
+	PatternTypeStandard PatternType = "standard"
+)
+
+// Normalize resolves PatternType and sets IsRegExp and IsStructuralPat to
+// match it, so that older searchers and code which only reads those fields
+// agree with newer clients. After Normalize, PatternType is one of literal,
+// regexp or structural. For PatternTypeStandard this may strip the
+// delimiting slashes from Pattern.
+//
+// It returns an error if PatternType is unknown or contradicts IsRegExp or
+// IsStructuralPat.
+func (p *PatternInfo) Normalize() error {
+	legacy := PatternTypeLiteral
+	if p.IsStructuralPat {
+		legacy = PatternTypeStructural
+	} else if p.IsRegExp {
+		legacy = PatternTypeRegexp
+	}
+
+	switch p.PatternType {
+	case "":
+		p.PatternType = legacy
+	case PatternTypeLiteral, PatternTypeRegexp, PatternTypeStructural:
+	case PatternTypeStandard:
+		if n := len(p.Pattern); n >= 2 && p.Pattern[0] == '/' && p.Pattern[n-1] == '/' {
+			p.Pattern = p.Pattern[1 : n-1]
+			p.PatternType = PatternTypeRegexp
+		} else {
+			p.PatternType = PatternTypeLiteral
+		}
+	default:
+		return fmt.Errorf("PatternType must be one of %q, %q, %q or %q (PatternType=%q)", PatternTypeLiteral, PatternTypeRegexp, PatternTypeStructural, PatternTypeStandard, p.PatternType)
+	}
+
+	if legacy != PatternTypeLiteral && legacy != p.PatternType {
+		return fmt.Errorf("PatternType %q conflicts with IsRegExp=%v and IsStructuralPat=%v", p.PatternType, p.IsRegExp, p.IsStructuralPat)
+	}
+	p.IsRegExp = p.PatternType == PatternTypeRegexp
+	p.IsStructuralPat = p.PatternType == PatternTypeStructural
+	return nil
+}
+
+// FileRange is an entry of PatternInfo.Files: a path and optionally the
+// lines of it to search.
+type FileRange struct {
+	Path string
+
+	// Lines are the ranges of lines to search. If empty, the whole file is
+	// searched.
+	Lines []LineRange
+}
+
+// LineRange is a 1-based inclusive range of lines.
+type LineRange struct {
+	Start, End int
+}
+
+// String returns f in the format parsed by ParseFileRange.
+func (f FileRange) String() string {
+	if len(f.Lines) == 0 {
+		return f.Path
+	}
+	ranges := make([]string, len(f.Lines))
+	for i, r := range f.Lines {
+		if r.Start == r.End {
+			ranges[i] = strconv.Itoa(r.Start)
+		} else {
+			ranges[i] = fmt.Sprintf("%d-%d", r.Start, r.End)
+		}
+	}
+	return f.Path + ":" + strings.Join(ranges, ",")
 }
 
+// ParseFileRange parses an entry of PatternInfo.Files. It is a path
+// optionally followed by a colon and a comma separated list of line numbers
+// or ranges of line numbers, eg "main.go:10-20,35". If what follows the
+// last colon is not a list of line ranges, the whole of s is the path.
+func ParseFileRange(s string) (FileRange, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return FileRange{Path: s}, nil
+	}
+	var lines []LineRange
+	for _, part := range strings.Split(s[i+1:], ",") {
+		startStr, endStr := part, part
+		if j := strings.IndexByte(part, '-'); j >= 0 {
+			startStr, endStr = part[:j], part[j+1:]
+		}
+		start, err1 := strconv.Atoi(startStr)
+		end, err2 := strconv.Atoi(endStr)
+		if err1 != nil || err2 != nil {
+			return FileRange{Path: s}, nil
+		}
+		if start < 1 || end < start {
+			return FileRange{}, fmt.Errorf("invalid line range %q in %q", part, s)
+		}
+		lines = append(lines, LineRange{Start: start, End: end})
+	}
+	return FileRange{Path: s[:i], Lines: lines}, nil
+}
+
+// TestFileFilter controls whether test files are searched.
+type TestFileFilter string
+
+const (
+	// TestFilesIncluded searches test files and non-test files.
+	TestFilesIncluded TestFileFilter = ""
+
+	// TestFilesOnly only searches test files.
+	TestFilesOnly TestFileFilter = "only"
+
+	// TestFilesExcluded only searches non-test files.
+	TestFilesExcluded TestFileFilter = "exclude"
+)
+
 func (p *PatternInfo) String() string {
 	args := []string{fmt.Sprintf("%q", p.Pattern)}
 	if p.IsRegExp {
@@ -115,6 +513,18 @@ func (p *PatternInfo) String() string {
 	if p.IsWordMatch {
 		args = append(args, "word")
 	}
+	if p.Multiline {
+		args = append(args, "multiline")
+	}
+	if p.CountOnly {
+		args = append(args, "countonly")
+	}
+	if p.RankBy != RankDefault {
+		args = append(args, fmt.Sprintf("rankby:%s", p.RankBy))
+	}
+	for _, pat := range p.PriorityPatterns {
+		args = append(args, fmt.Sprintf("priority:%q", pat))
+	}
 	if p.IsCaseSensitive {
 		args = append(args, "case")
 	}
@@ -127,6 +537,39 @@ func (p *PatternInfo) String() string {
 	if p.FileMatchLimit > 0 {
 		args = append(args, fmt.Sprintf("filematchlimit:%d", p.FileMatchLimit))
 	}
+	if p.MaxLineMatchesPerFile > 0 {
+		args = append(args, fmt.Sprintf("maxlinematchesperfile:%d", p.MaxLineMatchesPerFile))
+	}
+	if p.MaxMatches > 0 {
+		args = append(args, fmt.Sprintf("maxmatches:%d", p.MaxMatches))
+	}
+	if p.MaxBytesScanned > 0 {
+		args = append(args, fmt.Sprintf("maxbytesscanned:%d", p.MaxBytesScanned))
+	}
+	if p.MaxFileSize > 0 {
+		args = append(args, fmt.Sprintf("maxfilesize:%d", p.MaxFileSize))
+	}
+	if p.TestFiles != TestFilesIncluded {
+		args = append(args, fmt.Sprintf("testfiles:%s", p.TestFiles))
+	}
+	if p.GeneratedFiles != TestFilesIncluded {
+		args = append(args, fmt.Sprintf("generated:%s", p.GeneratedFiles))
+	}
+	if p.VendoredFiles != TestFilesIncluded {
+		args = append(args, fmt.Sprintf("vendored:%s", p.VendoredFiles))
+	}
+	if p.Scope != ScopeAll {
+		args = append(args, fmt.Sprintf("scope:%s", p.Scope))
+	}
+	if p.OwnedBy != "" {
+		args = append(args, fmt.Sprintf("owner:%s", p.OwnedBy))
+	}
+	if p.NotOwnedBy != "" {
+		args = append(args, fmt.Sprintf("-owner:%s", p.NotOwnedBy))
+	}
+	for _, f := range p.Files {
+		args = append(args, fmt.Sprintf("file:%q", f))
+	}
 
 	path := "glob"
 	if p.PathPatternsAreRegExps {
@@ -147,6 +590,137 @@ func (p *PatternInfo) String() string {
 	return fmt.Sprintf("PatternInfo{%s}", strings.Join(args, ","))
 }
 
+// RankBy is an order of the files returned by a search.
+type RankBy string
+
+const (
+	// RankDefault returns files in the order they are found.
+	RankDefault RankBy = ""
+
+	// RankPath orders files by path.
+	RankPath RankBy = "path"
+
+	// RankMatches orders files with more matches first. Since the number
+	// of matches is only known once a file is searched, it only orders the
+	// files found before a limit is hit.
+	RankMatches RankBy = "matches"
+
+	// RankRecency orders the most recently modified files first, according
+	// to the modification times in the archive. Archives of commits give
+	// all files the time of the commit, in which case files are ordered by
+	// path.
+	RankRecency RankBy = "recency"
+)
+
+// Priority is the scheduling lane of a request.
+type Priority string
+
+const (
+	// PriorityInteractive is for searches a user is waiting for. It is the
+	// default.
+	PriorityInteractive Priority = "interactive"
+
+	// PriorityBatch is for background searches. They run in a smaller
+	// share of searcher's capacity (see
+	// search.Service.MaxRunningBatchSearches), and wait while interactive
+	// searches are queued.
+	PriorityBatch Priority = "batch"
+)
+
+// SyntaxScope is a syntactic region of a file's content.
+type SyntaxScope string
+
+const (
+	// ScopeAll matches anywhere in a file.
+	ScopeAll SyntaxScope = ""
+
+	// ScopeComments only matches inside comments.
+	ScopeComments SyntaxScope = "comments"
+
+	// ScopeStrings only matches inside string literals.
+	ScopeStrings SyntaxScope = "strings"
+
+	// ScopeCode only matches outside of comments and string literals.
+	ScopeCode SyntaxScope = "code"
+)
+
+// RoutingKeyHeader is the header carrying the routing key (see RoutingKey)
+// of a request. Clients set it on requests so that proxies in front of
+// searcher can route on it, and searcher sets it on responses.
+const RoutingKeyHeader = "X-Searcher-Routing-Key"
+
+// RoutingKey returns the key used to pick the searcher replica for requests
+// about repo, by consistent hashing over the replicas. It only depends on
+// the repository, not the commit, so every commit of a repository is served
+// by the same replica and repeated searches of a repository reuse the
+// archives that replica has already cached.
+func RoutingKey(repo api.RepoName) string {
+	return string(repo)
+}
+
+// ClientHeader is the header (and gRPC metadata key) identifying who a
+// request is made on behalf of, eg a user, so that searcher can share its
+// capacity fairly between them (see search.Service.MaxRunningSearchesPerClient).
+// Requests without it are attributed to their remote address.
+const ClientHeader = "X-Searcher-Client"
+
+// AuthHeader is the header (and gRPC metadata key) carrying the shared
+// secret which authenticates requests to searchers configured with one (see
+// search.Service.AuthToken).
+const AuthHeader = "X-Searcher-Auth"
+
+// AuthzHeader is the header (and gRPC metadata key) carrying the
+// credentials searchers which authorize requests per repository pass to
+// their authorizer (see search.Service.Authorize), eg signed Claims.
+const AuthzHeader = "X-Searcher-Authorization"
+
+// PeerAuthHeader is the header carrying the secret which searcher replicas
+// send each other to read cached archives without per-repository
+// authorization (see search.Service.PeerToken).
+const PeerAuthHeader = "X-Searcher-Peer-Auth"
+
+// VersionHeader is the HTTP header carrying the version of the searcher
+// protocol. Clients send the newest version they speak, and searcher sets it
+// on its responses to the version it served the request with (see
+// NegotiateVersion). This lets searcher and its clients be upgraded
+// independently.
+const VersionHeader = "X-Searcher-Protocol-Version"
+
+const (
+	// Version is the newest protocol version, which this package
+	// describes. Changes to it:
+	//
+	//	1: Requests predating version negotiation. The kind of pattern may
+	//	   be given by IsRegExp and IsStructuralPat alone.
+	//	2: Requests must set PatternType.
+	Version = 2
+
+	// MinVersion is the oldest protocol version searcher serves.
+	MinVersion = 1
+)
+
+// NegotiateVersion returns the protocol version to serve a request with,
+// given the value of its VersionHeader: the newest version both sides
+// speak. Requests without the header predate negotiation and are version
+// 1. It returns an error if the client only speaks versions older than
+// MinVersion.
+func NegotiateVersion(header string) (int, error) {
+	if header == "" {
+		return 1, nil
+	}
+	v, err := strconv.Atoi(header)
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("invalid %s %q", VersionHeader, header)
+	}
+	if v < MinVersion {
+		return 0, fmt.Errorf("protocol version %d is no longer supported, searcher supports versions %d to %d", v, MinVersion, Version)
+	}
+	if v > Version {
+		v = Version
+	}
+	return v, nil
+}
+
 // Response represents the response from a Search request.
 type Response struct {
 	Matches []FileMatch
@@ -154,8 +728,125 @@ type Response struct {
 	// LimitHit is true if Matches may not include all FileMatches because a match limit was hit.
 	LimitHit bool
 
+	// LimitHitReason is the limit which was hit if LimitHit is true.
+	LimitHitReason LimitReason `json:",omitempty"`
+
 	// DeadlineHit is true if Matches may not include all FileMatches because a deadline was hit.
 	DeadlineHit bool
+
+	// MatchCount is the sum of the MatchCount of Matches. It is only set if
+	// the request set CountOnly.
+	MatchCount int `json:",omitempty"`
+
+	// Stats describes the resources used to serve the request.
+	Stats Stats
+
+	// RefinementToken if non-empty identifies this response's results for
+	// a short time. A request refining this one (see Request.Refines) can
+	// send it to have searcher reuse them.
+	RefinementToken string `json:",omitempty"`
+
+	// Cursor if non-empty resumes the search where this response stopped
+	// (see Request.Cursor). It is only set for Paginate requests which hit
+	// FileMatchLimit or MaxMatches.
+	Cursor string `json:",omitempty"`
+}
+
+// LimitReason is a limit on the results of a search.
+type LimitReason string
+
+const (
+	// LimitFileMatches is PatternInfo.FileMatchLimit, or the default
+	// limit on the number of files with matches.
+	LimitFileMatches LimitReason = "FileMatchLimit"
+
+	// LimitMatches is PatternInfo.MaxMatches.
+	LimitMatches LimitReason = "MaxMatches"
+
+	// LimitBytesScanned is PatternInfo.MaxBytesScanned.
+	LimitBytesScanned LimitReason = "MaxBytesScanned"
+
+	// LimitLFSObjects is the number of Git LFS objects resolved for
+	// Request.ResolveLFS. It is also reported if some objects failed to
+	// fetch. The pointer files of unresolved objects are searched instead.
+	LimitLFSObjects LimitReason = "LFSObjects"
+)
+
+// Content types of streamed search responses. A search request which
+// accepts one of them (via the Accept header) is answered with a stream of
+// events, so matches can be shown as they are found:
+//
+//	Server-Sent Events: an event named "match" whose data is a JSON encoded
+//	FileMatch per match, followed by an event named "done" whose data is a
+//	JSON encoded StreamDone.
+//
+//	Newline delimited JSON: a JSON encoded StreamEvent per line.
+//
+// Errors which occur before the first event are returned with the usual
+// status codes. Later errors are reported in StreamDone.
+const (
+	StreamContentTypeSSE    = "text/event-stream"
+	StreamContentTypeNDJSON = "application/x-ndjson"
+)
+
+// StreamEvent is an event of a streamed search response. Exactly one of its
+// fields is set.
+type StreamEvent struct {
+	Match *FileMatch  `json:",omitempty"`
+	Done  *StreamDone `json:",omitempty"`
+}
+
+// StreamDone is the last event of a streamed search response.
+type StreamDone struct {
+	// LimitHit is true if not all matches were sent because a match limit was hit.
+	LimitHit bool
+
+	// LimitHitReason is the limit which was hit if LimitHit is true.
+	LimitHitReason LimitReason `json:",omitempty"`
+
+	// DeadlineHit is true if not all matches were sent because a deadline was hit.
+	DeadlineHit bool
+
+	// MatchCount is like Response.MatchCount.
+	MatchCount int `json:",omitempty"`
+
+	// Stats describes the resources used to serve the request.
+	Stats Stats
+
+	// RefinementToken is like Response.RefinementToken.
+	RefinementToken string `json:",omitempty"`
+
+	// Cursor is like Response.Cursor.
+	Cursor string `json:",omitempty"`
+
+	// Error if non-empty is why the search failed after matches were sent.
+	Error string `json:",omitempty"`
+}
+
+// Stats describes the resources searcher used to serve a request, so that
+// callers can budget and report their searcher cost.
+type Stats struct {
+	// CPUMilliseconds is the CPU time spent matching file contents. The
+	// time spent by comby on structural searches is not included.
+	CPUMilliseconds int64
+
+	// CacheBytesRead is the number of bytes of cached archives searched.
+	CacheBytesRead int64
+
+	// GitserverBytesFetched is the number of bytes of archives fetched from
+	// gitserver for the request. It is zero if the archives were cached.
+	GitserverBytesFetched int64
+
+	// PeakBufferBytes is the largest amount of memory used at once for
+	// buffers holding file content, eg to match case insensitively.
+	PeakBufferBytes int64
+
+	// LargeFilesSkipped is the number of files whose content was not
+	// searched because they are too large (see PatternInfo.MaxFileSize),
+	// which explains why they have no matches. LargeFilesSkippedPaths
+	// holds the paths of the first of them.
+	LargeFilesSkipped      int64
+	LargeFilesSkippedPaths []string `json:",omitempty"`
 }
 
 // FileMatch is the struct used by vscode to receive search results
@@ -165,6 +856,282 @@ type FileMatch struct {
 
 	// LimitHit is true if LineMatches may not include all LineMatches.
 	LimitHit bool
+
+	// Content is the full content of the file. It is only set if the
+	// request set WantContent.
+	Content string `json:",omitempty"`
+
+	// ContentOmitted is true if the request set WantContent but Content
+	// was not set, eg because the file (or the content already included in
+	// the response) is too large.
+	ContentOmitted bool `json:",omitempty"`
+
+	// Encoding is the encoding of the file in the repository if it is not
+	// UTF-8, eg "utf-16le" or "windows-1252". The file is transcoded to
+	// UTF-8 to be searched, so Preview and Content are UTF-8. Since offsets
+	// are in characters they apply to the original file too.
+	Encoding string `json:",omitempty"`
+
+	// Binary is true if the file is binary. The LineMatches of binary files
+	// (only found if the request set SearchBinary) have no Preview and a
+	// LineNumber of 0. Their OffsetAndLengths are byte offsets in the file.
+	Binary bool `json:",omitempty"`
+
+	// MultilineMatches are the matches in the file, including those
+	// spanning several lines, in full. They are only set if the request set
+	// Multiline. LineMatches are still set, with a LineMatch for each line
+	// a match spans.
+	MultilineMatches []MultilineMatch `json:",omitempty"`
+
+	// Diff is the unified diff of replacing every match in the file with
+	// the request's Replacement, including matches beyond the request's
+	// limits. It is only set if the request set IncludeDiffs, and is empty
+	// if the replacements don't change the file.
+	Diff string `json:",omitempty"`
+
+	// MatchCount is the number of matches in the file. It is only set if
+	// the request set CountOnly, in which case LineMatches is empty.
+	MatchCount int `json:",omitempty"`
+}
+
+// MultilineMatch is a match which may span several lines.
+type MultilineMatch struct {
+	// Preview is the content of the lines the match spans, without the
+	// final newline. Lines longer than 16KiB in total are truncated.
+	Preview string
+
+	// Start and End are the positions of the start of the match and of the
+	// character following it.
+	Start, End Position
+}
+
+// Position is a position in a file.
+type Position struct {
+	// Line is the 0-based line number.
+	Line int
+
+	// Column is the 0-based offset in characters within the line.
+	Column int
+
+	// Offset is the 0-based offset in bytes from the start of the file.
+	// For files with an Encoding it is an offset in their UTF-8 content.
+	Offset int
+}
+
+// Range is the location of a match in a file.
+type Range struct {
+	// Start and End are the positions of the first character of the match
+	// and of the character following it.
+	Start, End Position
+}
+
+// RevisionsResponse is the response of searcher's /revisions endpoint, which
+// searches several commits of a repository at once. It accepts the same form
+// as a Request, with the commits to search in the repeated Commits field
+// instead of Commit.
+type RevisionsResponse struct {
+	Matches []RevisionFileMatch
+
+	// LimitHit is true if Matches may not include all FileMatches because a match limit was hit.
+	LimitHit bool
+
+	// DeadlineHit is true if Matches may not include all FileMatches because a deadline was hit.
+	DeadlineHit bool
+
+	// Stats describes the resources used to serve the request.
+	Stats Stats
+}
+
+// RevisionFileMatch is a FileMatch in one or more of the commits searched
+// by a /revisions request. A file which is identical in several commits is
+// only searched once, so its match applies to all of them.
+type RevisionFileMatch struct {
+	FileMatch
+
+	// Commits are the commits the match applies to, in the order they were
+	// requested.
+	Commits []api.CommitID
+}
+
+// BatchResponse is the response of searcher's /batch endpoint, which runs a
+// search over several repositories at once. It accepts the same form as a
+// Request, with the repositories to search in the repeated Repos field as
+// "repo@commit" instead of Repo and Commit. The deadline and FileMatchLimit
+// apply to the batch as a whole.
+type BatchResponse struct {
+	// Matches are ordered like the repositories in the request.
+	Matches []BatchFileMatch
+
+	// LimitHit is true if Matches may not include all FileMatches because a match limit was hit.
+	LimitHit bool
+
+	// DeadlineHit is true if Matches may not include all FileMatches because a deadline was hit.
+	DeadlineHit bool
+
+	// Errors are the errors of the repositories which could not be
+	// searched. The other repositories are still searched.
+	Errors []BatchError `json:",omitempty"`
+
+	// Stats describes the resources used to serve the request.
+	Stats Stats
+}
+
+// BatchFileMatch is a FileMatch in one of the repositories searched by a
+// /batch request.
+type BatchFileMatch struct {
+	Repo   api.RepoName
+	Commit api.CommitID
+	FileMatch
+}
+
+// BatchError is the error of a repository searched by a /batch request.
+type BatchError struct {
+	Repo   api.RepoName
+	Commit api.CommitID
+	Error  string
+}
+
+// SymbolsResponse is the response of searcher's /symbols endpoint, which
+// finds the symbols (definitions reported by ctags) of a repository at a
+// commit whose name matches Pattern. It accepts the same form as a Request.
+// The path filters of the request apply to the files symbols are extracted
+// from, and FileMatchLimit limits the number of symbols returned.
+type SymbolsResponse struct {
+	Symbols []Symbol
+
+	// LimitHit is true if Symbols may not include all matching symbols because a limit was hit.
+	LimitHit bool
+
+	// DeadlineHit is true if Symbols may not include all matching symbols because a deadline was hit.
+	DeadlineHit bool
+}
+
+// Symbol is a definition in a file, as reported by ctags.
+type Symbol struct {
+	// Name is the name of the symbol. eg "ParseConfig"
+	Name string
+
+	// Path is the path of the file the symbol is defined in.
+	Path string
+
+	// Line is the 0-based line the definition starts on.
+	Line int
+
+	// Kind is the kind of the symbol as reported by ctags. eg "func"
+	Kind string
+
+	// Language is the language of the file as detected by ctags.
+	Language string
+
+	// Parent and ParentKind describe the symbol containing this one, if any.
+	Parent     string `json:",omitempty"`
+	ParentKind string `json:",omitempty"`
+}
+
+// ListFilesResponse is the response of searcher's /files endpoint.
+type ListFilesResponse struct {
+	Files []FileInfo
+}
+
+// FileInfo describes a regular file in a repository at a commit.
+type FileInfo struct {
+	Path string
+
+	// Size is the size of the file in bytes.
+	Size int64
+
+	// Mode is the permission bits of the file (0644 or 0755).
+	Mode os.FileMode
+
+	// Encoding is the encoding of the file if it is not UTF-8 (see
+	// FileMatch.Encoding).
+	Encoding string `json:",omitempty"`
+
+	// Binary is true if the file is binary.
+	Binary bool `json:",omitempty"`
+}
+
+// LookupHashResponse is the response of searcher's /lookup-hash endpoint.
+type LookupHashResponse struct {
+	// Paths are the paths of the files with the requested hash, sorted.
+	Paths []string
+}
+
+// Readiness is the response of searcher's /readyz endpoint.
+type Readiness struct {
+	// Ready is whether searcher can serve requests. If it is false, Reason
+	// explains why.
+	Ready  bool
+	Reason string `json:",omitempty"`
+
+	// Gitserver is the health of the gitservers searcher fetches archives
+	// from, as of GitserverCheckedAt.
+	Gitserver          GitserverHealth
+	GitserverCheckedAt *time.Time `json:",omitempty"`
+
+	// UnreachableGitservers maps the address of every gitserver which
+	// could not be reached to the error reaching it.
+	UnreachableGitservers map[string]string `json:",omitempty"`
+}
+
+// GitserverHealth is the health of the gitservers as seen by searcher.
+type GitserverHealth string
+
+const (
+	// GitserverHealthUp means every gitserver is reachable.
+	GitserverHealthUp GitserverHealth = "up"
+
+	// GitserverHealthDegraded means some, but not all, gitservers are
+	// unreachable. Repositories on them can only be searched if their
+	// archives are cached.
+	GitserverHealthDegraded GitserverHealth = "degraded"
+
+	// GitserverHealthDown means no gitserver is reachable.
+	GitserverHealthDown GitserverHealth = "down"
+
+	// GitserverHealthUnknown means searcher has not checked yet, or is not
+	// configured to.
+	GitserverHealthUnknown GitserverHealth = "unknown"
+)
+
+// ArchiveRef identifies the archive of a repository at a commit.
+type ArchiveRef struct {
+	Repo   api.RepoName
+	Commit api.CommitID
+}
+
+// PrefetchJobRequest is the body of a request to searcher's /prefetch/jobs
+// endpoint, which fetches archives into the cache in the background.
+type PrefetchJobRequest struct {
+	// Archives are the archives to fetch. Commits must be resolved.
+	Archives []ArchiveRef
+}
+
+// PrefetchJob is the status of a prefetch job.
+type PrefetchJob struct {
+	ID string
+
+	// StatusURL is the path at which the status of the job can be polled.
+	StatusURL string
+
+	// Total is the number of archives in the job.
+	Total int
+
+	// Done and Failed are the number of archives which have been fetched
+	// and which failed to fetch respectively.
+	Done, Failed int
+
+	// Finished is true once every archive has been fetched or failed.
+	Finished bool
+
+	// Errors describes the archives which failed to fetch.
+	Errors []PrefetchError `json:",omitempty"`
+}
+
+// PrefetchError describes an archive which failed to prefetch.
+type PrefetchError struct {
+	ArchiveRef
+	Error string
 }
 
 // LineMatch is the struct used by vscode to receive search results for a line.
@@ -183,4 +1150,82 @@ type LineMatch struct {
 
 	// LimitHit is true if OffsetAndLengths may not include all OffsetAndLengths.
 	LimitHit bool
+
+	// PreviewOffset is the character offset within the line at which
+	// Preview starts. It is non-zero when the line is too long to return in
+	// full, in which case Preview is a window of the line around the match.
+	// OffsetAndLengths are relative to Preview.
+	PreviewOffset int `json:",omitempty"`
+
+	// Blame is the commit which last changed the line. It is only set if
+	// the request set IncludeBlame.
+	Blame *LineBlame `json:",omitempty"`
+
+	// EnclosingScope is the innermost definition (eg function or class)
+	// containing the line. It is only set if the request set
+	// IncludeEnclosingScope.
+	EnclosingScope *EnclosingScope `json:",omitempty"`
+
+	// Before and After are the lines preceding and following the line, up
+	// to the request's ContextBefore and ContextAfter lines. Like Preview,
+	// long lines are truncated. They are only set if the request asked for
+	// context lines.
+	Before []string `json:",omitempty"`
+	After  []string `json:",omitempty"`
+
+	// Replacements is the text each range in OffsetAndLengths would be
+	// replaced with. It is only set if the request set IncludeReplacements.
+	// The replacement of a match spanning several lines is on its first
+	// line; the ranges continuing it on later lines are replaced with "".
+	Replacements []string `json:",omitempty"`
+
+	// Ranges are the locations in the file of the ranges in
+	// OffsetAndLengths, in the same order. They are only set if the
+	// request set IncludeRanges, and not for binary files.
+	Ranges []Range `json:",omitempty"`
+}
+
+// EnclosingScope is a definition which contains a line.
+type EnclosingScope struct {
+	// Name is the name of the definition. eg "ParseConfig"
+	Name string
+
+	// Kind is the kind of the definition as reported by ctags. eg "func"
+	Kind string
+
+	// StartLine and EndLine are the 0-based lines (inclusive) the
+	// definition spans.
+	StartLine, EndLine int
+}
+
+// LineBlame attributes a line to the commit which last changed it.
+type LineBlame struct {
+	Commit      api.CommitID
+	AuthorName  string
+	AuthorEmail string
+	AuthorDate  time.Time
+}
+
+// Limits are the runtime tunable limits of a searcher, as read and updated
+// via its /admin/limits endpoint. When updating, nil fields are left
+// unchanged. Durations are parsed with time.ParseDuration.
+type Limits struct {
+	// DefaultTimeout is the time a search request without a deadline may
+	// run for.
+	DefaultTimeout *string `json:",omitempty"`
+
+	// MaxTimeout is the longest a search request may run for.
+	MaxTimeout *string `json:",omitempty"`
+
+	// FallbackRegexpTimeout bounds the time the fallback regexp engine
+	// spends matching a single file. "0" disables the fallback engine.
+	FallbackRegexpTimeout *string `json:",omitempty"`
+
+	// MaxConcurrentFetches is the maximum number of archives fetched
+	// from gitserver concurrently.
+	MaxConcurrentFetches *int `json:",omitempty"`
+
+	// MaxCacheSizeBytes is the size above which cached archives are
+	// evicted.
+	MaxCacheSizeBytes *int64 `json:",omitempty"`
 }
@@ -0,0 +1,194 @@
+package search
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
+
+// requireAdmin wraps h such that it is only served to requests
+// authenticated with AdminToken. If AdminToken is empty the endpoint does
+// not exist.
+func (s *Service) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// serveLimits reads (GET) and updates (POST) the limits searcher applies at
+// runtime:
+//
+//	curl -H 'Authorization: Bearer $TOKEN' --data '{"MaxTimeout": "1m"}' http://searcher:3181/admin/limits
+//
+// Updates last until searcher restarts. The response is the JSON encoded
+// protocol.Limits in effect after the update.
+func (s *Service) serveLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var l protocol.Limits
+		if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.setLimits(&l); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("limits updated via admin endpoint: %s", limitsString(&l))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.getLimits())
+}
+
+// serveCache lists (GET), inspects (GET with a commit) and purges (DELETE)
+// the archives in the cache:
+//
+//	curl -H 'Authorization: Bearer $TOKEN' 'http://searcher:3181/admin/cache?repo=github.com/gorilla/mux'
+//	curl -H 'Authorization: Bearer $TOKEN' 'http://searcher:3181/admin/cache?repo=github.com/gorilla/mux&commit=599cba5e7b6137d46ddf58fb1765f5d928e69604'
+//	curl -X DELETE -H 'Authorization: Bearer $TOKEN' 'http://searcher:3181/admin/cache?repo=github.com/gorilla/mux'
+//
+// Without a repo every archive is listed. Purging every archive requires
+// all=true instead of a repo. The response is the JSON encoded listed,
+// inspected or purged store.CacheEntry values.
+func (s *Service) serveCache(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	repo, commit := api.RepoName(q.Get("repo")), api.CommitID(q.Get("commit"))
+	if commit != "" && (repo == "" || len(commit) != 40) {
+		http.Error(w, "commit must be absolute and requires a repo", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		var (
+			v   interface{}
+			err error
+		)
+		if commit != "" {
+			v, err = s.Store.InspectCacheEntries(repo, commit)
+		} else {
+			v, err = s.Store.CacheEntries(repo)
+		}
+		if err != nil {
+			http.Error(w, "failed to list cache: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, v)
+	case "DELETE":
+		if repo == "" && q.Get("all") != "true" {
+			http.Error(w, "a repo, or all=true to purge every archive, is required", http.StatusBadRequest)
+			return
+		}
+		purged, err := s.Store.PurgeCache(repo, commit)
+		log.Printf("purged %d archives via admin endpoint (repo=%q commit=%q)", len(purged), repo, commit)
+		if err != nil {
+			http.Error(w, "failed to purge cache: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, purged)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Service) getLimits() *protocol.Limits {
+	s.limitsMu.RLock()
+	defaultTimeout := s.DefaultTimeout.String()
+	maxTimeout := s.MaxTimeout.String()
+	fallbackRegexpTimeout := s.FallbackRegexpTimeout.String()
+	s.limitsMu.RUnlock()
+
+	maxConcurrentFetches := s.Store.MaxConcurrentFetchTar()
+	maxCacheSizeBytes := s.Store.GetMaxCacheSizeBytes()
+	return &protocol.Limits{
+		DefaultTimeout:        &defaultTimeout,
+		MaxTimeout:            &maxTimeout,
+		FallbackRegexpTimeout: &fallbackRegexpTimeout,
+		MaxConcurrentFetches:  &maxConcurrentFetches,
+		MaxCacheSizeBytes:     &maxCacheSizeBytes,
+	}
+}
+
+// setLimits applies the non-nil fields of l. Either every field is applied
+// or, if one is invalid, none are.
+func (s *Service) setLimits(l *protocol.Limits) error {
+	parse := func(name string, v *string) (*time.Duration, error) {
+		if v == nil {
+			return nil, nil
+		}
+		d, err := time.ParseDuration(*v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", name)
+		}
+		if d < 0 {
+			return nil, errors.Errorf("invalid %s: must not be negative", name)
+		}
+		return &d, nil
+	}
+	defaultTimeout, err := parse("DefaultTimeout", l.DefaultTimeout)
+	if err != nil {
+		return err
+	}
+	maxTimeout, err := parse("MaxTimeout", l.MaxTimeout)
+	if err != nil {
+		return err
+	}
+	fallbackRegexpTimeout, err := parse("FallbackRegexpTimeout", l.FallbackRegexpTimeout)
+	if err != nil {
+		return err
+	}
+	if l.MaxConcurrentFetches != nil && *l.MaxConcurrentFetches <= 0 {
+		return errors.New("invalid MaxConcurrentFetches: must be positive")
+	}
+	if l.MaxCacheSizeBytes != nil && *l.MaxCacheSizeBytes <= 0 {
+		return errors.New("invalid MaxCacheSizeBytes: must be positive")
+	}
+
+	s.limitsMu.Lock()
+	if defaultTimeout != nil {
+		s.DefaultTimeout = *defaultTimeout
+	}
+	if maxTimeout != nil {
+		s.MaxTimeout = *maxTimeout
+	}
+	if fallbackRegexpTimeout != nil {
+		s.FallbackRegexpTimeout = *fallbackRegexpTimeout
+	}
+	s.limitsMu.Unlock()
+
+	if l.MaxConcurrentFetches != nil {
+		s.Store.PinMaxConcurrentFetchTar(*l.MaxConcurrentFetches)
+	}
+	if l.MaxCacheSizeBytes != nil {
+		s.Store.SetMaxCacheSizeBytes(*l.MaxCacheSizeBytes)
+	}
+	return nil
+}
+
+// limitsString describes the fields set in l for logging.
+func limitsString(l *protocol.Limits) string {
+	b, _ := json.Marshal(l)
+	return string(b)
+}
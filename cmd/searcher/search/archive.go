@@ -0,0 +1,63 @@
+package search
+
+import (
+	"net/http"
+
+	"github.com/sourcegraph/sourcegraph/internal/conf"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// maxArchiveUploadBytes is the largest tar archive accepted by
+// serveArchiveSearch.
+const maxArchiveUploadBytes = 100 * 1024 * 1024
+
+// serveArchiveSearch searches a tar archive uploaded as the body of a POST
+// request, rather than the archive of a repository at a commit. The search
+// parameters are read from the URL query. Repo and Commit are optional and
+// are only used for logging.
+func (s *Service) serveArchiveSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	done, retryAfter, ok := s.admit(ctx, requestClient(r), requestPriority(r))
+	if !ok {
+		writeOverloaded(w, retryAfter)
+		return
+	}
+	defer done()
+
+	p, ctx, cancel, err := s.decodeRequest(ctx, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+	if err = validatePattern(p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.IsStructuralPat {
+		http.Error(w, "structural search is not supported for uploaded archives", http.StatusBadRequest)
+		return
+	}
+	if p.IncludeBlame || p.ResolveLFS || changedFilesBase(p) != "" {
+		http.Error(w, "blame, LFS resolution and changed file restrictions require a repository", http.StatusBadRequest)
+		return
+	}
+
+	var maxFileSize int64
+	if s.Store != nil {
+		maxFileSize = s.Store.MaxFileSize
+	}
+	zf, err := store.ReadTarArchive(http.MaxBytesReader(w, r.Body, maxArchiveUploadBytes), conf.Get().SearchLargeFiles, maxFileSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.writeSearchResponse(ctx, w, p, zf, newStreamWriter(w, r))
+}
@@ -0,0 +1,66 @@
+package search
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+// authenticate reports whether r has the credentials required by AuthToken
+// and RequireClientCert. Health checks need none, so that probes don't have
+// to be configured with them.
+func (s *Service) authenticate(r *http.Request) bool {
+	if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+		return true
+	}
+	if s.RequireClientCert && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+		return false
+	}
+	return s.validAuthToken(r.Header.Get(protocol.AuthHeader))
+}
+
+// authenticateGRPC is authenticate for the gRPC request of ctx.
+func (s *Service) authenticateGRPC(ctx context.Context) bool {
+	if s.RequireClientCert {
+		p, ok := peer.FromContext(ctx)
+		if !ok {
+			return false
+		}
+		info, ok := p.AuthInfo.(credentials.TLSInfo)
+		if !ok || len(info.State.PeerCertificates) == 0 {
+			return false
+		}
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	token := ""
+	if v := md.Get(protocol.AuthHeader); len(v) > 0 {
+		token = v[0]
+	}
+	return s.validAuthToken(token)
+}
+
+// validAuthToken reports whether token is AuthToken, or AuthToken is empty.
+func (s *Service) validAuthToken(token string) bool {
+	if s.AuthToken == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.AuthToken)) == 1
+}
+
+var unauthenticatedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "service",
+	Name:      "unauthenticated_requests_total",
+	Help:      "Number of requests rejected because they lacked the shared secret or client certificate searcher requires.",
+}, []string{"api"})
+
+func init() {
+	prometheus.MustRegister(unauthenticatedTotal)
+}
@@ -0,0 +1,75 @@
+package search
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+func TestAuthenticate(t *testing.T) {
+	withToken := func(path, token string) *http.Request {
+		r := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			r.Header.Set(protocol.AuthHeader, token)
+		}
+		return r
+	}
+	withCert := func(r *http.Request) *http.Request {
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+		return r
+	}
+
+	tests := []struct {
+		name    string
+		s       *Service
+		r       *http.Request
+		allowed bool
+	}{
+		{name: "no auth", s: &Service{}, r: withToken("/", ""), allowed: true},
+		{name: "token", s: &Service{AuthToken: "secret"}, r: withToken("/", "secret"), allowed: true},
+		{name: "missing token", s: &Service{AuthToken: "secret"}, r: withToken("/", ""), allowed: false},
+		{name: "wrong token", s: &Service{AuthToken: "secret"}, r: withToken("/", "guess"), allowed: false},
+		{name: "health check", s: &Service{AuthToken: "secret", RequireClientCert: true}, r: withToken("/healthz", ""), allowed: true},
+		{name: "client cert", s: &Service{RequireClientCert: true}, r: withCert(withToken("/", "")), allowed: true},
+		{name: "missing client cert", s: &Service{RequireClientCert: true}, r: withToken("/", ""), allowed: false},
+		{name: "client cert without token", s: &Service{AuthToken: "secret", RequireClientCert: true}, r: withCert(withToken("/", "")), allowed: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.s.authenticate(test.r); got != test.allowed {
+				t.Errorf("got %v, want %v", got, test.allowed)
+			}
+		})
+	}
+}
+
+func TestServeHTTP_unauthenticated(t *testing.T) {
+	s := &Service{AuthToken: "secret"}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/?Repo=foo", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthenticateGRPC(t *testing.T) {
+	s := &Service{AuthToken: "secret"}
+	if s.authenticateGRPC(context.Background()) {
+		t.Error("expected a request without a token to be rejected")
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(protocol.AuthHeader, "secret"))
+	if !s.authenticateGRPC(ctx) {
+		t.Error("expected a request with the token to be allowed")
+	}
+	s.RequireClientCert = true
+	if s.authenticateGRPC(ctx) {
+		t.Error("expected a request without a client certificate to be rejected")
+	}
+}
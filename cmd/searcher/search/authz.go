@@ -0,0 +1,219 @@
+package search
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
+
+// An Authorizer reports whether a client sending credentials in
+// protocol.AuthzHeader may read repo. See Service.Authorize.
+type Authorizer func(ctx context.Context, repo api.RepoName, credentials string) (bool, error)
+
+// ClaimsAuthorizer returns an Authorizer allowing clients to read the
+// repositories of the protocol.Claims they send signed with key.
+func ClaimsAuthorizer(key []byte) Authorizer {
+	return func(ctx context.Context, repo api.RepoName, credentials string) (bool, error) {
+		if credentials == "" {
+			return false, nil
+		}
+		c, err := protocol.VerifyClaims(key, credentials)
+		if err != nil {
+			return false, nil
+		}
+		return c.Allows(repo, time.Now()), nil
+	}
+}
+
+// HTTPAuthorizer returns an Authorizer which asks the service at authzURL
+// whether clients may read repositories:
+//
+//	GET authzURL?repo=github.com/foo/bar
+//	X-Searcher-Authorization: <the credentials of the client>
+//
+// A 200 response allows the request, and 401, 403 and 404 responses deny
+// it. If client is nil, http.DefaultClient is used.
+func HTTPAuthorizer(authzURL string, client *http.Client) Authorizer {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	sep := "?"
+	if strings.Contains(authzURL, "?") {
+		sep = "&"
+	}
+	return func(ctx context.Context, repo api.RepoName, credentials string) (bool, error) {
+		req, err := http.NewRequest("GET", authzURL+sep+url.Values{"repo": {string(repo)}}.Encode(), nil)
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set(protocol.AuthzHeader, credentials)
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return false, errors.Wrap(err, "authorization request failed")
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return true, nil
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			return false, nil
+		default:
+			return false, errors.Errorf("authorization request failed with status %d", resp.StatusCode)
+		}
+	}
+}
+
+// authorizeExempt are the patterns of the handlers which authorizeHTTP
+// doesn't authorize per repository:
+//
+//   - /healthz and /readyz don't name repositories.
+//   - /admin/ endpoints are only served to the operator holding AdminToken
+//     (see requireAdmin), and act on the cache as a whole.
+//   - /prefetch/jobs names repositories in its JSON body rather than its
+//     parameters, so prefetcher.serveJobs authorizes them itself. The status
+//     of a job is only known to whoever started it, by its random ID.
+//
+// They are patterns rather than paths since a path without a handler of
+// its own is served by the search handler.
+var authorizeExempt = map[string]bool{
+	"/healthz":        true,
+	"/readyz":         true,
+	"/admin/limits":   true,
+	"/admin/cache":    true,
+	"/prefetch/jobs":  true,
+	"/prefetch/jobs/": true,
+}
+
+// peerPatterns are the patterns of the handlers other replicas read this
+// replica's cache with (see Peers). Requests to them with PeerToken aren't
+// authorized per repository, and others are authorized like any request.
+var peerPatterns = map[string]bool{
+	"/cached":       true,
+	"/peer/archive": true,
+}
+
+// authorizeHTTP writes an error to w and returns false unless Authorize
+// allows r to read the repositories it names.
+func (s *Service) authorizeHTTP(w http.ResponseWriter, r *http.Request) bool {
+	if s.Authorize == nil {
+		return true
+	}
+	_, pattern := s.mux.Handler(r)
+	if authorizeExempt[pattern] || (peerPatterns[pattern] && s.validPeerToken(r.Header.Get(protocol.PeerAuthHeader))) {
+		return true
+	}
+	repos, err := requestRepos(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return s.authorizeRepos(w, r, repos)
+}
+
+// authorizeRepos writes an error to w and returns false unless Authorize
+// allows the client of r to read all of repos.
+func (s *Service) authorizeRepos(w http.ResponseWriter, r *http.Request, repos []api.RepoName) bool {
+	if s.Authorize == nil {
+		return true
+	}
+	ok, err := s.authorize(r.Context(), repos, r.Header.Get(protocol.AuthzHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return false
+	}
+	if !ok {
+		unauthorizedTotal.WithLabelValues("http").Inc()
+		http.Error(w, "not authorized to read the repository", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// validPeerToken reports whether token is PeerToken, which must be set.
+func (s *Service) validPeerToken(token string) bool {
+	return s.PeerToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.PeerToken)) == 1
+}
+
+// authorizeGRPC reports whether Authorize allows the gRPC request of ctx to
+// read repo.
+func (s *Service) authorizeGRPC(ctx context.Context, repo api.RepoName) (bool, error) {
+	if s.Authorize == nil {
+		return true, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	credentials := ""
+	if v := md.Get(protocol.AuthzHeader); len(v) > 0 {
+		credentials = v[0]
+	}
+	ok, err := s.authorize(ctx, []api.RepoName{repo}, credentials)
+	if err == nil && !ok {
+		unauthorizedTotal.WithLabelValues("grpc").Inc()
+	}
+	return ok, err
+}
+
+// authorize reports whether Authorize allows a client with credentials to
+// read all of repos.
+func (s *Service) authorize(ctx context.Context, repos []api.RepoName, credentials string) (bool, error) {
+	for _, repo := range repos {
+		ok, err := s.Authorize(ctx, repo, credentials)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// requestRepos returns the repositories named by the parameters of r,
+// which are the ones it reads.
+//
+// Handlers disagree on which of repeated parameters they use: gorilla/schema
+// takes the last value and matches keys case insensitively, while
+// url.Values.Get takes the first. So every value of every spelling of a key
+// is returned, and a request is only served if all of them are authorized.
+func requestRepos(r *http.Request) ([]api.RepoName, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	var repos []api.RepoName
+	for k, vs := range r.Form {
+		switch {
+		case strings.EqualFold(k, "Repo"):
+			for _, v := range vs {
+				if v != "" {
+					repos = append(repos, api.RepoName(v))
+				}
+			}
+		case strings.EqualFold(k, "Repos"):
+			targets, err := parseBatchRepos(vs)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range targets {
+				repos = append(repos, t.repo)
+			}
+		}
+	}
+	return repos, nil
+}
+
+var unauthorizedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "service",
+	Name:      "unauthorized_requests_total",
+	Help:      "Number of requests rejected because the client may not read the repository they name.",
+}, []string{"api"})
+
+func init() {
+	prometheus.MustRegister(unauthorizedTotal)
+}
@@ -0,0 +1,160 @@
+package search
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+func TestClaimsAuthorizer(t *testing.T) {
+	key := []byte("key")
+	sign := func(key []byte, repo api.RepoName, expiry time.Time) string {
+		token, err := protocol.SignClaims(key, protocol.Claims{Repos: []api.RepoName{repo}, Expiry: expiry.Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := sign(key, "foo", time.Now().Add(time.Minute))
+
+	tests := []struct {
+		name        string
+		repo        api.RepoName
+		credentials string
+		allowed     bool
+	}{
+		{name: "valid", repo: "foo", credentials: valid, allowed: true},
+		{name: "other repo", repo: "bar", credentials: valid, allowed: false},
+		{name: "none", repo: "foo", credentials: "", allowed: false},
+		{name: "expired", repo: "foo", credentials: sign(key, "foo", time.Now().Add(-time.Minute)), allowed: false},
+		{name: "other key", repo: "foo", credentials: sign([]byte("guess"), "foo", time.Now().Add(time.Minute)), allowed: false},
+		{name: "malformed", repo: "foo", credentials: "foo.bar", allowed: false},
+	}
+	authorize := ClaimsAuthorizer(key)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, err := authorize(context.Background(), test.repo, test.credentials)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != test.allowed {
+				t.Errorf("got %v, want %v", ok, test.allowed)
+			}
+		})
+	}
+}
+
+func TestHTTPAuthorizer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Query().Get("repo") == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.URL.Query().Get("repo") == "foo" && r.Header.Get(protocol.AuthzHeader) == "alice":
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer ts.Close()
+
+	authorize := HTTPAuthorizer(ts.URL, nil)
+	if ok, err := authorize(context.Background(), "foo", "alice"); err != nil || !ok {
+		t.Errorf("expected alice to read foo, got %v, %v", ok, err)
+	}
+	if ok, err := authorize(context.Background(), "foo", "mallory"); err != nil || ok {
+		t.Errorf("expected mallory not to read foo, got %v, %v", ok, err)
+	}
+	if _, err := authorize(context.Background(), "broken", "alice"); err == nil {
+		t.Error("expected an error if the authorization service fails")
+	}
+}
+
+func TestServeHTTP_unauthorized(t *testing.T) {
+	s := &Service{Authorize: func(ctx context.Context, repo api.RepoName, credentials string) (bool, error) {
+		return repo == "foo", nil
+	}}
+	tests := []struct {
+		path string
+		body string // form encoded
+		want int
+	}{
+		{path: "/?Repo=bar", want: http.StatusForbidden},
+		{path: "/file?repo=bar&commit=deadbeef&path=a", want: http.StatusForbidden},
+		{path: "/batch?Repos=foo@deadbeef&Repos=bar@deadbeef", want: http.StatusForbidden},
+		// The decoder uses the last value and matches keys case
+		// insensitively, so every value must be authorized.
+		{path: "/?Repo=foo&Repo=bar", want: http.StatusForbidden},
+		{path: "/?Repo=foo&REPO=bar", want: http.StatusForbidden},
+		{path: "/file?repo=bar&commit=deadbeef&path=a", body: "repo=foo", want: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.body != "" {
+			r = httptest.NewRequest("POST", test.path, strings.NewReader(test.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.path, w.Code, test.want)
+		}
+	}
+}
+
+func TestServeHTTP_exemptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &Service{
+		Store:     &store.Store{Path: dir},
+		PeerToken: "peer",
+		Authorize: func(ctx context.Context, repo api.RepoName, credentials string) (bool, error) {
+			return repo == "foo", nil
+		},
+	}
+	commit := strings.Repeat("a", 40)
+	tests := []struct {
+		method, path, body string
+		peerToken          string
+		want               int
+	}{
+		// Replicas read each other's cache with PeerToken, and everyone
+		// else is authorized per repository.
+		{method: "GET", path: "/peer/archive?repo=bar&commit=" + commit, peerToken: "peer", want: http.StatusNotFound},
+		{method: "GET", path: "/peer/archive?repo=bar&commit=" + commit, want: http.StatusForbidden},
+		{method: "GET", path: "/peer/archive?repo=bar&commit=" + commit, peerToken: "guess", want: http.StatusForbidden},
+		{method: "GET", path: "/peer/archive?repo=foo&commit=" + commit, want: http.StatusNotFound},
+		{method: "HEAD", path: "/cached?repo=bar&commit=" + commit, want: http.StatusForbidden},
+		{method: "HEAD", path: "/cached?repo=bar&commit=" + commit, peerToken: "peer", want: http.StatusNotFound},
+
+		{method: "POST", path: "/prefetch?repo=bar&commit=" + commit, want: http.StatusForbidden},
+		{method: "POST", path: "/prefetch/jobs", body: `{"Archives": [{"Repo": "foo", "Commit": "` + commit + `"}, {"Repo": "bar", "Commit": "` + commit + `"}]}`, want: http.StatusForbidden},
+		{method: "GET", path: "/prefetch/jobs/unknown", want: http.StatusNotFound},
+
+		// Paths without a handler of their own are searches.
+		{method: "GET", path: "/admin/foo?Repo=bar", want: http.StatusForbidden},
+		{method: "GET", path: "/prefetch/foo?Repo=bar", want: http.StatusForbidden},
+		{method: "GET", path: "/admin/limits?Repo=bar", want: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.peerToken != "" {
+			r.Header.Set(protocol.PeerAuthHeader, test.peerToken)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.path, w.Code, test.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package search
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+const (
+	// minRetryAfter and maxRetryAfter bound the Retry-After sent when
+	// shedding load.
+	minRetryAfter = time.Second
+	maxRetryAfter = 30 * time.Second
+
+	// heapSampleInterval is how often the heap size is read to apply
+	// MaxHeapBytes. Reading it stops the world, so we don't do it for every
+	// request.
+	heapSampleInterval = time.Second
+)
+
+// load tracks the search requests a Service is running, to shed load when
+// it is overloaded.
+type load struct {
+	mu          sync.Mutex
+	running     int
+	batch       int            // running PriorityBatch requests
+	clients     map[string]int // running requests by client
+	queued      int
+	interactive int           // queued requests which are not PriorityBatch
+	freed       chan struct{} // closed when a request finishes, nil if nobody waits
+	avgDuration time.Duration // moving average of search request durations
+
+	heapSampledAt time.Time
+	heapBytes     uint64
+}
+
+// admit starts a search request made for client (see requestClient) with
+// priority. If the service is busy it waits up to MaxQueueWait for a running
+// request to finish. If the service is still overloaded it returns ok=false
+// and how long the client should wait before retrying. Otherwise done must
+// be called once the request has been served.
+//
+// Waiting requests are not served in order: whichever notices a finished
+// request first runs, except that batch requests wait for interactive ones.
+func (s *Service) admit(ctx context.Context, client string, priority protocol.Priority) (done func(), retryAfter time.Duration, ok bool) {
+	batch := priority == protocol.PriorityBatch
+	s.load.mu.Lock()
+	defer s.load.mu.Unlock()
+
+	var timeout <-chan time.Time
+	for {
+		reason := ""
+		if s.MaxHeapBytes > 0 && s.load.heapInUse() > s.MaxHeapBytes {
+			reason = "memory"
+		} else if s.MaxRunningSearches > 0 && s.load.running >= s.MaxRunningSearches {
+			reason = "concurrency"
+		} else if s.MaxRunningSearchesPerClient > 0 && s.load.clients[client] >= s.MaxRunningSearchesPerClient {
+			reason = "client"
+		} else if batch && s.MaxRunningBatchSearches > 0 && s.load.batch >= s.MaxRunningBatchSearches {
+			reason = "batch"
+		} else if batch && s.load.interactive > 0 {
+			// Let the interactive requests waiting for a slot have it.
+			reason = "priority"
+		}
+		if reason == "" {
+			break
+		}
+
+		// Only wait for running requests to finish if that can help and
+		// there is room in the queue.
+		if timeout == nil {
+			if reason == "memory" || s.MaxQueueWait <= 0 {
+				return s.load.shed(reason, s.MaxRunningSearches)
+			}
+			if s.MaxQueuedSearches > 0 && s.load.queued >= s.MaxQueuedSearches {
+				return s.load.shed("queue", s.MaxRunningSearches)
+			}
+			t := time.NewTimer(s.MaxQueueWait)
+			defer t.Stop()
+			timeout = t.C
+			s.load.queued++
+			queued.Inc()
+			if !batch {
+				s.load.interactive++
+			}
+			defer func() {
+				s.load.queued--
+				queued.Dec()
+				if !batch {
+					// Batch requests may be waiting for this one.
+					s.load.interactive--
+					s.load.wake()
+				}
+			}()
+		}
+
+		if s.load.freed == nil {
+			s.load.freed = make(chan struct{})
+		}
+		freed := s.load.freed
+		s.load.mu.Unlock()
+		var expired bool
+		select {
+		case <-freed:
+		case <-timeout:
+			expired = true
+		case <-ctx.Done():
+			expired = true
+		}
+		s.load.mu.Lock()
+		if expired {
+			return s.load.shed("timeout", s.MaxRunningSearches)
+		}
+	}
+
+	s.load.running++
+	if batch {
+		s.load.batch++
+	}
+	if s.load.clients == nil {
+		s.load.clients = map[string]int{}
+	}
+	s.load.clients[client]++
+	running.Inc()
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+		s.load.mu.Lock()
+		s.load.running--
+		if batch {
+			s.load.batch--
+		}
+		if s.load.clients[client]--; s.load.clients[client] == 0 {
+			delete(s.load.clients, client)
+		}
+		if s.load.avgDuration == 0 {
+			s.load.avgDuration = d
+		} else {
+			s.load.avgDuration += (d - s.load.avgDuration) / 8
+		}
+		s.load.wake()
+		s.load.mu.Unlock()
+		running.Dec()
+	}, 0, true
+}
+
+// wake wakes the requests waiting in admit, so that they check whether they
+// can run now. It must be called with l.mu held.
+func (l *load) wake() {
+	if l.freed != nil {
+		close(l.freed)
+		l.freed = nil
+	}
+}
+
+// shed records that a request was rejected because of reason, and returns
+// the results of admit for it. It must be called with l.mu held.
+func (l *load) shed(reason string, limit int) (done func(), retryAfter time.Duration, ok bool) {
+	shedTotal.WithLabelValues(reason).Inc()
+	return nil, l.retryAfter(limit), false
+}
+
+// requestPriority returns the Priority of the request r, which is read
+// before the request is decoded to admit it.
+func requestPriority(r *http.Request) protocol.Priority {
+	return protocol.Priority(r.FormValue("Priority"))
+}
+
+// requestClient returns who r is made for (see protocol.ClientHeader).
+func requestClient(r *http.Request) string {
+	if client := r.Header.Get(protocol.ClientHeader); client != "" {
+		return client
+	}
+	return remoteHost(r.RemoteAddr)
+}
+
+// remoteHost returns the host of the remote address addr, so that the
+// connections of a client share its limits.
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// retryAfter estimates how long it will take until a request would be
+// admitted: the time to work through the running requests, limit at a
+// time. It must be called with l.mu held.
+func (l *load) retryAfter(limit int) time.Duration {
+	if limit <= 0 {
+		limit = 1
+	}
+	d := l.avgDuration * time.Duration(l.running) / time.Duration(limit)
+	if d < minRetryAfter {
+		d = minRetryAfter
+	} else if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	return d
+}
+
+// heapInUse returns the size of the heap, sampled at most every
+// heapSampleInterval. It must be called with l.mu held.
+func (l *load) heapInUse() uint64 {
+	if time.Since(l.heapSampledAt) >= heapSampleInterval {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		l.heapBytes = m.HeapInuse
+		l.heapSampledAt = time.Now()
+	}
+	return l.heapBytes
+}
+
+// writeOverloaded responds to a request which was shed because the service
+// is overloaded. Clients should retry after retryAfter.
+func writeOverloaded(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "searcher is overloaded", http.StatusTooManyRequests)
+}
+
+var shedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "service",
+	Name:      "shed_total",
+	Help:      "Number of search requests rejected because searcher was overloaded, by the limit hit (concurrency, client, batch, priority, memory, queue or timeout).",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(shedTotal)
+}
@@ -0,0 +1,190 @@
+package search
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+func TestAdmit(t *testing.T) {
+	s := &Service{MaxRunningSearches: 2}
+
+	done1, _, ok := s.admit(context.Background(), "a", "")
+	if !ok {
+		t.Fatal("expected first search to be admitted")
+	}
+	done2, _, ok := s.admit(context.Background(), "a", "")
+	if !ok {
+		t.Fatal("expected second search to be admitted")
+	}
+
+	s.load.avgDuration = 10 * time.Second
+	_, retryAfter, ok := s.admit(context.Background(), "a", "")
+	if ok {
+		t.Fatal("expected third search to be shed")
+	}
+	// Two running searches of 10s each, two at a time.
+	if retryAfter != 10*time.Second {
+		t.Errorf("got Retry-After %s, want 10s", retryAfter)
+	}
+
+	done1()
+	if _, _, ok := s.admit(context.Background(), "a", ""); !ok {
+		t.Error("expected a search to be admitted once another finished")
+	}
+	done2()
+}
+
+func TestAdmit_perClient(t *testing.T) {
+	s := &Service{MaxRunningSearchesPerClient: 1}
+	ctx := context.Background()
+
+	done, _, ok := s.admit(ctx, "a", "")
+	if !ok {
+		t.Fatal("expected the first search of a to be admitted")
+	}
+	if _, _, ok := s.admit(ctx, "a", ""); ok {
+		t.Fatal("expected the second search of a to be shed")
+	}
+	doneB, _, ok := s.admit(ctx, "b", "")
+	if !ok {
+		t.Fatal("expected the search of b to be admitted")
+	}
+	done()
+	doneB()
+	if len(s.load.clients) != 0 {
+		t.Errorf("got running clients %v, want none", s.load.clients)
+	}
+}
+
+func TestAdmit_queue(t *testing.T) {
+	s := &Service{MaxRunningSearches: 1, MaxQueueWait: time.Minute, MaxQueuedSearches: 1}
+	ctx := context.Background()
+
+	done, _, ok := s.admit(ctx, "a", "")
+	if !ok {
+		t.Fatal("expected the first search to be admitted")
+	}
+
+	// The second search waits for the first one to finish.
+	admitted := make(chan func())
+	go func() {
+		done, _, ok := s.admit(ctx, "b", "")
+		if !ok {
+			done = nil
+		}
+		admitted <- done
+	}()
+	for queued := 0; queued == 0; {
+		time.Sleep(time.Millisecond)
+		s.load.mu.Lock()
+		queued = s.load.queued
+		s.load.mu.Unlock()
+	}
+
+	// The queue is full.
+	if _, _, ok := s.admit(ctx, "c", ""); ok {
+		t.Fatal("expected the third search to be shed")
+	}
+
+	done()
+	done2 := <-admitted
+	if done2 == nil {
+		t.Fatal("expected the queued search to be admitted")
+	}
+
+	// Searches give up waiting after MaxQueueWait.
+	s.MaxQueueWait = time.Millisecond
+	if _, _, ok := s.admit(ctx, "d", ""); ok {
+		t.Fatal("expected the search to be shed after waiting")
+	}
+	done2()
+}
+
+func TestAdmit_priority(t *testing.T) {
+	s := &Service{MaxRunningSearches: 2, MaxRunningBatchSearches: 1}
+	ctx := context.Background()
+
+	doneBatch, _, ok := s.admit(ctx, "a", protocol.PriorityBatch)
+	if !ok {
+		t.Fatal("expected the first batch search to be admitted")
+	}
+	if _, _, ok := s.admit(ctx, "b", protocol.PriorityBatch); ok {
+		t.Fatal("expected the second batch search to be shed")
+	}
+	done, _, ok := s.admit(ctx, "c", protocol.PriorityInteractive)
+	if !ok {
+		t.Fatal("expected the interactive search to be admitted")
+	}
+	doneBatch()
+	done()
+
+	// Queued interactive searches run before queued batch ones.
+	s = &Service{MaxRunningSearches: 1, MaxQueueWait: time.Minute}
+	done, _, ok = s.admit(ctx, "a", "")
+	if !ok {
+		t.Fatal("expected the first search to be admitted")
+	}
+	queuedSearches := func() int {
+		s.load.mu.Lock()
+		defer s.load.mu.Unlock()
+		return s.load.queued
+	}
+	// admit starts a search and returns once it is queued.
+	admit := func(client string, priority protocol.Priority) <-chan func() {
+		admitted := make(chan func(), 1)
+		queued := queuedSearches()
+		go func() {
+			done, _, _ := s.admit(ctx, client, priority)
+			admitted <- done
+		}()
+		for queuedSearches() == queued {
+			time.Sleep(time.Millisecond)
+		}
+		return admitted
+	}
+	batch := admit("b", protocol.PriorityBatch)
+	interactive := admit("c", protocol.PriorityInteractive)
+
+	done()
+	done = <-interactive
+	if done == nil {
+		t.Fatal("expected the interactive search to be admitted")
+	}
+	select {
+	case <-batch:
+		t.Fatal("expected the batch search to wait for the interactive one")
+	case <-time.After(10 * time.Millisecond):
+	}
+	done()
+	if done := <-batch; done == nil {
+		t.Fatal("expected the batch search to be admitted")
+	} else {
+		done()
+	}
+}
+
+func TestRetryAfterBounds(t *testing.T) {
+	l := load{running: 1000, avgDuration: time.Minute}
+	if got := l.retryAfter(1); got != maxRetryAfter {
+		t.Errorf("got %s, want %s", got, maxRetryAfter)
+	}
+	l = load{}
+	if got := l.retryAfter(0); got != minRetryAfter {
+		t.Errorf("got %s, want %s", got, minRetryAfter)
+	}
+}
+
+func TestWriteOverloaded(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeOverloaded(w, 1500*time.Millisecond)
+	if w.Code != 429 {
+		t.Errorf("got status %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("got Retry-After %q, want 2", got)
+	}
+}
@@ -0,0 +1,240 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime/pprof"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
+
+const (
+	// maxBatchRepos is the maximum number of repositories a /batch request
+	// may search.
+	maxBatchRepos = 100
+
+	// batchConcurrency is the maximum number of repositories a /batch
+	// request searches concurrently.
+	batchConcurrency = 4
+)
+
+// serveBatch runs a search over several repositories. It accepts the same
+// form as a search, with the repositories in the repeated Repos field:
+//
+//	POST /batch Repos=github.com/foo/bar@deadbeef...&Repos=github.com/foo/baz@cafebabe...&Pattern=foo
+//
+// The deadline and FileMatchLimit of the request are shared by all
+// repositories. The response is a JSON encoded protocol.BatchResponse.
+func (s *Service) serveBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	done, retryAfter, ok := s.admit(ctx, requestClient(r), requestPriority(r))
+	if !ok {
+		writeOverloaded(w, retryAfter)
+		return
+	}
+	defer done()
+
+	p, ctx, cancel, err := s.decodeRequest(ctx, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+	targets, err := parseBatchRepos(r.Form["Repos"])
+	if err == nil {
+		err = validateBatchParams(p, targets)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp protocol.BatchResponse
+	u := &usage{}
+	ctx = withUsage(ctx, u)
+	pprof.Do(ctx, pprof.Labels("repo", "batch", "query_type", queryType(p)), func(ctx context.Context) {
+		resp, err = s.searchBatch(ctx, p, targets)
+	})
+	if err != nil {
+		writeSearchError(ctx, w, p, err)
+		return
+	}
+	if resp.Matches == nil {
+		resp.Matches = make([]protocol.BatchFileMatch, 0)
+	}
+	resp.Stats = u.stats()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&resp)
+}
+
+// batchRepo is a repository searched by a /batch request.
+type batchRepo struct {
+	repo   api.RepoName
+	commit api.CommitID
+}
+
+// parseBatchRepos parses the "repo@commit" values of the Repos field.
+func parseBatchRepos(values []string) ([]batchRepo, error) {
+	targets := make([]batchRepo, 0, len(values))
+	for _, v := range values {
+		// Commits can't contain "@", repository names could.
+		i := strings.LastIndexByte(v, '@')
+		if i <= 0 {
+			return nil, errors.Errorf("Repos must be of the form repo@commit (Repos=%q)", v)
+		}
+		targets = append(targets, batchRepo{repo: api.RepoName(v[:i]), commit: api.CommitID(v[i+1:])})
+	}
+	return targets, nil
+}
+
+func validateBatchParams(p *protocol.Request, targets []batchRepo) error {
+	if p.Repo != "" || p.Commit != "" {
+		return errors.New("Repo and Commit may not be set, use Repos")
+	}
+	if len(targets) == 0 || len(targets) > maxBatchRepos {
+		return errors.Errorf("between 1 and %d Repos must be given (got %d)", maxBatchRepos, len(targets))
+	}
+	for _, t := range targets {
+		if len(t.commit) != 40 {
+			return errors.Errorf("Commits must be resolved (Repos=%s@%s)", t.repo, t.commit)
+		}
+	}
+	// Refinement tokens refer to the results of a single repository.
+	if p.Refines != "" {
+		return errors.New("Refines is not supported when searching several repositories")
+	}
+	// Cursors are positions in the archive of a single repository.
+	if p.Paginate || p.Cursor != "" {
+		return errors.New("Paginate and Cursor are not supported when searching several repositories")
+	}
+	return validatePattern(p)
+}
+
+// searchBatch runs the search p over each of targets. Errors of a single
+// repository are reported in the response, unless they are caused by p
+// itself.
+func (s *Service) searchBatch(ctx context.Context, p *protocol.Request, targets []batchRepo) (resp protocol.BatchResponse, err error) {
+	batchRepos.Observe(float64(len(targets)))
+	fileMatchLimit := p.FileMatchLimit
+	if fileMatchLimit > maxFileMatches || fileMatchLimit <= 0 {
+		fileMatchLimit = maxFileMatches
+	}
+
+	type result struct {
+		matches []protocol.FileMatch
+		err     error
+	}
+	var (
+		results = make([]result, len(targets))
+		sem     = make(chan struct{}, batchConcurrency)
+		wg      sync.WaitGroup
+
+		mu          sync.Mutex
+		remaining   = fileMatchLimit
+		limitHit    bool
+		deadlineHit bool
+	)
+	// Once the limit is hit the remaining searches are cancelled.
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for i, t := range targets {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		mu.Lock()
+		limit := remaining
+		mu.Unlock()
+		if limit <= 0 {
+			<-sem
+			break
+		}
+
+		pc := *p
+		pc.Repo = t.repo
+		pc.Commit = t.commit
+		pc.FileMatchLimit = limit
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			matches, repoLimitHit, repoDeadlineHit, err := s.searchWithMiddleware(ctx, &pc, nil)
+			results[i] = result{matches: matches, err: err}
+
+			mu.Lock()
+			defer mu.Unlock()
+			remaining -= len(matches)
+			if repoLimitHit || remaining <= 0 {
+				limitHit = true
+				cancel()
+			}
+			deadlineHit = deadlineHit || repoDeadlineHit
+		}(i)
+	}
+	wg.Wait()
+	if parent.Err() == context.Canceled {
+		return resp, parent.Err()
+	}
+
+	for i, r := range results {
+		switch {
+		case r.err == nil:
+		case isBadRequest(r.err):
+			// Every repository would fail the same way.
+			return resp, r.err
+		case limitHit && errors.Cause(r.err) == context.Canceled:
+			// Cancelled by us once the limit was hit.
+			continue
+		case ctx.Err() == context.DeadlineExceeded || errors.Cause(r.err) == context.DeadlineExceeded:
+			deadlineHit = true
+			continue
+		default:
+			resp.Errors = append(resp.Errors, protocol.BatchError{
+				Repo:   targets[i].repo,
+				Commit: targets[i].commit,
+				Error:  r.err.Error(),
+			})
+			continue
+		}
+		for _, m := range r.matches {
+			if len(resp.Matches) == fileMatchLimit {
+				limitHit = true
+				break
+			}
+			resp.Matches = append(resp.Matches, protocol.BatchFileMatch{
+				Repo:      targets[i].repo,
+				Commit:    targets[i].commit,
+				FileMatch: m,
+			})
+		}
+	}
+	if err := ctx.Err(); err == context.DeadlineExceeded {
+		deadlineHit = true
+	}
+	resp.LimitHit = limitHit
+	resp.DeadlineHit = deadlineHit
+	return resp, nil
+}
+
+var batchRepos = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "searcher",
+	Subsystem: "service",
+	Name:      "batch_repos",
+	Help:      "Number of repositories searched by /batch requests.",
+	Buckets:   []float64{1, 2, 5, 10, 20, 50, 100},
+})
+
+func init() {
+	prometheus.MustRegister(batchRepos)
+}
@@ -0,0 +1,67 @@
+package search
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+// blameConcurrency is the maximum number of files we concurrently ask
+// gitserver to blame for a single request.
+const blameConcurrency = 4
+
+// BlameHunk attributes the 1-based lines [StartLine, EndLine) of a file to
+// the commit which last changed them.
+type BlameHunk struct {
+	StartLine, EndLine int
+	protocol.LineBlame
+}
+
+// attachBlame sets Blame on every LineMatch in matches. It only blames the
+// range of lines spanned by each file's matches.
+func (s *Service) attachBlame(ctx context.Context, p *protocol.Request, matches []protocol.FileMatch) error {
+	if s.Blame == nil {
+		return badRequestError{"blame is not supported"}
+	}
+
+	sem := make(chan struct{}, blameConcurrency)
+	g, ctx := errgroup.WithContext(ctx)
+	for i := range matches {
+		fm := &matches[i]
+		if len(fm.LineMatches) == 0 || fm.Binary {
+			continue
+		}
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			// LineMatches are sorted by line number. Blame uses 1-based
+			// line numbers.
+			startLine := fm.LineMatches[0].LineNumber + 1
+			endLine := fm.LineMatches[len(fm.LineMatches)-1].LineNumber + 1
+			hunks, err := s.Blame(ctx, p.GitserverRepo(), p.Commit, fm.Path, startLine, endLine)
+			if err != nil {
+				return errors.Wrapf(err, "failed to blame %s", fm.Path)
+			}
+			for j := range fm.LineMatches {
+				lm := &fm.LineMatches[j]
+				line := lm.LineNumber + 1
+				for k := range hunks {
+					if hunks[k].StartLine <= line && line < hunks[k].EndLine {
+						lm.Blame = &hunks[k].LineBlame
+						break
+					}
+				}
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
@@ -0,0 +1,107 @@
+package search
+
+import "sync"
+
+// maxPooledBuf is the capacity above which buffers are not returned to
+// their pool, so that a rare huge file doesn't keep its buffers alive.
+const maxPooledBuf = 1 << 20
+
+// transformBufs pools the transformBuf of readerGreps. Each is as large as
+// the largest file of an archive, so allocating one for every worker of
+// every request dominated the allocations of case-insensitive searches.
+var transformBufs sync.Pool // *[]byte
+
+// getTransformBuf returns a buffer of length n from transformBufs.
+func getTransformBuf(n int) []byte {
+	if v := transformBufs.Get(); v != nil {
+		if b := *v.(*[]byte); cap(b) >= n {
+			return b[:n]
+		}
+	}
+	return make([]byte, n)
+}
+
+// releaseBuffers returns the buffers of rg to their pools. rg must not be
+// searching.
+func (rg *readerGrep) releaseBuffers() {
+	if rg.transformBuf == nil {
+		return
+	}
+	b := rg.transformBuf[:0]
+	transformBufs.Put(&b)
+	rg.transformBuf = nil
+}
+
+// previewBuilder collects the Previews of the matches of a file, which must
+// be copied out of its archive, into a single string which they are sliced
+// from. This replaces an allocation per match by one per file.
+type previewBuilder struct {
+	buf  []byte
+	ends []int // end of each Preview in buf
+	s    string
+
+	// offsets backs the OffsetAndLengths of the matches. Unlike buf it
+	// isn't reused, since they keep it.
+	offsets [][2]int
+}
+
+var previewBuilders = sync.Pool{New: func() interface{} { return new(previewBuilder) }}
+
+// getPreviewBuilder returns an empty previewBuilder for about n matches.
+// It must be released.
+func getPreviewBuilder(n int) *previewBuilder {
+	pb := previewBuilders.Get().(*previewBuilder)
+	if n > 0 {
+		pb.offsets = make([][2]int, 0, n)
+	}
+	return pb
+}
+
+// add appends the Preview of the next match.
+func (pb *previewBuilder) add(preview []byte) {
+	pb.buf = append(pb.buf, preview...)
+	pb.ends = append(pb.ends, len(pb.buf))
+}
+
+// offsetAndLength returns the OffsetAndLengths of a LineMatch with the
+// single range [offset, offset+length). Appending to it copies it.
+func (pb *previewBuilder) offsetAndLength(offset, length int) [][2]int {
+	pb.offsets = append(pb.offsets, [2]int{offset, length})
+	n := len(pb.offsets)
+	return pb.offsets[n-1 : n : n]
+}
+
+// finish copies the Previews added into the string preview slices.
+func (pb *previewBuilder) finish() {
+	pb.s = string(pb.buf)
+}
+
+// preview returns the i-th Preview added. finish must have been called.
+func (pb *previewBuilder) preview(i int) string {
+	start := 0
+	if i > 0 {
+		start = pb.ends[i-1]
+	}
+	return pb.s[start:pb.ends[i]]
+}
+
+func (pb *previewBuilder) release() {
+	if cap(pb.buf) > maxPooledBuf {
+		pb.buf = nil
+	}
+	pb.buf, pb.ends, pb.s, pb.offsets = pb.buf[:0], pb.ends[:0], "", nil
+	previewBuilders.Put(pb)
+}
+
+// splitLocs returns the [start, end) pairs of flat as the match locations
+// FindAllIndex returns, backed by flat instead of allocated one by one.
+func splitLocs(flat []int) [][]int {
+	if len(flat) == 0 {
+		return nil
+	}
+	locs := make([][]int, len(flat)/2)
+	for i := range locs {
+		locs[i] = flat[2*i : 2*i+2 : 2*i+2]
+	}
+	return locs
+}
@@ -0,0 +1,123 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/pathmatch"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// changedFilesBase returns the revision to diff p.Commit against to
+// implement ChangedSinceCommit and ChangedInLastCommits. It returns "" if
+// neither is set.
+func changedFilesBase(p *protocol.Request) string {
+	if p.ChangedSinceCommit != "" {
+		return string(p.ChangedSinceCommit)
+	}
+	if p.ChangedInLastCommits > 0 {
+		return string(p.Commit) + "~" + strconv.Itoa(p.ChangedInLastCommits)
+	}
+	return ""
+}
+
+// changedFilesMatcher returns a PathMatcher which only matches the files
+// which changed between base and p.Commit and also match matchPath. It also
+// returns the changed files.
+func (s *Service) changedFilesMatcher(ctx context.Context, p *protocol.Request, base string, matchPath pathmatch.PathMatcher) (pathmatch.PathMatcher, []string, error) {
+	if s.ChangedFiles == nil {
+		return nil, nil, badRequestError{"searching only changed files is not supported"}
+	}
+	paths, err := s.ChangedFiles(ctx, p.GitserverRepo(), base, string(p.Commit))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to list files changed since %s", base)
+	}
+	changed := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		changed[path] = true
+	}
+	return &pathSetMatcher{
+		PathMatcher: matchPath,
+		paths:       changed,
+		desc:        fmt.Sprintf("changed:%s..%s", base, p.Commit),
+	}, paths, nil
+}
+
+// maxChangedArchivePaths is the most changed files fetched as an archive of
+// only those files (see getChangedZipFile). gitserver receives the paths in
+// its URL, and with more files the archive is unlikely to be much smaller
+// than the whole repository.
+const maxChangedArchivePaths = 500
+
+// getChangedZipFile returns an archive of only the files of p.Commit in
+// changed, so that searching the changes since an indexed commit (whose
+// results are merged with the index's upstream) does not fetch the whole
+// repository. It returns a nil ZipFile if the archive of the whole
+// repository should be searched instead: because it is cached, because
+// there are too many changed files, or because the store can't fetch
+// archives of some paths. The returned ZipFile must be closed.
+func (s *Service) getChangedZipFile(ctx context.Context, p *protocol.Request, changed []string) (string, *store.ZipFile, error) {
+	if p.PathSpec != "" {
+		var inDir []string
+		for _, path := range changed {
+			if inSubtree(path, p.PathSpec) {
+				inDir = append(inDir, path)
+			}
+		}
+		changed = inDir
+	}
+	if s.Store.FetchTarPaths == nil || s.NoFetch || p.NoFetch || len(changed) > maxChangedArchivePaths {
+		changedArchives.WithLabelValues("full").Inc()
+		return "", nil, nil
+	}
+	if _, _, err := s.Store.StatZip(p.GitserverRepo(), p.Commit); err == nil {
+		changedArchives.WithLabelValues("full").Inc()
+		return "", nil, nil
+	}
+	if len(changed) == 0 {
+		// Nothing to search, and an empty list of paths would fetch the
+		// whole repository.
+		changedArchives.WithLabelValues("empty").Inc()
+		zf, err := store.ReadTarArchive(bytes.NewReader(nil), nil, 0)
+		return "", zf, err
+	}
+	changedArchives.WithLabelValues("partial").Inc()
+	return s.getZipFileWith(ctx, p, func(ctx context.Context) (string, error) {
+		return s.Store.PrepareZipPaths(ctx, p.GitserverRepo(), p.Commit, changed)
+	})
+}
+
+// pathSetMatcher wraps a PathMatcher to additionally only match paths in a
+// fixed set. If exclude is true, it instead only matches paths which are not
+// in the set.
+type pathSetMatcher struct {
+	pathmatch.PathMatcher
+	paths   map[string]bool
+	exclude bool
+	desc    string
+}
+
+func (m *pathSetMatcher) MatchPath(name string) bool {
+	return m.paths[name] != m.exclude && m.PathMatcher.MatchPath(name)
+}
+
+func (m *pathSetMatcher) String() string {
+	return m.PathMatcher.String() + " " + m.desc
+}
+
+var changedArchives = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "service",
+	Name:      "changed_files_archives_total",
+	Help:      "Number of searches of changed files, by the archive searched: full (the whole repository), partial (only the changed files) or empty (no changed files).",
+}, []string{"archive"})
+
+func init() {
+	prometheus.MustRegister(changedArchives)
+}
@@ -0,0 +1,186 @@
+package search
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/pathmatch"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// codeownersPaths are the locations of the CODEOWNERS file, in the order
+// GitHub and GitLab look for it.
+var codeownersPaths = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS", ".gitlab/CODEOWNERS"}
+
+// codeownersRule assigns owners to the files matching a pattern.
+type codeownersRule struct {
+	pattern *regexp.Regexp
+	owners  []string
+}
+
+// codeowners is a parsed CODEOWNERS file.
+type codeowners []codeownersRule
+
+// parseCodeowners parses the content of a CODEOWNERS file. Lines which
+// are not valid rules, such as GitLab section headers, are ignored.
+func parseCodeowners(data []byte) codeowners {
+	var rules codeowners
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") || strings.HasPrefix(line, "^[") {
+			continue
+		}
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		re, err := compileCodeownersPattern(fields[0])
+		if err != nil {
+			continue
+		}
+		rules = append(rules, codeownersRule{pattern: re, owners: fields[1:]})
+	}
+	return rules
+}
+
+// compileCodeownersPattern compiles a CODEOWNERS pattern, which uses the
+// gitignore syntax, to a regexp matching the paths it applies to.
+func compileCodeownersPattern(pattern string) (*regexp.Regexp, error) {
+	return compileGitignorePattern("", pattern, true)
+}
+
+// compileGitignorePattern compiles a pattern in the gitignore syntax of a
+// file in dir ("" for the root) to a regexp matching the paths it applies
+// to. If contents is true, a pattern matching a directory applies to
+// everything inside it, as in CODEOWNERS. Otherwise it only matches files,
+// as in .gitattributes.
+func compileGitignorePattern(dir, pattern string, contents bool) (*regexp.Regexp, error) {
+	// Like gitignore, a pattern containing a slash other than at its end is
+	// relative to dir. Otherwise it matches at any depth.
+	anchored := strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+
+	var b strings.Builder
+	b.WriteString("^")
+	if dir != "" {
+		b.WriteString(regexp.QuoteMeta(dir + "/"))
+	}
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	// A pattern matching a directory applies to everything inside it. As
+	// documented by GitHub, a trailing wildcard (eg docs/*) only matches
+	// the files directly inside a directory.
+	switch {
+	case !contents:
+		b.WriteString("$")
+	case dirOnly:
+		b.WriteString("/.*$")
+	case strings.HasSuffix(pattern, "*"):
+		b.WriteString("$")
+	default:
+		b.WriteString("(?:/.*)?$")
+	}
+	return regexp.Compile(b.String())
+}
+
+// owners returns the owners of path. As in GitHub and GitLab, the last
+// matching rule wins, and a rule without owners leaves the path unowned.
+func (c codeowners) owners(path string) []string {
+	for i := len(c) - 1; i >= 0; i-- {
+		if c[i].pattern.MatchString(path) {
+			return c[i].owners
+		}
+	}
+	return nil
+}
+
+// ownedBy reports whether owner is one of the owners of path. Owners are
+// compared case insensitively, and the leading @ of users and teams is
+// optional.
+func (c codeowners) ownedBy(path, owner string) bool {
+	owner = strings.TrimPrefix(owner, "@")
+	for _, o := range c.owners(path) {
+		if strings.EqualFold(strings.TrimPrefix(o, "@"), owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// readCodeowners returns the rules of the CODEOWNERS file in zf, or none if
+// it has no CODEOWNERS file.
+func readCodeowners(zf *store.ZipFile) codeowners {
+	for _, name := range codeownersPaths {
+		for i := range zf.Files {
+			if zf.Files[i].Name == name {
+				return parseCodeowners(zf.DataFor(&zf.Files[i]))
+			}
+		}
+	}
+	return nil
+}
+
+// codeownersMatcher wraps a PathMatcher to additionally only match files
+// owned, and not owned, by the owners given in a request.
+type codeownersMatcher struct {
+	pathmatch.PathMatcher
+	codeowners codeowners
+	ownedBy    string
+	notOwnedBy string
+}
+
+// ownersMatcher returns matchPath restricted to the files owned by
+// p.OwnedBy and not owned by p.NotOwnedBy according to the CODEOWNERS file
+// in zf. Files matching no CODEOWNERS rule have no owners.
+func ownersMatcher(zf *store.ZipFile, p *protocol.Request, matchPath pathmatch.PathMatcher) pathmatch.PathMatcher {
+	return &codeownersMatcher{
+		PathMatcher: matchPath,
+		codeowners:  readCodeowners(zf),
+		ownedBy:     p.OwnedBy,
+		notOwnedBy:  p.NotOwnedBy,
+	}
+}
+
+func (m *codeownersMatcher) MatchPath(name string) bool {
+	if m.ownedBy != "" && !m.codeowners.ownedBy(name, m.ownedBy) {
+		return false
+	}
+	if m.notOwnedBy != "" && m.codeowners.ownedBy(name, m.notOwnedBy) {
+		return false
+	}
+	return m.PathMatcher.MatchPath(name)
+}
+
+func (m *codeownersMatcher) String() string {
+	s := m.PathMatcher.String()
+	if m.ownedBy != "" {
+		s += " owner:" + m.ownedBy
+	}
+	if m.notOwnedBy != "" {
+		s += " -owner:" + m.notOwnedBy
+	}
+	return s
+}
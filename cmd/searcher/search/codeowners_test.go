@@ -0,0 +1,53 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCodeowners(t *testing.T) {
+	c := parseCodeowners([]byte(`# Default owners
+*       @global
+
+*.js    @js-owner
+/build/ @build-team
+docs/*  docs@example.com
+apps/   @apps
+**/logs @logs
+/scripts/ @scripts @ops
+
+[Section]
+/unowned/generated
+`))
+
+	cases := map[string][]string{
+		"README.md":              {"@global"},
+		"web/index.js":           {"@js-owner"},
+		"build/out/index.js":     {"@build-team"},
+		"sub/build/x.go":         {"@global"},
+		"docs/getting-started":   {"docs@example.com"},
+		"docs/deep/nested.md":    {"@global"},
+		"apps/web/main.go":       {"@apps"},
+		"nested/apps/foo.go":     {"@apps"},
+		"logs/today":             {"@logs"},
+		"deep/in/logs/today":     {"@logs"},
+		"scripts/deploy.sh":      {"@scripts", "@ops"},
+		"unowned/generated/x.go": {},
+	}
+	for path, want := range cases {
+		got := c.owners(path)
+		if len(got) == 0 && len(want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("owners(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	if !c.ownedBy("scripts/deploy.sh", "OPS") {
+		t.Error("expected owners to be compared case insensitively without @")
+	}
+	if c.ownedBy("unowned/generated/x.go", "@global") {
+		t.Error("expected a rule without owners to override earlier rules")
+	}
+}
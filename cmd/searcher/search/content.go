@@ -0,0 +1,46 @@
+package search
+
+import (
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+const (
+	// maxContentSize is the largest file whose content is returned for
+	// WantContent.
+	maxContentSize = 1 << 20
+
+	// maxTotalContentSize bounds the content returned for WantContent in a
+	// single response.
+	maxTotalContentSize = 32 << 20
+)
+
+// attachContent sets Content on every match from the corresponding file in
+// zf, subject to maxContentSize and maxTotalContentSize. The content of
+// binary files is omitted.
+func attachContent(zf *store.ZipFile, matches []protocol.FileMatch) {
+	files := make(map[string]*store.SrcFile, len(zf.Files))
+	for i := range zf.Files {
+		files[zf.Files[i].Name] = &zf.Files[i]
+	}
+
+	total := 0
+	for i := range matches {
+		fm := &matches[i]
+		f, ok := files[fm.Path]
+		if !ok {
+			// eg the match is in a resolved LFS object.
+			fm.ContentOmitted = true
+			continue
+		}
+		size := int(f.Len)
+		if fm.Binary || size > maxContentSize || total+size > maxTotalContentSize {
+			fm.ContentOmitted = true
+			continue
+		}
+		// Copy the content since zf's data must not be used after it is
+		// closed.
+		fm.Content = string(zf.DataFor(f))
+		total += size
+	}
+}
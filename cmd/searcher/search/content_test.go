@@ -0,0 +1,51 @@
+package search
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+	"github.com/sourcegraph/sourcegraph/internal/testutil"
+)
+
+func TestAttachContent(t *testing.T) {
+	files := map[string]string{
+		"small.txt": "hello",
+		"big.txt":   strings.Repeat("x", maxContentSize+1),
+	}
+	// Enough files at the size limit to exceed the total limit.
+	n := maxTotalContentSize / maxContentSize
+	for i := 0; i < n; i++ {
+		files[strings.Repeat("m", i+1)] = strings.Repeat("x", maxContentSize)
+	}
+	zipData, err := testutil.CreateZip(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zf, err := store.MockZipFile(zipData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches := []protocol.FileMatch{{Path: "small.txt"}, {Path: "big.txt"}, {Path: "missing.txt"}}
+	for i := 0; i < n; i++ {
+		matches = append(matches, protocol.FileMatch{Path: strings.Repeat("m", i+1)})
+	}
+	attachContent(zf, matches)
+
+	if matches[0].Content != "hello" || matches[0].ContentOmitted {
+		t.Errorf("unexpected match for small.txt: %+v", matches[0])
+	}
+	for _, fm := range matches[1:3] {
+		if fm.Content != "" || !fm.ContentOmitted {
+			t.Errorf("expected content of %s to be omitted", fm.Path)
+		}
+	}
+	// The last file would take the response over maxTotalContentSize.
+	for i, fm := range matches[3:] {
+		if omitted := i == n-1; fm.ContentOmitted != omitted || (fm.Content == "") != omitted {
+			t.Errorf("%s: got ContentOmitted=%v, want %v", fm.Path, fm.ContentOmitted, omitted)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package search
+
+import (
+	"bytes"
+	"unicode/utf8"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// attachContextLines sets Before and After on every LineMatch of matches to
+// up to before and after lines around it from the corresponding file in zf,
+// so clients don't have to fetch the file to show the context of a match.
+func attachContextLines(zf *store.ZipFile, before, after int, matches []protocol.FileMatch) {
+	if before <= 0 && after <= 0 {
+		return
+	}
+	files := make(map[string]*store.SrcFile, len(zf.Files))
+	for i := range zf.Files {
+		files[zf.Files[i].Name] = &zf.Files[i]
+	}
+
+	for i := range matches {
+		fm := &matches[i]
+		f, ok := files[fm.Path]
+		if !ok || len(fm.LineMatches) == 0 || fm.Binary {
+			continue
+		}
+		lines := bytes.Split(zf.DataFor(f), []byte{'\n'})
+		for j := range fm.LineMatches {
+			lm := &fm.LineMatches[j]
+			lm.Before = contextLines(lines, lm.LineNumber-before, lm.LineNumber)
+			lm.After = contextLines(lines, lm.LineNumber+1, lm.LineNumber+1+after)
+		}
+	}
+}
+
+// contextLines returns lines[start:end], clamped to the bounds of lines.
+// Lines are copied, since zf's data must not be used after it is closed,
+// and truncated like a Preview.
+func contextLines(lines [][]byte, start, end int) []string {
+	if start < 0 {
+		start = 0
+	}
+	// A trailing newline does not start another line.
+	n := len(lines)
+	if n > 0 && len(lines[n-1]) == 0 {
+		n--
+	}
+	if end > n {
+		end = n
+	}
+	if start >= end {
+		return nil
+	}
+	context := make([]string, 0, end-start)
+	for _, line := range lines[start:end] {
+		if len(line) > maxPreviewLen {
+			end := maxPreviewLen
+			for end > 0 && !utf8.RuneStart(line[end]) {
+				end--
+			}
+			line = line[:end]
+		}
+		context = append(context, string(bytes.TrimSuffix(line, []byte{'\r'})))
+	}
+	return context
+}
@@ -0,0 +1,122 @@
+package search
+
+import (
+	"fmt"
+	"regexp/syntax"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxRegexpInsts bounds the size of the program a pattern compiles to.
+// Matching costs up to that many steps for every byte searched.
+const maxRegexpInsts = 20000
+
+// regexpCostError rejects a pattern which is too expensive to match. Go's
+// regexp engine runs in linear time, so patterns can't backtrack
+// catastrophically, but the factor can still make a search of a large
+// archive take minutes.
+type regexpCostError struct {
+	// Reason is what makes the pattern expensive, eg "program size".
+	Reason string
+
+	// Value is the measure of Reason for the pattern, and Limit the
+	// largest value accepted. Both are zero if Reason is not measured.
+	Value, Limit int
+
+	// Hint suggests how to rewrite the pattern.
+	Hint string
+}
+
+func (e *regexpCostError) Error() string {
+	msg := "pattern is too expensive to match: " + e.Reason
+	if e.Limit > 0 {
+		msg += fmt.Sprintf(" is %d (limit %d)", e.Value, e.Limit)
+	}
+	return msg + ". " + e.Hint
+}
+
+func (e *regexpCostError) BadRequest() bool { return true }
+
+// checkRegexpCost returns a *regexpCostError if expr, which compile is about
+// to compile, is too expensive to match. multiline is whether "." matches
+// newlines.
+func checkRegexpCost(expr string, multiline bool) error {
+	err := regexpCost(expr, multiline)
+	if e, ok := err.(*regexpCostError); ok {
+		regexpRejectedTotal.WithLabelValues(e.Reason).Inc()
+	}
+	return err
+}
+
+func regexpCost(expr string, multiline bool) error {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		// The parser bounds repetitions itself, but doesn't explain why.
+		// Other errors are reported by compiling.
+		if serr, ok := err.(*syntax.Error); ok {
+			switch serr.Code {
+			case syntax.ErrInvalidRepeatSize:
+				return &regexpCostError{
+					Reason: "repetition count",
+					Hint:   fmt.Sprintf("%s repeats more than 1000 times, counting the repetitions it is nested in. Use + or * instead.", serr.Expr),
+				}
+			case syntax.ErrLarge:
+				return &regexpCostError{
+					Reason: "program size",
+					Hint:   "Use fewer or shorter alternatives and repetitions.",
+				}
+			}
+		}
+		return nil
+	}
+	if multiline && leadingAnyStar(re) {
+		return &regexpCostError{
+			Reason: "leading .*",
+			Hint:   "In Multiline mode it extends every match to the start of the file. Remove it.",
+		}
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil
+	}
+	if n := len(prog.Inst); n > maxRegexpInsts {
+		return &regexpCostError{
+			Reason: "program size",
+			Value:  n,
+			Limit:  maxRegexpInsts,
+			Hint:   "Use fewer or shorter alternatives and repetitions.",
+		}
+	}
+	return nil
+}
+
+// leadingAnyStar reports whether re starts with an unanchored .* (or .+)
+// matching any character including newlines.
+func leadingAnyStar(re *syntax.Regexp) bool {
+	for {
+		switch re.Op {
+		case syntax.OpCapture:
+			re = re.Sub[0]
+		case syntax.OpConcat:
+			if len(re.Sub) == 0 {
+				return false
+			}
+			re = re.Sub[0]
+		case syntax.OpStar, syntax.OpPlus:
+			return re.Sub[0].Op == syntax.OpAnyChar
+		default:
+			return false
+		}
+	}
+}
+
+var regexpRejectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "service",
+	Name:      "regexp_rejected_total",
+	Help:      "Number of patterns rejected because they are too expensive to match, by reason.",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(regexpRejectedTotal)
+}
@@ -0,0 +1,59 @@
+package search
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+func TestRegexpCost(t *testing.T) {
+	cases := []struct {
+		pattern    string
+		multiline  bool
+		wantReason string
+	}{
+		{pattern: `foo.*bar`},
+		{pattern: `.*foo`},
+		{pattern: `a{1000}`},
+		{pattern: `(a{10}){100}`},
+		{pattern: `((a{100}){10}){11}`, wantReason: "repetition count"},
+		{pattern: `(?:x{2,}){20000}`, wantReason: "repetition count"},
+		{pattern: `.*foo`, multiline: true, wantReason: "leading .*"},
+		{pattern: `(.+)foo`, multiline: true, wantReason: "leading .*"},
+		{pattern: `foo.*`, multiline: true},
+		{pattern: `(alpha|beta|gamma|delta){1000}`, wantReason: "program size"},
+		{pattern: `(foo|bar){1000}`},
+	}
+	for _, tc := range cases {
+		expr := "(?m:" + tc.pattern + ")"
+		if tc.multiline {
+			expr = "(?ms:" + tc.pattern + ")"
+		}
+		err := checkRegexpCost(expr, tc.multiline)
+		var reason string
+		if e, ok := err.(*regexpCostError); ok {
+			reason = e.Reason
+		} else if err != nil {
+			t.Fatalf("%s: unexpected error %v", tc.pattern, err)
+		}
+		if reason != tc.wantReason {
+			t.Errorf("%s (multiline=%v): got reason %q, want %q", tc.pattern, tc.multiline, reason, tc.wantReason)
+		}
+	}
+}
+
+func TestCompile_tooExpensive(t *testing.T) {
+	_, err := compile(&protocol.PatternInfo{Pattern: `((a{100}){10}){11}`, IsRegExp: true})
+	if !isBadRequest(err) {
+		t.Fatalf("got %v, want a bad request", err)
+	}
+	if want := "repetition count. {11} repeats more than 1000 times"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got %q, want it to contain %q", err, want)
+	}
+
+	// Long literals are cheap to match.
+	if _, err := compile(&protocol.PatternInfo{Pattern: strings.Repeat("foo(", 10000), IsCaseSensitive: true}); err != nil {
+		t.Errorf("unexpected error for a long literal: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package search
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// cursor is the position in the files of an archive where a Paginate
+// search stopped. Requests send it back encoded as their Cursor to resume
+// from there.
+type cursor struct {
+	Commit api.CommitID `json:"c"`
+
+	// File is the index of the file to resume from, in the order files are
+	// searched, and Path its path. Path is the zero value on the first
+	// page.
+	File int    `json:"f"`
+	Path string `json:"p"`
+
+	// Skip is the number of matches of the file which were returned.
+	Skip int `json:"s,omitempty"`
+}
+
+func (c *cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// compilePage returns where the Paginate request p starts, or nil if p
+// doesn't paginate.
+func compilePage(p *protocol.Request) (*cursor, error) {
+	if p.Cursor == "" {
+		if !p.Paginate {
+			return nil, nil
+		}
+		return &cursor{}, nil
+	}
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(p.Cursor)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil || c.File < 0 || c.Skip < 0 || c.Path == "" {
+		return nil, errors.Errorf("invalid Cursor %q", p.Cursor)
+	}
+	if c.Commit != p.Commit {
+		return nil, errors.Errorf("Cursor is for commit %s, not %s", c.Commit, p.Commit)
+	}
+	return &c, nil
+}
+
+// find returns the index in files of the file c resumes from. Files are
+// usually where c found them, but archives of a commit are not always
+// identical, eg when only the files changed since another commit are
+// fetched.
+func (c *cursor) find(files []store.SrcFile) (int, error) {
+	if c.Path == "" {
+		return 0, nil
+	}
+	if c.File < len(files) && files[c.File].Name == c.Path {
+		return c.File, nil
+	}
+	for i := range files {
+		if files[i].Name == c.Path {
+			return i, nil
+		}
+	}
+	return 0, badRequestError{"Cursor is not of a file in the archive (Path=" + c.Path + ")"}
+}
+
+// pageMatches returns the number of matches of fm which limits.take counts,
+// and cursors skip.
+func pageMatches(fm *protocol.FileMatch) int {
+	if fm.MatchCount > 0 {
+		return fm.MatchCount
+	}
+	return len(fm.LineMatches)
+}
+
+// skipMatches drops the first n matches of fm, which previous pages
+// returned. It reports whether any are left.
+func skipMatches(fm *protocol.FileMatch, n int) bool {
+	if n == 0 {
+		return true
+	}
+	if fm.MatchCount > 0 {
+		fm.MatchCount -= n
+		return fm.MatchCount > 0
+	}
+	if n >= len(fm.LineMatches) {
+		fm.LineMatches = nil
+		return false
+	}
+	fm.LineMatches = fm.LineMatches[n:]
+	return true
+}
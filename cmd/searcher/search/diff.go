@@ -0,0 +1,200 @@
+package search
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/sourcegraph/go-diff/diff"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// diffContextLines is the number of unchanged lines around changes in the
+// diffs of attachDiffs, like the default of diff -u.
+const diffContextLines = 3
+
+// attachDiffs sets Diff on every FileMatch in matches with line matches to
+// the unified diff of replacing every match in the file by the expansion of
+// template (see regexp.Expand). Unlike the LineMatches, it covers the
+// matches beyond the limits of the request. Only rg's regexp is used, so it
+// must be the readerGrep which found matches.
+func attachDiffs(zf *store.ZipFile, rg *readerGrep, template string, matches []protocol.FileMatch) error {
+	re, ok := stdRegexp(rg.re)
+	if !ok {
+		return badRequestError{"Replacement is not supported for patterns which require the fallback regexp engine"}
+	}
+
+	files := make(map[string]*store.SrcFile, len(zf.Files))
+	for i := range zf.Files {
+		files[zf.Files[i].Name] = &zf.Files[i]
+	}
+
+	tmpl := []byte(template)
+	for i := range matches {
+		fm := &matches[i]
+		f, ok := files[fm.Path]
+		if len(fm.LineMatches) == 0 || !ok || fm.Binary {
+			continue
+		}
+
+		data := zf.DataFor(f)
+		submatches := submatchesByStart(rg, re, data)
+		var edits []edit
+		for _, loc := range rg.findAll(f.Name, data, matchContent(rg, data), -1) {
+			if m, ok := submatches[loc[0]]; ok {
+				edits = append(edits, edit{start: loc[0], end: loc[1], text: re.Expand(nil, tmpl, data, m)})
+			}
+		}
+		d, err := unifiedDiff(f.Name, data, edits)
+		if err != nil {
+			return err
+		}
+		fm.Diff = d
+	}
+	return nil
+}
+
+// edit replaces data[start:end] by text.
+type edit struct {
+	start, end int
+	text       []byte
+}
+
+// unifiedDiff returns the unified diff of path from data to data with edits
+// applied, or "" if they change nothing. edits must be in order and must not
+// overlap.
+func unifiedDiff(path string, data []byte, edits []edit) (string, error) {
+	// Every line of data ends with a newline, except maybe the last one.
+	starts := lineStarts(data)
+	if starts[len(starts)-1] == len(data) {
+		starts = starts[:len(starts)-1]
+	}
+	lineOf := func(off int) int {
+		return sort.SearchInts(starts, off+1) - 1
+	}
+	lineStart := func(line int) int {
+		if line >= len(starts) {
+			return len(data)
+		}
+		return starts[line]
+	}
+
+	// Lines changed by the same edits form a block, which is replaced as a
+	// whole. Edits on the same or adjacent lines share a block.
+	type block struct {
+		start, end int // lines
+		old, new   [][]byte
+	}
+	var blocks []*block
+	for i := 0; i < len(edits); {
+		b := &block{start: lineOf(edits[i].start)}
+		if b.start < 0 {
+			b.start = 0
+		}
+		var content []byte
+		last := lineStart(b.start)
+		for ; i < len(edits); i++ {
+			e := edits[i]
+			if b.end > 0 && lineOf(e.start) > b.end {
+				break
+			}
+			// The block ends with the line of the last replaced character,
+			// or the line after it if the edit joins them.
+			end := e.end
+			if end > e.start && (data[end-1] != '\n' || bytes.HasSuffix(e.text, []byte{'\n'})) {
+				end--
+			}
+			if l := lineOf(end) + 1; l > b.end {
+				b.end = l
+			}
+			content = append(content, data[last:e.start]...)
+			content = append(content, e.text...)
+			last = e.end
+		}
+		if b.end > len(starts) {
+			b.end = len(starts)
+		}
+		content = append(content, data[last:lineStart(b.end)]...)
+		b.old = splitLines(data[lineStart(b.start):lineStart(b.end)])
+		b.new = splitLines(content)
+		if !linesEqual(b.old, b.new) {
+			blocks = append(blocks, b)
+		}
+	}
+	if len(blocks) == 0 {
+		return "", nil
+	}
+
+	// Blocks separated by less than twice the context share a hunk.
+	lines := splitLines(data)
+	var hunks []*diff.Hunk
+	delta := 0 // lines added by the blocks before the current hunk
+	for i := 0; i < len(blocks); {
+		start := blocks[i].start - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		h := &diff.Hunk{OrigStartLine: int32(start + 1), NewStartLine: int32(start + delta + 1)}
+		var body bytes.Buffer
+		pos := start
+		for ; i < len(blocks) && blocks[i].start-pos <= 2*diffContextLines; i++ {
+			b := blocks[i]
+			writeDiffLines(&body, ' ', lines[pos:b.start])
+			writeDiffLines(&body, '-', b.old)
+			writeDiffLines(&body, '+', b.new)
+			h.OrigLines += int32(b.start - pos + len(b.old))
+			h.NewLines += int32(b.start - pos + len(b.new))
+			delta += len(b.new) - len(b.old)
+			pos = b.end
+		}
+		end := pos + diffContextLines
+		if end > len(lines) {
+			end = len(lines)
+		}
+		writeDiffLines(&body, ' ', lines[pos:end])
+		h.OrigLines += int32(end - pos)
+		h.NewLines += int32(end - pos)
+		h.Body = body.Bytes()
+		hunks = append(hunks, h)
+	}
+
+	b, err := diff.PrintFileDiff(&diff.FileDiff{OrigName: "a/" + path, NewName: "b/" + path, Hunks: hunks})
+	return string(b), err
+}
+
+// splitLines splits b after every newline.
+func splitLines(b []byte) [][]byte {
+	if len(b) == 0 {
+		return nil
+	}
+	lines := bytes.SplitAfter(b, []byte{'\n'})
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func linesEqual(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeDiffLines writes lines to w prefixed by op, marking a last line
+// without a newline like diff does.
+func writeDiffLines(w *bytes.Buffer, op byte, lines [][]byte) {
+	for _, line := range lines {
+		w.WriteByte(op)
+		w.Write(line)
+		if !bytes.HasSuffix(line, []byte{'\n'}) {
+			w.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package search
+
+import (
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	cases := []struct {
+		name  string
+		data  string
+		edits []edit
+		want  string
+	}{{
+		name:  "no change",
+		data:  "foo\n",
+		edits: []edit{{start: 0, end: 3, text: []byte("foo")}},
+		want:  "",
+	}, {
+		name: "separate hunks",
+		data: "a\nfoo\nb\nc\nd\ne\nf\ng\nh\ni\nfoo\nj",
+		edits: []edit{
+			{start: 2, end: 5, text: []byte("bar")},
+			{start: 22, end: 25, text: []byte("bar")},
+		},
+		want: "--- a/x\n+++ b/x\n@@ -1,5 +1,5 @@\n a\n-foo\n+bar\n b\n c\n d\n@@ -8,5 +8,5 @@\n g\n h\n i\n-foo\n+bar\n j\n\\ No newline at end of file\n",
+	}, {
+		name: "shared hunk",
+		data: "foo\na\nfoo\n",
+		edits: []edit{
+			{start: 0, end: 3, text: []byte("bar")},
+			{start: 6, end: 9, text: []byte("bar")},
+		},
+		want: "--- a/x\n+++ b/x\n@@ -1,3 +1,3 @@\n-foo\n+bar\n a\n-foo\n+bar\n",
+	}, {
+		name:  "added lines",
+		data:  "x\nfoo\ny\n",
+		edits: []edit{{start: 2, end: 5, text: []byte("b\nc")}},
+		want:  "--- a/x\n+++ b/x\n@@ -1,3 +1,4 @@\n x\n-foo\n+b\n+c\n y\n",
+	}, {
+		name:  "removed newline",
+		data:  "foo\nbar\nbaz\n",
+		edits: []edit{{start: 3, end: 4, text: []byte(" ")}},
+		want:  "--- a/x\n+++ b/x\n@@ -1,3 +1,2 @@\n-foo\n-bar\n+foo bar\n baz\n",
+	}}
+	for _, c := range cases {
+		got, err := unifiedDiff("x", []byte(c.data), c.edits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package search
+
+import (
+	"context"
+	"log"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/ctags"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+const (
+	// enclosingScopeConcurrency is the maximum number of files we
+	// concurrently parse with ctags for a single request.
+	enclosingScopeConcurrency = 4
+
+	// maxEnclosingScopeFiles is the maximum number of files we parse with
+	// ctags for a single request.
+	maxEnclosingScopeFiles = 100
+)
+
+// attachEnclosingScopes sets EnclosingScope on every LineMatch in matches
+// which is inside a definition ctags reports the extent of. Files which
+// fail to parse are skipped.
+func (s *Service) attachEnclosingScopes(ctx context.Context, zf *store.ZipFile, matches []protocol.FileMatch) error {
+	if s.ParseSymbols == nil {
+		return badRequestError{"enclosing scopes are not supported"}
+	}
+
+	files := make(map[string]*store.SrcFile, len(zf.Files))
+	for i := range zf.Files {
+		files[zf.Files[i].Name] = &zf.Files[i]
+	}
+
+	sem := make(chan struct{}, enclosingScopeConcurrency)
+	g, ctx := errgroup.WithContext(ctx)
+	parsed := 0
+	for i := range matches {
+		fm := &matches[i]
+		f, ok := files[fm.Path]
+		if len(fm.LineMatches) == 0 || !ok || fm.Binary {
+			continue
+		}
+		if parsed++; parsed > maxEnclosingScopeFiles {
+			break
+		}
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			entries, err := s.ParseSymbols(ctx, f.Name, zf.DataFor(f))
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Printf("failed to parse %s with ctags: %s", f.Name, err)
+				return nil
+			}
+			for j := range fm.LineMatches {
+				fm.LineMatches[j].EnclosingScope = enclosingScope(entries, fm.LineMatches[j].LineNumber)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// enclosingScope returns the innermost entry containing the 0-based line, or
+// nil if there is none.
+func enclosingScope(entries []ctags.Entry, line int) *protocol.EnclosingScope {
+	var best *ctags.Entry
+	for i := range entries {
+		e := &entries[i]
+		// ctags lines are 1-based.
+		if e.End == 0 || e.Line-1 > line || e.End-1 < line {
+			continue
+		}
+		if best == nil || e.Line > best.Line || (e.Line == best.Line && e.End < best.End) {
+			best = e
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return &protocol.EnclosingScope{
+		Name:      best.Name,
+		Kind:      best.Kind,
+		StartLine: best.Line - 1,
+		EndLine:   best.End - 1,
+	}
+}
@@ -0,0 +1,121 @@
+package search
+
+import (
+	"errors"
+	"regexp/syntax"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dlclark/regexp2"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+// fallbackRegexp matches using regexp2, a backtracking engine which supports
+// lookaround and backreferences. It has no linear time guarantee, so it is
+// only used for patterns RE2 rejects and the time spent matching a single
+// file is bounded by MatchTimeout.
+type fallbackRegexp struct {
+	re *regexp2.Regexp
+}
+
+// isUnsupportedRegexp returns true if err is RE2 rejecting a pattern because
+// it uses a feature RE2 deliberately does not implement, such as lookaround
+// or backreferences.
+func isUnsupportedRegexp(err error) bool {
+	var serr *syntax.Error
+	if !errors.As(err, &serr) {
+		return false
+	}
+	switch serr.Code {
+	case syntax.ErrInvalidPerlOp, syntax.ErrInvalidEscape:
+		return true
+	case syntax.ErrInvalidNamedCapture:
+		// Lookbehind looks like a named capture to RE2.
+		return strings.HasPrefix(serr.Expr, "(?<=") || strings.HasPrefix(serr.Expr, "(?<!")
+	}
+	return false
+}
+
+// compileFallback is like compile, but matches p.Pattern with the fallback
+// engine. Matching a file stops after timeout.
+func compileFallback(p *protocol.PatternInfo, timeout time.Duration) (*readerGrep, error) {
+	expr := p.Pattern
+	// Like compile, we want anchors to match at newlines. Unlike compile,
+	// we let the engine handle case insensitivity rather than lowercasing
+	// the input, since lowercasing would break backreferences.
+	opts := regexp2.RegexOptions(regexp2.RE2 | regexp2.Multiline)
+	if !p.IsCaseSensitive {
+		opts |= regexp2.IgnoreCase
+	}
+	if p.Multiline {
+		opts |= regexp2.Singleline
+	}
+	re, err := regexp2.Compile(expr, opts)
+	if err != nil {
+		return nil, err
+	}
+	re.MatchTimeout = timeout
+
+	var matcher regexpMatcher = &fallbackRegexp{re: re}
+	if p.IsWordMatch {
+		matcher = &wordMatcher{re: matcher}
+	}
+
+	matchPath, err := compilePathMatcher(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &readerGrep{
+		re:             matcher,
+		matchPath:      matchPath,
+		scope:          p.Scope,
+		invert:         p.InvertMatch,
+		firstMatchOnly: p.FirstMatchOnly,
+		searchBinary:   p.SearchBinary,
+		maxFileSize:    p.MaxFileSize,
+		multiline:      p.Multiline,
+		countOnly:      p.CountOnly,
+		maxLineMatches: p.MaxLineMatchesPerFile,
+	}, nil
+}
+
+func (re *fallbackRegexp) MatchString(s string) bool {
+	ok, err := re.re.MatchString(s)
+	return err == nil && ok
+}
+
+// FindAllIndex returns the byte offsets of at most n (or all if n < 0)
+// successive matches in b. If matching times out, the matches found so far
+// are returned.
+func (re *fallbackRegexp) FindAllIndex(b []byte, n int) [][]int {
+	s := string(b)
+
+	// regexp2 reports offsets in runes. Matches are returned in order, so
+	// we convert them to byte offsets in a single pass over s.
+	bytePos, runePos := 0, 0
+	toByteOffset := func(runeOffset int) int {
+		for runePos < runeOffset && bytePos < len(s) {
+			_, size := utf8.DecodeRuneInString(s[bytePos:])
+			bytePos += size
+			runePos++
+		}
+		return bytePos
+	}
+
+	var locs [][]int
+	m, err := re.re.FindStringMatch(s)
+	for m != nil && err == nil && (n < 0 || len(locs) < n) {
+		start := toByteOffset(m.Index)
+		end := toByteOffset(m.Index + m.Length)
+		locs = append(locs, []int{start, end})
+		m, err = re.re.FindNextMatch(m)
+	}
+	return locs
+}
+
+func (re *fallbackRegexp) String() string {
+	return re.re.String()
+}
@@ -0,0 +1,44 @@
+package search
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+func TestIsUnsupportedRegexp(t *testing.T) {
+	cases := map[string]bool{
+		`foo(?!bar)`:  true,
+		`(?<=a)b`:     true,
+		`(a)\1`:       true,
+		`foo(`:        false,
+		`a**`:         false,
+		`[z-a]`:       false,
+		`foo\s+(bar)`: false,
+	}
+	for expr, want := range cases {
+		_, err := regexp.Compile(expr)
+		if got := err != nil && isUnsupportedRegexp(err); got != want {
+			t.Errorf("isUnsupportedRegexp(%q) = %v, want %v (err=%v)", expr, got, want, err)
+		}
+	}
+}
+
+func TestFallbackRegexp(t *testing.T) {
+	rg, err := compileFallback(&protocol.PatternInfo{Pattern: `(\w)\1(?!x)`, IsRegExp: true, IsCaseSensitive: true}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Offsets are in bytes, so the multibyte runes shift the second match.
+	got := rg.re.FindAllIndex([]byte("aaX ééé bbx CC"), -1)
+	want := [][]int{{0, 2}, {4, 8}, {15, 17}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := rg.re.FindAllIndex([]byte("aa bb"), 1); len(got) != 1 {
+		t.Errorf("expected limit of 1 match to be respected, got %v", got)
+	}
+}
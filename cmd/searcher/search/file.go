@@ -0,0 +1,253 @@
+package search
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// serveFile serves the content of a single file from the cached archive of
+// a repository at a commit:
+//
+//	GET /file?repo=github.com/foo/bar&commit=deadbeef...&path=README.md
+//
+// It never fetches the archive. It responds with 404 if the archive is not
+// cached or does not contain the file (eg it is binary or too large to
+// search), in which case the caller should fall back to gitserver.
+func (s *Service) serveFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	repo, commit, path := api.RepoName(q.Get("repo")), api.CommitID(q.Get("commit")), q.Get("path")
+	if repo == "" || len(commit) != 40 || path == "" {
+		http.Error(w, "repo, absolute commit and path are required", http.StatusBadRequest)
+		return
+	}
+
+	zf, err := s.getCachedZipFile(gitserver.Repo{Name: repo}, commit)
+	if os.IsNotExist(err) {
+		http.Error(w, "archive not cached", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer zf.Close()
+
+	for i := range zf.Files {
+		f := &zf.Files[i]
+		if f.Name != path {
+			continue
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(int(f.Len)))
+		if r.Method == "GET" {
+			_, _ = w.Write(zf.DataFor(f))
+		}
+		return
+	}
+	http.Error(w, "file not found in archive", http.StatusNotFound)
+}
+
+// serveListFiles lists the regular files in a repository at a commit:
+//
+//	GET /files?repo=github.com/foo/bar&commit=deadbeef...
+//
+// The response is a JSON encoded protocol.ListFilesResponse. The archive is
+// fetched if it is not already cached, waiting at most fetchTimeout (a
+// duration, default 500ms). If NoFetch is set it responds with 404 instead.
+func (s *Service) serveListFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	repo, commit := api.RepoName(q.Get("repo")), api.CommitID(q.Get("commit"))
+	if repo == "" || len(commit) != 40 {
+		http.Error(w, "repo and absolute commit are required", http.StatusBadRequest)
+		return
+	}
+	path, ok := s.prepareZipForFileRequest(w, r, repo, commit)
+	if !ok {
+		return
+	}
+	files, err := store.ListZip(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := protocol.ListFilesResponse{Files: make([]protocol.FileInfo, len(files))}
+	for i, f := range files {
+		resp.Files[i] = protocol.FileInfo{Path: f.Name, Size: f.Size, Mode: f.Mode, Encoding: f.Encoding, Binary: f.Binary}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&resp)
+}
+
+// serveLookupHash lists the paths of the files in a repository at a commit
+// whose content has a given hash:
+//
+//	GET /lookup-hash?repo=github.com/foo/bar&commit=deadbeef...&hash=abc123...
+//
+// hash is either the hex encoded git blob SHA-1 or SHA-256 of the content.
+// Only files searcher caches are considered, so binary and large files are
+// never found. The response is a JSON encoded
+// protocol.LookupHashResponse. The archive is fetched like for /files, and
+// its hashes are kept in a sidecar file next to the cached archive so
+// subsequent lookups are cheap.
+func (s *Service) serveLookupHash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	repo, commit, hash := api.RepoName(q.Get("repo")), api.CommitID(q.Get("commit")), strings.ToLower(q.Get("hash"))
+	if repo == "" || len(commit) != 40 {
+		http.Error(w, "repo and absolute commit are required", http.StatusBadRequest)
+		return
+	}
+	if _, err := hex.DecodeString(hash); err != nil || (len(hash) != 40 && len(hash) != 64) {
+		http.Error(w, "hash must be a hex encoded git blob SHA-1 or SHA-256", http.StatusBadRequest)
+		return
+	}
+
+	path, ok := s.prepareZipForFileRequest(w, r, repo, commit)
+	if !ok {
+		return
+	}
+	zf, err := s.Store.ZipCache.Get(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer zf.Close()
+	idx, err := s.Store.HashIndex(path, zf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := protocol.LookupHashResponse{Paths: idx.Lookup(hash)}
+	if resp.Paths == nil {
+		resp.Paths = []string{}
+	}
+	sort.Strings(resp.Paths)
+	writeJSON(w, http.StatusOK, &resp)
+}
+
+// prepareZipForFileRequest returns the path of the archive of repo at
+// commit for one of the file endpoints. The archive is fetched if it is not
+// already cached, waiting at most the request's fetchTimeout (a duration,
+// default 500ms), unless NoFetch is set. If it fails, an error has been
+// written to w and ok is false.
+func (s *Service) prepareZipForFileRequest(w http.ResponseWriter, r *http.Request, repo api.RepoName, commit api.CommitID) (path string, ok bool) {
+	fetchTimeout := 500 * time.Millisecond
+	if v := r.URL.Query().Get("fetchTimeout"); v != "" {
+		var err error
+		if fetchTimeout, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "invalid fetchTimeout: "+err.Error(), http.StatusBadRequest)
+			return "", false
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), fetchTimeout)
+	defer cancel()
+	var err error
+	if s.NoFetch {
+		path, _, err = s.Store.StatZip(gitserver.Repo{Name: repo}, commit)
+		if os.IsNotExist(err) {
+			err = notCachedError{repo: repo, commit: commit}
+		}
+	} else {
+		path, err = s.Store.PrepareZip(ctx, gitserver.Repo{Name: repo}, commit)
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		if isNotCached(err) {
+			code = http.StatusNotFound
+		} else if isBadRequest(err) || r.Context().Err() == context.Canceled {
+			code = http.StatusBadRequest
+		} else if isTemporary(err) {
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), code)
+		return "", false
+	}
+	return path, true
+}
+
+// serveCached reports whether the archive of a repository at a commit is
+// cached, without fetching it:
+//
+//	HEAD /cached?repo=github.com/foo/bar&commit=deadbeef...
+//
+// It responds with 200 if the archive is cached and 404 otherwise. For a
+// cached archive the X-Archive-Size header is its size in bytes and
+// Last-Modified is when it was last used.
+func (s *Service) serveCached(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	repo, commit := api.RepoName(q.Get("repo")), api.CommitID(q.Get("commit"))
+	if repo == "" || len(commit) != 40 {
+		http.Error(w, "repo and absolute commit are required", http.StatusBadRequest)
+		return
+	}
+
+	_, fi, err := s.Store.StatZip(gitserver.Repo{Name: repo}, commit)
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Archive-Size", strconv.FormatInt(fi.Size(), 10))
+	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// getCachedZipFile returns the archive of repo at commit if it is already
+// cached. If it is not the error satisfies os.IsNotExist. The returned
+// ZipFile must be closed.
+func (s *Service) getCachedZipFile(repo gitserver.Repo, commit api.CommitID) (*store.ZipFile, error) {
+	_, zf, err := s.getCachedZipFileWithPath(repo, commit)
+	return zf, err
+}
+
+// getCachedZipFileWithPath is like getCachedZipFile, but also returns the
+// path of the archive on disk.
+func (s *Service) getCachedZipFileWithPath(repo gitserver.Repo, commit api.CommitID) (string, *store.ZipFile, error) {
+	path, _, err := s.Store.StatZip(repo, commit)
+	if err != nil {
+		return "", nil, err
+	}
+	// The archive may be evicted between StatZip and Get, in which case
+	// Get fails with a not exist error.
+	zf, err := s.Store.ZipCache.Get(path)
+	return path, zf, err
+}
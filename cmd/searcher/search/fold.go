@@ -0,0 +1,181 @@
+package search
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// foldLiteral matches an ASCII literal ignoring ASCII case. Unlike a
+// regexp of the lowered literal it searches the content as is, so Find
+// doesn't need to lower every file first. Like ripgrep, it looks for the
+// rarest byte of the literal with bytes.IndexByte, which is vectorized, and
+// only compares the whole literal around its occurrences.
+type foldLiteral struct {
+	// needle is the lowered literal.
+	needle []byte
+
+	// rare is the index in needle of its rarest byte, and rareCases are
+	// the cases of that byte (twice the same byte if it has no case).
+	rare      int
+	rareCases [2]byte
+
+	// re is a regexp matching the same as needle in lowered content. It is
+	// used where a *regexp.Regexp is needed (see stdRegexp).
+	re *regexp.Regexp
+}
+
+// newFoldLiteral returns a foldLiteral for lit, or nil if lit is empty or
+// contains non-ASCII characters with other cases. Those need Unicode case
+// folding, which the regexp engine implements (see compile).
+func newFoldLiteral(lit string) *foldLiteral {
+	if lit == "" || !foldsASCII(lit) {
+		return nil
+	}
+	m := &foldLiteral{
+		needle: []byte(lowerASCII(lit)),
+		re:     regexp.MustCompile(regexp.QuoteMeta(lowerASCII(lit))),
+	}
+	for i, c := range m.needle {
+		if byteFrequency(c) < byteFrequency(m.needle[m.rare]) {
+			m.rare = i
+		}
+	}
+	c := m.needle[m.rare]
+	m.rareCases = [2]byte{c, c}
+	if 'a' <= c && c <= 'z' {
+		m.rareCases[1] = c - 'a' + 'A'
+	}
+	return m
+}
+
+// byteFrequency ranks how common c is in source code, the most common being
+// the highest.
+func byteFrequency(c byte) int {
+	const letters = "zqjxkvbpgwyfmculdhrsnioate" // rarest first
+	switch {
+	case c == ' ' || c == '\n' || c == '\t':
+		return 100
+	case 'a' <= c && c <= 'z':
+		return 50 + strings.IndexByte(letters, c)
+	case '0' <= c && c <= '9':
+		return 40
+	case c == '_' || c == '.' || c == '(' || c == ')' || c == ',' || c == ';' || c == '"':
+		return 30
+	case c >= utf8.RuneSelf:
+		return 10
+	}
+	return 20
+}
+
+// foldsASCII reports whether ASCII case folding is enough to match s ignoring
+// case, ie whether none of its non-ASCII characters have other cases.
+func foldsASCII(s string) bool {
+	for _, r := range s {
+		if r >= utf8.RuneSelf && unicode.SimpleFold(r) != r {
+			return false
+		}
+	}
+	return true
+}
+
+func lowerASCII(s string) string {
+	b := make([]byte, len(s))
+	bytesToLowerASCII(b, []byte(s))
+	return string(b)
+}
+
+// index returns the index of the first match in b, or -1.
+func (m *foldLiteral) index(b []byte) int {
+	// next holds the next occurrence of each case of the rare byte at or
+	// after i, or -1 once there are none. -2 means it must be looked up.
+	next := [2]int{-2, -2}
+	for i := m.rare; i < len(b); {
+		for j, c := range m.rareCases {
+			if next[j] != -1 && next[j] < i {
+				next[j] = bytes.IndexByte(b[i:], c)
+				if next[j] >= 0 {
+					next[j] += i
+				}
+			}
+		}
+		p := next[0]
+		if p < 0 || (next[1] >= 0 && next[1] < p) {
+			p = next[1]
+		}
+		if p < 0 {
+			return -1
+		}
+		start := p - m.rare
+		if start+len(m.needle) <= len(b) && m.matchesAt(b[start:start+len(m.needle)]) {
+			return start
+		}
+		i = p + 1
+	}
+	return -1
+}
+
+// matchesAt reports whether b equals the needle, ignoring ASCII case.
+func (m *foldLiteral) matchesAt(b []byte) bool {
+	for i, c := range b {
+		if lowerTable[c] != m.needle[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *foldLiteral) MatchString(s string) bool {
+	return m.index([]byte(s)) >= 0
+}
+
+// FindAllIndex returns the byte offsets of at most n (or all if n < 0)
+// successive non-overlapping matches in b.
+func (m *foldLiteral) FindAllIndex(b []byte, n int) [][]int {
+	var flat []int
+	for off := 0; n < 0 || len(flat) < 2*n; {
+		i := m.index(b[off:])
+		if i < 0 {
+			break
+		}
+		start := off + i
+		off = start + len(m.needle)
+		flat = append(flat, start, off)
+	}
+	return splitLocs(flat)
+}
+
+func (m *foldLiteral) String() string {
+	return m.re.String()
+}
+
+// stdRegexp returns the *regexp.Regexp which matches like re in the content
+// Find matches against, if there is one. It is needed for features the
+// regexpMatcher interface doesn't cover, eg submatches.
+func stdRegexp(re regexpMatcher) (*regexp.Regexp, bool) {
+	switch re := re.(type) {
+	case *regexp.Regexp:
+		return re, true
+	case *foldLiteral:
+		return re.re, true
+	case *wordMatcher:
+		// Callers only look at matches Find found, which are a subset of
+		// those of the wrapped matcher.
+		return stdRegexp(re.re)
+	}
+	return nil, false
+}
+
+// foldsCase reports whether re ignores case itself, so the content it
+// matches doesn't need to be lowered.
+func foldsCase(re regexpMatcher) bool {
+	switch re := re.(type) {
+	case *foldLiteral:
+		return true
+	case *wordMatcher:
+		return foldsCase(re.re)
+	}
+	return false
+}
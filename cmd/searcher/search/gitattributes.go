@@ -0,0 +1,151 @@
+package search
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/pathmatch"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// The .gitattributes attributes with which linguist (and so GitHub) lets
+// repositories mark files as generated or vendored.
+const (
+	attrGenerated = "linguist-generated"
+	attrVendored  = "linguist-vendored"
+)
+
+// gitattributesRule sets (or unsets) attributes of the files matching a
+// pattern. Attributes it doesn't mention are left as they are.
+type gitattributesRule struct {
+	pattern *regexp.Regexp
+	attrs   map[string]bool
+}
+
+// gitattributes are the rules of the .gitattributes files of an archive,
+// from the least to the most specific: files closer to the root first, and
+// in each file in order.
+type gitattributes []gitattributesRule
+
+// parseGitattributes parses the content of the .gitattributes file in dir
+// ("" for the root). Only the linguist attributes are kept. Macros and
+// patterns git ignores, such as those ending in a slash, are skipped.
+func parseGitattributes(dir string, data []byte) gitattributes {
+	var rules gitattributes
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "[attr]") || strings.HasSuffix(fields[0], "/") {
+			continue
+		}
+		attrs := map[string]bool{}
+		for _, attr := range fields[1:] {
+			value := true
+			switch {
+			case strings.HasPrefix(attr, "-"):
+				attr, value = attr[1:], false
+			case strings.HasPrefix(attr, "!"):
+				// Unspecified, which for linguist is the same as unset.
+				attr, value = attr[1:], false
+			case strings.HasSuffix(attr, "=false"):
+				attr, value = strings.TrimSuffix(attr, "=false"), false
+			case strings.HasSuffix(attr, "=true"):
+				attr = strings.TrimSuffix(attr, "=true")
+			}
+			if attr == attrGenerated || attr == attrVendored {
+				attrs[attr] = value
+			}
+		}
+		if len(attrs) == 0 {
+			continue
+		}
+		re, err := compileGitignorePattern(dir, fields[0], false)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, gitattributesRule{pattern: re, attrs: attrs})
+	}
+	return rules
+}
+
+// has reports whether attr is set for path. As in git, the last matching
+// rule which mentions attr wins.
+func (g gitattributes) has(path, attr string) bool {
+	for i := len(g) - 1; i >= 0; i-- {
+		if value, ok := g[i].attrs[attr]; ok && g[i].pattern.MatchString(path) {
+			return value
+		}
+	}
+	return false
+}
+
+// readGitattributes returns the rules of the .gitattributes files in zf.
+func readGitattributes(zf *store.ZipFile) gitattributes {
+	var files []*store.SrcFile
+	for i := range zf.Files {
+		if path.Base(zf.Files[i].Name) == ".gitattributes" {
+			files = append(files, &zf.Files[i])
+		}
+	}
+	// Rules of files deeper in the tree take precedence.
+	sort.Slice(files, func(i, j int) bool {
+		return strings.Count(files[i].Name, "/") < strings.Count(files[j].Name, "/")
+	})
+
+	var rules gitattributes
+	for _, f := range files {
+		dir := path.Dir(f.Name)
+		if dir == "." {
+			dir = ""
+		}
+		rules = append(rules, parseGitattributes(dir, zf.DataFor(f))...)
+	}
+	return rules
+}
+
+// gitattributesMatcher wraps a PathMatcher to additionally include only, or
+// exclude, files marked as generated or vendored in .gitattributes.
+type gitattributesMatcher struct {
+	pathmatch.PathMatcher
+	gitattributes gitattributes
+	generated     protocol.TestFileFilter
+	vendored      protocol.TestFileFilter
+}
+
+// attributesMatcher returns matchPath restricted to the files which are, or
+// are not, generated and vendored as requested by p.GeneratedFiles and
+// p.VendoredFiles according to the .gitattributes files in zf.
+func attributesMatcher(zf *store.ZipFile, p *protocol.Request, matchPath pathmatch.PathMatcher) pathmatch.PathMatcher {
+	return &gitattributesMatcher{
+		PathMatcher:   matchPath,
+		gitattributes: readGitattributes(zf),
+		generated:     p.GeneratedFiles,
+		vendored:      p.VendoredFiles,
+	}
+}
+
+func (m *gitattributesMatcher) MatchPath(name string) bool {
+	if m.generated != protocol.TestFilesIncluded && (m.generated == protocol.TestFilesOnly) != m.gitattributes.has(name, attrGenerated) {
+		return false
+	}
+	if m.vendored != protocol.TestFilesIncluded && (m.vendored == protocol.TestFilesOnly) != m.gitattributes.has(name, attrVendored) {
+		return false
+	}
+	return m.PathMatcher.MatchPath(name)
+}
+
+func (m *gitattributesMatcher) String() string {
+	s := m.PathMatcher.String()
+	if m.generated != protocol.TestFilesIncluded {
+		s += " generated:" + string(m.generated)
+	}
+	if m.vendored != protocol.TestFilesIncluded {
+		s += " vendored:" + string(m.vendored)
+	}
+	return s
+}
@@ -0,0 +1,49 @@
+package search
+
+import (
+	"testing"
+)
+
+func TestGitattributes(t *testing.T) {
+	g := append(parseGitattributes("", []byte(`# Mark generated and vendored code
+*.pb.go       linguist-generated
+/dist/**      linguist-generated=true
+third_party/* linguist-vendored
+docs/         linguist-generated
+[attr]gen     linguist-generated
+*.min.js      -diff linguist-generated linguist-vendored
+*.go          text eol=lf
+`)), parseGitattributes("web", []byte(`
+api.pb.go    -linguist-generated
+/static/*.js linguist-vendored
+lib/*.min.js !linguist-generated
+`))...)
+
+	cases := []struct {
+		path                string
+		generated, vendored bool
+	}{
+		{path: "main.go"},
+		{path: "api/api.pb.go", generated: true},
+		{path: "dist/app.js", generated: true},
+		{path: "dist/deep/app.js", generated: true},
+		{path: "src/dist/app.js"},
+		{path: "third_party/lib.c", vendored: true},
+		{path: "third_party/deep/lib.c"},
+		{path: "docs/index.md"},
+		{path: "jquery.min.js", generated: true, vendored: true},
+		{path: "web/api.pb.go"},
+		{path: "web/sub/api.pb.go"},
+		{path: "web/static/app.js", vendored: true},
+		{path: "static/app.js"},
+		{path: "web/lib/x.min.js", vendored: true},
+	}
+	for _, c := range cases {
+		if got := g.has(c.path, attrGenerated); got != c.generated {
+			t.Errorf("%s: got generated %v, want %v", c.path, got, c.generated)
+		}
+		if got := g.has(c.path, attrVendored); got != c.vendored {
+			t.Errorf("%s: got vendored %v, want %v", c.path, got, c.vendored)
+		}
+	}
+}
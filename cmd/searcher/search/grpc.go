@@ -0,0 +1,312 @@
+package search
+
+//go:generate protoc --go_out=plugins=grpc:. searcher.proto
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
+
+// RegisterGRPC registers the gRPC API of s (see searcher.proto) with srv. It
+// serves the same searches as the HTTP API. Every field of protocol.Request
+// and protocol.FileMatch has a counterpart in searcher.proto.
+func (s *Service) RegisterGRPC(srv *grpc.Server) {
+	RegisterSearcherServer(srv, &grpcServer{s: s})
+}
+
+// grpcServer implements SearcherServer for a Service.
+type grpcServer struct {
+	s *Service
+}
+
+func (g *grpcServer) Search(req *SearchRequest, srv Searcher_SearchServer) error {
+	s := g.s
+	span, ctx := startGRPCSpan(srv.Context(), "Searcher.Search")
+	defer span.Finish()
+	if !s.authenticateGRPC(ctx) {
+		unauthenticatedTotal.WithLabelValues("grpc").Inc()
+		return status.Error(codes.Unauthenticated, "unauthenticated")
+	}
+	// Like ServeHTTP, authorize before admitting, so that requests which
+	// will be denied don't take up capacity.
+	if ok, err := s.authorizeGRPC(ctx, api.RepoName(req.Repo)); err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	} else if !ok {
+		return status.Error(codes.PermissionDenied, "not authorized to read the repository")
+	}
+	done, retryAfter, ok := s.admit(ctx, grpcClient(ctx), protocol.Priority(req.Priority))
+	if !ok {
+		_ = srv.SetHeader(metadata.Pairs("retry-after", strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))))
+		return status.Error(codes.ResourceExhausted, "searcher is overloaded")
+	}
+	defer done()
+
+	p := requestFromProto(req)
+	deadline, _ := ctx.Deadline()
+	ctx, cancel := s.withDeadline(ctx, deadline)
+	defer cancel()
+	if !p.PatternMatchesContent && !p.PatternMatchesPath {
+		// Like the HTTP API, search file content if neither is set.
+		p.PatternMatchesContent = true
+	}
+	if err := p.PatternInfo.Normalize(); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateParams(p); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := s.streamSearch(ctx, p, nil, &grpcStream{srv: srv}); err != nil {
+		return grpcError(ctx, p, err)
+	}
+	return nil
+}
+
+// startGRPCSpan starts the server span of the gRPC request of ctx. Like
+// nethttp.Middleware does for the HTTP API, it continues the trace
+// propagated in the metadata of the request, eg in a W3C traceparent header.
+func startGRPCSpan(ctx context.Context, operationName string) (opentracing.Span, context.Context) {
+	tracer := opentracing.GlobalTracer()
+	md, _ := metadata.FromIncomingContext(ctx)
+	h := http.Header{}
+	for k, vs := range md {
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+	parent, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h))
+	span := tracer.StartSpan(operationName, ext.RPCServerOption(parent))
+	ext.Component.Set(span, "grpc")
+	return span, opentracing.ContextWithSpan(ctx, span)
+}
+
+// grpcClient returns who the request of ctx is made for, like
+// requestClient.
+func grpcClient(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if client := md.Get(protocol.ClientHeader); len(client) > 0 && client[0] != "" {
+		return client[0]
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		return remoteHost(p.Addr.String())
+	}
+	return ""
+}
+
+// requestFromProto converts req to the equivalent protocol.Request.
+func requestFromProto(req *SearchRequest) *protocol.Request {
+	p := &protocol.Request{
+		Repo:                  api.RepoName(req.Repo),
+		URL:                   req.Url,
+		Commit:                api.CommitID(req.Commit),
+		FetchTimeout:          req.FetchTimeout,
+		NoFetch:               req.NoFetch,
+		Query:                 req.Query,
+		ChangedSinceCommit:    api.CommitID(req.ChangedSinceCommit),
+		ChangedInLastCommits:  int(req.ChangedInLastCommits),
+		IncludeRanges:         req.IncludeRanges,
+		IncludeDiffs:          req.IncludeDiffs,
+		Replacement:           req.Replacement,
+		IncludeBlame:          req.IncludeBlame,
+		ResolveLFS:            req.ResolveLfs,
+		IncludeEnclosingScope: req.IncludeEnclosingScope,
+		IncludeReplacements:   req.IncludeReplacements,
+		WantContent:           req.WantContent,
+		ContextBefore:         int(req.ContextBefore),
+		ContextAfter:          int(req.ContextAfter),
+		Refines:               req.Refines,
+		Paginate:              req.Paginate,
+		Cursor:                req.Cursor,
+		Priority:              protocol.Priority(req.Priority),
+	}
+	p.PatternInfo = protocol.PatternInfo{
+		Pattern:                      req.Pattern,
+		PatternType:                  protocol.PatternType(req.PatternType),
+		IsWordMatch:                  req.IsWordMatch,
+		Multiline:                    req.Multiline,
+		CountOnly:                    req.CountOnly,
+		RankBy:                       protocol.RankBy(req.RankBy),
+		PriorityPatterns:             req.PriorityPatterns,
+		IsCaseSensitive:              req.IsCaseSensitive,
+		InvertMatch:                  req.InvertMatch,
+		FirstMatchOnly:               req.FirstMatchOnly,
+		SearchBinary:                 req.SearchBinary,
+		PatternMatchesContent:        req.PatternMatchesContent,
+		PatternMatchesPath:           req.PatternMatchesPath,
+		FileMatchLimit:               int(req.FileMatchLimit),
+		MaxLineMatchesPerFile:        int(req.MaxLineMatchesPerFile),
+		MaxMatches:                   int(req.MaxMatches),
+		MaxBytesScanned:              req.MaxBytesScanned,
+		MaxFileSize:                  req.MaxFileSize,
+		IncludePatterns:              req.IncludePatterns,
+		ExcludePattern:               req.ExcludePattern,
+		PathPatternsAreRegExps:       req.PathPatternsAreRegexps,
+		PathPatternsAreCaseSensitive: req.PathPatternsAreCaseSensitive,
+		Languages:                    req.Languages,
+		ExcludeLanguages:             req.ExcludeLanguages,
+		CombyRule:                    req.CombyRule,
+		TestFiles:                    protocol.TestFileFilter(req.TestFiles),
+		GeneratedFiles:               protocol.TestFileFilter(req.GeneratedFiles),
+		VendoredFiles:                protocol.TestFileFilter(req.VendoredFiles),
+		Scope:                        protocol.SyntaxScope(req.Scope),
+		OwnedBy:                      req.OwnedBy,
+		NotOwnedBy:                   req.NotOwnedBy,
+		Files:                        req.Files,
+		PathSpec:                     req.PathSpec,
+	}
+	return p
+}
+
+// grpcError returns the gRPC status for the error err of the search p. It
+// mirrors the status codes of writeSearchError.
+func grpcError(ctx context.Context, p *protocol.Request, err error) error {
+	code := codes.Internal
+	switch {
+	case isBadRequest(err):
+		code = codes.InvalidArgument
+	case ctx.Err() == context.Canceled:
+		code = codes.Canceled
+	case ctx.Err() == context.DeadlineExceeded:
+		code = codes.DeadlineExceeded
+	case isNotCached(err):
+		code = codes.NotFound
+	case isTemporary(err):
+		code = codes.Unavailable
+	default:
+		log.Printf("internal error serving %#+v: %s", p, err)
+	}
+	return status.Error(code, err.Error())
+}
+
+// grpcStream sends the results of a search to a gRPC stream. Send errors
+// are ignored: they mean the client went away, which cancels the search.
+type grpcStream struct {
+	mu      sync.Mutex
+	srv     Searcher_SearchServer
+	started bool
+	sent    int
+}
+
+func (gs *grpcStream) match(fm protocol.FileMatch) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.started = true
+	gs.sent++
+	_ = gs.srv.Send(&SearchResponse{Message: &SearchResponse_FileMatch{FileMatch: fileMatchToProto(fm)}})
+}
+
+func (gs *grpcStream) done(d protocol.StreamDone) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.started = true
+	_ = gs.srv.Send(&SearchResponse{Message: &SearchResponse_Done{Done: &SearchDone{
+		LimitHit:       d.LimitHit,
+		LimitHitReason: string(d.LimitHitReason),
+		DeadlineHit:    d.DeadlineHit,
+		MatchCount:     int32(d.MatchCount),
+		Stats: &SearchStats{
+			CpuMilliseconds:        d.Stats.CPUMilliseconds,
+			CacheBytesRead:         d.Stats.CacheBytesRead,
+			GitserverBytesFetched:  d.Stats.GitserverBytesFetched,
+			PeakBufferBytes:        d.Stats.PeakBufferBytes,
+			LargeFilesSkipped:      d.Stats.LargeFilesSkipped,
+			LargeFilesSkippedPaths: d.Stats.LargeFilesSkippedPaths,
+		},
+		RefinementToken: d.RefinementToken,
+		Cursor:          d.Cursor,
+		Error:           d.Error,
+	}}})
+}
+
+func (gs *grpcStream) hasStarted() bool {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return gs.started
+}
+
+func (gs *grpcStream) matchesSent() int {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return gs.sent
+}
+
+func fileMatchToProto(fm protocol.FileMatch) *FileMatch {
+	m := &FileMatch{
+		Path:           fm.Path,
+		LimitHit:       fm.LimitHit,
+		Content:        fm.Content,
+		ContentOmitted: fm.ContentOmitted,
+		Encoding:       fm.Encoding,
+		Binary:         fm.Binary,
+		MatchCount:     int32(fm.MatchCount),
+		Diff:           fm.Diff,
+		LineMatches:    make([]*LineMatch, 0, len(fm.LineMatches)),
+	}
+	for _, mm := range fm.MultilineMatches {
+		m.MultilineMatches = append(m.MultilineMatches, &MultilineMatch{
+			Preview: mm.Preview,
+			Start:   positionToProto(mm.Start),
+			End:     positionToProto(mm.End),
+		})
+	}
+	for _, lm := range fm.LineMatches {
+		ranges := make([]*Range, 0, len(lm.OffsetAndLengths))
+		for _, ol := range lm.OffsetAndLengths {
+			ranges = append(ranges, &Range{Offset: int32(ol[0]), Length: int32(ol[1])})
+		}
+		var matchRanges []*MatchRange
+		for _, r := range lm.Ranges {
+			matchRanges = append(matchRanges, &MatchRange{Start: positionToProto(r.Start), End: positionToProto(r.End)})
+		}
+		plm := &LineMatch{
+			Preview:       lm.Preview,
+			LineNumber:    int32(lm.LineNumber),
+			Ranges:        ranges,
+			LimitHit:      lm.LimitHit,
+			PreviewOffset: int32(lm.PreviewOffset),
+			Before:        lm.Before,
+			After:         lm.After,
+			MatchRanges:   matchRanges,
+			Replacements:  lm.Replacements,
+		}
+		if b := lm.Blame; b != nil {
+			plm.Blame = &LineBlame{
+				Commit:      string(b.Commit),
+				AuthorName:  b.AuthorName,
+				AuthorEmail: b.AuthorEmail,
+				AuthorDate:  b.AuthorDate.Format(time.RFC3339),
+			}
+		}
+		if es := lm.EnclosingScope; es != nil {
+			plm.EnclosingScope = &EnclosingScope{
+				Name:      es.Name,
+				Kind:      es.Kind,
+				StartLine: int32(es.StartLine),
+				EndLine:   int32(es.EndLine),
+			}
+		}
+		m.LineMatches = append(m.LineMatches, plm)
+	}
+	return m
+}
+
+func positionToProto(p protocol.Position) *Position {
+	return &Position{Line: int32(p.Line), Column: int32(p.Column), Offset: int32(p.Offset)}
+}
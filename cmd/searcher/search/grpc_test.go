@@ -0,0 +1,159 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+func TestStartGRPCSpan(t *testing.T) {
+	tracer := mocktracer.New()
+	orig := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(orig)
+
+	parent := tracer.StartSpan("client")
+	h := http.Header{}
+	if err := tracer.Inject(parent.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h)); err != nil {
+		t.Fatal(err)
+	}
+	md := metadata.MD{}
+	for k, vs := range h {
+		// gRPC metadata keys are lowercase.
+		md.Append(k, vs...)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+
+	span, ctx := startGRPCSpan(ctx, "Searcher.Search")
+	span.Finish()
+	if opentracing.SpanFromContext(ctx) != span {
+		t.Error("expected the span to be in the returned context")
+	}
+	got := span.(*mocktracer.MockSpan)
+	want := parent.(*mocktracer.MockSpan)
+	if got.SpanContext.TraceID != want.SpanContext.TraceID || got.ParentID != want.SpanContext.SpanID {
+		t.Errorf("expected the span to continue the trace of the request, got trace %d parent %d, want trace %d parent %d", got.SpanContext.TraceID, got.ParentID, want.SpanContext.TraceID, want.SpanContext.SpanID)
+	}
+
+	span, _ = startGRPCSpan(context.Background(), "Searcher.Search")
+	if got := span.(*mocktracer.MockSpan); got.ParentID != 0 {
+		t.Errorf("expected a request without trace context to start a trace, got parent %d", got.ParentID)
+	}
+}
+
+func TestRequestFromProto(t *testing.T) {
+	// These are set from the call or from other fields instead.
+	unmapped := map[string]bool{
+		"Request.Deadline":                    true,
+		"Request.PatternInfo.IsRegExp":        true,
+		"Request.PatternInfo.IsStructuralPat": true,
+	}
+
+	req := &SearchRequest{}
+	fill(reflect.ValueOf(req).Elem())
+	p := requestFromProto(req)
+	walk(reflect.ValueOf(p).Elem(), "Request", func(name string, v reflect.Value) {
+		if v.IsZero() && !unmapped[name] {
+			t.Errorf("%s is not set from the gRPC SearchRequest", name)
+		}
+	})
+}
+
+func TestFileMatchToProto(t *testing.T) {
+	newFileMatch := func() *protocol.FileMatch {
+		fm := &protocol.FileMatch{}
+		fill(reflect.ValueOf(fm).Elem())
+		return fm
+	}
+	var names []string
+	walk(reflect.ValueOf(newFileMatch()).Elem(), "FileMatch", func(name string, v reflect.Value) {
+		names = append(names, name)
+	})
+	want := fileMatchToProto(*newFileMatch())
+
+	// A field is mapped if clearing it changes the gRPC FileMatch.
+	for i, name := range names {
+		fm := newFileMatch()
+		j := 0
+		walk(reflect.ValueOf(fm).Elem(), "FileMatch", func(_ string, v reflect.Value) {
+			if j == i {
+				v.Set(reflect.Zero(v.Type()))
+			}
+			j++
+		})
+		if proto.Equal(fileMatchToProto(*fm), want) {
+			t.Errorf("%s is not mapped to the gRPC FileMatch", name)
+		}
+	}
+}
+
+// fill sets every exported field reachable from v to a non-zero value.
+// Slices get a single element.
+func fill(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		fill(v.Elem())
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			v.Set(reflect.ValueOf(time.Unix(1, 0)))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if exported(v.Type().Field(i)) {
+				fill(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fill(v.Index(0))
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			fill(v.Index(i))
+		}
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	default:
+		panic("fill: unsupported kind " + v.Kind().String())
+	}
+}
+
+// walk calls f with every value without exported fields or elements
+// reachable from v, and its name relative to name.
+func walk(v reflect.Value, name string, f func(name string, v reflect.Value)) {
+	switch {
+	case v.Kind() == reflect.Ptr && !v.IsNil():
+		walk(v.Elem(), name, f)
+	case v.Kind() == reflect.Struct && v.Type() != reflect.TypeOf(time.Time{}):
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Type().Field(i); exported(field) {
+				walk(v.Field(i), name+"."+field.Name, f)
+			}
+		}
+	case (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) && v.Len() > 0:
+		for i := 0; i < v.Len(); i++ {
+			walk(v.Index(i), fmt.Sprintf("%s[%d]", name, i), f)
+		}
+	default:
+		f(name, v)
+	}
+}
+
+func exported(field reflect.StructField) bool {
+	return field.PkgPath == "" && !strings.HasPrefix(field.Name, "XXX_")
+}
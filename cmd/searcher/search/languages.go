@@ -0,0 +1,228 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/src-d/enry/v2"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/pathmatch"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+const (
+	// maxArchiveLanguages bounds the number of archives whose file
+	// languages are remembered.
+	maxArchiveLanguages = 64
+
+	// maxLanguageDetectionBytes is how much of a file's content is used to
+	// detect its language when its name is ambiguous.
+	maxLanguageDetectionBytes = 16 * 1024
+)
+
+// archiveLanguages remembers the languages detected from the content of
+// the files of recently searched archives, by repo@commit. The zero value
+// is ready to use.
+type archiveLanguages struct {
+	mu sync.Mutex
+	m  map[string]*fileLanguages // repo@commit
+}
+
+// get returns the languages of the files of the archive identified by key.
+// If key is empty the languages are not remembered.
+func (a *archiveLanguages) get(key string) *fileLanguages {
+	if key == "" {
+		return &fileLanguages{}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if langs, ok := a.m[key]; ok {
+		return langs
+	}
+	if a.m == nil {
+		a.m = map[string]*fileLanguages{}
+	}
+	if len(a.m) >= maxArchiveLanguages {
+		// Drop an arbitrary archive, its languages can be detected again.
+		for k := range a.m {
+			delete(a.m, k)
+			break
+		}
+	}
+	langs := &fileLanguages{}
+	a.m[key] = langs
+	return langs
+}
+
+// fileLanguages is the languages detected from the content of the files of
+// an archive. Only the files searched with a lang: filter are detected.
+type fileLanguages struct {
+	mu sync.Mutex
+	m  map[string]string // path -> language
+}
+
+// detect returns the language of the file at path, calling content to
+// detect it if it isn't remembered.
+func (l *fileLanguages) detect(path string, content func() []byte) string {
+	l.mu.Lock()
+	lang, ok := l.m[path]
+	l.mu.Unlock()
+	if ok {
+		languageDetections.WithLabelValues("memory").Inc()
+		return lang
+	}
+
+	b := content()
+	if len(b) > maxLanguageDetectionBytes {
+		b = b[:maxLanguageDetectionBytes]
+	}
+	lang = enry.GetLanguage(path, b)
+	languageDetections.WithLabelValues("computed").Inc()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.m == nil {
+		l.m = map[string]string{}
+	}
+	l.m[path] = lang
+	return lang
+}
+
+// languageNames returns the languages with the given aliases (eg "go"), as
+// named by enry. It returns an error for unknown aliases.
+func languageNames(aliases []string) (map[string]bool, error) {
+	names := make(map[string]bool, len(aliases))
+	for _, alias := range aliases {
+		lang, ok := enry.GetLanguageByAlias(alias)
+		if !ok {
+			return nil, badRequestError{"unknown language " + alias}
+		}
+		names[lang] = true
+	}
+	return names, nil
+}
+
+// languageMatcher returns matchPath restricted to the files of zf in one of
+// p.Languages and in none of p.ExcludeLanguages. It returns nil if p
+// filters by neither.
+func (s *Service) languageMatcher(p *protocol.Request, zf *store.ZipFile, memoize bool, matchPath pathmatch.PathMatcher) (pathmatch.PathMatcher, error) {
+	if len(p.Languages) == 0 && len(p.ExcludeLanguages) == 0 {
+		return nil, nil
+	}
+	include, err := languageNames(p.Languages)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := languageNames(p.ExcludeLanguages)
+	if err != nil {
+		return nil, err
+	}
+	key := ""
+	if memoize {
+		key = string(p.Repo) + "@" + string(p.Commit)
+	}
+	return &langMatcher{
+		PathMatcher: matchPath,
+		zf:          zf,
+		langs:       s.languages.get(key),
+		include:     include,
+		exclude:     exclude,
+	}, nil
+}
+
+// langMatcher matches the paths matched by PathMatcher whose language is in
+// include (if non-empty) and not in exclude. A file with an extension shared
+// by several languages, eg .h, is in each of them, like the extension globs
+// the frontend also sends. It is excluded only if its content is in an
+// excluded language.
+type langMatcher struct {
+	pathmatch.PathMatcher
+	zf               *store.ZipFile
+	langs            *fileLanguages
+	include, exclude map[string]bool
+
+	filesOnce sync.Once
+	files     map[string]*store.SrcFile // path -> file, built on first use
+}
+
+func (m *langMatcher) MatchPath(path string) bool {
+	// Languages are only detected for the paths which would otherwise be
+	// searched.
+	if !m.PathMatcher.MatchPath(path) {
+		return false
+	}
+	candidates, safe := extensionLanguages(path)
+	if len(m.include) > 0 {
+		found := false
+		for _, lang := range candidates {
+			found = found || m.include[lang]
+		}
+		if !found && (safe || !m.include[m.detect(path)]) {
+			return false
+		}
+	}
+	if len(m.exclude) > 0 {
+		lang := ""
+		if safe {
+			lang = candidates[0]
+		} else {
+			lang = m.detect(path)
+		}
+		if m.exclude[lang] {
+			return false
+		}
+	}
+	return true
+}
+
+// detect returns the language of the file at path detected from its name
+// and content.
+func (m *langMatcher) detect(path string) string {
+	return m.langs.detect(path, func() []byte {
+		m.filesOnce.Do(func() {
+			m.files = make(map[string]*store.SrcFile, len(m.zf.Files))
+			for i := range m.zf.Files {
+				m.files[m.zf.Files[i].Name] = &m.zf.Files[i]
+			}
+		})
+		if f, ok := m.files[path]; ok {
+			return m.zf.DataFor(f)
+		}
+		return nil
+	})
+}
+
+// extensionLanguages returns the languages of the extension of path, and
+// whether it is the only one.
+func extensionLanguages(path string) (langs []string, safe bool) {
+	if lang, safe := enry.GetLanguageByExtension(path); safe {
+		return []string{lang}, true
+	}
+	return enry.GetLanguagesByExtension(path, nil, nil), false
+}
+
+func (m *langMatcher) String() string {
+	var filters []string
+	for lang := range m.include {
+		filters = append(filters, "lang:"+lang)
+	}
+	for lang := range m.exclude {
+		filters = append(filters, "-lang:"+lang)
+	}
+	sort.Strings(filters)
+	return m.PathMatcher.String() + " " + strings.Join(filters, " ")
+}
+
+var languageDetections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "service",
+	Name:      "language_detections_total",
+	Help:      "Number of files whose language was detected from their content, by whether it was remembered (memory) or detected (computed).",
+}, []string{"source"})
+
+func init() {
+	prometheus.MustRegister(languageDetections)
+}
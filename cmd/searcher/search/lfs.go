@@ -0,0 +1,251 @@
+package search
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+const (
+	// maxLFSPointerSize is the size limit of Git LFS pointer files as set
+	// by the specification. Larger files are never pointers.
+	maxLFSPointerSize = 1024
+
+	// maxLFSObjectSize is the largest LFS object we resolve. It matches the
+	// limit on file size store applies when it caches an archive.
+	maxLFSObjectSize = 1 << 20
+
+	// maxLFSObjects is the maximum number of LFS objects we resolve for a
+	// single request.
+	maxLFSObjects = 100
+
+	// lfsConcurrency is the maximum number of LFS objects we concurrently
+	// fetch for a single request.
+	lfsConcurrency = 4
+)
+
+// lfsPointer is a parsed Git LFS pointer file. See
+// https://github.com/git-lfs/git-lfs/blob/master/docs/spec.md
+type lfsPointer struct {
+	// oid is the hex encoded SHA-256 of the object.
+	oid  string
+	size int64
+}
+
+var lfsVersionLines = [][]byte{
+	[]byte("version https://git-lfs.github.com/spec/v1\n"),
+	[]byte("version https://hawser.github.com/spec/v1\n"),
+}
+
+// parseLFSPointer parses data as a Git LFS pointer file. ok is false if data
+// is not a pointer.
+func parseLFSPointer(data []byte) (ptr lfsPointer, ok bool) {
+	if len(data) > maxLFSPointerSize {
+		return ptr, false
+	}
+	isPointer := false
+	for _, v := range lfsVersionLines {
+		if bytes.HasPrefix(data, v) {
+			data = data[len(v):]
+			isPointer = true
+			break
+		}
+	}
+	if !isPointer {
+		return ptr, false
+	}
+
+	ptr.size = -1
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		i := bytes.IndexByte(line, ' ')
+		if i < 0 {
+			continue
+		}
+		key, value := string(line[:i]), string(line[i+1:])
+		switch key {
+		case "oid":
+			const prefix = "sha256:"
+			if len(value) != len(prefix)+64 || value[:len(prefix)] != prefix {
+				return ptr, false
+			}
+			ptr.oid = value[len(prefix):]
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return ptr, false
+			}
+			ptr.size = size
+		}
+	}
+	return ptr, ptr.oid != "" && ptr.size >= 0
+}
+
+// regexSearchLFS is like regexSearch, but searches the content of the LFS
+// objects the pointer files in zf refer to instead of the pointer files.
+func (s *Service) regexSearchLFS(ctx context.Context, p *protocol.Request, rg *readerGrep, zf *store.ZipFile) (matches []protocol.FileMatch, limitHit bool, err error) {
+	lfs, pointers, unresolved, err := s.resolveLFS(ctx, p, rg, zf)
+	if err != nil {
+		return nil, false, err
+	}
+	defer lfs.Close()
+	if unresolved {
+		// Limits hit by the search itself are reported first.
+		defer func() {
+			if err == nil {
+				usageFromContext(ctx).hitLimit(protocol.LimitLFSObjects)
+				limitHit = true
+			}
+		}()
+	}
+
+	// Search everything but the resolved pointers in zf, then the content of
+	// the objects they point to.
+	matchPath := rg.matchPath
+	rg.matchPath = &pathSetMatcher{
+		PathMatcher: matchPath,
+		paths:       pointers,
+		exclude:     true,
+		desc:        "lfs",
+	}
+	limits := newSearchLimits(&p.PatternInfo)
+	matches, limitHit, err = regexSearch(ctx, rg, zf, limits, p.PatternMatchesContent, p.PatternMatchesPath)
+	rg.matchPath = matchPath
+	if err != nil || limitHit || len(lfs.Files) == 0 {
+		return matches, limitHit, err
+	}
+
+	if limits.fileMatches <= 0 {
+		usageFromContext(ctx).hitLimit(protocol.LimitFileMatches)
+		return matches, true, nil
+	}
+	lfsMatches, limitHit, err := regexSearch(ctx, rg, lfs, limits, p.PatternMatchesContent, p.PatternMatchesPath)
+	return append(matches, lfsMatches...), limitHit, err
+}
+
+// resolveLFS fetches the objects of the LFS pointer files in zf which match
+// rg.matchPath. It returns an in-memory archive of the object contents, stored
+// under the paths of their pointers, and the set of pointer paths which were
+// resolved. Objects which are too large are skipped like large files.
+// Objects beyond maxLFSObjects or which fail to fetch are skipped too, and
+// unresolved is true. The pointer files of skipped objects are searched
+// instead. It fails if no object could be fetched.
+func (s *Service) resolveLFS(ctx context.Context, p *protocol.Request, rg *readerGrep, zf *store.ZipFile) (lfs *store.ZipFile, pointers map[string]bool, unresolved bool, err error) {
+	if s.FetchLFS == nil {
+		return nil, nil, false, badRequestError{"resolving Git LFS objects is not supported"}
+	}
+
+	type object struct {
+		path string
+		lfsPointer
+		data []byte
+	}
+	var objects []*object
+	for i := range zf.Files {
+		f := &zf.Files[i]
+		if f.Len > maxLFSPointerSize || !rg.matchPath.MatchPath(f.Name) {
+			continue
+		}
+		ptr, ok := parseLFSPointer(zf.DataFor(f))
+		if !ok {
+			continue
+		}
+		if ptr.size > maxLFSObjectSize {
+			usageFromContext(ctx).skipLarge(f.Name)
+			continue
+		}
+		if len(objects) == maxLFSObjects {
+			unresolved = true
+			break
+		}
+		objects = append(objects, &object{path: f.Name, lfsPointer: ptr})
+	}
+
+	var (
+		sem      = make(chan struct{}, lfsConcurrency)
+		g, gctx  = errgroup.WithContext(ctx)
+		failedMu sync.Mutex
+		failed   error // the last fetch error
+	)
+	for _, o := range objects {
+		o := o
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+
+			data, err := s.FetchLFS(gctx, p.GitserverRepo(), p.Commit, o.path)
+			if err == nil {
+				if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != o.oid {
+					err = errors.New("object does not match its pointer")
+				}
+			}
+			if err != nil {
+				if gctx.Err() != nil {
+					return gctx.Err()
+				}
+				log.Printf("failed to fetch LFS object for %s@%s:%s: %s", p.Repo, p.Commit, o.path, err)
+				failedMu.Lock()
+				failed = errors.Wrapf(err, "failed to fetch LFS object for %s", o.path)
+				failedMu.Unlock()
+				return nil
+			}
+			o.data = data
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, nil, false, err
+	}
+
+	// Build the archive in path order so results are deterministic.
+	sort.Slice(objects, func(i, j int) bool { return objects[i].path < objects[j].path })
+	var (
+		buf bytes.Buffer
+		zw  = zip.NewWriter(&buf)
+	)
+	pointers = map[string]bool{}
+	for _, o := range objects {
+		if o.data == nil {
+			unresolved = true
+			continue
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:   o.path,
+			Method: zip.Store,
+		})
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if _, err := w.Write(o.data); err != nil {
+			return nil, nil, false, err
+		}
+		pointers[o.path] = true
+	}
+	if failed != nil && len(pointers) == 0 {
+		// Most likely gitserver can't fetch LFS objects at all.
+		return nil, nil, false, failed
+	}
+	if err := zw.Close(); err != nil {
+		return nil, nil, false, err
+	}
+	lfs, err = store.NewZipFile(buf.Bytes())
+	if err != nil {
+		return nil, nil, false, errors.Wrap(err, "failed to read LFS archive")
+	}
+	return lfs, pointers, unresolved, nil
+}
@@ -0,0 +1,48 @@
+package search
+
+import (
+	"testing"
+)
+
+func TestParseLFSPointer(t *testing.T) {
+	const oid = "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+	cases := map[string]struct {
+		data string
+		want lfsPointer
+		ok   bool
+	}{
+		"pointer": {
+			data: "version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize 12345\n",
+			want: lfsPointer{oid: oid, size: 12345},
+			ok:   true,
+		},
+		"extension keys": {
+			data: "version https://git-lfs.github.com/spec/v1\next-0-foo sha256:" + oid + "\noid sha256:" + oid + "\nsize 0\n",
+			want: lfsPointer{oid: oid, size: 0},
+			ok:   true,
+		},
+		"old version": {
+			data: "version https://hawser.github.com/spec/v1\noid sha256:" + oid + "\nsize 1\n",
+			want: lfsPointer{oid: oid, size: 1},
+			ok:   true,
+		},
+		"not a pointer": {
+			data: "package main\n",
+		},
+		"missing size": {
+			data: "version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\n",
+		},
+		"bad oid": {
+			data: "version https://git-lfs.github.com/spec/v1\noid sha256:abc\nsize 1\n",
+		},
+		"bad size": {
+			data: "version https://git-lfs.github.com/spec/v1\noid sha256:" + oid + "\nsize -1\n",
+		},
+	}
+	for name, tc := range cases {
+		got, ok := parseLFSPointer([]byte(tc.data))
+		if ok != tc.ok || (ok && got != tc.want) {
+			t.Errorf("%s: got %+v, %v, want %+v, %v", name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package search
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+// searchLimits is what is left of the limits of a request. Searches of
+// several archives for the same request (eg of LFS objects or of several
+// commits) share it, each consuming what it finds.
+type searchLimits struct {
+	bytesScanned int64 // bytes of file content which may be searched, accessed atomically
+	fileMatches  int   // files with matches which may be returned
+	matches      int   // LineMatches, counted matches or files matched by their path which may be returned
+}
+
+// newSearchLimits returns the limits requested by p.
+func newSearchLimits(p *protocol.PatternInfo) *searchLimits {
+	l := &searchLimits{
+		bytesScanned: p.MaxBytesScanned,
+		fileMatches:  p.FileMatchLimit,
+		matches:      p.MaxMatches,
+	}
+	if l.bytesScanned <= 0 {
+		l.bytesScanned = math.MaxInt64
+	}
+	if l.fileMatches > maxFileMatches || l.fileMatches <= 0 {
+		l.fileMatches = maxFileMatches
+	}
+	if l.matches <= 0 {
+		l.matches = math.MaxInt32
+	}
+	return l
+}
+
+// scan consumes n bytes of file content. It returns false if the remaining
+// bytes are insufficient, in which case the file should not be searched.
+func (l *searchLimits) scan(n int) bool {
+	return atomic.AddInt64(&l.bytesScanned, -int64(n)) >= 0
+}
+
+// take consumes fm if there is room for it. fm's LineMatches (or MatchCount)
+// are truncated if there is only room for some of them. If a limit was hit, it is
+// returned. The caller must serialize calls.
+func (l *searchLimits) take(fm *protocol.FileMatch) (ok bool, hit protocol.LimitReason) {
+	if l.fileMatches <= 0 {
+		return false, protocol.LimitFileMatches
+	}
+	if l.matches <= 0 {
+		return false, protocol.LimitMatches
+	}
+	l.fileMatches--
+	n := len(fm.LineMatches)
+	if fm.MatchCount > 0 {
+		n = fm.MatchCount
+	}
+	if n == 0 {
+		n = 1
+	}
+	if n > l.matches {
+		if fm.MatchCount > 0 {
+			fm.MatchCount = l.matches
+		} else {
+			fm.LineMatches = fm.LineMatches[:l.matches]
+		}
+		fm.LimitHit = true
+		l.matches = 0
+		return true, protocol.LimitMatches
+	}
+	l.matches -= n
+	return true, ""
+}
+
+// lineMatchLimit returns the number of LineMatches rg returns per file.
+func (rg *readerGrep) lineMatchLimit() int {
+	if rg.maxLineMatches > 0 && rg.maxLineMatches < maxLineMatches {
+		return rg.maxLineMatches
+	}
+	return maxLineMatches
+}
+
+// validateLimits returns an error if the limits requested by p are invalid.
+func validateLimits(p *protocol.Request) error {
+	if p.MaxLineMatchesPerFile < 0 || p.MaxMatches < 0 || p.MaxBytesScanned < 0 || p.MaxFileSize < 0 {
+		return errors.Errorf("MaxLineMatchesPerFile, MaxMatches, MaxBytesScanned and MaxFileSize must be non-negative (MaxLineMatchesPerFile=%d, MaxMatches=%d, MaxBytesScanned=%d, MaxFileSize=%d)", p.MaxLineMatchesPerFile, p.MaxMatches, p.MaxBytesScanned, p.MaxFileSize)
+	}
+	if p.IsStructuralPat && (p.MaxLineMatchesPerFile > 0 || p.MaxMatches > 0 || p.MaxBytesScanned > 0 || p.MaxFileSize > 0) {
+		return errors.New("MaxLineMatchesPerFile, MaxMatches, MaxBytesScanned and MaxFileSize are not supported for structural search")
+	}
+	return nil
+}
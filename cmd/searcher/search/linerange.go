@@ -0,0 +1,59 @@
+package search
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/pathmatch"
+)
+
+// filesMatcher returns matchPath restricted to the paths in files (see
+// protocol.PatternInfo.Files), and the line ranges to restrict matches to
+// by path. Paths searched in full have no entry in lineRanges.
+func filesMatcher(files []string, matchPath pathmatch.PathMatcher) (_ pathmatch.PathMatcher, lineRanges map[string][]protocol.LineRange, err error) {
+	paths := make(map[string]bool, len(files))
+	whole := map[string]bool{}
+	for _, s := range files {
+		f, err := protocol.ParseFileRange(s)
+		if err != nil {
+			return nil, nil, badRequestError{err.Error()}
+		}
+		paths[f.Path] = true
+		if len(f.Lines) == 0 {
+			whole[f.Path] = true
+			continue
+		}
+		if lineRanges == nil {
+			lineRanges = map[string][]protocol.LineRange{}
+		}
+		lineRanges[f.Path] = append(lineRanges[f.Path], f.Lines...)
+	}
+	// A path listed both with and without line ranges is searched in full.
+	for path := range whole {
+		delete(lineRanges, path)
+	}
+	return &pathSetMatcher{
+		PathMatcher: matchPath,
+		paths:       paths,
+		desc:        fmt.Sprintf("files:%d", len(paths)),
+	}, lineRanges, nil
+}
+
+// filterLineRanges returns the locs in data which start on a line in
+// ranges. locs must be sorted.
+func filterLineRanges(data []byte, locs [][]int, ranges []protocol.LineRange) [][]int {
+	filtered := locs[:0]
+	line, lineOffset := 1, 0
+	for _, loc := range locs {
+		line += bytes.Count(data[lineOffset:loc[0]], []byte{'\n'})
+		lineOffset = loc[0]
+		for _, r := range ranges {
+			if r.Start <= line && line <= r.End {
+				filtered = append(filtered, loc)
+				break
+			}
+		}
+	}
+	return filtered
+}
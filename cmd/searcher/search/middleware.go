@@ -0,0 +1,129 @@
+package search
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// Middleware hooks into the handling of every search request, so
+// deployment-specific policies (eg mandatory excludes, forced limits or
+// tenant scoping) can be added without changing the Service. A request is
+// handled in the stages
+//
+//	validate → rewrite → execute → post-filter
+//
+// Each stage runs the corresponding hook of every registered Middleware in
+// registration order. Any hook may be nil.
+type Middleware struct {
+	// Name identifies the middleware in errors.
+	Name string
+
+	// Validate may reject a request by returning an error. The request
+	// fails with 400 Bad Request.
+	Validate func(ctx context.Context, p *protocol.Request) error
+
+	// Rewrite may modify p before it is executed. The rewritten request is
+	// validated again, and fails with 400 Bad Request if it is invalid.
+	Rewrite func(ctx context.Context, p *protocol.Request) error
+
+	// PostFilter may modify or drop the matches of a request before they
+	// are returned. An error fails the request.
+	PostFilter func(ctx context.Context, p *protocol.Request, matches []protocol.FileMatch) ([]protocol.FileMatch, error)
+}
+
+// middlewares holds the Middleware registered with a Service.
+type middlewares struct {
+	mu sync.RWMutex
+	ms []Middleware
+}
+
+// Use registers m to be run for every subsequent search request.
+func (s *Service) Use(m Middleware) {
+	s.middlewares.mu.Lock()
+	s.middlewares.ms = append(s.middlewares.ms, m)
+	s.middlewares.mu.Unlock()
+}
+
+// hasPostFilter reports whether any registered Middleware has a PostFilter.
+func (ms *middlewares) hasPostFilter() bool {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	for _, m := range ms.ms {
+		if m.PostFilter != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// searchWithMiddleware is like search, but runs the registered Middleware
+// around it.
+func (s *Service) searchWithMiddleware(ctx context.Context, p *protocol.Request, zf *store.ZipFile) (matches []protocol.FileMatch, limitHit, deadlineHit bool, err error) {
+	s.middlewares.mu.RLock()
+	ms := s.middlewares.ms
+	s.middlewares.mu.RUnlock()
+	if len(ms) == 0 {
+		return s.search(ctx, p, zf)
+	}
+
+	if err := runPreSearchMiddleware(ctx, ms, p); err != nil {
+		// search would have closed zf.
+		if zf != nil {
+			zf.Close()
+		}
+		return nil, false, false, err
+	}
+
+	matches, limitHit, deadlineHit, err = s.search(ctx, p, zf)
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	for _, m := range ms {
+		if m.PostFilter == nil {
+			continue
+		}
+		matches, err = m.PostFilter(ctx, p, matches)
+		if err != nil {
+			return nil, false, false, errors.Wrapf(err, "middleware %s", m.Name)
+		}
+	}
+	return matches, limitHit, deadlineHit, nil
+}
+
+// runPreSearchMiddleware runs the validate and rewrite stages of ms on p.
+func runPreSearchMiddleware(ctx context.Context, ms []Middleware, p *protocol.Request) error {
+	for _, m := range ms {
+		if m.Validate == nil {
+			continue
+		}
+		if err := m.Validate(ctx, p); err != nil {
+			return badRequestError{"rejected by middleware " + m.Name + ": " + err.Error()}
+		}
+	}
+
+	rewritten := false
+	for _, m := range ms {
+		if m.Rewrite == nil {
+			continue
+		}
+		if err := m.Rewrite(ctx, p); err != nil {
+			return errors.Wrapf(err, "middleware %s", m.Name)
+		}
+		rewritten = true
+	}
+	if rewritten {
+		if err := p.PatternInfo.Normalize(); err != nil {
+			return badRequestError{"invalid rewritten request: " + err.Error()}
+		}
+		if err := validatePattern(p); err != nil {
+			return badRequestError{"invalid rewritten request: " + err.Error()}
+		}
+	}
+	return nil
+}
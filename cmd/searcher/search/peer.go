@@ -0,0 +1,165 @@
+package search
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/endpoint"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver"
+)
+
+// peerProbeTimeout bounds how long we wait for peers to report whether they
+// have an archive cached.
+const peerProbeTimeout = time.Second
+
+// Peers finds archives in the caches of other searcher replicas, so that a
+// replica missing an archive can copy it from a sibling instead of fetching
+// it from gitserver again. Its FetchZip method is intended to be used as
+// store.Store.FetchPeerZip.
+//
+// Replicas only share archives if they have the same search.largeFiles
+// configuration, since that determines which files an archive contains.
+type Peers struct {
+	// Endpoints are the searcher replicas. It may include this replica,
+	// which never has the archives it is looking for cached.
+	Endpoints *endpoint.Map
+
+	// Client is the client used to talk to peers. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	// AuthToken if non-empty is sent to peers in protocol.AuthHeader (see
+	// Service.AuthToken).
+	AuthToken string
+
+	// PeerToken if non-empty is sent to peers in protocol.PeerAuthHeader
+	// (see Service.PeerToken).
+	PeerToken string
+}
+
+// FetchZip returns the zip archive of repo at commit from a peer which has
+// it cached, or nil if no peer does.
+func (p *Peers) FetchZip(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+	eps, err := p.Endpoints.Endpoints()
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{"repo": {string(repo.Name)}, "commit": {string(commit)}}.Encode()
+
+	// Ask every peer whether it has the archive, and take it from the first
+	// one which does.
+	probeCtx, cancel := context.WithTimeout(ctx, peerProbeTimeout)
+	defer cancel()
+	found := make(chan string, len(eps))
+	for ep := range eps {
+		go func(ep string) {
+			resp, err := p.do(probeCtx, "HEAD", ep+"/cached?"+q)
+			if err != nil {
+				found <- ""
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				ep = ""
+			}
+			found <- ep
+		}(strings.TrimSuffix(ep, "/"))
+	}
+	for range eps {
+		ep := <-found
+		if ep == "" {
+			continue
+		}
+		resp, err := p.do(ctx, "GET", ep+"/peer/archive?"+q)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp.Body, nil
+		}
+		resp.Body.Close()
+		// The peer may have evicted the archive since we asked, so try the
+		// next one.
+	}
+	return nil, nil
+}
+
+func (p *Peers) do(ctx context.Context, method, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.AuthToken != "" {
+		req.Header.Set(protocol.AuthHeader, p.AuthToken)
+	}
+	if p.PeerToken != "" {
+		req.Header.Set(protocol.PeerAuthHeader, p.PeerToken)
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	return resp, errors.Wrap(err, "searcher peer request failed")
+}
+
+// servePeerArchive serves the cached zip archive of a repository at a commit
+// to another searcher replica (see Peers):
+//
+//	GET /peer/archive?repo=github.com/foo/bar&commit=deadbeef...
+//
+// It never fetches the archive, and responds with 404 if it is not cached.
+func (s *Service) servePeerArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	repo, commit := api.RepoName(q.Get("repo")), api.CommitID(q.Get("commit"))
+	if repo == "" || len(commit) != 40 {
+		http.Error(w, "repo and absolute commit are required", http.StatusBadRequest)
+		return
+	}
+
+	path, _, err := s.Store.StatZip(gitserver.Repo{Name: repo}, commit)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "archive not cached", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	// The archive may be evicted while we serve it. That is fine since the
+	// open file remains readable.
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		http.Error(w, "archive not cached", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	_, _ = io.Copy(w, f)
+}
@@ -0,0 +1,299 @@
+package search
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver"
+)
+
+const (
+	// maxPrefetchArchives is the maximum number of archives in a single
+	// prefetch job.
+	maxPrefetchArchives = 10000
+
+	// prefetchTimeout bounds the time spent fetching a single archive for
+	// a prefetch job.
+	prefetchTimeout = 5 * time.Minute
+
+	// prefetchJobTTL is how long the status of a finished prefetch job is
+	// kept.
+	prefetchJobTTL = time.Hour
+)
+
+// prefetcher runs prefetch jobs. The concurrency budgets are shared by all
+// jobs.
+type prefetcher struct {
+	s *Service
+
+	// sem limits the number of archives fetched concurrently.
+	sem chan struct{}
+
+	mu sync.Mutex
+	// gitserverSems limits the number of archives fetched concurrently
+	// from each gitserver, keyed by gitserver address.
+	gitserverSems map[string]chan struct{}
+	jobs          map[string]*prefetchJob
+}
+
+type prefetchJob struct {
+	mu         sync.Mutex
+	status     protocol.PrefetchJob
+	finishedAt time.Time
+}
+
+func newPrefetcher(s *Service) *prefetcher {
+	concurrency := s.PrefetchConcurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	return &prefetcher{
+		s:             s,
+		sem:           make(chan struct{}, concurrency),
+		gitserverSems: map[string]chan struct{}{},
+		jobs:          map[string]*prefetchJob{},
+	}
+}
+
+// serveJobs creates prefetch jobs (POST /prefetch/jobs) and reports their
+// status (GET /prefetch/jobs/<id>).
+func (pf *prefetcher) serveJobs(w http.ResponseWriter, r *http.Request) {
+	if id := strings.TrimPrefix(r.URL.Path, "/prefetch/jobs/"); id != r.URL.Path && id != "" {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status, ok := pf.status(id)
+		if !ok {
+			http.Error(w, "prefetch job not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if pf.s.NoFetch {
+		http.Error(w, "prefetching is disabled while fetching is disabled", http.StatusServiceUnavailable)
+		return
+	}
+	var req protocol.PrefetchJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Archives) == 0 || len(req.Archives) > maxPrefetchArchives {
+		http.Error(w, "a prefetch job must contain between 1 and 10000 archives", http.StatusBadRequest)
+		return
+	}
+	for _, a := range req.Archives {
+		if a.Repo == "" || len(a.Commit) != 40 {
+			http.Error(w, "every archive must have a repo and an absolute commit", http.StatusBadRequest)
+			return
+		}
+	}
+	repos := make([]api.RepoName, len(req.Archives))
+	for i, a := range req.Archives {
+		repos[i] = a.Repo
+	}
+	if !pf.s.authorizeRepos(w, r, repos) {
+		return
+	}
+
+	status, err := pf.start(req.Archives)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// servePrefetch starts a job fetching the archive of a single commit (POST
+// /prefetch?repo=...&commit=...). It is a simpler form of serveJobs for
+// callers such as push webhooks.
+func (pf *prefetcher) servePrefetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if pf.s.NoFetch {
+		http.Error(w, "prefetching is disabled while fetching is disabled", http.StatusServiceUnavailable)
+		return
+	}
+	q := r.URL.Query()
+	a := protocol.ArchiveRef{Repo: api.RepoName(q.Get("repo")), Commit: api.CommitID(q.Get("commit"))}
+	if a.Repo == "" || len(a.Commit) != 40 {
+		http.Error(w, "repo and absolute commit are required", http.StatusBadRequest)
+		return
+	}
+
+	status, err := pf.start([]protocol.ArchiveRef{a})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// start starts a job fetching archives in the background and returns its
+// initial status.
+func (pf *prefetcher) start(archives []protocol.ArchiveRef) (protocol.PrefetchJob, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return protocol.PrefetchJob{}, err
+	}
+	id := hex.EncodeToString(b[:])
+	job := &prefetchJob{status: protocol.PrefetchJob{
+		ID:        id,
+		StatusURL: "/prefetch/jobs/" + id,
+		Total:     len(archives),
+	}}
+
+	pf.mu.Lock()
+	// Forget jobs which finished a while ago.
+	for id, j := range pf.jobs {
+		j.mu.Lock()
+		expired := !j.finishedAt.IsZero() && time.Since(j.finishedAt) > prefetchJobTTL
+		j.mu.Unlock()
+		if expired {
+			delete(pf.jobs, id)
+		}
+	}
+	pf.jobs[id] = job
+	pf.mu.Unlock()
+
+	prefetchJobsStarted.Inc()
+	status := job.status
+	go pf.run(job, archives)
+	return status, nil
+}
+
+func (pf *prefetcher) run(job *prefetchJob, archives []protocol.ArchiveRef) {
+	var wg sync.WaitGroup
+	for _, a := range archives {
+		a := a
+		gitserverSem := pf.gitserverSem(a.Repo)
+
+		// Acquire the budgets before starting a goroutine, so a large job
+		// doesn't start thousands of goroutines.
+		gitserverSem <- struct{}{}
+		pf.sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				<-pf.sem
+				<-gitserverSem
+			}()
+			err := pf.fetch(a)
+
+			job.mu.Lock()
+			if err != nil {
+				job.status.Failed++
+				job.status.Errors = append(job.status.Errors, protocol.PrefetchError{ArchiveRef: a, Error: err.Error()})
+			} else {
+				job.status.Done++
+			}
+			job.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	job.mu.Lock()
+	job.status.Finished = true
+	job.finishedAt = time.Now()
+	job.mu.Unlock()
+}
+
+func (pf *prefetcher) fetch(a protocol.ArchiveRef) error {
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+	defer cancel()
+	fetched, err := pf.s.Store.Prefetch(ctx, gitserver.Repo{Name: a.Repo}, a.Commit)
+	switch {
+	case err != nil:
+		prefetchArchives.WithLabelValues("error").Inc()
+	case !fetched:
+		prefetchArchives.WithLabelValues("cached").Inc()
+	default:
+		prefetchArchives.WithLabelValues("success").Inc()
+	}
+	return err
+}
+
+// gitserverSem returns the semaphore limiting concurrent fetches from the
+// gitserver which serves repo.
+func (pf *prefetcher) gitserverSem(repo api.RepoName) chan struct{} {
+	var addr string
+	if pf.s.GitserverAddr != nil {
+		addr = pf.s.GitserverAddr(context.Background(), repo)
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	sem, ok := pf.gitserverSems[addr]
+	if !ok {
+		concurrency := pf.s.PrefetchConcurrencyPerGitserver
+		if concurrency <= 0 {
+			concurrency = 2
+		}
+		sem = make(chan struct{}, concurrency)
+		pf.gitserverSems[addr] = sem
+	}
+	return sem
+}
+
+func (pf *prefetcher) status(id string) (protocol.PrefetchJob, bool) {
+	pf.mu.Lock()
+	job, ok := pf.jobs[id]
+	pf.mu.Unlock()
+	if !ok {
+		return protocol.PrefetchJob{}, false
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	status := job.status
+	status.Errors = append([]protocol.PrefetchError(nil), job.status.Errors...)
+	return status, true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+var (
+	prefetchJobsStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "prefetch",
+		Name:      "jobs_total",
+		Help:      "Number of prefetch jobs started.",
+	})
+	prefetchArchives = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "prefetch",
+		Name:      "archives_total",
+		Help:      "Number of archives prefetched by prefetch jobs, by result: success, cached (it was cached already) or error.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(prefetchJobsStarted)
+	prometheus.MustRegister(prefetchArchives)
+}
@@ -0,0 +1,316 @@
+package search
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/src-d/enry/v2"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// maxQueryNodes bounds the size of a structured query.
+const maxQueryNodes = 100
+
+// queryMatcher evaluates a node of a structured query (protocol.QueryNode)
+// against a file.
+type queryMatcher interface {
+	// match reports whether f matches. If it does and collect is true, the
+	// line matches of the content leaves which contributed to the match
+	// are appended to lm.
+	match(zf *store.ZipFile, f *store.SrcFile, collect bool, lm *[]protocol.LineMatch) bool
+
+	// copy returns a copy of the matcher that is safe to use from another
+	// goroutine.
+	copy() queryMatcher
+}
+
+// compileQueryRequest returns a readerGrep which evaluates the JSON encoded
+// structured query q against the files matching the path filters of p.
+func compileQueryRequest(p *protocol.PatternInfo, q string) (*readerGrep, error) {
+	var n protocol.QueryNode
+	if err := json.Unmarshal([]byte(q), &n); err != nil {
+		return nil, errors.Wrap(err, "invalid Query")
+	}
+	nodes := 0
+	query, err := compileQuery(&n, p, &nodes)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid Query")
+	}
+	matchPath, err := compilePathMatcher(p)
+	if err != nil {
+		return nil, err
+	}
+	return &readerGrep{
+		matchPath:   matchPath,
+		query:       query,
+		scope:       p.Scope,
+		maxFileSize: p.MaxFileSize,
+	}, nil
+}
+
+// compileQuery compiles n. Content leaves only match within the Scope of p,
+// and skip files larger than its MaxFileSize. nodes counts the nodes
+// compiled so far.
+func compileQuery(n *protocol.QueryNode, p *protocol.PatternInfo, nodes *int) (queryMatcher, error) {
+	if *nodes++; *nodes > maxQueryNodes {
+		return nil, errors.Errorf("query has more than %d nodes", maxQueryNodes)
+	}
+
+	set := 0
+	for _, ok := range []bool{n.And != nil, n.Or != nil, n.Not != nil, n.Content != nil, n.Path != nil, n.Lang != "", n.Predicate != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("exactly one of And, Or, Not, Content, Path, Lang and Predicate must be set on every query node")
+	}
+
+	compileAll := func(ns []protocol.QueryNode) ([]queryMatcher, error) {
+		if len(ns) == 0 {
+			return nil, errors.New("And and Or must not be empty")
+		}
+		qs := make([]queryMatcher, len(ns))
+		for i := range ns {
+			q, err := compileQuery(&ns[i], p, nodes)
+			if err != nil {
+				return nil, err
+			}
+			qs[i] = q
+		}
+		return qs, nil
+	}
+
+	switch {
+	case n.And != nil:
+		qs, err := compileAll(n.And)
+		return andQuery(qs), err
+
+	case n.Or != nil:
+		qs, err := compileAll(n.Or)
+		return orQuery(qs), err
+
+	case n.Not != nil:
+		q, err := compileQuery(n.Not, p, nodes)
+		return &notQuery{q: q}, err
+
+	case n.Content != nil, n.Path != nil:
+		qp := n.Content
+		if qp == nil {
+			qp = n.Path
+		}
+		if qp.Pattern == "" {
+			return nil, errors.New("Content and Path patterns must not be empty")
+		}
+		rg, err := compile(&protocol.PatternInfo{
+			Pattern:         qp.Pattern,
+			IsRegExp:        qp.IsRegExp,
+			IsWordMatch:     qp.IsWordMatch,
+			IsCaseSensitive: qp.IsCaseSensitive,
+			Scope:           p.Scope,
+			MaxFileSize:     p.MaxFileSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if n.Content != nil {
+			return &contentQuery{rg: rg}, nil
+		}
+		return &pathQuery{rg: rg}, nil
+
+	case n.Lang != "":
+		lang, ok := enry.GetLanguageByAlias(n.Lang)
+		if !ok {
+			return nil, errors.Errorf("unknown language %q", n.Lang)
+		}
+		exts := map[string]bool{}
+		for _, ext := range enry.GetLanguageExtensions(lang) {
+			exts[strings.ToLower(ext)] = true
+		}
+		return langQuery(exts), nil
+
+	default:
+		pred, ok := queryPredicates[n.Predicate]
+		if !ok {
+			return nil, errors.Errorf("unknown predicate %q", n.Predicate)
+		}
+		return pred, nil
+	}
+}
+
+type andQuery []queryMatcher
+
+func (q andQuery) match(zf *store.ZipFile, f *store.SrcFile, collect bool, lm *[]protocol.LineMatch) bool {
+	n := len(*lm)
+	for _, c := range q {
+		if !c.match(zf, f, collect, lm) {
+			// Drop the line matches of the children which did match.
+			*lm = (*lm)[:n]
+			return false
+		}
+	}
+	return true
+}
+
+func (q andQuery) copy() queryMatcher { return andQuery(copyQueries(q)) }
+
+type orQuery []queryMatcher
+
+func (q orQuery) match(zf *store.ZipFile, f *store.SrcFile, collect bool, lm *[]protocol.LineMatch) bool {
+	matched := false
+	for _, c := range q {
+		if c.match(zf, f, collect, lm) {
+			matched = true
+			// We only need to evaluate the remaining children to collect
+			// their line matches.
+			if !collect {
+				return true
+			}
+		}
+	}
+	return matched
+}
+
+func (q orQuery) copy() queryMatcher { return orQuery(copyQueries(q)) }
+
+type notQuery struct {
+	q queryMatcher
+}
+
+func (q *notQuery) match(zf *store.ZipFile, f *store.SrcFile, collect bool, lm *[]protocol.LineMatch) bool {
+	return !q.q.match(zf, f, false, lm)
+}
+
+func (q *notQuery) copy() queryMatcher { return &notQuery{q: q.q.copy()} }
+
+type contentQuery struct {
+	rg *readerGrep
+}
+
+func (q *contentQuery) match(zf *store.ZipFile, f *store.SrcFile, collect bool, lm *[]protocol.LineMatch) bool {
+	matches, _, _ := q.rg.Find(zf, f)
+	if len(matches) == 0 {
+		return false
+	}
+	if collect {
+		*lm = append(*lm, matches...)
+	}
+	return true
+}
+
+func (q *contentQuery) copy() queryMatcher { return &contentQuery{rg: q.rg.Copy()} }
+
+type pathQuery struct {
+	rg *readerGrep
+}
+
+func (q *pathQuery) match(zf *store.ZipFile, f *store.SrcFile, collect bool, lm *[]protocol.LineMatch) bool {
+	return q.rg.matchString(f.Name)
+}
+
+func (q *pathQuery) copy() queryMatcher { return q }
+
+// langQuery matches files by extension.
+type langQuery map[string]bool
+
+func (q langQuery) match(zf *store.ZipFile, f *store.SrcFile, collect bool, lm *[]protocol.LineMatch) bool {
+	return q[strings.ToLower(path.Ext(f.Name))]
+}
+
+func (q langQuery) copy() queryMatcher { return q }
+
+// predicateQuery matches files which satisfy a predicate.
+type predicateQuery func(zf *store.ZipFile, f *store.SrcFile) bool
+
+func (q predicateQuery) match(zf *store.ZipFile, f *store.SrcFile, collect bool, lm *[]protocol.LineMatch) bool {
+	return q(zf, f)
+}
+
+func (q predicateQuery) copy() queryMatcher { return q }
+
+var queryPredicates = map[string]predicateQuery{
+	"test": func(zf *store.ZipFile, f *store.SrcFile) bool {
+		return isTestFile(f.Name)
+	},
+	"vendor": func(zf *store.ZipFile, f *store.SrcFile) bool {
+		return enry.IsVendor(f.Name)
+	},
+	"lfs": func(zf *store.ZipFile, f *store.SrcFile) bool {
+		if f.Len > maxLFSPointerSize {
+			return false
+		}
+		_, ok := parseLFSPointer(zf.DataFor(f))
+		return ok
+	},
+}
+
+func copyQueries(qs []queryMatcher) []queryMatcher {
+	c := make([]queryMatcher, len(qs))
+	for i, q := range qs {
+		c[i] = q.copy()
+	}
+	return c
+}
+
+// findQuery is like FindZip, but evaluates rg.query. ok is false if f does
+// not match.
+func (rg *readerGrep) findQuery(zf *store.ZipFile, f *store.SrcFile) (fm protocol.FileMatch, ok bool) {
+	var lm []protocol.LineMatch
+	if !rg.query.match(zf, f, true, &lm) {
+		return fm, false
+	}
+	lm, limitHit := mergeLineMatches(lm, rg.lineMatchLimit())
+	return protocol.FileMatch{
+		Path:        f.Name,
+		LineMatches: lm,
+		LimitHit:    limitHit,
+		Encoding:    zf.Encodings[f.Name],
+		Binary:      zf.Binary[f.Name],
+	}, true
+}
+
+// mergeLineMatches sorts lm by line number and merges the matches of
+// different content leaves on the same line. It returns at most limit
+// lines.
+func mergeLineMatches(lm []protocol.LineMatch, limit int) (merged []protocol.LineMatch, limitHit bool) {
+	sort.SliceStable(lm, func(i, j int) bool { return lm[i].LineNumber < lm[j].LineNumber })
+	for _, m := range lm {
+		if n := len(merged); n > 0 && merged[n-1].LineNumber == m.LineNumber {
+			last := &merged[n-1]
+			// Offsets are relative to the preview, so they can only be
+			// merged if the previews are the same window of the line.
+			if last.PreviewOffset == m.PreviewOffset {
+				last.OffsetAndLengths = mergeOffsets(last.OffsetAndLengths, m.OffsetAndLengths)
+			}
+			continue
+		}
+		merged = append(merged, m)
+	}
+	if len(merged) > limit {
+		return merged[:limit], true
+	}
+	return merged, false
+}
+
+func mergeOffsets(a, b [][2]int) [][2]int {
+	all := append(append([][2]int{}, a...), b...)
+	sort.Slice(all, func(i, j int) bool {
+		if all[i][0] != all[j][0] {
+			return all[i][0] < all[j][0]
+		}
+		return all[i][1] < all[j][1]
+	})
+	out := all[:0]
+	for _, o := range all {
+		if len(out) > 0 && out[len(out)-1] == o {
+			continue
+		}
+		out = append(out, o)
+	}
+	return out
+}
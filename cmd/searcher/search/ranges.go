@@ -0,0 +1,59 @@
+package search
+
+import (
+	"bytes"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// attachRanges sets Ranges on every LineMatch of matches to the locations
+// of its OffsetAndLengths in the corresponding file in zf. Offsets within a
+// line are in characters, so clients would otherwise need the file to find
+// the byte offsets of matches.
+func attachRanges(zf *store.ZipFile, matches []protocol.FileMatch) {
+	files := make(map[string]*store.SrcFile, len(zf.Files))
+	for i := range zf.Files {
+		files[zf.Files[i].Name] = &zf.Files[i]
+	}
+
+	for i := range matches {
+		fm := &matches[i]
+		f, ok := files[fm.Path]
+		if !ok || len(fm.LineMatches) == 0 || fm.Binary {
+			continue
+		}
+		data := zf.DataFor(f)
+
+		// line is the number of the line starting at lineStart. LineMatches
+		// are usually in order, so we only go back to the start otherwise.
+		line, lineStart := 0, 0
+		for j := range fm.LineMatches {
+			lm := &fm.LineMatches[j]
+			if lm.LineNumber < line {
+				line, lineStart = 0, 0
+			}
+			for line < lm.LineNumber {
+				eol := bytes.IndexByte(data[lineStart:], '\n')
+				if eol < 0 {
+					break
+				}
+				lineStart += eol + 1
+				line++
+			}
+			if line != lm.LineNumber {
+				continue
+			}
+
+			lm.Ranges = make([]protocol.Range, 0, len(lm.OffsetAndLengths))
+			for _, ol := range lm.OffsetAndLengths {
+				start := lm.PreviewOffset + ol[0]
+				startOffset := lineStart + runeOffset(data[lineStart:], start)
+				lm.Ranges = append(lm.Ranges, protocol.Range{
+					Start: protocol.Position{Line: line, Column: start, Offset: startOffset},
+					End:   protocol.Position{Line: line, Column: start + ol[1], Offset: startOffset + runeOffset(data[startOffset:], ol[1])},
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package search
+
+import (
+	"sort"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/pathmatch"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// ranker orders files by PriorityPatterns and then RankBy. Ties are broken
+// by path, so the order is stable across requests.
+type ranker struct {
+	by       protocol.RankBy
+	priority []pathmatch.PathMatcher
+}
+
+// compileRanker returns the ranker for p, or nil if p doesn't ask for an
+// order.
+func compileRanker(p *protocol.PatternInfo) (*ranker, error) {
+	if p.RankBy == protocol.RankDefault && len(p.PriorityPatterns) == 0 {
+		return nil, nil
+	}
+	r := &ranker{by: p.RankBy}
+	for _, pattern := range p.PriorityPatterns {
+		m, err := pathmatch.CompilePattern(pattern, pathmatch.CompileOptions{
+			RegExp:        p.PathPatternsAreRegExps,
+			CaseSensitive: p.PathPatternsAreCaseSensitive,
+		})
+		if err != nil {
+			return nil, err
+		}
+		r.priority = append(r.priority, m)
+	}
+	return r, nil
+}
+
+// priorityOf returns the index of the first priority pattern matching path,
+// or len(r.priority) if there is none.
+func (r *ranker) priorityOf(path string) int {
+	for i, m := range r.priority {
+		if m.MatchPath(path) {
+			return i
+		}
+	}
+	return len(r.priority)
+}
+
+// sortFiles returns a copy of the files of zf in the order to search them.
+// The order of zf.Files itself is shared by all requests.
+func (r *ranker) sortFiles(zf *store.ZipFile) []store.SrcFile {
+	files := append([]store.SrcFile(nil), zf.Files...)
+	var priorities map[string]int
+	if len(r.priority) > 0 {
+		priorities = make(map[string]int, len(files))
+		for _, f := range files {
+			priorities[f.Name] = r.priorityOf(f.Name)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i].Name, files[j].Name
+		if pa, pb := priorities[a], priorities[b]; pa != pb {
+			return pa < pb
+		}
+		return r.lessStatic(zf, a, b)
+	})
+	return files
+}
+
+// lessStatic reports whether the file a comes before b by RankBy, ignoring
+// matches.
+func (r *ranker) lessStatic(zf *store.ZipFile, a, b string) bool {
+	switch r.by {
+	case protocol.RankPath:
+		return a < b
+	case protocol.RankRecency:
+		if ta, tb := zf.ModTimes[a], zf.ModTimes[b]; !ta.Equal(tb) {
+			return ta.After(tb)
+		}
+		return a < b
+	}
+	// Keep the order of the archive, or in which matches were found.
+	return false
+}
+
+// sortMatches sorts matches, which were found in zf, most relevant first.
+func (r *ranker) sortMatches(zf *store.ZipFile, matches []protocol.FileMatch) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := &matches[i], &matches[j]
+		if pa, pb := r.priorityOf(a.Path), r.priorityOf(b.Path); pa != pb {
+			return pa < pb
+		}
+		if r.by == protocol.RankMatches {
+			if na, nb := fileMatchCount(a), fileMatchCount(b); na != nb {
+				return na > nb
+			}
+			return a.Path < b.Path
+		}
+		return r.lessStatic(zf, a.Path, b.Path)
+	})
+}
+
+// fileMatchCount returns the number of matches in fm.
+func fileMatchCount(fm *protocol.FileMatch) int {
+	if fm.MatchCount > 0 {
+		return fm.MatchCount
+	}
+	n := 0
+	for _, lm := range fm.LineMatches {
+		n += len(lm.OffsetAndLengths)
+	}
+	return n
+}
+
+// orderedResults orders the results of files searched concurrently by the
+// order of the files, for ranked and paginated searches.
+type orderedResults struct {
+	next    int                         // index of the next file in order
+	pending map[int]*protocol.FileMatch // results of later files, nil if they don't match
+}
+
+// orderedMatch is the match of the i-th file.
+type orderedMatch struct {
+	i  int
+	fm *protocol.FileMatch
+}
+
+// add records the result of the i-th file, and returns the matches which
+// are now next in order.
+func (r *orderedResults) add(i int, fm *protocol.FileMatch) []orderedMatch {
+	if r.pending == nil {
+		r.pending = map[int]*protocol.FileMatch{}
+	}
+	r.pending[i] = fm
+	var ready []orderedMatch
+	for {
+		fm, ok := r.pending[r.next]
+		if !ok {
+			return ready
+		}
+		delete(r.pending, r.next)
+		if fm != nil {
+			ready = append(ready, orderedMatch{i: r.next, fm: fm})
+		}
+		r.next++
+	}
+}
@@ -0,0 +1,217 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+const (
+	// gitserverPingTimeout bounds a single ping of a gitserver.
+	gitserverPingTimeout = 5 * time.Second
+
+	// stalledFetchTimeout is how long fetches may wait for a fetch slot,
+	// without any fetch getting one, before searcher is unhealthy. It is
+	// longer than the timeout of a fetch.
+	stalledFetchTimeout = 5 * time.Minute
+)
+
+// GitserverProber periodically pings every gitserver and records whether it
+// is reachable, so that /readyz and metrics can tell a broken searcher apart
+// from a healthy searcher which can't reach gitserver.
+type GitserverProber struct {
+	// Addrs returns the addresses of the gitservers.
+	Addrs func(ctx context.Context) []string
+
+	// Ping returns an error if the gitserver at addr is unreachable.
+	Ping func(ctx context.Context, addr string) error
+
+	// Interval is the time between probes. Defaults to 10s.
+	Interval time.Duration
+
+	mu          sync.Mutex
+	addrs       []string          // the gitservers probed last
+	unreachable map[string]string // addr -> error, nil before the first probe
+	checkedAt   time.Time
+}
+
+// Run probes the gitservers every Interval until ctx is done.
+func (p *GitserverProber) Run(ctx context.Context) {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	for {
+		p.probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// probe pings every gitserver once and records the result.
+func (p *GitserverProber) probe(ctx context.Context) {
+	addrs := p.Addrs(ctx)
+	type result struct {
+		addr string
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			ctx, cancel := context.WithTimeout(ctx, gitserverPingTimeout)
+			defer cancel()
+			results <- result{addr, p.Ping(ctx, addr)}
+		}(addr)
+	}
+
+	unreachable := map[string]string{}
+	for range addrs {
+		r := <-results
+		up := 1.0
+		if r.err != nil {
+			unreachable[r.addr] = r.err.Error()
+			up = 0
+		}
+		gitserverUp.WithLabelValues(r.addr).Set(up)
+	}
+
+	current := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		current[addr] = true
+	}
+
+	p.mu.Lock()
+	// Forget gitservers which have been removed.
+	for _, addr := range p.addrs {
+		if !current[addr] {
+			gitserverUp.DeleteLabelValues(addr)
+		}
+	}
+	p.addrs = addrs
+	p.unreachable = unreachable
+	p.checkedAt = time.Now()
+	p.mu.Unlock()
+}
+
+// health returns the health of the gitservers as of the last probe.
+func (p *GitserverProber) health() (health protocol.GitserverHealth, unreachable map[string]string, checkedAt time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.unreachable == nil:
+		health = protocol.GitserverHealthUnknown
+	case len(p.unreachable) == 0:
+		health = protocol.GitserverHealthUp
+	case len(p.unreachable) < len(p.addrs):
+		health = protocol.GitserverHealthDegraded
+	default:
+		health = protocol.GitserverHealthDown
+	}
+	return health, p.unreachable, p.checkedAt
+}
+
+// Drain makes /readyz report that searcher is not ready, so that load
+// balancers stop sending it requests before it shuts down.
+func (s *Service) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// unhealthy returns why searcher can't serve requests, or "" if it can: its
+// cache directory is not writable, or fetches from gitserver are wedged.
+func (s *Service) unhealthy() string {
+	if err := checkWritable(s.Store.Path); err != nil {
+		return "cache directory is not usable: " + err.Error()
+	}
+	if s.Store.FetchesStalled(stalledFetchTimeout) {
+		return fmt.Sprintf("no fetch from gitserver could start for %s", stalledFetchTimeout)
+	}
+	return ""
+}
+
+// checkWritable returns an error if files can't be written in dir.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".healthcheck-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("ok"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// serveHealth reports whether searcher is alive, for liveness probes:
+//
+//	GET /healthz
+//
+// The status is 503, with the reason as body, if searcher can't serve
+// requests until it is restarted.
+func (s *Service) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if reason := s.unhealthy(); reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok"))
+}
+
+// serveReady reports whether searcher is ready to serve requests, and the
+// health of the gitservers it fetches archives from:
+//
+//	GET /readyz
+//
+// The response is a JSON encoded protocol.Readiness. The status is 503 if
+// searcher itself is not ready (see serveHealth) or is shutting down. Unreachable gitservers
+// do not make searcher unready, since it can still search the archives it
+// has cached.
+func (s *Service) serveReady(w http.ResponseWriter, r *http.Request) {
+	resp := protocol.Readiness{Ready: true, Gitserver: protocol.GitserverHealthUnknown}
+	if atomic.LoadInt32(&s.draining) != 0 {
+		resp.Ready = false
+		resp.Reason = "shutting down"
+	} else if reason := s.unhealthy(); reason != "" {
+		resp.Ready = false
+		resp.Reason = reason
+	}
+	if s.Gitservers != nil {
+		var checkedAt time.Time
+		resp.Gitserver, resp.UnreachableGitservers, checkedAt = s.Gitservers.health()
+		if !checkedAt.IsZero() {
+			resp.GitserverCheckedAt = &checkedAt
+		}
+	}
+
+	code := http.StatusOK
+	if !resp.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, &resp)
+}
+
+var gitserverUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "searcher",
+	Name:      "gitserver_up",
+	Help:      "Whether the last probe of a gitserver succeeded (1) or failed (0). Gitservers are degraded if some are down.",
+}, []string{"addr"})
+
+func init() {
+	prometheus.MustRegister(gitserverUp)
+}
@@ -0,0 +1,168 @@
+package search
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/pathmatch"
+)
+
+const (
+	// refinementTTL is how long the results of a request are remembered for
+	// requests refining it. Refinements are typed, so this is short.
+	refinementTTL = 30 * time.Second
+
+	// maxRefinements bounds the number of remembered results.
+	maxRefinements = 1000
+)
+
+// refinements remembers the files matched by recent requests, so that a
+// request refining one of them (eg search-as-you-type adding to a literal
+// pattern) only needs to search those files. The zero value is ready to use.
+type refinements struct {
+	mu sync.Mutex
+	m  map[string]*refinement
+}
+
+// refinement is the result of a request which can be refined.
+type refinement struct {
+	key     protocol.Request // see refinementKey
+	pattern string
+	paths   map[string]bool // the files which matched
+	expires time.Time
+}
+
+// refinable reports whether requests can refine p. Only literal patterns
+// are supported: every file containing a pattern also contains any
+// substring of it. Resumed searches lack the results of earlier pages.
+func refinable(p *protocol.Request) bool {
+	return p.PatternType == protocol.PatternTypeLiteral && p.Pattern != "" && !p.IsWordMatch && !p.InvertMatch && p.Query == "" && !p.ResolveLFS && p.Cursor == ""
+}
+
+// refinementKey returns p without the fields which don't affect which files
+// it matches, other than its pattern. A request can only refine another
+// with the same key.
+func refinementKey(p *protocol.Request) protocol.Request {
+	k := *p
+	k.Pattern = ""
+	k.FileMatchLimit = 0
+	k.MaxMatches = 0
+	k.MaxBytesScanned = 0
+	k.Deadline = ""
+	k.Priority = ""
+	k.FetchTimeout = ""
+	k.NoFetch = false
+	k.Refines = ""
+	k.Paginate = false
+	k.URL = ""
+	k.WantContent = false
+	k.IncludeBlame = false
+	k.IncludeEnclosingScope = false
+	k.ContextBefore = 0
+	k.ContextAfter = 0
+	k.IncludeRanges = false
+	k.IncludeReplacements = false
+	k.IncludeDiffs = false
+	k.Replacement = ""
+	return k
+}
+
+// add remembers the complete results of p, and returns the token which
+// requests refining p can send. It returns "" if p can't be refined.
+func (r *refinements) add(p *protocol.Request, matches []protocol.FileMatch) string {
+	if !refinable(p) {
+		return ""
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	token := hex.EncodeToString(b)
+	paths := make(map[string]bool, len(matches))
+	for _, m := range matches {
+		paths[m.Path] = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.m == nil {
+		r.m = map[string]*refinement{}
+	}
+	now := time.Now()
+	if len(r.m) >= maxRefinements {
+		// Drop expired entries, and if that is not enough the oldest.
+		var oldest string
+		for t, ref := range r.m {
+			if now.After(ref.expires) {
+				delete(r.m, t)
+			} else if oldest == "" || ref.expires.Before(r.m[oldest].expires) {
+				oldest = t
+			}
+		}
+		if len(r.m) >= maxRefinements {
+			delete(r.m, oldest)
+		}
+	}
+	r.m[token] = &refinement{
+		key:     refinementKey(p),
+		pattern: p.Pattern,
+		paths:   paths,
+		expires: now.Add(refinementTTL),
+	}
+	return token
+}
+
+// matcher returns matchPath restricted to the files which matched the
+// request p refines, if p can reuse its results. Otherwise it returns nil.
+func (r *refinements) matcher(p *protocol.Request, matchPath pathmatch.PathMatcher) pathmatch.PathMatcher {
+	if p.Refines == "" {
+		return nil
+	}
+	r.mu.Lock()
+	ref := r.m[p.Refines]
+	r.mu.Unlock()
+
+	result := "hit"
+	switch {
+	case ref == nil || time.Now().After(ref.expires):
+		result = "unknown"
+	case !refinable(p) || !reflect.DeepEqual(ref.key, refinementKey(p)) || !refines(p, ref.pattern):
+		result = "mismatch"
+	}
+	refinementsTotal.WithLabelValues(result).Inc()
+	if result != "hit" {
+		return nil
+	}
+	return &pathSetMatcher{
+		PathMatcher: matchPath,
+		paths:       ref.paths,
+		desc:        "refines:" + p.Refines,
+	}
+}
+
+// refines reports whether every file matched by the literal pattern of p
+// contains the literal pattern prior.
+func refines(p *protocol.Request, prior string) bool {
+	if p.IsCaseSensitive {
+		return strings.Contains(p.Pattern, prior)
+	}
+	return strings.Contains(strings.ToLower(p.Pattern), strings.ToLower(prior))
+}
+
+var refinementsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "service",
+	Name:      "refinements_total",
+	Help:      "Number of search requests refining a previous request, by whether its results were reused (hit), the token was unknown or expired, or the request did not refine it (mismatch).",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(refinementsTotal)
+}
@@ -0,0 +1,70 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/pathmatch"
+)
+
+func TestRefinements(t *testing.T) {
+	req := func(pattern string) *protocol.Request {
+		return &protocol.Request{
+			Repo:   "foo",
+			Commit: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo: protocol.PatternInfo{
+				Pattern:               pattern,
+				PatternType:           protocol.PatternTypeLiteral,
+				PatternMatchesContent: true,
+			},
+		}
+	}
+	matchAll, err := pathmatch.CompilePathPatterns(nil, "", pathmatch.CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r refinements
+	token := r.add(req("Fo"), []protocol.FileMatch{{Path: "a.go"}, {Path: "b.go"}})
+	if token == "" {
+		t.Fatal("expected a token for a literal pattern")
+	}
+	if tok := r.add(&protocol.Request{PatternInfo: protocol.PatternInfo{Pattern: "fo+", PatternType: protocol.PatternTypeRegexp}}, nil); tok != "" {
+		t.Errorf("expected no token for a regexp pattern, got %q", tok)
+	}
+
+	refining := func(pattern string, modify func(*protocol.Request)) *protocol.Request {
+		p := req(pattern)
+		p.Refines = token
+		p.FileMatchLimit = 10
+		if modify != nil {
+			modify(p)
+		}
+		return p
+	}
+	cases := []struct {
+		name string
+		p    *protocol.Request
+		hit  bool
+	}{
+		{name: "extended", p: refining("foo", nil), hit: true},
+		{name: "prepended", p: refining("xfoy", nil), hit: true},
+		{name: "same", p: refining("fo", nil), hit: true},
+		{name: "shortened", p: refining("f", nil), hit: false},
+		{name: "case sensitive", p: refining("Foo", func(p *protocol.Request) { p.IsCaseSensitive = true }), hit: false},
+		{name: "other commit", p: refining("foo", func(p *protocol.Request) { p.Commit = "cafebabecafebabecafebabecafebabecafebabe" }), hit: false},
+		{name: "word match", p: refining("foo", func(p *protocol.Request) { p.IsWordMatch = true }), hit: false},
+		{name: "unknown token", p: refining("foo", func(p *protocol.Request) { p.Refines = "abc" }), hit: false},
+		{name: "no token", p: refining("foo", func(p *protocol.Request) { p.Refines = "" }), hit: false},
+	}
+	for _, c := range cases {
+		m := r.matcher(c.p, matchAll)
+		if hit := m != nil; hit != c.hit {
+			t.Errorf("%s: got hit=%v, want %v", c.name, hit, c.hit)
+			continue
+		}
+		if m != nil && (!m.MatchPath("a.go") || m.MatchPath("c.go")) {
+			t.Errorf("%s: expected only the previously matched files to match, got %s", c.name, m)
+		}
+	}
+}
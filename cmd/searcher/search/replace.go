@@ -0,0 +1,105 @@
+package search
+
+import (
+	"bytes"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// attachReplacements sets Replacements on every LineMatch in matches to the
+// result of expanding template (see regexp.Expand) for each of its ranges.
+// Only rg's regexp is used, so it must be the readerGrep which found
+// matches.
+func attachReplacements(zf *store.ZipFile, rg *readerGrep, template string, matches []protocol.FileMatch) error {
+	re, ok := stdRegexp(rg.re)
+	if !ok {
+		return badRequestError{"Replacement is not supported for patterns which require the fallback regexp engine"}
+	}
+
+	files := make(map[string]*store.SrcFile, len(zf.Files))
+	for i := range zf.Files {
+		files[zf.Files[i].Name] = &zf.Files[i]
+	}
+
+	tmpl := []byte(template)
+	for i := range matches {
+		fm := &matches[i]
+		f, ok := files[fm.Path]
+		if len(fm.LineMatches) == 0 || !ok || fm.Binary {
+			continue
+		}
+
+		data := zf.DataFor(f)
+		submatches := submatchesByStart(rg, re, data)
+
+		lines := lineStarts(data)
+		for j := range fm.LineMatches {
+			lm := &fm.LineMatches[j]
+			if lm.LineNumber >= len(lines) {
+				continue
+			}
+			line := data[lines[lm.LineNumber]:]
+			lm.Replacements = make([]string, len(lm.OffsetAndLengths))
+			for k, ol := range lm.OffsetAndLengths {
+				start := lines[lm.LineNumber] + runeOffset(line, lm.PreviewOffset+ol[0])
+				// Ranges which continue a match from a previous line have no
+				// submatch starting at them, so keep an empty replacement.
+				if m, ok := submatches[start]; ok {
+					// The indexes of m are the same in data, since
+					// bytesToLowerASCII preserves length, so captures keep
+					// their original case.
+					lm.Replacements[k] = string(re.Expand(nil, tmpl, data, m))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// matchContent returns the content rg matches data as, which is data
+// lowered if rg ignores case. It has the same length as data.
+func matchContent(rg *readerGrep, data []byte) []byte {
+	if !rg.ignoreCase {
+		return data
+	}
+	matchData := make([]byte, len(data))
+	bytesToLowerASCII(matchData, data)
+	return matchData
+}
+
+// submatchesByStart returns the submatches of re, which is the regexp of
+// rg, in data by the offset they start at. They are found the same way Find
+// found the matches, so that both agree on where matches start.
+func submatchesByStart(rg *readerGrep, re *regexp.Regexp, data []byte) map[int][]int {
+	submatches := map[int][]int{}
+	for _, m := range re.FindAllSubmatchIndex(matchContent(rg, data), -1) {
+		submatches[m[0]] = m
+	}
+	return submatches
+}
+
+// lineStarts returns the byte offset of the start of every line in b.
+func lineStarts(b []byte) []int {
+	starts := []int{0}
+	for i := 0; ; {
+		idx := bytes.IndexByte(b[i:], '\n')
+		if idx < 0 {
+			return starts
+		}
+		i += idx + 1
+		starts = append(starts, i)
+	}
+}
+
+// runeOffset returns the byte offset of the n-th rune in b.
+func runeOffset(b []byte, n int) int {
+	off := 0
+	for ; n > 0 && off < len(b); n-- {
+		_, size := utf8.DecodeRune(b[off:])
+		off += size
+	}
+	return off
+}
@@ -0,0 +1,118 @@
+package search
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+// logRequest logs a finished search request to s.Log. code is the label
+// recorded in the request metrics, eg "200" or "timedout".
+//
+// Requests which failed with a server error are logged at error level, and
+// bad requests at warn level. Other requests are sampled at LogSampleRate
+// and logged at info level, so that log volume stays manageable at high QPS.
+// Slow requests are logged in full by logSlowRequest once their response is
+// written.
+//
+// The fields are the same for every request, so that with SRC_LOG_FORMAT=json
+// logs can be aggregated, eg by patternHash to find expensive queries.
+func (s *Service) logRequest(ctx context.Context, p *protocol.Request, code string, matches int, limitHit, deadlineHit bool, duration time.Duration, err error) {
+	if s.Log == nil {
+		return
+	}
+	slow := s.SlowRequestThreshold > 0 && duration >= s.SlowRequestThreshold
+
+	log := s.Log.Info
+	switch {
+	case code == "500" || code == "503":
+		log = s.Log.Error
+	case code == "400" || code == "timedout":
+		log = s.Log.Warn
+	case s.LogSampleRate <= 0 || rand.Float64() >= s.LogSampleRate:
+		return
+	}
+
+	fields := []interface{}{
+		"repo", p.Repo,
+		"commit", p.Commit,
+		"pattern", p.Pattern,
+		"patternHash", patternHash(p),
+		"patternType", p.PatternType,
+		"isRegExp", p.IsRegExp,
+		"isStructuralPat", p.IsStructuralPat,
+		"languages", p.Languages,
+		"isWordMatch", p.IsWordMatch,
+		"isCaseSensitive", p.IsCaseSensitive,
+		"patternMatchesContent", p.PatternMatchesContent,
+		"patternMatchesPath", p.PatternMatchesPath,
+		"matches", matches,
+		"limitHit", limitHit,
+		"deadlineHit", deadlineHit,
+		"code", code,
+		"duration", duration,
+		"durationMs", duration.Milliseconds(),
+		"slow", slow,
+	}
+	if u := usageFromContext(ctx); u != nil {
+		lookups, misses := u.fetch.CacheLookups()
+		fields = append(fields,
+			"limit", u.limitReason(limitHit),
+			"filesScanned", atomic.LoadInt64(&u.filesRead),
+			"bytesScanned", atomic.LoadInt64(&u.bytesRead),
+			"cpuMs", time.Duration(atomic.LoadInt64(&u.cpu)).Milliseconds(),
+			"cacheHit", lookups > 0 && misses == 0,
+			"bytesFetched", u.fetch.BytesFetched(),
+		)
+	}
+	if err != nil {
+		fields = append(fields, "err", err)
+	}
+	log("search request", fields...)
+}
+
+// slowRequestPhases are the phases of a search request logged by
+// logSlowRequest, in order.
+var slowRequestPhases = []string{"fetch", "extract", "match", "attach", "serialize"}
+
+// logSlowRequest logs the search p at warn level if it took at least
+// SlowRequestThreshold, including writing its response of matches. The
+// record has all the parameters of p, the time spent in each phase (see
+// usage.addPhase) and the ID of the trace of the search, so that slow
+// queries can be reproduced and their traces found.
+func (s *Service) logSlowRequest(p *protocol.Request, u *usage, matches int, duration time.Duration) {
+	if s.Log == nil || s.SlowRequestThreshold <= 0 || duration < s.SlowRequestThreshold {
+		return
+	}
+
+	u.phaseMu.Lock()
+	fields := []interface{}{
+		"repo", p.Repo,
+		"commit", p.Commit,
+		"patternHash", patternHash(p),
+		"traceID", u.traceID,
+		"matches", matches,
+		"durationMs", duration.Milliseconds(),
+	}
+	for _, phase := range slowRequestPhases {
+		fields = append(fields, phase+"Ms", u.phases[phase].Milliseconds())
+	}
+	u.phaseMu.Unlock()
+	fields = append(fields, "request", *p)
+	s.Log.Warn("slow search request", fields...)
+}
+
+// patternHash identifies the query of p, regardless of the repository and
+// commit it searches. It is a prefix of the SHA-256 of the pattern and the
+// options changing what it matches.
+func patternHash(p *protocol.Request) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %s %v %v %v %v %q %q", p.Pattern, p.PatternType, p.IsRegExp, p.IsStructuralPat, p.IsWordMatch, p.IsCaseSensitive, p.IncludePatterns, p.ExcludePattern)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
@@ -0,0 +1,149 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	log15 "gopkg.in/inconshreveable/log15.v2"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+func TestLogRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleRate float64
+		code       string
+		duration   time.Duration
+		err        error
+		want       log15.Lvl // -1 if not logged
+	}{
+		{name: "fast unsampled", sampleRate: 0, code: "200", duration: time.Millisecond, want: -1},
+		{name: "fast sampled", sampleRate: 1, code: "200", duration: time.Millisecond, want: log15.LvlInfo},
+		{name: "slow", sampleRate: 0, code: "200", duration: time.Minute, want: -1}, // see logSlowRequest
+		{name: "bad request", sampleRate: 0, code: "400", duration: time.Millisecond, err: errors.New("bad"), want: log15.LvlWarn},
+		{name: "internal error", sampleRate: 0, code: "500", duration: time.Millisecond, err: errors.New("boom"), want: log15.LvlError},
+		{name: "canceled", sampleRate: 0, code: "canceled", duration: time.Millisecond, want: -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var records []*log15.Record
+			logger := log15.New()
+			logger.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+				records = append(records, r)
+				return nil
+			}))
+			s := &Service{Log: logger, LogSampleRate: test.sampleRate, SlowRequestThreshold: time.Second}
+			s.logRequest(context.Background(), &protocol.Request{}, test.code, 0, false, false, test.duration, test.err)
+
+			if test.want < 0 {
+				if len(records) != 0 {
+					t.Fatalf("expected no log, got %+v", records)
+				}
+				return
+			}
+			if len(records) != 1 {
+				t.Fatalf("expected 1 log record, got %d", len(records))
+			}
+			if records[0].Lvl != test.want {
+				t.Errorf("got level %s, want %s", records[0].Lvl, test.want)
+			}
+		})
+	}
+}
+
+func TestLogRequest_json(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log15.New()
+	logger.SetHandler(log15.StreamHandler(&buf, log15.JsonFormat()))
+	s := &Service{Log: logger, LogSampleRate: 1}
+
+	u := &usage{}
+	ctx := withUsage(context.Background(), u)
+	u.addRead(100)
+	u.addRead(50)
+	u.hitLimit(protocol.LimitMatches)
+	p := &protocol.Request{Repo: "foo", Commit: "deadbeef", PatternInfo: protocol.PatternInfo{Pattern: "bar"}}
+	s.logRequest(ctx, p, "200", 3, true, false, 1500*time.Millisecond, nil)
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("expected a JSON record, got %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"repo":         "foo",
+		"commit":       "deadbeef",
+		"patternHash":  patternHash(p),
+		"matches":      float64(3),
+		"limitHit":     true,
+		"deadlineHit":  false,
+		"limit":        string(protocol.LimitMatches),
+		"durationMs":   float64(1500),
+		"filesScanned": float64(2),
+		"bytesScanned": float64(150),
+		"cacheHit":     false,
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: got %v, want %v", k, got[k], v)
+		}
+	}
+
+	q := *p
+	q.Repo = "other"
+	if patternHash(&q) != patternHash(p) {
+		t.Error("expected the pattern hash not to depend on the repository")
+	}
+	q.IsCaseSensitive = true
+	if patternHash(&q) == patternHash(p) {
+		t.Error("expected the pattern hash to depend on the options of the pattern")
+	}
+}
+
+func TestLogSlowRequest(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log15.New()
+	logger.SetHandler(log15.StreamHandler(&buf, log15.JsonFormat()))
+	s := &Service{Log: logger, SlowRequestThreshold: time.Second}
+
+	u := &usage{}
+	u.setTraceID("abc123")
+	u.addPhase("fetch", 200*time.Millisecond)
+	u.addPhase("fetch", 100*time.Millisecond)
+	u.addPhase("match", time.Second)
+	p := &protocol.Request{Repo: "foo", Commit: "deadbeef", PatternInfo: protocol.PatternInfo{Pattern: "bar", IsRegExp: true}}
+
+	s.logSlowRequest(p, u, 3, 500*time.Millisecond)
+	if buf.Len() != 0 {
+		t.Fatalf("expected fast request not to be logged, got %q", buf.String())
+	}
+
+	s.logSlowRequest(p, u, 3, 1500*time.Millisecond)
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("expected a JSON record, got %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"lvl":         "warn",
+		"repo":        "foo",
+		"traceID":     "abc123",
+		"durationMs":  float64(1500),
+		"fetchMs":     float64(300),
+		"extractMs":   float64(0),
+		"matchMs":     float64(1000),
+		"serializeMs": float64(0),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: got %v, want %v", k, got[k], v)
+		}
+	}
+	req, _ := got["request"].(map[string]interface{})
+	if req["Pattern"] != "bar" || req["IsRegExp"] != true {
+		t.Errorf("expected the record to have the parameters of the request, got %v", got["request"])
+	}
+}
@@ -0,0 +1,241 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime/pprof"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
+
+// maxRevisions is the maximum number of commits a /revisions request may
+// search.
+const maxRevisions = 50
+
+// serveRevisions searches several commits of a repository. It accepts the
+// same form as a search, with the commits in the repeated Commits field:
+//
+//	POST /revisions Repo=github.com/foo/bar&Commits=deadbeef...&Commits=cafebabe...&Pattern=foo
+//
+// A file which is identical (by path and git blob SHA-1) in several of the
+// commits is only searched once, and its match lists all the commits it
+// applies to. The response is a JSON encoded protocol.RevisionsResponse.
+func (s *Service) serveRevisions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	done, retryAfter, ok := s.admit(ctx, requestClient(r), requestPriority(r))
+	if !ok {
+		writeOverloaded(w, retryAfter)
+		return
+	}
+	defer done()
+
+	p, ctx, cancel, err := s.decodeRequest(ctx, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+	commits := make([]api.CommitID, 0, len(r.Form["Commits"]))
+	for _, c := range r.Form["Commits"] {
+		commits = append(commits, api.CommitID(c))
+	}
+	if err := validateRevisionsParams(p, commits); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp protocol.RevisionsResponse
+	u := &usage{}
+	ctx = withUsage(ctx, u)
+	pprof.Do(ctx, pprof.Labels("repo", string(p.Repo), "query_type", queryType(p)), func(ctx context.Context) {
+		resp, err = s.searchRevisions(ctx, p, commits)
+	})
+	if err != nil {
+		writeSearchError(ctx, w, p, err)
+		return
+	}
+	if resp.Matches == nil {
+		resp.Matches = make([]protocol.RevisionFileMatch, 0)
+	}
+	resp.Stats = u.stats()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&resp)
+}
+
+func validateRevisionsParams(p *protocol.Request, commits []api.CommitID) error {
+	if p.Repo == "" {
+		return errors.New("Repo must be non-empty")
+	}
+	if len(commits) == 0 || len(commits) > maxRevisions {
+		return errors.Errorf("between 1 and %d Commits must be given (got %d)", maxRevisions, len(commits))
+	}
+	for _, c := range commits {
+		if len(c) != 40 {
+			return errors.Errorf("Commits must be resolved (Commit=%q)", c)
+		}
+	}
+	// These depend on more than the content of a file, so a match could not
+	// be shared by the commits a file is identical in.
+	if p.IsStructuralPat || p.ResolveLFS || p.IncludeBlame || p.IncludeReplacements || p.IncludeDiffs || p.IncludeEnclosingScope || changedFilesBase(p) != "" || p.OwnedBy != "" || p.NotOwnedBy != "" || p.GeneratedFiles != protocol.TestFilesIncluded || p.VendoredFiles != protocol.TestFilesIncluded {
+		return errors.New("structural search, ResolveLFS, IncludeBlame, IncludeReplacements, IncludeDiffs, IncludeEnclosingScope, ChangedSinceCommit, ChangedInLastCommits, OwnedBy, NotOwnedBy, GeneratedFiles and VendoredFiles are not supported when searching several commits")
+	}
+	// The hash indexes deduplicating files are of whole archives.
+	if p.PathSpec != "" {
+		return errors.New("PathSpec is not supported when searching several commits")
+	}
+	// Cursors are positions in the archive of a single commit.
+	if p.Paginate || p.Cursor != "" {
+		return errors.New("Paginate and Cursor are not supported when searching several commits")
+	}
+	return validatePattern(p)
+}
+
+// fileVersion identifies the content of a file at a path.
+type fileVersion struct {
+	path string
+	blob string // git blob SHA-1
+}
+
+// searchRevisions runs the search p over each of commits. Each version of a
+// file is searched in the first commit containing it.
+func (s *Service) searchRevisions(ctx context.Context, p *protocol.Request, commits []api.CommitID) (resp protocol.RevisionsResponse, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "SearchRevisions")
+	ext.Component.Set(span, "service")
+	span.SetTag("repo", p.Repo)
+	span.SetTag("commits", len(commits))
+	span.SetTag("pattern", p.Pattern)
+	defer func() {
+		if ctx.Err() == context.DeadlineExceeded || errors.Cause(err) == context.DeadlineExceeded {
+			resp.DeadlineHit = true
+			err = nil // the matches found so far are returned
+		}
+		if err != nil {
+			ext.Error.Set(span, true)
+			span.SetTag("err", err.Error())
+		}
+		span.LogFields(otlog.Int("matches.len", len(resp.Matches)))
+		span.Finish()
+	}()
+
+	rg, _, err := s.compilePattern(p)
+	if err != nil {
+		return resp, err
+	}
+	if len(p.Files) > 0 {
+		rg.matchPath, rg.lineRanges, err = filesMatcher(p.Files, rg.matchPath)
+		if err != nil {
+			return resp, err
+		}
+	}
+
+	// Assign each version of a file to the first commit containing it, using
+	// the hash index of each archive.
+	var (
+		versions = map[fileVersion][]api.CommitID{}
+		owned    = make([]map[string]string, len(commits)) // path -> blob searched in each commit
+		nFiles   int
+	)
+	for i, commit := range commits {
+		pc := *p
+		pc.Commit = commit
+		zipPath, zf, err := s.getZipFile(ctx, &pc)
+		if err != nil {
+			return resp, err
+		}
+		idx, err := s.Store.HashIndex(zipPath, zf)
+		zf.Close()
+		if err != nil {
+			return resp, err
+		}
+		owned[i] = map[string]string{}
+		for _, f := range idx.Files {
+			v := fileVersion{path: f.Path, blob: f.BlobSHA1}
+			if _, ok := versions[v]; !ok {
+				owned[i][f.Path] = f.BlobSHA1
+			}
+			versions[v] = append(versions[v], commit)
+		}
+		nFiles += len(idx.Files)
+	}
+	revisionFilesDeduplicated.Add(float64(nFiles - len(versions)))
+	span.LogFields(otlog.Int("files", nFiles), otlog.Int("versions", len(versions)))
+
+	limits := newSearchLimits(&p.PatternInfo)
+	ctx = withWorkerPool(ctx, s.workerPool())
+	for i, commit := range commits {
+		if len(owned[i]) == 0 {
+			continue
+		}
+		if limits.fileMatches <= 0 {
+			resp.LimitHit = true
+			break
+		}
+
+		pc := *p
+		pc.Commit = commit
+		_, zf, err := s.getZipFile(ctx, &pc)
+		if err != nil {
+			return resp, err
+		}
+		paths := make(map[string]bool, len(owned[i]))
+		for path := range owned[i] {
+			paths[path] = true
+		}
+		crg := rg.Copy()
+		crg.matchPath = &pathSetMatcher{
+			PathMatcher: rg.matchPath,
+			paths:       paths,
+			desc:        "revision:" + string(commit),
+		}
+		if m, err := s.languageMatcher(&pc, zf, true, crg.matchPath); err != nil {
+			zf.Close()
+			return resp, err
+		} else if m != nil {
+			crg.matchPath = m
+		}
+		matches, limitHit, err := regexSearch(ctx, crg, zf, limits, p.PatternMatchesContent, p.PatternMatchesPath)
+		if err == nil && p.WantContent {
+			attachContent(zf, matches)
+		}
+		if err == nil {
+			attachContextLines(zf, p.ContextBefore, p.ContextAfter, matches)
+		}
+		if err == nil && p.IncludeRanges {
+			attachRanges(zf, matches)
+		}
+		zf.Close()
+		for _, m := range matches {
+			resp.Matches = append(resp.Matches, protocol.RevisionFileMatch{
+				FileMatch: m,
+				Commits:   versions[fileVersion{path: m.Path, blob: owned[i][m.Path]}],
+			})
+		}
+		if err != nil {
+			return resp, err
+		}
+		if limitHit {
+			resp.LimitHit = true
+			break
+		}
+	}
+	return resp, nil
+}
+
+var revisionFilesDeduplicated = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "service",
+	Name:      "revision_files_deduplicated_total",
+	Help:      "Number of files not searched by /revisions requests because they are identical in an earlier commit of the same request.",
+})
+
+func init() {
+	prometheus.MustRegister(revisionFilesDeduplicated)
+}
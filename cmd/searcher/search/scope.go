@@ -0,0 +1,226 @@
+package search
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+// lexRules describes just enough of a language's lexical syntax to tell
+// comments and string literals apart from code. It is intentionally simple:
+// we do not need to tokenize, only to find the byte ranges of comments and
+// strings.
+type lexRules struct {
+	lineComments  []string
+	blockComments [][2]string
+	strings       []stringDelim
+}
+
+// stringDelim is a string literal delimiter. If raw is true, escape
+// sequences are not recognized inside the literal. If multiline is false, the
+// literal ends at the end of the line even if it is not terminated.
+type stringDelim struct {
+	open, close string
+	raw         bool
+	multiline   bool
+}
+
+var (
+	quotes = []stringDelim{{open: `"`, close: `"`}, {open: `'`, close: `'`}}
+
+	cLike = &lexRules{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		strings:       quotes,
+	}
+	goRules = &lexRules{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		strings:       append([]stringDelim{{open: "`", close: "`", raw: true, multiline: true}}, quotes...),
+	}
+	jsRules = &lexRules{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		strings:       append([]stringDelim{{open: "`", close: "`", multiline: true}}, quotes...),
+	}
+	rustRules = &lexRules{
+		lineComments:  []string{"//"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		// ' is not a string delimiter since it is also used for lifetimes.
+		strings: []stringDelim{{open: `"`, close: `"`}},
+	}
+	pythonRules = &lexRules{
+		lineComments: []string{"#"},
+		strings: append([]stringDelim{
+			{open: `"""`, close: `"""`, multiline: true},
+			{open: `'''`, close: `'''`, multiline: true},
+		}, quotes...),
+	}
+	hashRules = &lexRules{
+		lineComments: []string{"#"},
+		strings:      quotes,
+	}
+	sqlRules = &lexRules{
+		lineComments:  []string{"--"},
+		blockComments: [][2]string{{"/*", "*/"}},
+		strings:       []stringDelim{{open: `'`, close: `'`}},
+	}
+	cssRules = &lexRules{
+		blockComments: [][2]string{{"/*", "*/"}},
+		strings:       quotes,
+	}
+	markupRules = &lexRules{
+		blockComments: [][2]string{{"<!--", "-->"}},
+		strings:       quotes,
+	}
+)
+
+// lexRulesByExt maps a lower case file extension to its lexRules.
+var lexRulesByExt = map[string]*lexRules{
+	".go":    goRules,
+	".c":     cLike,
+	".h":     cLike,
+	".cc":    cLike,
+	".cpp":   cLike,
+	".hpp":   cLike,
+	".cs":    cLike,
+	".java":  cLike,
+	".kt":    cLike,
+	".scala": cLike,
+	".swift": cLike,
+	".php":   cLike,
+	".dart":  cLike,
+	".js":    jsRules,
+	".jsx":   jsRules,
+	".mjs":   jsRules,
+	".ts":    jsRules,
+	".tsx":   jsRules,
+	".rs":    rustRules,
+	".py":    pythonRules,
+	".rb":    hashRules,
+	".sh":    hashRules,
+	".bash":  hashRules,
+	".pl":    hashRules,
+	".r":     hashRules,
+	".yaml":  hashRules,
+	".yml":   hashRules,
+	".toml":  hashRules,
+	".sql":   sqlRules,
+	".css":   cssRules,
+	".scss":  cssRules,
+	".less":  cssRules,
+	".html":  markupRules,
+	".xml":   markupRules,
+	".vue":   markupRules,
+}
+
+// lexRulesFor returns the lexRules for the file name, or nil if we don't
+// know how to lex it.
+func lexRulesFor(name string) *lexRules {
+	return lexRulesByExt[strings.ToLower(path.Ext(name))]
+}
+
+// syntaxRegion is a byte range [start, end) of a file that is either a
+// comment or a string literal.
+type syntaxRegion struct {
+	start, end int
+	scope      protocol.SyntaxScope
+}
+
+// regions returns the comment and string literal regions in data, sorted by
+// start offset. Unterminated regions extend to the end of data.
+func (l *lexRules) regions(data []byte) []syntaxRegion {
+	var regions []syntaxRegion
+	i := 0
+	// endOf returns the index after the next occurrence of end in data[from:],
+	// or len(data) if there is none.
+	endOf := func(from int, end string) int {
+		if idx := bytes.Index(data[from:], []byte(end)); idx >= 0 {
+			return from + idx + len(end)
+		}
+		return len(data)
+	}
+outer:
+	for i < len(data) {
+		rest := data[i:]
+		for _, prefix := range l.lineComments {
+			if bytes.HasPrefix(rest, []byte(prefix)) {
+				end := len(data)
+				if idx := bytes.IndexByte(rest, '\n'); idx >= 0 {
+					end = i + idx
+				}
+				regions = append(regions, syntaxRegion{start: i, end: end, scope: protocol.ScopeComments})
+				i = end
+				continue outer
+			}
+		}
+		for _, delims := range l.blockComments {
+			if bytes.HasPrefix(rest, []byte(delims[0])) {
+				end := endOf(i+len(delims[0]), delims[1])
+				regions = append(regions, syntaxRegion{start: i, end: end, scope: protocol.ScopeComments})
+				i = end
+				continue outer
+			}
+		}
+		for _, delim := range l.strings {
+			if !bytes.HasPrefix(rest, []byte(delim.open)) {
+				continue
+			}
+			j := i + len(delim.open)
+			end := len(data)
+			for j < len(data) {
+				if !delim.raw && data[j] == '\\' {
+					j += 2
+					continue
+				}
+				if bytes.HasPrefix(data[j:], []byte(delim.close)) {
+					end = j + len(delim.close)
+					break
+				}
+				// This stops an apostrophe in prose we failed to detect as a
+				// comment from swallowing the rest of the file.
+				if data[j] == '\n' && !delim.multiline {
+					end = j
+					break
+				}
+				j++
+			}
+			regions = append(regions, syntaxRegion{start: i, end: end, scope: protocol.ScopeStrings})
+			i = end
+			continue outer
+		}
+		i++
+	}
+	return regions
+}
+
+// scopeOf returns the scope of the byte at offset in a file with regions
+// (as returned by lexRules.regions).
+func scopeOf(regions []syntaxRegion, offset int) protocol.SyntaxScope {
+	i := sort.Search(len(regions), func(i int) bool { return regions[i].end > offset })
+	if i < len(regions) && regions[i].start <= offset {
+		return regions[i].scope
+	}
+	return protocol.ScopeCode
+}
+
+// filterScope returns the match locations in locs (as returned by
+// regexp.FindAllIndex) which start inside scope. If the language of name
+// is not known, no locations are returned.
+func filterScope(name string, data []byte, locs [][]int, scope protocol.SyntaxScope) [][]int {
+	rules := lexRulesFor(name)
+	if rules == nil || len(locs) == 0 {
+		return nil
+	}
+	regions := rules.regions(data)
+	filtered := locs[:0]
+	for _, loc := range locs {
+		if scopeOf(regions, loc[0]) == scope {
+			filtered = append(filtered, loc)
+		}
+	}
+	return filtered
+}
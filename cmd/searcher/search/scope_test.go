@@ -0,0 +1,87 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+	"github.com/sourcegraph/sourcegraph/internal/testutil"
+)
+
+func TestScope(t *testing.T) {
+	files := map[string]string{
+		"main.go": `package main
+
+// TODO: say hello
+func main() {
+	todo := "TODO later" /* TODO block */
+	fmt.Println(todo, ` + "`raw TODO`" + `)
+}
+`,
+		"app.py": `# TODO python
+def todo():
+    return """TODO
+    docstring"""
+`,
+		"notes.unknown": "TODO",
+	}
+	zipData, err := testutil.CreateZip(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zf, err := store.MockZipFile(zipData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		scope protocol.SyntaxScope
+		want  map[string][]int // path -> 0-based line numbers
+	}{{
+		scope: protocol.ScopeAll,
+		want: map[string][]int{
+			"main.go":       {2, 4, 4, 4, 5, 5},
+			"app.py":        {0, 1, 2},
+			"notes.unknown": {0},
+		},
+	}, {
+		scope: protocol.ScopeComments,
+		want: map[string][]int{
+			"main.go": {2, 4},
+			"app.py":  {0},
+		},
+	}, {
+		scope: protocol.ScopeStrings,
+		want: map[string][]int{
+			"main.go": {4, 5},
+			"app.py":  {2},
+		},
+	}, {
+		scope: protocol.ScopeCode,
+		want: map[string][]int{
+			"main.go": {4, 5},
+			"app.py":  {1},
+		},
+	}}
+	for _, tc := range cases {
+		rg, err := compile(&protocol.PatternInfo{Pattern: "todo", Scope: tc.scope})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string][]int{}
+		for i := range zf.Files {
+			f := &zf.Files[i]
+			lms, _, err := rg.Find(zf, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, lm := range lms {
+				got[f.Name] = append(got[f.Name], lm.LineNumber)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("scope %q: got line matches %v, want %v", tc.scope, got, tc.want)
+		}
+	}
+}
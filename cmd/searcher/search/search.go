@@ -4,7 +4,8 @@
 // Architecture Notes:
 // * Archive is fetched from gitserver
 // * Simple HTTP API exposed
-// * Currently no concept of authorization
+// * Clients are optionally authenticated by a shared secret or TLS client
+//   certificate, and authorized per repository by a pluggable Authorizer
 // * On disk cache of fetched archives to reduce load on gitserver
 // * Run search on archive. Rely on OS file buffers
 // * Simple to scale up since stateless
@@ -17,14 +18,22 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"runtime/pprof"
 	"strconv"
+	"sync"
 	"time"
 
 	"golang.org/x/net/trace"
 	log15 "gopkg.in/inconshreveable/log15.v2"
 
 	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/ctags"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver"
+	"github.com/sourcegraph/sourcegraph/internal/metrics"
 	"github.com/sourcegraph/sourcegraph/internal/store"
+	sgtrace "github.com/sourcegraph/sourcegraph/internal/trace"
 
 	"github.com/pkg/errors"
 
@@ -42,17 +51,201 @@ const (
 	// maxLineMatches is the limit on number of matches to return in a
 	// file.
 	maxLineMatches = 100
-
-	// numWorkers is how many concurrent readerGreps run in the case of
-	// regexSearch, and the number of parallel workers in the case of
-	// structuralSearch.
-	numWorkers = 8
 )
 
 // Service is the search service. It is an http.Handler.
 type Service struct {
 	Store *store.Store
-	Log   log15.Logger
+
+	// Log if non-nil is used to log search requests. Failed and slow
+	// requests are always logged, other requests are sampled at
+	// LogSampleRate.
+	Log log15.Logger
+
+	// LogSampleRate is the fraction (between 0 and 1) of successful
+	// requests which are logged.
+	LogSampleRate float64
+
+	// SlowRequestThreshold if positive is the duration after which a
+	// request is logged as slow with all its parameters and phase timings,
+	// regardless of LogSampleRate.
+	SlowRequestThreshold time.Duration
+
+	// mux routes requests to the search endpoints. It is initialized on
+	// first use by muxOnce.
+	mux     *http.ServeMux
+	muxOnce sync.Once
+
+	// ChangedFiles returns the paths of the files which differ between the
+	// revisions base and head of repo. It is used to implement
+	// ChangedSinceCommit and ChangedInLastCommits. If nil, requests using
+	// those fields are rejected.
+	ChangedFiles func(ctx context.Context, repo gitserver.Repo, base, head string) ([]string, error)
+
+	// Blame returns the blame hunks covering the 1-based lines
+	// [startLine, endLine] of path in repo at commit. It is used to
+	// implement IncludeBlame. If nil, requests using it are rejected.
+	Blame func(ctx context.Context, repo gitserver.Repo, commit api.CommitID, path string, startLine, endLine int) ([]BlameHunk, error)
+
+	// FetchLFS returns the content of the Git LFS object which path in repo
+	// at commit points to. It is used to implement ResolveLFS. If nil,
+	// requests using it are rejected.
+	FetchLFS func(ctx context.Context, repo gitserver.Repo, commit api.CommitID, path string) ([]byte, error)
+
+	// ParseSymbols returns the ctags entries for the file at path with the
+	// given content. It is used to implement IncludeEnclosingScope. If nil,
+	// requests using it are rejected.
+	ParseSymbols func(ctx context.Context, path string, content []byte) ([]ctags.Entry, error)
+
+	// limitsMu protects DefaultTimeout, MaxTimeout and
+	// FallbackRegexpTimeout, which may be updated via /admin/limits while
+	// serving.
+	limitsMu sync.RWMutex
+
+	// DefaultTimeout if positive is the time a request without a Deadline
+	// may run for.
+	DefaultTimeout time.Duration
+
+	// MaxTimeout if positive bounds the time any request may run for,
+	// regardless of its Deadline.
+	MaxTimeout time.Duration
+
+	// FallbackRegexpTimeout if positive enables matching regular expressions
+	// which use features RE2 does not support (eg lookaround and
+	// backreferences) with a backtracking engine. It bounds the time spent
+	// matching a single file. Otherwise such patterns are rejected.
+	FallbackRegexpTimeout time.Duration
+
+	// StructuralFileTimeout if positive bounds the time comby spends
+	// matching a structural pattern against a single file. Files which time
+	// out are skipped. Otherwise comby's default applies.
+	StructuralFileTimeout time.Duration
+
+	// PrefetchConcurrency is the maximum number of archives fetched
+	// concurrently by prefetch jobs. Defaults to 4.
+	PrefetchConcurrency int
+
+	// PrefetchConcurrencyPerGitserver is the maximum number of archives
+	// prefetch jobs fetch concurrently from a single gitserver. Defaults
+	// to 2.
+	PrefetchConcurrencyPerGitserver int
+
+	// GitserverAddr returns the address of the gitserver which serves repo.
+	// It is used to apply PrefetchConcurrencyPerGitserver. If nil, all
+	// repositories are treated as served by the same gitserver.
+	GitserverAddr func(ctx context.Context, repo api.RepoName) string
+
+	// Gitservers if non-nil reports the reachability of the gitservers
+	// in /readyz. It must be run separately.
+	Gitservers *GitserverProber
+
+	// NoFetch if true only serves archives which are already cached, as if
+	// every request set NoFetch. It protects gitserver from fetch load, eg
+	// during maintenance.
+	NoFetch bool
+
+	// ShadowURL if non-empty is the URL of a canary searcher to which a
+	// sample of search requests is mirrored. Its responses are ignored.
+	ShadowURL string
+
+	// ShadowRate is the fraction (between 0 and 1) of search requests
+	// mirrored to ShadowURL.
+	ShadowRate float64
+
+	// MaxRunningSearches if positive is the maximum number of search
+	// requests served concurrently. Further requests wait for up to
+	// MaxQueueWait, and are then rejected with 429 and a Retry-After
+	// header.
+	MaxRunningSearches int
+
+	// MaxRunningSearchesPerClient if positive is the maximum number of
+	// search requests served concurrently for a single client (see
+	// protocol.ClientHeader), so that one client's expensive searches
+	// can't starve the others. Further requests of the client are queued
+	// and rejected like those beyond MaxRunningSearches.
+	MaxRunningSearchesPerClient int
+
+	// MaxRunningBatchSearches if positive is the maximum number of
+	// protocol.PriorityBatch search requests served concurrently. They
+	// are queued and rejected like those beyond MaxRunningSearches.
+	// Whatever the limits, batch requests wait while interactive ones are
+	// queued.
+	MaxRunningBatchSearches int
+
+	// MaxQueueWait is how long a request waits for a running one to
+	// finish when MaxRunningSearches or MaxRunningSearchesPerClient is
+	// reached. If zero, it is rejected immediately.
+	MaxQueueWait time.Duration
+
+	// MaxQueuedSearches if positive is the maximum number of requests
+	// waiting at once. Further requests are rejected immediately.
+	MaxQueuedSearches int
+
+	// WorkersPerRequest is the number of files a search request searches
+	// concurrently. If zero, it is GOMAXPROCS.
+	WorkersPerRequest int
+
+	// MaxWorkers is the number of files searched concurrently by all
+	// requests together. If zero, it is GOMAXPROCS.
+	MaxWorkers int
+
+	workersOnce sync.Once
+	workers     *workerPool
+
+	// MaxHeapBytes if positive rejects search requests with 429 and a
+	// Retry-After header while the heap is larger than it.
+	MaxHeapBytes uint64
+
+	// load tracks running searches to apply MaxRunningSearches,
+	// MaxRunningSearchesPerClient, MaxQueuedSearches and MaxHeapBytes.
+	load load
+
+	// draining is non-zero once Drain was called. It is accessed
+	// atomically.
+	draining int32
+
+	// AdminToken if non-empty enables the /admin endpoints for requests
+	// which send it in an "Authorization: Bearer" header.
+	AdminToken string
+
+	// AuthToken if non-empty is the shared secret requests must send in
+	// protocol.AuthHeader, so that only trusted clients (eg frontend and
+	// other searcher replicas) can search.
+	AuthToken string
+
+	// RequireClientCert is whether requests must be made over TLS with a
+	// client certificate. The certificate is verified by the server's TLS
+	// configuration, which should only request one (see
+	// tls.VerifyClientCertIfGiven) so that health checks can be made
+	// without.
+	RequireClientCert bool
+
+	// Authorize if non-nil is asked whether the client may read each
+	// repository a request names, so that a compromised client can't read
+	// private repositories by guessing their names. Requests it denies are
+	// rejected with 403 (PermissionDenied over gRPC).
+	Authorize Authorizer
+
+	// PeerToken if non-empty is the secret other searcher replicas send in
+	// protocol.PeerAuthHeader to read this replica's cache (see Peers)
+	// without being authorized per repository. Unlike AuthToken, frontends
+	// must not be given it.
+	PeerToken string
+
+	// refinements remembers the results of recent requests for requests
+	// refining them.
+	refinements refinements
+
+	// languages remembers the languages of the files of recently searched
+	// archives.
+	languages archiveLanguages
+
+	// middlewares are the Middleware registered with Use.
+	middlewares middlewares
+
+	// shadowSem limits the number of concurrent shadow requests. It is
+	// initialized by muxOnce.
+	shadowSem chan struct{}
 }
 
 var decoder = schema.NewDecoder()
@@ -61,57 +254,166 @@ func init() {
 	decoder.IgnoreUnknownKeys(true)
 }
 
-// ServeHTTP handles HTTP based search requests
+// ServeHTTP handles HTTP based search requests. Requests to any path without
+// a more specific handler are searches of a repository at a commit.
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.muxOnce.Do(func() {
+		s.mux = http.NewServeMux()
+		s.shadowSem = make(chan struct{}, maxShadowRequests)
+		s.mux.HandleFunc("/", s.serveSearch)
+		s.mux.HandleFunc("/archive", s.serveArchiveSearch)
+		s.mux.HandleFunc("/revisions", s.serveRevisions)
+		s.mux.HandleFunc("/symbols", s.serveSymbols)
+		s.mux.HandleFunc("/batch", s.serveBatch)
+		s.mux.HandleFunc("/file", s.serveFile)
+		s.mux.HandleFunc("/files", s.serveListFiles)
+		s.mux.HandleFunc("/lookup-hash", s.serveLookupHash)
+		s.mux.HandleFunc("/cached", s.serveCached)
+		s.mux.HandleFunc("/peer/archive", s.servePeerArchive)
+		s.mux.HandleFunc("/healthz", s.serveHealth)
+		s.mux.HandleFunc("/readyz", s.serveReady)
+
+		pf := newPrefetcher(s)
+		s.mux.HandleFunc("/prefetch", pf.servePrefetch)
+		s.mux.HandleFunc("/prefetch/jobs", pf.serveJobs)
+		s.mux.HandleFunc("/prefetch/jobs/", pf.serveJobs)
+		s.mux.HandleFunc("/admin/limits", s.requireAdmin(s.serveLimits))
+		s.mux.HandleFunc("/admin/cache", s.requireAdmin(s.serveCache))
+	})
+
+	if !s.authenticate(r) {
+		unauthenticatedTotal.WithLabelValues("http").Inc()
+		http.Error(w, "unauthenticated", http.StatusUnauthorized)
+		return
+	}
+	if !s.authorizeHTTP(w, r) {
+		return
+	}
+
+	r, ok := negotiateVersion(w, r)
+	if !ok {
+		return
+	}
+
+	// Tell clients and proxies which key requests about this repo are
+	// routed by, so they can send future requests to the same replica.
+	q := r.URL.Query()
+	repo := q.Get("Repo")
+	if repo == "" {
+		repo = q.Get("repo")
+	}
+	if repo != "" {
+		w.Header().Set(protocol.RoutingKeyHeader, protocol.RoutingKey(api.RepoName(repo)))
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// serveSearch searches a repository at a commit.
+func (s *Service) serveSearch(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	running.Inc()
-	defer running.Dec()
+	done, retryAfter, ok := s.admit(ctx, requestClient(r), requestPriority(r))
+	if !ok {
+		writeOverloaded(w, retryAfter)
+		return
+	}
+	defer done()
 
-	err := r.ParseForm()
+	p, ctx, cancel, err := s.decodeRequest(ctx, r)
 	if err != nil {
-		http.Error(w, "failed to parse form: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+	if err = validateParams(p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	s.shadow(r.Form)
+
+	s.writeSearchResponse(ctx, w, p, nil, newStreamWriter(w, r))
+}
+
+// decodeRequest decodes the search request in the form of r. The returned
+// context has the request's deadline (bounded by DefaultTimeout and
+// MaxTimeout) applied and must be cancelled once the request has been
+// served.
+func (s *Service) decodeRequest(ctx context.Context, r *http.Request) (*protocol.Request, context.Context, context.CancelFunc, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to parse form")
+	}
 
 	var p protocol.Request
 	err = decoder.Decode(&p, r.Form)
 	if err != nil {
-		http.Error(w, "failed to decode form: "+err.Error(), http.StatusBadRequest)
-		return
+		return nil, nil, nil, errors.Wrap(err, "failed to decode form")
 	}
+	var deadline time.Time
 	if p.Deadline != "" {
-		var deadline time.Time
 		if err := deadline.UnmarshalText([]byte(p.Deadline)); err != nil {
-			http.Error(w, "invalid deadline: "+err.Error(), http.StatusBadRequest)
-			return
+			return nil, nil, nil, errors.Wrap(err, "invalid deadline")
 		}
-		dctx, cancel := context.WithDeadline(ctx, deadline)
-		defer cancel()
-		ctx = dctx
+	}
+	ctx, cancel := s.withDeadline(ctx, deadline)
+	if p.PatternType == "" && protocolVersion(ctx) >= 2 {
+		cancel()
+		return nil, nil, nil, errors.New("PatternType is required since protocol version 2")
 	}
 	if !p.PatternMatchesContent && !p.PatternMatchesPath {
 		// BACKCOMPAT: Old frontends send neither of these fields, but we still want to
 		// search file content in that case.
 		p.PatternMatchesContent = true
 	}
-	if err = validateParams(&p); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := p.PatternInfo.Normalize(); err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+	return &p, ctx, cancel, nil
+}
+
+// withDeadline returns ctx with deadline applied, bounded by DefaultTimeout
+// if it is zero and by MaxTimeout. The returned context must be cancelled
+// once the request has been served.
+func (s *Service) withDeadline(ctx context.Context, deadline time.Time) (context.Context, context.CancelFunc) {
+	s.limitsMu.RLock()
+	defaultTimeout, maxTimeout := s.DefaultTimeout, s.MaxTimeout
+	s.limitsMu.RUnlock()
+	if deadline.IsZero() && defaultTimeout > 0 {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	if maxTimeout > 0 {
+		if maxDeadline := time.Now().Add(maxTimeout); deadline.IsZero() || deadline.After(maxDeadline) {
+			deadline = maxDeadline
+		}
+	}
+	if deadline.IsZero() {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// writeSearchResponse runs the search p and writes the response to w. If zf
+// is nil, the archive for p.Repo@p.Commit is searched. Otherwise zf is
+// searched (and closed). If stream is non-nil, the response is streamed
+// with it.
+func (s *Service) writeSearchResponse(ctx context.Context, w http.ResponseWriter, p *protocol.Request, zf *store.ZipFile, stream *streamWriter) {
+	if stream != nil {
+		if err := s.streamSearch(ctx, p, zf, stream); err != nil {
+			writeSearchError(ctx, w, p, err)
+		}
 		return
 	}
 
-	matches, limitHit, deadlineHit, err := s.search(ctx, &p)
+	start := time.Now()
+	u := &usage{}
+	ctx = withUsage(ctx, u)
+	matches, limitHit, deadlineHit, err := s.labelledSearch(ctx, p, zf)
 	if err != nil {
-		code := http.StatusInternalServerError
-		if isBadRequest(err) || ctx.Err() == context.Canceled {
-			code = http.StatusBadRequest
-		} else if isTemporary(err) {
-			code = http.StatusServiceUnavailable
-		} else {
-			log.Printf("internal error serving %#+v: %s", p, err)
-		}
-		http.Error(w, err.Error(), code)
+		writeSearchError(ctx, w, p, err)
 		return
 	}
+	serializeStart := time.Now()
+	span, _ := opentracing.StartSpanFromContext(ctx, "Serialize")
 	if matches == nil {
 		// Return an empty list
 		matches = make([]protocol.FileMatch, 0)
@@ -119,18 +421,113 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	resp := protocol.Response{
-		Matches:     matches,
-		LimitHit:    limitHit,
-		DeadlineHit: deadlineHit,
+		Matches:         matches,
+		LimitHit:        limitHit,
+		LimitHitReason:  u.limitReason(limitHit),
+		DeadlineHit:     deadlineHit,
+		MatchCount:      matchCount(matches),
+		Stats:           u.stats(),
+		RefinementToken: s.refinementToken(p, zf, matches, limitHit || deadlineHit),
+		Cursor:          u.cursor(p.Commit),
 	}
 	// The only reasonable error is the client going away now since we know we
 	// can encode resp. This happens relatively often due to our
 	// graphqlbackend regularly cancelling in-flight requests. We can't send
 	// an error response, so we just ignore.
 	_ = json.NewEncoder(w).Encode(&resp)
+	span.Finish()
+	u.addPhase("serialize", time.Since(serializeStart))
+	s.logSlowRequest(p, u, len(matches), time.Since(start))
+}
+
+// streamSearch runs the search p like writeSearchResponse, but sends its
+// results to stream. Errors which occur before anything was sent are
+// returned, later ones are sent in the done event.
+func (s *Service) streamSearch(ctx context.Context, p *protocol.Request, zf *store.ZipFile, stream searchStream) error {
+	start := time.Now()
+	u := &usage{}
+	ctx = withUsage(ctx, u)
+	// Middleware may drop matches, so they can only be sent once it ran.
+	if !s.middlewares.hasPostFilter() {
+		ctx = withMatchSink(ctx, stream.match)
+	}
+	matches, limitHit, deadlineHit, err := s.labelledSearch(ctx, p, zf)
+	if err != nil {
+		if !stream.hasStarted() {
+			return err
+		}
+		stream.done(protocol.StreamDone{Error: err.Error(), Stats: u.stats()})
+		return nil
+	}
+
+	// Matches found by regexSearch have already been sent.
+	serializeStart := time.Now()
+	span, _ := opentracing.StartSpanFromContext(ctx, "Serialize")
+	for i := stream.matchesSent(); i < len(matches); i++ {
+		stream.match(matches[i])
+	}
+	stream.done(protocol.StreamDone{
+		LimitHit:        limitHit,
+		LimitHitReason:  u.limitReason(limitHit),
+		DeadlineHit:     deadlineHit,
+		MatchCount:      matchCount(matches),
+		Stats:           u.stats(),
+		RefinementToken: s.refinementToken(p, zf, matches, limitHit || deadlineHit),
+		Cursor:          u.cursor(p.Commit),
+	})
+	span.Finish()
+	u.addPhase("serialize", time.Since(serializeStart))
+	s.logSlowRequest(p, u, len(matches), time.Since(start))
+	return nil
+}
+
+// matchCount returns the total MatchCount of matches, which is only set for
+// CountOnly requests.
+func matchCount(matches []protocol.FileMatch) int {
+	n := 0
+	for _, fm := range matches {
+		n += fm.MatchCount
+	}
+	return n
 }
 
-func (s *Service) search(ctx context.Context, p *protocol.Request) (matches []protocol.FileMatch, limitHit, deadlineHit bool, err error) {
+// labelledSearch is searchWithMiddleware with the search labelled, so that
+// CPU profiles can be broken down by repository and query type.
+func (s *Service) labelledSearch(ctx context.Context, p *protocol.Request, zf *store.ZipFile) (matches []protocol.FileMatch, limitHit, deadlineHit bool, err error) {
+	pprof.Do(ctx, pprof.Labels("repo", string(p.Repo), "query_type", queryType(p)), func(ctx context.Context) {
+		matches, limitHit, deadlineHit, err = s.searchWithMiddleware(ctx, p, zf)
+	})
+	return matches, limitHit, deadlineHit, err
+}
+
+// refinementToken remembers matches for requests refining p, and returns
+// the token for them. Only the complete results of archives we fetched
+// ourselves can be reused.
+func (s *Service) refinementToken(p *protocol.Request, zf *store.ZipFile, matches []protocol.FileMatch, incomplete bool) string {
+	if zf != nil || incomplete {
+		return ""
+	}
+	return s.refinements.add(p, matches)
+}
+
+// writeSearchError writes the error err of the search p to w.
+func writeSearchError(ctx context.Context, w http.ResponseWriter, p *protocol.Request, err error) {
+	code := http.StatusInternalServerError
+	if isBadRequest(err) || ctx.Err() == context.Canceled {
+		code = http.StatusBadRequest
+	} else if isNotCached(err) {
+		code = http.StatusNotFound
+	} else if isTemporary(err) {
+		code = http.StatusServiceUnavailable
+	} else {
+		log.Printf("internal error serving %#+v: %s", p, err)
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// search runs the search p. If zf is nil, the archive for p.Repo@p.Commit is
+// searched. Otherwise zf is searched (and closed).
+func (s *Service) search(ctx context.Context, p *protocol.Request, zf *store.ZipFile) (matches []protocol.FileMatch, limitHit, deadlineHit bool, err error) {
 	tr := trace.New("search", fmt.Sprintf("%s@%s", p.Repo, p.Commit))
 	tr.LazyPrintf("%s", p.Pattern)
 
@@ -140,6 +537,7 @@ func (s *Service) search(ctx context.Context, p *protocol.Request) (matches []pr
 	span.SetTag("url", p.URL)
 	span.SetTag("commit", p.Commit)
 	span.SetTag("pattern", p.Pattern)
+	span.SetTag("patternType", string(p.PatternType))
 	span.SetTag("isRegExp", strconv.FormatBool(p.IsRegExp))
 	span.SetTag("isStructuralPat", strconv.FormatBool(p.IsStructuralPat))
 	span.SetTag("languages", p.Languages)
@@ -148,9 +546,25 @@ func (s *Service) search(ctx context.Context, p *protocol.Request) (matches []pr
 	span.SetTag("pathPatternsAreRegExps", strconv.FormatBool(p.PathPatternsAreRegExps))
 	span.SetTag("pathPatternsAreCaseSensitive", strconv.FormatBool(p.PathPatternsAreCaseSensitive))
 	span.SetTag("fileMatchLimit", p.FileMatchLimit)
+	span.SetTag("maxLineMatchesPerFile", p.MaxLineMatchesPerFile)
+	span.SetTag("maxMatches", p.MaxMatches)
+	span.SetTag("maxBytesScanned", p.MaxBytesScanned)
 	span.SetTag("patternMatchesContent", p.PatternMatchesContent)
 	span.SetTag("patternMatchesPath", p.PatternMatchesPath)
+	span.SetTag("testFiles", string(p.TestFiles))
+	span.SetTag("generatedFiles", string(p.GeneratedFiles))
+	span.SetTag("vendoredFiles", string(p.VendoredFiles))
+	span.SetTag("scope", string(p.Scope))
+	span.SetTag("ownedBy", p.OwnedBy)
+	span.SetTag("notOwnedBy", p.NotOwnedBy)
 	span.SetTag("deadline", p.Deadline)
+	span.SetTag("changedSinceCommit", p.ChangedSinceCommit)
+	span.SetTag("changedInLastCommits", p.ChangedInLastCommits)
+	span.SetTag("includeBlame", p.IncludeBlame)
+	span.SetTag("resolveLFS", p.ResolveLFS)
+	span.SetTag("wantContent", p.WantContent)
+	usage := usageFromContext(ctx)
+	usage.setTraceID(sgtrace.SpanTraceID(span))
 	defer func(start time.Time) {
 		code := "200"
 		// We often have canceled and timed out requests. We do not want to
@@ -158,7 +572,7 @@ func (s *Service) search(ctx context.Context, p *protocol.Request) (matches []pr
 		if ctx.Err() == context.Canceled {
 			code = "canceled"
 			span.SetTag("err", err)
-		} else if ctx.Err() == context.DeadlineExceeded {
+		} else if ctx.Err() == context.DeadlineExceeded || (deadlineHit && err == nil) {
 			code = "timedout"
 			span.SetTag("err", err)
 			deadlineHit = true
@@ -170,6 +584,8 @@ func (s *Service) search(ctx context.Context, p *protocol.Request) (matches []pr
 			span.SetTag("err", err.Error())
 			if isBadRequest(err) {
 				code = "400"
+			} else if isNotCached(err) {
+				code = "404"
 			} else if isTemporary(err) {
 				code = "503"
 			} else {
@@ -179,44 +595,107 @@ func (s *Service) search(ctx context.Context, p *protocol.Request) (matches []pr
 		tr.LazyPrintf("code=%s matches=%d limitHit=%v deadlineHit=%v", code, len(matches), limitHit, deadlineHit)
 		tr.Finish()
 		requestTotal.WithLabelValues(code).Inc()
+		metrics.ObserveWithTrace(ctx, requestDuration.WithLabelValues(code), time.Since(start).Seconds())
 		span.LogFields(otlog.Int("matches.len", len(matches)))
 		span.SetTag("limitHit", limitHit)
 		span.SetTag("deadlineHit", deadlineHit)
 		span.Finish()
-		if s.Log != nil {
-			s.Log.Debug("search request", "repo", p.Repo, "commit", p.Commit, "pattern", p.Pattern, "isRegExp", p.IsRegExp, "isStructuralPat", p.IsStructuralPat, "languages", p.Languages, "isWordMatch", p.IsWordMatch, "isCaseSensitive", p.IsCaseSensitive, "patternMatchesContent", p.PatternMatchesContent, "patternMatchesPath", p.PatternMatchesPath, "matches", len(matches), "code", code, "duration", time.Since(start), "err", err)
-		}
+		s.logRequest(ctx, p, code, len(matches), limitHit, deadlineHit, time.Since(start), err)
 	}(time.Now())
 
-	rg, err := compile(&p.PatternInfo)
+	rg, engine, err := s.compilePattern(p)
 	if err != nil {
-		return nil, false, false, badRequestError{err.Error()}
+		return nil, false, false, err
+	}
+	if p.Pattern != "" && !p.IsStructuralPat {
+		tr.LazyPrintf("engine=%s", engine)
+		span.SetTag("regexpEngine", engine)
+		regexpEngineTotal.WithLabelValues(engine).Inc()
 	}
 
-	if p.FetchTimeout == "" {
-		p.FetchTimeout = "500ms"
+	if len(p.Files) > 0 {
+		rg.matchPath, rg.lineRanges, err = filesMatcher(p.Files, rg.matchPath)
+		if err != nil {
+			return nil, false, false, err
+		}
 	}
-	fetchTimeout, err := time.ParseDuration(p.FetchTimeout)
-	if err != nil {
-		return nil, false, false, err
+
+	if p.PathSpec != "" {
+		rg.matchPath = &subtreeMatcher{PathMatcher: rg.matchPath, dir: p.PathSpec}
 	}
-	prepareCtx, cancel := context.WithTimeout(ctx, fetchTimeout)
-	defer cancel()
 
-	getZf := func() (string, *store.ZipFile, error) {
-		path, err := s.Store.PrepareZip(prepareCtx, p.GitserverRepo(), p.Commit)
+	var changed []string
+	base := changedFilesBase(p)
+	if base != "" {
+		rg.matchPath, changed, err = s.changedFilesMatcher(ctx, p, base, rg.matchPath)
 		if err != nil {
-			return "", nil, err
+			return nil, false, false, err
 		}
-		zf, err := s.Store.ZipCache.Get(path)
-		return path, zf, err
 	}
 
-	zipPath, zf, err := store.GetZipFileWithRetry(getZf)
-	if err != nil {
-		return nil, false, false, errors.Wrap(err, "failed to get archive")
+	if zf == nil {
+		if m := s.refinements.matcher(p, rg.matchPath); m != nil {
+			rg.matchPath = m
+		}
+	}
+
+	archiveStart := time.Now()
+	var zipPath string
+	partial := false
+	if zf == nil && base != "" {
+		zipPath, zf, err = s.getChangedZipFile(ctx, p, changed)
+		if err != nil {
+			return nil, false, false, err
+		}
+		partial = zf != nil
+	}
+	if zf == nil && p.PathSpec != "" {
+		zipPath, zf, err = s.getSubtreeZipFile(ctx, p)
+		if err != nil {
+			return nil, false, false, err
+		}
+		partial = zf != nil
+	}
+	if zf == nil && len(p.IncludePatterns) > 0 {
+		zipPath, zf, err = s.getSparseZipFile(ctx, p)
+		if err != nil {
+			return nil, false, false, err
+		}
+		partial = zf != nil
+	}
+	if zf == nil {
+		zipPath, zf, err = s.getZipFile(ctx, p)
+		if err != nil {
+			return nil, false, false, err
+		}
 	}
 	defer zf.Close()
+	phaseDuration.WithLabelValues("archive").Observe(time.Since(archiveStart).Seconds())
+
+	if p.OwnedBy != "" || p.NotOwnedBy != "" {
+		rg.matchPath = ownersMatcher(zf, p, rg.matchPath)
+	}
+	if p.GeneratedFiles != protocol.TestFilesIncluded || p.VendoredFiles != protocol.TestFilesIncluded {
+		rg.matchPath = attributesMatcher(zf, p, rg.matchPath)
+	}
+
+	if !p.IsStructuralPat {
+		m, err := s.languageMatcher(p, zf, zipPath != "" && !partial, rg.matchPath)
+		if err != nil {
+			return nil, false, false, err
+		}
+		if m != nil {
+			rg.matchPath = m
+		}
+	}
+
+	// Only archives we fetched ourselves are indexed. LFS pointers don't
+	// contain the content which is searched.
+	if zipPath != "" && !p.IsStructuralPat && !p.ResolveLFS {
+		if m := s.trigramMatcher(zipPath, zf, p, rg); m != nil {
+			rg.matchPath = m
+		}
+	}
 
 	nFiles := uint64(len(zf.Files))
 	bytes := int64(len(zf.Data))
@@ -227,12 +706,151 @@ func (s *Service) search(ctx context.Context, p *protocol.Request) (matches []pr
 	archiveFiles.Observe(float64(nFiles))
 	archiveSize.Observe(float64(bytes))
 
+	if p.WantContent || rg.rank != nil || p.IncludeReplacements || p.IncludeDiffs || p.IncludeRanges || p.IncludeEnclosingScope || p.IncludeBlame || p.ContextBefore > 0 || p.ContextAfter > 0 {
+		// The matches are only complete once the fields below are attached,
+		// so they can't be streamed as they are found.
+		ctx = withMatchSink(ctx, nil)
+	}
+	ctx = withWorkerPool(ctx, s.workerPool())
+	matchStart := time.Now()
 	if p.IsStructuralPat {
-		matches, limitHit, err = structuralSearch(ctx, zipPath, p.Pattern, p.CombyRule, p.Languages, p.IncludePatterns, p.Repo)
+		var cleanup func()
+		zipPath, cleanup, err = combyZipPath(zipPath, zf)
+		if err != nil {
+			return nil, false, false, err
+		}
+		defer cleanup()
+		matches, limitHit, err = structuralSearch(ctx, zipPath, p.Pattern, p.CombyRule, p.Languages, p.IncludePatterns, p.Repo, s.StructuralFileTimeout)
+	} else if p.ResolveLFS {
+		matches, limitHit, err = s.regexSearchLFS(ctx, p, rg, zf)
+	} else {
+		matches, limitHit, err = regexSearch(ctx, rg, zf, newSearchLimits(&p.PatternInfo), p.PatternMatchesContent, p.PatternMatchesPath)
+	}
+	if err == context.DeadlineExceeded {
+		// regexSearch stops shortly before the deadline of ctx, so there is
+		// still time to return the matches of the files searched so far.
+		deadlineHit, err = true, nil
+	}
+	phaseDuration.WithLabelValues("match").Observe(time.Since(matchStart).Seconds())
+	usage.addPhase("match", time.Since(matchStart))
+
+	attachStart := time.Now()
+	if err == nil && p.IncludeReplacements {
+		err = attachReplacements(zf, rg, p.Replacement, matches)
+	}
+	if err == nil && p.IncludeDiffs {
+		err = attachDiffs(zf, rg, p.Replacement, matches)
+	}
+	if err == nil && p.WantContent {
+		attachContent(zf, matches)
+	}
+	if err == nil {
+		attachContextLines(zf, p.ContextBefore, p.ContextAfter, matches)
+	}
+	if err == nil && p.IncludeRanges {
+		attachRanges(zf, matches)
+	}
+	if err == nil && p.IncludeEnclosingScope {
+		err = s.attachEnclosingScopes(ctx, zf, matches)
+	}
+	if err == nil && p.IncludeBlame {
+		err = s.attachBlame(ctx, p, matches)
+	}
+	phaseDuration.WithLabelValues("attach").Observe(time.Since(attachStart).Seconds())
+	usage.addPhase("attach", time.Since(attachStart))
+	return matches, limitHit, deadlineHit, err
+}
+
+// compilePattern compiles the pattern of p. engine is the regular expression
+// engine which is used to match it.
+func (s *Service) compilePattern(p *protocol.Request) (rg *readerGrep, engine string, err error) {
+	s.limitsMu.RLock()
+	fallbackTimeout := s.FallbackRegexpTimeout
+	s.limitsMu.RUnlock()
+	engine = "re2"
+	if p.Query != "" {
+		rg, err = compileQueryRequest(&p.PatternInfo, p.Query)
 	} else {
-		matches, limitHit, err = regexSearch(ctx, rg, zf, p.FileMatchLimit, p.PatternMatchesContent, p.PatternMatchesPath)
+		rg, err = compile(&p.PatternInfo)
+		if err != nil && p.IsRegExp && fallbackTimeout > 0 && isUnsupportedRegexp(err) {
+			engine = "fallback"
+			rg, err = compileFallback(&p.PatternInfo, fallbackTimeout)
+		}
+	}
+	if err == nil {
+		rg.rank, err = compileRanker(&p.PatternInfo)
+	}
+	if err == nil {
+		rg.page, err = compilePage(p)
+	}
+	if err != nil {
+		if !isBadRequest(err) {
+			err = badRequestError{err.Error()}
+		}
+		return nil, "", err
+	}
+	return rg, engine, nil
+}
+
+// getZipFile returns the archive for p.Repo@p.Commit, fetching it if it is
+// not already cached. The returned ZipFile must be closed.
+func (s *Service) getZipFile(ctx context.Context, p *protocol.Request) (string, *store.ZipFile, error) {
+	if s.NoFetch || p.NoFetch {
+		path, zf, err := s.getCachedZipFileWithPath(p.GitserverRepo(), p.Commit)
+		if os.IsNotExist(err) {
+			return "", nil, notCachedError{repo: p.Repo, commit: p.Commit}
+		}
+		return path, zf, err
+	}
+
+	return s.getZipFileWith(ctx, p, func(ctx context.Context) (string, error) {
+		return s.Store.PrepareZip(ctx, p.GitserverRepo(), p.Commit)
+	})
+}
+
+// getZipFileWith returns the archive prepare returns the path of, waiting
+// at most p.FetchTimeout for it to be fetched. The returned ZipFile must be
+// closed.
+func (s *Service) getZipFileWith(ctx context.Context, p *protocol.Request, prepare func(context.Context) (string, error)) (string, *store.ZipFile, error) {
+	if p.FetchTimeout == "" {
+		p.FetchTimeout = "500ms"
+	}
+	fetchTimeout, err := time.ParseDuration(p.FetchTimeout)
+	if err != nil {
+		return "", nil, err
+	}
+	prepareCtx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	u := usageFromContext(ctx)
+	getZf := func() (string, *store.ZipFile, error) {
+		fetchStart := time.Now()
+		path, err := prepare(prepareCtx)
+		u.addPhase("fetch", time.Since(fetchStart))
+		if err != nil {
+			return "", nil, err
+		}
+		extractStart := time.Now()
+		span, _ := opentracing.StartSpanFromContext(ctx, "ZipCache.Get")
+		zf, err := s.Store.ZipCache.Get(path)
+		span.Finish()
+		u.addPhase("extract", time.Since(extractStart))
+		return path, zf, err
+	}
+
+	zipPath, zf, err := store.GetZipFileWithRetry(getZf)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to get archive")
+	}
+	return zipPath, zf, nil
+}
+
+// queryType returns the kind of search p is, eg "regexp" or "structural".
+func queryType(p *protocol.Request) string {
+	if p.Query != "" {
+		return "query"
 	}
-	return matches, limitHit, false, err
+	return string(p.PatternType)
 }
 
 func validateParams(p *protocol.Request) error {
@@ -243,9 +861,114 @@ func validateParams(p *protocol.Request) error {
 	if len(p.Commit) != 40 {
 		return errors.Errorf("Commit must be resolved (Commit=%q)", p.Commit)
 	}
-	if p.Pattern == "" && p.ExcludePattern == "" && len(p.IncludePatterns) == 0 {
+	return validatePattern(p)
+}
+
+// validatePattern validates the fields of p which describe what to search
+// for, rather than where to search.
+func validatePattern(p *protocol.Request) error {
+	if p.Pattern == "" && p.Query == "" && p.ExcludePattern == "" && len(p.IncludePatterns) == 0 && p.TestFiles == protocol.TestFilesIncluded && p.GeneratedFiles == protocol.TestFilesIncluded && p.VendoredFiles == protocol.TestFilesIncluded && p.OwnedBy == "" && p.NotOwnedBy == "" && len(p.Files) == 0 {
 		return errors.New("At least one of pattern and include/exclude pattners must be non-empty")
 	}
+	if p.Query != "" && (p.Pattern != "" || p.IsStructuralPat) {
+		return errors.New("Query may not be combined with Pattern or structural search")
+	}
+	if p.InvertMatch && (p.Pattern == "" || p.IsStructuralPat || p.Query != "" || p.PatternMatchesPath) {
+		return errors.New("InvertMatch requires a non-structural Pattern matched only against file content")
+	}
+	for name, filter := range map[string]protocol.TestFileFilter{"TestFiles": p.TestFiles, "GeneratedFiles": p.GeneratedFiles, "VendoredFiles": p.VendoredFiles} {
+		switch filter {
+		case protocol.TestFilesIncluded, protocol.TestFilesOnly, protocol.TestFilesExcluded:
+		default:
+			return errors.Errorf("%s must be one of %q or %q (%s=%q)", name, protocol.TestFilesOnly, protocol.TestFilesExcluded, name, filter)
+		}
+	}
+	switch p.Scope {
+	case protocol.ScopeAll, protocol.ScopeComments, protocol.ScopeStrings, protocol.ScopeCode:
+	default:
+		return errors.Errorf("Scope must be one of %q, %q or %q (Scope=%q)", protocol.ScopeComments, protocol.ScopeStrings, protocol.ScopeCode, p.Scope)
+	}
+	if p.TestFiles != protocol.TestFilesIncluded && p.IsStructuralPat {
+		return errors.New("TestFiles is not supported for structural search")
+	}
+	if p.Scope != protocol.ScopeAll && p.IsStructuralPat {
+		return errors.New("Scope is not supported for structural search")
+	}
+	if changedFilesBase(p) != "" && p.IsStructuralPat {
+		return errors.New("ChangedSinceCommit and ChangedInLastCommits are not supported for structural search")
+	}
+	if len(p.Files) > 0 && (p.IsStructuralPat || p.Query != "") {
+		return errors.New("Files is not supported for structural search or Query")
+	}
+	for _, f := range p.Files {
+		if _, err := protocol.ParseFileRange(f); err != nil {
+			return err
+		}
+	}
+	if (p.OwnedBy != "" || p.NotOwnedBy != "") && p.IsStructuralPat {
+		return errors.New("OwnedBy and NotOwnedBy are not supported for structural search")
+	}
+	if (p.GeneratedFiles != protocol.TestFilesIncluded || p.VendoredFiles != protocol.TestFilesIncluded) && p.IsStructuralPat {
+		return errors.New("GeneratedFiles and VendoredFiles are not supported for structural search")
+	}
+	switch p.Priority {
+	case "", protocol.PriorityInteractive, protocol.PriorityBatch:
+	default:
+		return errors.Errorf("Priority must be %q or %q (Priority=%q)", protocol.PriorityInteractive, protocol.PriorityBatch, p.Priority)
+	}
+	switch p.RankBy {
+	case protocol.RankDefault, protocol.RankPath, protocol.RankMatches, protocol.RankRecency:
+	default:
+		return errors.Errorf("RankBy must be one of %q, %q or %q (RankBy=%q)", protocol.RankPath, protocol.RankMatches, protocol.RankRecency, p.RankBy)
+	}
+	if (p.RankBy != protocol.RankDefault || len(p.PriorityPatterns) > 0) && p.IsStructuralPat {
+		return errors.New("RankBy and PriorityPatterns are not supported for structural search")
+	}
+	if (p.Paginate || p.Cursor != "") && (p.IsStructuralPat || p.ResolveLFS || p.RankBy == protocol.RankMatches) {
+		return errors.Errorf("Paginate and Cursor are not supported for structural search or with ResolveLFS or RankBy %q", protocol.RankMatches)
+	}
+	if p.CountOnly && (p.IsStructuralPat || p.Query != "" || p.InvertMatch || p.Multiline || p.ContextBefore > 0 || p.ContextAfter > 0 || p.IncludeReplacements || p.IncludeDiffs || p.IncludeRanges || p.IncludeBlame || p.IncludeEnclosingScope) {
+		return errors.New("CountOnly is not supported for structural search or with Query, InvertMatch, Multiline, ContextBefore, ContextAfter, IncludeReplacements, IncludeDiffs, IncludeRanges, IncludeBlame or IncludeEnclosingScope")
+	}
+	if p.Multiline && (p.IsStructuralPat || p.Query != "") {
+		return errors.New("Multiline is not supported for structural search or Query")
+	}
+	if p.IsStructuralPat && len(p.ExcludeLanguages) > 0 {
+		return errors.New("ExcludeLanguages is not supported for structural search")
+	}
+	if !p.IsStructuralPat {
+		if _, err := languageNames(p.Languages); err != nil {
+			return err
+		}
+		if _, err := languageNames(p.ExcludeLanguages); err != nil {
+			return err
+		}
+	}
+	if err := validatePathSpec(p.PathSpec); err != nil {
+		return err
+	}
+	if err := validateLimits(p); err != nil {
+		return err
+	}
+	if p.ChangedInLastCommits < 0 {
+		return errors.Errorf("ChangedInLastCommits must be non-negative (ChangedInLastCommits=%d)", p.ChangedInLastCommits)
+	}
+	if p.ResolveLFS && p.IsStructuralPat {
+		return errors.New("ResolveLFS is not supported for structural search")
+	}
+	if p.ContextBefore < 0 || p.ContextBefore > protocol.MaxContextLines || p.ContextAfter < 0 || p.ContextAfter > protocol.MaxContextLines {
+		return errors.Errorf("ContextBefore and ContextAfter must be between 0 and %d (ContextBefore=%d, ContextAfter=%d)", protocol.MaxContextLines, p.ContextBefore, p.ContextAfter)
+	}
+	if (p.ContextBefore > 0 || p.ContextAfter > 0) && p.ResolveLFS {
+		// The matches in LFS objects are not in the archive.
+		return errors.New("ContextBefore and ContextAfter are not supported with ResolveLFS")
+	}
+	if p.IncludeRanges && p.ResolveLFS {
+		return errors.New("IncludeRanges is not supported with ResolveLFS")
+	}
+	if (p.IncludeReplacements || p.IncludeDiffs) && (p.Pattern == "" || p.IsStructuralPat || p.Query != "" || p.InvertMatch || p.ResolveLFS) {
+		return errors.New("IncludeReplacements and IncludeDiffs require a non-structural Pattern and are not supported with Query, InvertMatch or ResolveLFS")
+	}
 	return nil
 }
 
@@ -258,6 +981,12 @@ var (
 		Name:      "running",
 		Help:      "Number of running search requests.",
 	})
+	queued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "searcher",
+		Subsystem: "service",
+		Name:      "queued",
+		Help:      "Number of search requests waiting to run.",
+	})
 	archiveSize = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Namespace: "searcher",
 		Subsystem: "service",
@@ -278,13 +1007,37 @@ var (
 		Name:      "request_total",
 		Help:      "Number of returned search requests.",
 	}, []string{"code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "searcher",
+		Subsystem: "service",
+		Name:      "request_duration_seconds",
+		Help:      "Time spent on search requests. Exemplars link to their traces.",
+		Buckets:   []float64{0.05, 0.1, 0.2, 0.5, 1, 2, 5, 10, 30, 60},
+	}, []string{"code"})
+	phaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "searcher",
+		Subsystem: "service",
+		Name:      "phase_duration_seconds",
+		Help:      "Time spent on each phase of search requests: archive (getting the archive, fetching it if needed), match (matching file paths and contents) and attach (adding content, context lines, blame etc to the matches).",
+		Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.2, 0.5, 1, 2, 5, 10, 30, 60},
+	}, []string{"phase"})
+	regexpEngineTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "service",
+		Name:      "regexp_engine_total",
+		Help:      "Number of searches served by each regular expression engine.",
+	}, []string{"engine"})
 )
 
 func init() {
 	prometheus.MustRegister(running)
+	prometheus.MustRegister(queued)
 	prometheus.MustRegister(archiveSize)
 	prometheus.MustRegister(archiveFiles)
 	prometheus.MustRegister(requestTotal)
+	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(phaseDuration)
+	prometheus.MustRegister(regexpEngineTotal)
 }
 
 type badRequestError struct{ msg string }
@@ -299,6 +1052,25 @@ func isBadRequest(err error) bool {
 	return ok && e.BadRequest()
 }
 
+// notCachedError is returned when a request may not fetch an archive (see
+// NoFetch) and it is not cached.
+type notCachedError struct {
+	repo   api.RepoName
+	commit api.CommitID
+}
+
+func (e notCachedError) Error() string {
+	return fmt.Sprintf("archive for %s@%s is not cached and fetching is disabled", e.repo, e.commit)
+}
+func (e notCachedError) NotCached() bool { return true }
+
+func isNotCached(err error) bool {
+	e, ok := errors.Cause(err).(interface {
+		NotCached() bool
+	})
+	return ok && e.NotCached()
+}
+
 func isTemporary(err error) bool {
 	e, ok := errors.Cause(err).(interface {
 		Temporary() bool
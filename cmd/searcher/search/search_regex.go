@@ -41,7 +41,7 @@ import (
 // TODO(keegan) return search statistics
 type readerGrep struct {
 	// re is the regexp to match, or nil if empty ("match all files' content").
-	re *regexp.Regexp
+	re regexpMatcher
 
 	// ignoreCase if true means we need to do case insensitive matching.
 	ignoreCase bool
@@ -49,11 +49,15 @@ type readerGrep struct {
 	// transformBuf is reused between file searches to avoid
 	// re-allocating. It is only used if we need to transform the input
 	// before matching. For example we lower case the input in the case of
-	// ignoreCase.
+	// ignoreCase. It is taken from transformBufs, and returned to it by
+	// releaseBuffers.
 	transformBuf []byte
 
 	// matchPath is compiled from the include/exclude path patterns and reports
-	// whether a file path matches (and should be searched).
+	// whether a file path matches (and should be searched). It is checked
+	// before a file's content is read. The patterns can't be applied when
+	// the archive is fetched instead, since the cached archive is shared by
+	// requests with different patterns.
 	matchPath pathmatch.PathMatcher
 
 	// literalSubstring is used to test if a file is worth considering for
@@ -61,28 +65,92 @@ type readerGrep struct {
 	// re. It is the output of the longestLiteral function. It is only set if
 	// the regex has an empty LiteralPrefix.
 	literalSubstring []byte
+
+	// scope if set restricts matches to comments, strings or code.
+	scope protocol.SyntaxScope
+
+	// query if non-nil is a structured query to evaluate instead of re.
+	query queryMatcher
+
+	// invert if true matches the files whose content does not match re.
+	invert bool
+
+	// firstMatchOnly if true stops searching a file after its first match.
+	firstMatchOnly bool
+
+	// searchBinary if true searches the content of binary files too.
+	searchBinary bool
+
+	// maxFileSize if positive skips the content of larger files.
+	maxFileSize int64
+
+	// multiline if true also returns each match in full as a
+	// MultilineMatch.
+	multiline bool
+
+	// countOnly if true only counts the matches in each file.
+	countOnly bool
+
+	// rank if non-nil is the order in which files are searched and
+	// returned.
+	rank *ranker
+
+	// page if non-nil is where a Paginate request starts.
+	page *cursor
+
+	// lineRanges if non-nil restricts matches in the files it has an entry
+	// for to start on the given lines.
+	lineRanges map[string][]protocol.LineRange
+
+	// maxLineMatches if positive lowers the number of LineMatches returned
+	// per file (see lineMatchLimit).
+	maxLineMatches int
+}
+
+// regexpMatcher is the subset of *regexp.Regexp used by readerGrep. It is
+// also implemented by fallbackRegexp for patterns RE2 can't compile.
+type regexpMatcher interface {
+	MatchString(s string) bool
+	FindAllIndex(b []byte, n int) [][]int
+	String() string
 }
 
 // compile returns a readerGrep for matching p.
 func compile(p *protocol.PatternInfo) (*readerGrep, error) {
 	var (
-		re               *regexp.Regexp
+		re               regexpMatcher
 		literalSubstring []byte
 	)
-	if p.Pattern != "" {
+	if p.Pattern != "" && !p.IsRegExp && !p.IsCaseSensitive {
+		// Case insensitive literals are the most common searches, so they
+		// get a matcher which doesn't need the content lowered.
+		if m := newFoldLiteral(p.Pattern); m != nil {
+			re = m
+		}
+	}
+	if p.Pattern != "" && re == nil {
 		expr := p.Pattern
 		if !p.IsRegExp {
 			expr = regexp.QuoteMeta(expr)
 		}
-		if p.IsWordMatch {
-			expr = `\b` + expr + `\b`
-		}
-		if p.IsRegExp {
+		if p.IsRegExp && p.Multiline {
+			// Multiline patterns may also match newlines with ".".
+			expr = "(?ms:" + expr + ")"
+		} else if p.IsRegExp {
 			// We don't do the search line by line, therefore we want the
 			// regex engine to consider newlines for anchors (^$).
 			expr = "(?m:" + expr + ")"
 		}
-		if !p.IsCaseSensitive {
+		if p.IsRegExp {
+			if err := checkRegexpCost(expr, p.Multiline); err != nil {
+				return nil, err
+			}
+		}
+		if !p.IsCaseSensitive && !p.IsRegExp && !foldsASCII(p.Pattern) {
+			// Lowering only folds ASCII case, so literals with other
+			// letters are matched by the slower (?i).
+			expr = "(?i:" + expr + ")"
+		} else if !p.IsCaseSensitive {
 			// We don't just use (?i) because regexp library doesn't seem
 			// to contain good optimizations for case insensitive
 			// search. Instead we lowercase the input and pattern.
@@ -94,15 +162,15 @@ func compile(p *protocol.PatternInfo) (*readerGrep, error) {
 			expr = re.String()
 		}
 
-		var err error
-		re, err = regexp.Compile(expr)
+		compiled, err := regexp.Compile(expr)
 		if err != nil {
 			return nil, err
 		}
+		re = compiled
 
 		// Only use literalSubstring optimization if the regex engine doesn't
 		// have a prefix to use.
-		if pre, _ := re.LiteralPrefix(); pre == "" {
+		if pre, _ := compiled.LiteralPrefix(); pre == "" {
 			ast, err := syntax.Parse(expr, syntax.Perl)
 			if err != nil {
 				return nil, err
@@ -111,12 +179,11 @@ func compile(p *protocol.PatternInfo) (*readerGrep, error) {
 			literalSubstring = []byte(longestLiteral(ast))
 		}
 	}
-
-	pathOptions := pathmatch.CompileOptions{
-		RegExp:        p.PathPatternsAreRegExps,
-		CaseSensitive: p.PathPatternsAreCaseSensitive,
+	if re != nil && p.IsWordMatch {
+		re = &wordMatcher{re: re}
 	}
-	matchPath, err := pathmatch.CompilePathPatterns(p.IncludePatterns, p.ExcludePattern, pathOptions)
+
+	matchPath, err := compilePathMatcher(p)
 	if err != nil {
 		return nil, err
 	}
@@ -126,18 +193,57 @@ func compile(p *protocol.PatternInfo) (*readerGrep, error) {
 		ignoreCase:       !p.IsCaseSensitive,
 		matchPath:        matchPath,
 		literalSubstring: literalSubstring,
+		scope:            p.Scope,
+		invert:           p.InvertMatch,
+		firstMatchOnly:   p.FirstMatchOnly,
+		searchBinary:     p.SearchBinary,
+		maxFileSize:      p.MaxFileSize,
+		multiline:        p.Multiline,
+		countOnly:        p.CountOnly,
+		maxLineMatches:   p.MaxLineMatchesPerFile,
 	}, nil
 }
 
+// compilePathMatcher returns the PathMatcher for the path filters of p.
+func compilePathMatcher(p *protocol.PatternInfo) (pathmatch.PathMatcher, error) {
+	pathOptions := pathmatch.CompileOptions{
+		RegExp:        p.PathPatternsAreRegExps,
+		CaseSensitive: p.PathPatternsAreCaseSensitive,
+	}
+	matchPath, err := pathmatch.CompilePathPatterns(p.IncludePatterns, p.ExcludePattern, pathOptions)
+	if err != nil {
+		return nil, err
+	}
+	if p.TestFiles != protocol.TestFilesIncluded {
+		matchPath = &testFileMatcher{PathMatcher: matchPath, filter: p.TestFiles}
+	}
+	return matchPath, nil
+}
+
 // Copy returns a copied version of rg that is safe to use from another
 // goroutine.
 func (rg *readerGrep) Copy() *readerGrep {
-	return &readerGrep{
+	c := &readerGrep{
 		re:               rg.re,
 		ignoreCase:       rg.ignoreCase,
 		matchPath:        rg.matchPath,
 		literalSubstring: rg.literalSubstring,
+		scope:            rg.scope,
+		invert:           rg.invert,
+		firstMatchOnly:   rg.firstMatchOnly,
+		searchBinary:     rg.searchBinary,
+		maxFileSize:      rg.maxFileSize,
+		multiline:        rg.multiline,
+		countOnly:        rg.countOnly,
+		rank:             rg.rank,
+		page:             rg.page,
+		lineRanges:       rg.lineRanges,
+		maxLineMatches:   rg.maxLineMatches,
 	}
+	if rg.query != nil {
+		c.query = rg.query.copy()
+	}
+	return c
 }
 
 // matchString returns whether rg's regexp pattern matches s. It is intended to be
@@ -152,23 +258,44 @@ func (rg *readerGrep) matchString(s string) bool {
 	return rg.re.MatchString(s)
 }
 
+// content returns the content of f to search, which is empty for files
+// which are too large and for binary files unless rg searches them.
+func (rg *readerGrep) content(zf *store.ZipFile, f *store.SrcFile) []byte {
+	if rg.tooLarge(zf, f) || zf.Binary[f.Name] && !rg.searchBinary {
+		return nil
+	}
+	return zf.DataFor(f)
+}
+
+// tooLarge reports whether the content of f is skipped because f is larger
+// than the limit of the store or of rg.
+func (rg *readerGrep) tooLarge(zf *store.ZipFile, f *store.SrcFile) bool {
+	return zf.TooLarge[f.Name] || rg.maxFileSize > 0 && int64(f.Len) > rg.maxFileSize
+}
+
 // Find returns a LineMatch for each line that matches rg in reader.
 // LimitHit is true if some matches may not have been included in the result.
 // NOTE: This is not safe to use concurrently.
 func (rg *readerGrep) Find(zf *store.ZipFile, f *store.SrcFile) (matches []protocol.LineMatch, limitHit bool, err error) {
-	// fileMatchBuf is what we run match on, fileBuf is the original
-	// data (for Preview).
-	fileBuf := zf.DataFor(f)
-	fileMatchBuf := fileBuf
+	fileBuf, fileMatchBuf, locs := rg.findLocs(zf, f)
+	return rg.lineMatches(zf, f, fileBuf, fileMatchBuf, locs)
+}
+
+// findLocs returns the matches of rg in f, at most one more than
+// lineMatchLimit unless rg only counts them. fileMatchBuf is the content they were found in, and
+// fileBuf the original content (for Preview). They only differ in case.
+func (rg *readerGrep) findLocs(zf *store.ZipFile, f *store.SrcFile) (fileBuf, fileMatchBuf []byte, locs [][]int) {
+	fileBuf = rg.content(zf, f)
+	fileMatchBuf = fileBuf
 
 	// If we are ignoring case, we transform the input instead of
 	// relying on the regular expression engine which can be
 	// slow. compile has already lowercased the pattern. We also
 	// trade some correctness for perf by using a non-utf8 aware
-	// lowercase function.
-	if rg.ignoreCase {
+	// lowercase function. foldLiteral ignores case itself.
+	if rg.ignoreCase && !foldsCase(rg.re) {
 		if rg.transformBuf == nil {
-			rg.transformBuf = make([]byte, zf.MaxLen)
+			rg.transformBuf = getTransformBuf(zf.MaxLen)
 		}
 		fileMatchBuf = rg.transformBuf[:len(fileBuf)]
 		bytesToLowerASCII(fileMatchBuf, fileBuf)
@@ -182,10 +309,54 @@ func (rg *readerGrep) Find(zf *store.ZipFile, f *store.SrcFile) (matches []proto
 	// per-line. Additionally if we have a non-empty literalSubstring, we use
 	// that to prune out files since doing bytes.Index is very fast.
 	if !bytes.Contains(fileMatchBuf, rg.literalSubstring) {
-		return nil, false, nil
+		return fileBuf, fileMatchBuf, nil
 	}
 
-	locs := rg.re.FindAllIndex(fileMatchBuf, maxLineMatches+1)
+	// Inverted and first match only searches stop at the first match.
+	maxMatches := rg.lineMatchLimit()
+	limit := maxMatches + 1
+	if rg.firstMatchOnly || rg.invert {
+		limit = 1
+	} else if rg.countOnly {
+		limit = -1
+	}
+	return fileBuf, fileMatchBuf, rg.findAll(f.Name, fileBuf, fileMatchBuf, limit)
+}
+
+// findAll returns the first limit (or all if limit < 0) matches of rg in
+// the file name which are in its scope and requested lines.
+func (rg *readerGrep) findAll(name string, fileBuf, fileMatchBuf []byte, limit int) [][]int {
+	lineRanges := rg.lineRanges[name]
+	if rg.scope == protocol.ScopeAll && lineRanges == nil {
+		return rg.re.FindAllIndex(fileMatchBuf, limit)
+	}
+	// We can only limit the number of matches after discarding those
+	// outside of scope or the requested lines.
+	locs := rg.re.FindAllIndex(fileMatchBuf, -1)
+	if lineRanges != nil {
+		locs = filterLineRanges(fileMatchBuf, locs, lineRanges)
+	}
+	if rg.scope != protocol.ScopeAll {
+		locs = filterScope(name, fileBuf, locs, rg.scope)
+	}
+	if limit >= 0 && len(locs) > limit {
+		locs = locs[:limit]
+	}
+	return locs
+}
+
+// lineMatches returns the LineMatches of the matches locs found by findLocs.
+func (rg *readerGrep) lineMatches(zf *store.ZipFile, f *store.SrcFile, fileBuf, fileMatchBuf []byte, locs [][]int) (matches []protocol.LineMatch, limitHit bool, err error) {
+	maxMatches := rg.lineMatchLimit()
+	if rg.searchBinary && zf.Binary[f.Name] {
+		return binaryMatches(locs, maxMatches)
+	}
+	if len(locs) == 0 {
+		return nil, false, nil
+	}
+	matches = make([]protocol.LineMatch, 0, len(locs))
+	pb := getPreviewBuilder(len(locs))
+	defer pb.release()
 	lastStart := 0
 	lastLineNumber := 0
 	lastMatchIndex := 0
@@ -216,14 +387,33 @@ func (rg *readerGrep) Find(zf *store.ZipFile, f *store.SrcFile) (matches []proto
 
 		lastMatchIndex = matchIndex
 		lastLineNumber = lineNumber
-		matches = appendMatches(matches, fileBuf[lineStart:lineEnd], fileMatchBuf[lineStart:lineEnd], lineNumber, start-lineStart, end-lineStart)
+		matches = appendMatches(matches, pb, fileBuf[lineStart:lineEnd], fileMatchBuf[lineStart:lineEnd], lineNumber, start-lineStart, end-lineStart)
 
-		if len(matches) > maxLineMatches {
-			matches = matches[:maxLineMatches]
+		if len(matches) > maxMatches {
+			matches = matches[:maxMatches]
 			limitHit = true
 			break
 		}
 	}
+	pb.finish()
+	for i := range matches {
+		matches[i].Preview = pb.preview(i)
+	}
+	return matches, limitHit, nil
+}
+
+// binaryMatches returns a LineMatch without Preview for each match in a
+// binary file, whose "lines" may be megabytes long. Offsets are in bytes.
+func binaryMatches(locs [][]int, maxMatches int) (matches []protocol.LineMatch, limitHit bool, err error) {
+	if len(locs) > maxMatches {
+		locs = locs[:maxMatches]
+		limitHit = true
+	}
+	for _, loc := range locs {
+		matches = append(matches, protocol.LineMatch{
+			OffsetAndLengths: [][2]int{{loc[0], loc[1] - loc[0]}},
+		})
+	}
 	return matches, limitHit, nil
 }
 
@@ -233,7 +423,8 @@ func hydrateLineNumbers(fileBuf []byte, lastLineNumber, lastMatchIndex, lineStar
 }
 
 // matchLineBuf is a byte slice that contains the full line(s) that the match appears on.
-func appendMatches(matches []protocol.LineMatch, fileBuf []byte, matchLineBuf []byte, lineNumber, start, end int) []protocol.LineMatch {
+// The Preview of each LineMatch appended is added to pb instead of being set.
+func appendMatches(matches []protocol.LineMatch, pb *previewBuilder, fileBuf []byte, matchLineBuf []byte, lineNumber, start, end int) []protocol.LineMatch {
 	// If any newlines appear between start and end, we need to append multiple LineMatch.
 	// We assume there are no newlines before start.
 	for len(matchLineBuf) > 0 {
@@ -254,23 +445,38 @@ func appendMatches(matches []protocol.LineMatch, fileBuf []byte, matchLineBuf []
 			e = len(line)
 		}
 
-		offset := utf8.RuneCount(line[:start])
-		length := utf8.RuneCount(line[start:e])
 		limit := eol
 		if limit < 0 {
 			limit = len(fileBuf)
 		}
-		matches = append(matches, protocol.LineMatch{
-			// we are not allowed to use the fileBuf data after the ZipFile has been Closed,
-			// which currently occurs before Preview has been serialized.
-			// TODO: consider moving the call to Close until after we are
-			// done with Preview, and stop making a copy here.
-			// Special care must be taken to call Close on all possible paths, including error paths.
-			Preview:          string(fileBuf[:limit]),
+
+		// For long lines (eg minified code) we only return a window of the
+		// line around the match, since each Preview is copied.
+		previewStart, previewEnd, matchEnd := 0, limit, e
+		if limit > maxPreviewLen {
+			previewStart, previewEnd = previewWindow(line, start, e, limit)
+			if matchEnd > previewEnd {
+				matchEnd = previewEnd
+			}
+		}
+
+		offset := utf8.RuneCount(line[previewStart:start])
+		length := utf8.RuneCount(line[start:matchEnd])
+		// we are not allowed to use the fileBuf data after the ZipFile has been Closed,
+		// which currently occurs before Preview has been serialized.
+		// TODO: consider moving the call to Close until after we are
+		// done with Preview, and stop making a copy here.
+		// Special care must be taken to call Close on all possible paths, including error paths.
+		pb.add(fileBuf[previewStart:previewEnd])
+		lm := protocol.LineMatch{
 			LineNumber:       lineNumber,
-			OffsetAndLengths: [][2]int{{offset, length}},
+			OffsetAndLengths: pb.offsetAndLength(offset, length),
 			LimitHit:         false, // We will always return false for this field since we no longer limit the number of offsets per line.
-		})
+		}
+		if previewStart > 0 {
+			lm.PreviewOffset = utf8.RuneCount(line[:previewStart])
+		}
+		matches = append(matches, lm)
 
 		if eol >= 0 {
 			fileBuf = fileBuf[eol+1:]
@@ -283,18 +489,136 @@ func appendMatches(matches []protocol.LineMatch, fileBuf []byte, matchLineBuf []
 	return matches
 }
 
+const (
+	// maxPreviewLen is the length in bytes above which a line's Preview is
+	// a window around the match rather than the whole line.
+	maxPreviewLen = 4 * 1024
+
+	// previewContext is the number of bytes on either side of a match
+	// included in a windowed Preview.
+	previewContext = 256
+)
+
+// previewWindow returns the byte range [previewStart, previewEnd) of the
+// first limit bytes of line to use as the Preview for the match [start, end).
+// The window includes previewContext bytes either side of the match, is at
+// most maxPreviewLen bytes long and does not split UTF-8 sequences.
+func previewWindow(line []byte, start, end, limit int) (previewStart, previewEnd int) {
+	previewStart = start - previewContext
+	if previewStart < 0 {
+		previewStart = 0
+	}
+	for previewStart > 0 && !utf8.RuneStart(line[previewStart]) {
+		previewStart--
+	}
+
+	previewEnd = end + previewContext
+	if maxEnd := previewStart + maxPreviewLen; previewEnd > maxEnd {
+		previewEnd = maxEnd
+	}
+	if previewEnd > limit {
+		previewEnd = limit
+	}
+	for previewEnd < limit && !utf8.RuneStart(line[previewEnd]) {
+		previewEnd++
+	}
+	return previewStart, previewEnd
+}
+
 // FindZip is a convenience function to run Find on f.
 func (rg *readerGrep) FindZip(zf *store.ZipFile, f *store.SrcFile) (protocol.FileMatch, error) {
-	lm, limitHit, err := rg.Find(zf, f)
-	return protocol.FileMatch{
+	fileBuf, fileMatchBuf, locs := rg.findLocs(zf, f)
+	if rg.countOnly {
+		// Without LineMatches there is no need to find the lines of the
+		// matches.
+		return protocol.FileMatch{
+			Path:       f.Name,
+			MatchCount: len(locs),
+			Encoding:   zf.Encodings[f.Name],
+			Binary:     zf.Binary[f.Name],
+		}, nil
+	}
+	lm, limitHit, err := rg.lineMatches(zf, f, fileBuf, fileMatchBuf, locs)
+	fm := protocol.FileMatch{
 		Path:        f.Name,
 		LineMatches: lm,
 		LimitHit:    limitHit,
-	}, err
+		Encoding:    zf.Encodings[f.Name],
+		Binary:      zf.Binary[f.Name],
+	}
+	if rg.multiline && !fm.Binary && len(locs) > 0 {
+		fm.MultilineMatches = multilineMatches(fileBuf, locs, rg.lineMatchLimit())
+	}
+	return fm, err
+}
+
+// maxMultilinePreviewLen is the length in bytes above which the Preview of
+// a MultilineMatch is truncated.
+const maxMultilinePreviewLen = 16 * 1024
+
+// multilineMatches returns a MultilineMatch for each of the first
+// maxMatches matches locs in fileBuf.
+func multilineMatches(fileBuf []byte, locs [][]int, maxMatches int) []protocol.MultilineMatch {
+	if len(locs) > maxMatches {
+		locs = locs[:maxMatches]
+	}
+
+	// line is the number of the line starting at lineStart, the last line
+	// starting before off. Matches don't overlap, so we only go forward.
+	line, lineStart, off := 0, 0, 0
+	position := func(i int) protocol.Position {
+		for {
+			eol := bytes.IndexByte(fileBuf[off:i], '\n')
+			if eol < 0 {
+				break
+			}
+			line++
+			lineStart = off + eol + 1
+			off = lineStart
+		}
+		off = i
+		return protocol.Position{Line: line, Column: utf8.RuneCount(fileBuf[lineStart:i]), Offset: i}
+	}
+
+	pb := getPreviewBuilder(0)
+	defer pb.release()
+	matches := make([]protocol.MultilineMatch, 0, len(locs))
+	for _, loc := range locs {
+		start, end := loc[0], loc[1]
+		m := protocol.MultilineMatch{Start: position(start)}
+		previewStart := lineStart
+		m.End = position(end)
+
+		// The preview ends with the line of the last character of the
+		// match, which is the line before End if it is a newline.
+		last := start
+		if end > start {
+			last = end - 1
+		}
+		previewEnd := len(fileBuf)
+		if eol := bytes.IndexByte(fileBuf[last:], '\n'); eol >= 0 {
+			previewEnd = last + eol
+		}
+		if previewEnd-previewStart > maxMultilinePreviewLen {
+			previewEnd = previewStart + maxMultilinePreviewLen
+			for previewEnd > previewStart && !utf8.RuneStart(fileBuf[previewEnd]) {
+				previewEnd--
+			}
+		}
+		pb.add(fileBuf[previewStart:previewEnd])
+		matches = append(matches, m)
+	}
+	pb.finish()
+	for i := range matches {
+		matches[i].Preview = pb.preview(i)
+	}
+	return matches
 }
 
 // regexSearch concurrently searches files in zr looking for matches using rg.
-func regexSearch(ctx context.Context, rg *readerGrep, zf *store.ZipFile, fileMatchLimit int, patternMatchesContent, patternMatchesPaths bool) (fm []protocol.FileMatch, limitHit bool, err error) {
+// It consumes the files it searches and the matches it returns from limits.
+// The limit which was hit, if any, is recorded in the usage of ctx.
+func regexSearch(ctx context.Context, rg *readerGrep, zf *store.ZipFile, limits *searchLimits, patternMatchesContent, patternMatchesPaths bool) (fm []protocol.FileMatch, limitHit bool, err error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "RegexSearch")
 	ext.Component.Set(span, "regex_search")
 	if rg.re != nil {
@@ -313,10 +637,6 @@ func regexSearch(ctx context.Context, rg *readerGrep, zf *store.ZipFile, fileMat
 		patternMatchesContent = true
 	}
 
-	if fileMatchLimit > maxFileMatches || fileMatchLimit <= 0 {
-		fileMatchLimit = maxFileMatches
-	}
-
 	// If we reach fileMatchLimit we use cancel to stop the search
 	var cancel context.CancelFunc
 	if deadline, ok := ctx.Deadline(); ok {
@@ -332,19 +652,69 @@ func regexSearch(ctx context.Context, rg *readerGrep, zf *store.ZipFile, fileMat
 	var (
 		filesmu   sync.Mutex // protects files
 		files     = zf.Files
-		matchesmu sync.Mutex // protects matches, limitHit
+		matchesmu sync.Mutex // protects matches, limitHit, limits (except bytesScanned)
 		matches   = []protocol.FileMatch{}
+		sink      = matchSinkFromContext(ctx)
+		usage     = usageFromContext(ctx)
 	)
+	if rg.rank != nil {
+		// Search the most relevant files first, and return them first
+		// even if the workers found others before them.
+		files = rg.rank.sortFiles(zf)
+		defer func() { rg.rank.sortMatches(zf, fm) }()
+	}
 
-	if rg.re == nil || (patternMatchesPaths && !patternMatchesContent) {
+	// first is the index of the first file searched, which is where a
+	// Paginate request resumes.
+	first := 0
+	if rg.page != nil {
+		if first, err = rg.page.find(files); err != nil {
+			return nil, false, err
+		}
+		files = files[first:]
+	}
+
+	// take takes fm, the match of the i-th file, from limits. It returns
+	// false once a limit was hit. matchesmu must be held.
+	take := func(i int, fm *protocol.FileMatch) bool {
+		skip := 0
+		if rg.page != nil && i == first {
+			skip = rg.page.Skip
+			if !skipMatches(fm, skip) {
+				return true
+			}
+		}
+		ok, hit := limits.take(fm)
+		if ok {
+			matches = append(matches, *fm)
+			if sink != nil {
+				sink(*fm)
+			}
+		}
+		if hit == "" {
+			return true
+		}
+		limitHit = true
+		if rg.page != nil {
+			if ok {
+				// fm was truncated, so the next page resumes within it.
+				skip += pageMatches(fm)
+			}
+			usage.stopAt(hit, cursor{File: i, Path: fm.Path, Skip: skip})
+		} else {
+			usage.hitLimit(hit)
+		}
+		cancel()
+		return false
+	}
+
+	if rg.query == nil && (rg.re == nil || (patternMatchesPaths && !patternMatchesContent)) {
 		// Fast path for only matching file paths (or with a nil pattern, which matches all files,
 		// so is effectively matching only on file paths).
-		for _, f := range files {
+		for i, f := range files {
 			if rg.matchPath.MatchPath(f.Name) && rg.matchString(f.Name) {
-				if len(matches) < fileMatchLimit {
-					matches = append(matches, protocol.FileMatch{Path: f.Name})
-				} else {
-					limitHit = true
+				fm := protocol.FileMatch{Path: f.Name}
+				if !take(first+i, &fm) {
 					break
 				}
 			}
@@ -359,13 +729,51 @@ func regexSearch(ctx context.Context, rg *readerGrep, zf *store.ZipFile, fileMat
 		wgErr         error
 		filesSkipped  uint32 // accessed atomically
 		filesSearched uint32 // accessed atomically
+		bufferBytes   int64  // accessed atomically
+		numFiles      = len(files)
+		ordered       *orderedResults
 	)
+	if rg.rank != nil || rg.page != nil {
+		ordered = &orderedResults{next: first}
+	}
 
-	// Start workers. They read from files and write to matches.
-	for i := 0; i < numWorkers; i++ {
+	// finish records the result of the i-th file, which is nil if it
+	// doesn't match. Matches are taken from limits as they are found, or
+	// in the order of the files if they are ranked or paginated, so that
+	// limits keep the most relevant ones and pages don't overlap.
+	// matchesmu must be held.
+	finish := func(i int, fm *protocol.FileMatch) {
+		if ordered == nil {
+			take(i, fm)
+			return
+		}
+		for _, m := range ordered.add(i, fm) {
+			if !take(m.i, m.fm) {
+				return
+			}
+		}
+	}
+
+	// Start workers. They read from files and write to matches. Each traces
+	// the batch of files it searched.
+	pool := workerPoolFromContext(ctx)
+	for i := 0; i < pool.perRequest; i++ {
 		wg.Add(1)
 		go func(rg *readerGrep) {
 			defer wg.Done()
+			defer usage.startWorker()()
+			var batchFiles, batchBytes, batchMatches int
+			batchSpan, _ := opentracing.StartSpanFromContext(ctx, "RegexSearch.batch")
+			defer func() {
+				batchSpan.SetTag("files", batchFiles)
+				batchSpan.SetTag("bytes", batchBytes)
+				batchSpan.SetTag("fileMatches", batchMatches)
+				batchSpan.Finish()
+			}()
+			defer func() {
+				atomic.AddInt64(&bufferBytes, int64(cap(rg.transformBuf)))
+				rg.releaseBuffers()
+			}()
 
 			for {
 				// check whether we've been cancelled
@@ -382,28 +790,66 @@ func regexSearch(ctx context.Context, rg *readerGrep, zf *store.ZipFile, fileMat
 					return
 				}
 				f := &files[0]
+				i := first + numFiles - len(files)
 				files = files[1:]
 				filesmu.Unlock()
 
 				// decide whether to process, record that decision
 				if !rg.matchPath.MatchPath(f.Name) {
 					atomic.AddUint32(&filesSkipped, 1)
+					if ordered != nil {
+						matchesmu.Lock()
+						finish(i, nil)
+						matchesmu.Unlock()
+					}
 					continue
 				}
+				n := len(rg.content(zf, f))
+				if !limits.scan(n) {
+					matchesmu.Lock()
+					limitHit = true
+					matchesmu.Unlock()
+					usage.hitLimit(protocol.LimitBytesScanned)
+					cancel()
+					return
+				}
 				atomic.AddUint32(&filesSearched, 1)
+				batchFiles++
+				batchBytes += n
+				usage.addRead(n)
+				if rg.tooLarge(zf, f) {
+					usage.skipLarge(f.Name)
+				}
 
-				// process
-				var fm protocol.FileMatch
-				fm, err := rg.FindZip(zf, f)
-				if err != nil {
-					wgErrOnce.Do(func() {
-						wgErr = err
-						cancel()
-					})
+				// process, once the pool has room for it
+				var (
+					fm    protocol.FileMatch
+					match bool
+				)
+				if !pool.acquire(ctx) {
 					return
 				}
-				match := len(fm.LineMatches) > 0
-				if !match && patternMatchesPaths {
+				if rg.query != nil {
+					fm, match = rg.findQuery(zf, f)
+					pool.release()
+				} else {
+					var err error
+					fm, err = rg.FindZip(zf, f)
+					pool.release()
+					if err != nil {
+						wgErrOnce.Do(func() {
+							wgErr = err
+							cancel()
+						})
+						return
+					}
+					match = len(fm.LineMatches) > 0 || fm.MatchCount > 0
+					if rg.invert {
+						match = !match
+						fm = protocol.FileMatch{Path: f.Name}
+					}
+				}
+				if !match && patternMatchesPaths && rg.query == nil {
 					// Try matching against the file path.
 					match = rg.matchString(f.Name)
 					if match {
@@ -411,13 +857,13 @@ func regexSearch(ctx context.Context, rg *readerGrep, zf *store.ZipFile, fileMat
 					}
 				}
 				if match {
+					batchMatches++
 					matchesmu.Lock()
-					if len(matches) < fileMatchLimit {
-						matches = append(matches, fm)
-					} else {
-						limitHit = true
-						cancel()
-					}
+					finish(i, &fm)
+					matchesmu.Unlock()
+				} else if ordered != nil {
+					matchesmu.Lock()
+					finish(i, nil)
 					matchesmu.Unlock()
 				}
 			}
@@ -425,6 +871,7 @@ func regexSearch(ctx context.Context, rg *readerGrep, zf *store.ZipFile, fileMat
 	}
 
 	wg.Wait()
+	usage.observeBuffers(int(atomic.LoadInt64(&bufferBytes)))
 
 	err = wgErr
 	if err == nil && ctx.Err() == context.DeadlineExceeded {
@@ -592,6 +1039,10 @@ func lowerRegexpASCII(re *syntax.Regexp) {
 func longestLiteral(re *syntax.Regexp) string {
 	switch re.Op {
 	case syntax.OpLiteral:
+		// Case folded literals can appear in the content in other cases.
+		if re.Flags&syntax.FoldCase != 0 {
+			return ""
+		}
 		return string(re.Rune)
 	case syntax.OpCapture, syntax.OpPlus:
 		return longestLiteral(re.Sub[0])
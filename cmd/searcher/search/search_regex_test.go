@@ -4,15 +4,19 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"fmt"
 	"os"
 	"reflect"
 	"regexp"
 	"regexp/syntax"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"testing/iotest"
 	"testing/quick"
+	"time"
+	"unicode/utf8"
 
 	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
 	"github.com/sourcegraph/sourcegraph/internal/pathmatch"
@@ -264,13 +268,102 @@ func benchSearchRegex(b *testing.B, p *protocol.Request) {
 	b.ResetTimer()
 
 	for n := 0; n < b.N; n++ {
-		_, _, err := regexSearch(ctx, rg, zf, 0, p.PatternMatchesContent, p.PatternMatchesPath)
+		_, _, err := regexSearch(ctx, rg, zf, newSearchLimits(&protocol.PatternInfo{}), p.PatternMatchesContent, p.PatternMatchesPath)
 		if err != nil {
 			b.Fatal(err)
 		}
 	}
 }
 
+func TestFoldLiteral(t *testing.T) {
+	cases := []struct {
+		pattern, content string
+	}{
+		{"foo", "foo Foo FOO fOo"},
+		{"FoO", "xfoofoo\nFOOBAR"},
+		{"a", "AaAbA"},
+		{"aab", "aaaab AAB aAb"},
+		{"needle", "haystack"},
+		{"[*]", "x[*]y[*]"},
+		{"日本 ok", "日本 OK 日本 ok"},
+		{"long pattern", "long"},
+	}
+	for _, c := range cases {
+		m := newFoldLiteral(c.pattern)
+		if m == nil {
+			t.Fatalf("%q: expected a foldLiteral", c.pattern)
+		}
+		lowered := []byte(lowerASCII(c.content))
+		want := m.re.FindAllIndex(lowered, -1)
+		if got := m.FindAllIndex([]byte(c.content), -1); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q in %q: got %v, want %v", c.pattern, c.content, got, want)
+		}
+		if got := m.FindAllIndex([]byte(c.content), 1); len(want) > 0 && !reflect.DeepEqual(got, want[:1]) {
+			t.Errorf("%q in %q: got %v for the first match, want %v", c.pattern, c.content, got, want[:1])
+		}
+	}
+
+	// Letters with other cases outside of ASCII need the regexp engine.
+	if m := newFoldLiteral("ÉTÉ"); m != nil {
+		t.Error("expected no foldLiteral for ÉTÉ")
+	}
+	rg, err := compile(&protocol.PatternInfo{Pattern: "ÉTÉ"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rg.matchString("un été chaud") {
+		t.Error("expected ÉTÉ to match été ignoring case")
+	}
+}
+
+func TestWordMatch(t *testing.T) {
+	cases := []struct {
+		p       protocol.PatternInfo
+		content string
+		want    [][]int
+	}{
+		{protocol.PatternInfo{Pattern: "foo", IsCaseSensitive: true}, "foo foobar barfoo foo_ (foo)", [][]int{{0, 3}, {24, 27}}},
+		{protocol.PatternInfo{Pattern: "café", IsCaseSensitive: true}, "cafés café", [][]int{{7, 12}}},
+		{protocol.PatternInfo{Pattern: "été", IsCaseSensitive: true}, "bébété été", [][]int{{10, 15}}},
+		{protocol.PatternInfo{Pattern: "foo(", IsCaseSensitive: true}, "xfoo( foo(x", [][]int{{6, 10}}},
+		{protocol.PatternInfo{Pattern: "(foo", IsCaseSensitive: true}, "x(foo (foox x(foo)", [][]int{{1, 5}, {13, 17}}},
+		{protocol.PatternInfo{Pattern: "fo+", IsRegExp: true, IsCaseSensitive: true}, "fooo foox fo", [][]int{{0, 4}, {10, 12}}},
+		{protocol.PatternInfo{Pattern: "FOO"}, "FooBar foo FOO", [][]int{{7, 10}, {11, 14}}},
+	}
+	for _, c := range cases {
+		c.p.IsWordMatch = true
+		rg, err := compile(&c.p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := []byte(c.content)
+		if rg.ignoreCase && !foldsCase(rg.re) {
+			content = []byte(strings.ToLower(c.content))
+		}
+		if got := rg.re.FindAllIndex(content, -1); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q in %q: got %v, want %v", c.p.Pattern, c.content, got, c.want)
+		}
+	}
+}
+
+func BenchmarkFoldLiteral(b *testing.B) {
+	content := bytes.Repeat([]byte("The Quick Brown Fox juMPs over the LAZY dog!?\n"), 1024)
+	b.Run("foldLiteral", func(b *testing.B) {
+		m := newFoldLiteral("lazy cat")
+		for i := 0; i < b.N; i++ {
+			m.FindAllIndex(content, -1)
+		}
+	})
+	b.Run("lower+regexp", func(b *testing.B) {
+		re := regexp.MustCompile("lazy cat")
+		buf := make([]byte, len(content))
+		for i := 0; i < b.N; i++ {
+			bytesToLowerASCII(buf, content)
+			re.FindAllIndex(buf, -1)
+		}
+	})
+}
+
 func TestLowerRegexp(t *testing.T) {
 	// The expected values are a bit volatile, since they come from
 	// syntex.Regexp.String. So they may change between go versions. Just
@@ -370,6 +463,29 @@ func TestLongestLiteral(t *testing.T) {
 	}
 }
 
+func TestRequiredLiterals(t *testing.T) {
+	cases := map[string][]string{
+		"foo":                        {"foo"},
+		"(?m:^foo)":                  {"foo"},
+		`\wfoo(\dlongest\wbam)\dbar`: {"foo", "longest", "bam", "bar"},
+		`(foo\dbar)+`:                {"foo", "bar"},
+		`(foo\dbar)*`:                nil,
+		"(foo|bar)":                  nil,
+		"(?i)foo":                    {"FOO"}, // case is folded by the trigram index
+		"(?i)é":                      nil,
+		"[A-Z]":                      nil,
+	}
+	for expr, want := range cases {
+		re, err := syntax.Parse(expr, syntax.Perl)
+		if err != nil {
+			t.Fatal(expr, err)
+		}
+		if got := requiredLiterals(re.Simplify()); !reflect.DeepEqual(got, want) {
+			t.Errorf("requiredLiterals(%q) == %q != %q", expr, got, want)
+		}
+	}
+}
+
 func TestReadAll(t *testing.T) {
 	input := []byte("Hello World")
 
@@ -454,7 +570,7 @@ func TestMaxMatches(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	fileMatches, limitHit, err := regexSearch(context.Background(), rg, zf, maxFileMatches, true, false)
+	fileMatches, limitHit, err := regexSearch(context.Background(), rg, zf, newSearchLimits(&protocol.PatternInfo{FileMatchLimit: maxFileMatches}), true, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -506,7 +622,7 @@ func TestPathMatches(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	fileMatches, _, err := regexSearch(context.Background(), rg, zf, 10, true, true)
+	fileMatches, _, err := regexSearch(context.Background(), rg, zf, newSearchLimits(&protocol.PatternInfo{FileMatchLimit: 10}), true, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -528,6 +644,60 @@ var githubStore = &store.Store{
 	Path:     "/tmp/search_test/store",
 }
 
+// slowRegexp is a regexpMatcher which takes a while to search content
+// containing "slow".
+type slowRegexp struct {
+	regexpMatcher
+}
+
+func (re slowRegexp) FindAllIndex(b []byte, n int) [][]int {
+	if bytes.Contains(b, []byte("slow")) {
+		time.Sleep(200 * time.Millisecond)
+	}
+	return re.regexpMatcher.FindAllIndex(b, n)
+}
+
+func TestRegexSearch_deadline(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := []string{"fast", "slow1", "slow2", "slow3", "slow4", "slow5", "slow6", "slow7", "slow8", "slow9"}
+	for _, name := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte("foo " + name + "\n"))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zf, err := store.MockZipFile(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rg, err := compile(&protocol.PatternInfo{Pattern: "foo", IsCaseSensitive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rg.re = slowRegexp{rg.re}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	fileMatches, _, err := regexSearch(ctx, rg, zf, newSearchLimits(&protocol.PatternInfo{}), true, false)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got err %v, want %v", err, context.DeadlineExceeded)
+	}
+	// The matches of the files searched before the deadline are returned,
+	// and the search stopped before searching every file.
+	paths := map[string]bool{}
+	for _, fm := range fileMatches {
+		paths[fm.Path] = true
+	}
+	if !paths["fast"] || len(paths) == len(files) {
+		t.Errorf("got matches in %v, want fast and not all files", paths)
+	}
+}
+
 func init() {
 	// Clear out store so we pick up changes in our store writing code.
 	os.RemoveAll(githubStore.Path)
@@ -581,7 +751,7 @@ func Test_regexSearch(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotFm, gotLimitHit, err := regexSearch(tt.args.ctx, tt.args.rg, tt.args.zf, tt.args.fileMatchLimit, tt.args.patternMatchesContent, tt.args.patternMatchesPaths)
+			gotFm, gotLimitHit, err := regexSearch(tt.args.ctx, tt.args.rg, tt.args.zf, newSearchLimits(&protocol.PatternInfo{FileMatchLimit: tt.args.fileMatchLimit}), tt.args.patternMatchesContent, tt.args.patternMatchesPaths)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("regexSearch() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -595,3 +765,88 @@ func Test_regexSearch(t *testing.T) {
 		})
 	}
 }
+
+func TestLongLinePreview(t *testing.T) {
+	// A single line much longer than maxPreviewLen with a match in the
+	// middle, preceded by multibyte runes.
+	prefix := strings.Repeat("é", 2*maxPreviewLen)
+	suffix := strings.Repeat("x", 2*maxPreviewLen)
+	data := prefix + "needle" + suffix + "\nneedle\n"
+	zipData, err := testutil.CreateZip(map[string]string{"min.js": data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zf, err := store.MockZipFile(zipData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rg, err := compile(&protocol.PatternInfo{Pattern: "needle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lms, _, err := rg.Find(zf, &zf.Files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lms) != 2 {
+		t.Fatalf("expected 2 line matches, got %d", len(lms))
+	}
+
+	lm := lms[0]
+	if len(lm.Preview) > maxPreviewLen {
+		t.Errorf("preview is %d bytes, want at most %d", len(lm.Preview), maxPreviewLen)
+	}
+	if !utf8.ValidString(lm.Preview) {
+		t.Errorf("preview splits a UTF-8 sequence")
+	}
+	preview := []rune(lm.Preview)
+	off, length := lm.OffsetAndLengths[0][0], lm.OffsetAndLengths[0][1]
+	if got := string(preview[off : off+length]); got != "needle" {
+		t.Errorf("offsets select %q, want %q", got, "needle")
+	}
+	if got, want := lm.PreviewOffset+off, utf8.RuneCountInString(prefix); got != want {
+		t.Errorf("match starts at character %d of the line, want %d", got, want)
+	}
+
+	// Short lines are returned in full.
+	if lms[1].Preview != "needle" || lms[1].PreviewOffset != 0 {
+		t.Errorf("unexpected short line match %+v", lms[1])
+	}
+}
+
+func BenchmarkFind(b *testing.B) {
+	data := strings.Repeat("The Quick Brown Fox juMPs over the LAZY dog!?\n", 1024)
+	zipData, err := testutil.CreateZip(map[string]string{"pangram.txt": data})
+	if err != nil {
+		b.Fatal(err)
+	}
+	zf, err := store.MockZipFile(zipData)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, p := range []protocol.PatternInfo{
+		{Pattern: "lazy dog"},
+		{Pattern: "LAZY dog", IsCaseSensitive: true},
+	} {
+		p := p
+		rg, err := compile(&p)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("casesensitive=%v", p.IsCaseSensitive), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rg := rg.Copy()
+				lms, _, err := rg.Find(zf, &zf.Files[0])
+				if err != nil {
+					b.Fatal(err)
+				}
+				rg.releaseBuffers()
+				if i == 0 {
+					b.ReportMetric(float64(len(lms)), "matches/op")
+				}
+			}
+		})
+	}
+}
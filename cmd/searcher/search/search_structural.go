@@ -3,13 +3,19 @@ package search
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
 	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/comby"
+	"github.com/sourcegraph/sourcegraph/internal/store"
 	log15 "gopkg.in/inconshreveable/log15.v2"
 )
 
@@ -179,7 +185,35 @@ func languageMetric(matcher string, includePatterns *[]string) string {
 	return "inferred:.generic"
 }
 
-func structuralSearch(ctx context.Context, zipPath, pattern, rule string, languages, includePatterns []string, repo api.RepoName) (matches []protocol.FileMatch, limitHit bool, err error) {
+// combyZipPath returns the path of an archive with the contents of zf, the
+// archive at zipPath, which comby can read. comby can't read compressed
+// archives and shouldn't parse binary files, so those archives are copied
+// uncompressed and without binary content to a temporary file which is
+// removed by cleanup.
+func combyZipPath(zipPath string, zf *store.ZipFile) (path string, cleanup func(), err error) {
+	if !zf.Compressed() && len(zf.Binary) == 0 {
+		return zipPath, func() {}, nil
+	}
+	f, err := ioutil.TempFile("", "searcher-structural-*.zip")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.Remove(f.Name()) }
+	err = zf.WriteUncompressed(f)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, errors.Wrap(err, "failed to write uncompressed archive for comby")
+	}
+	return f.Name(), cleanup, nil
+}
+
+// structuralSearch runs the comby pattern over the archive at zipPath. If
+// fileTimeout is positive, comby gives up on a file after it (rounded up to
+// a second).
+func structuralSearch(ctx context.Context, zipPath, pattern, rule string, languages, includePatterns []string, repo api.RepoName, fileTimeout time.Duration) (matches []protocol.FileMatch, limitHit bool, err error) {
 	log15.Info("structural search", "repo", string(repo))
 
 	// Cap the number of forked processes to limit the size of zip contents being mapped to memory. Resolving #7133 could help to lift this restriction.
@@ -204,6 +238,7 @@ func structuralSearch(ctx context.Context, zipPath, pattern, rule string, langua
 		FilePatterns:  includePatterns,
 		Rule:          rule,
 		NumWorkers:    numWorkers,
+		Timeout:       int(math.Ceil(fileTimeout.Seconds())),
 	}
 
 	combyMatches, err := comby.Matches(ctx, args)
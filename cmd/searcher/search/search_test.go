@@ -4,23 +4,37 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 
 	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
 	"github.com/sourcegraph/sourcegraph/cmd/searcher/search"
 	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/ctags"
+	"github.com/sourcegraph/sourcegraph/internal/endpoint"
 	"github.com/sourcegraph/sourcegraph/internal/gitserver"
 	"github.com/sourcegraph/sourcegraph/internal/store"
 	"github.com/sourcegraph/sourcegraph/internal/testutil"
@@ -73,6 +87,16 @@ main.go:6:	fmt.Println("Hello world")
 main.go:5:func main() {
 `},
 
+		{protocol.PatternInfo{Pattern: "func.*main", PatternType: protocol.PatternTypeRegexp}, `
+main.go:5:func main() {
+`},
+
+		{protocol.PatternInfo{Pattern: "/func.*main/", PatternType: protocol.PatternTypeStandard}, `
+main.go:5:func main() {
+`},
+
+		{protocol.PatternInfo{Pattern: "func.*main", PatternType: protocol.PatternTypeStandard}, ""},
+
 		// https://github.com/sourcegraph/sourcegraph/issues/8155
 		{protocol.PatternInfo{Pattern: "^func", IsRegExp: true}, `
 main.go:5:func main() {
@@ -82,6 +106,9 @@ main.go:5:func main() {
 `},
 
 		{protocol.PatternInfo{Pattern: "mai", IsWordMatch: true}, ""},
+		{protocol.PatternInfo{Pattern: "Println(", IsWordMatch: true}, `
+main.go:6:	fmt.Println("Hello world")
+`},
 
 		{protocol.PatternInfo{Pattern: "main", IsWordMatch: true}, `
 main.go:1:package main
@@ -249,6 +276,65 @@ func TestSearch_badrequest(t *testing.T) {
 			},
 		},
 
+		// InvertMatch without a pattern
+		{
+			Repo:   "foo",
+			URL:    "u",
+			Commit: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo: protocol.PatternInfo{
+				IncludePatterns: []string{"*.go"},
+				InvertMatch:     true,
+			},
+		},
+
+		// Replacements for a structural search
+		{
+			Repo:   "foo",
+			URL:    "u",
+			Commit: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo: protocol.PatternInfo{
+				Pattern:         "foo(:[x])",
+				IsStructuralPat: true,
+			},
+			IncludeReplacements: true,
+			Replacement:         "bar(:[x])",
+		},
+
+		// TestFiles for a structural search
+		{
+			Repo:   "foo",
+			URL:    "u",
+			Commit: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo: protocol.PatternInfo{
+				Pattern:         "foo(:[x])",
+				IsStructuralPat: true,
+				TestFiles:       protocol.TestFilesExcluded,
+			},
+		},
+
+		// Unknown pattern type
+		{
+			Repo:   "foo",
+			URL:    "u",
+			Commit: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo: protocol.PatternInfo{
+				Pattern:     "test",
+				PatternType: "fuzzy",
+			},
+		},
+
+		// Pattern type conflicts with IsRegExp
+		{
+			Repo:   "foo",
+			URL:    "u",
+			Commit: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo: protocol.PatternInfo{
+				Pattern:     "test",
+				PatternType: protocol.PatternTypeLiteral,
+				IsRegExp:    true,
+			},
+		},
+
 		// No repo
 		{
 			URL:    "u",
@@ -344,98 +430,3439 @@ func TestSearch_badrequest(t *testing.T) {
 	}
 }
 
-func doSearch(u string, p *protocol.Request) ([]protocol.FileMatch, error) {
-	form := url.Values{
-		"Repo":            []string{string(p.Repo)},
-		"URL":             []string{string(p.URL)},
-		"Commit":          []string{string(p.Commit)},
-		"Pattern":         []string{p.Pattern},
-		"FetchTimeout":    []string{p.FetchTimeout},
-		"IncludePatterns": p.IncludePatterns,
-		"ExcludePattern":  []string{p.ExcludePattern},
-	}
-	if p.IsRegExp {
-		form.Set("IsRegExp", "true")
+func TestSearch_fallbackRegexp(t *testing.T) {
+	files := map[string]string{
+		"a.txt": "foobar\nfoobaz\nidentity\nentity\n",
 	}
-	if p.IsStructuralPat {
-		form.Set("IsStructuralPat", "true")
+	store, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if p.IsWordMatch {
-		form.Set("IsWordMatch", "true")
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{
+		Store:                 store,
+		FallbackRegexpTimeout: time.Second,
+	})
+	defer ts.Close()
+
+	cases := []struct {
+		pattern string
+		want    string
+	}{
+		{`foo(?!bar)`, "a.txt:2:foobaz\n"},
+		{`(?<!id)entity`, "a.txt:4:entity\n"},
+		{`(t)i\1`, "a.txt:3:identity\na.txt:4:entity\n"},
+		// Patterns RE2 supports are still matched by RE2.
+		{`^ent`, "a.txt:4:entity\n"},
 	}
-	if p.IsCaseSensitive {
-		form.Set("IsCaseSensitive", "true")
+	for _, tc := range cases {
+		req := protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:  protocol.PatternInfo{Pattern: tc.pattern, IsRegExp: true},
+			FetchTimeout: "2000ms",
+		}
+		m, err := doSearch(ts.URL, &req)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.pattern, err)
+		}
+		if got := toString(m); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.pattern, got, tc.want)
+		}
 	}
-	if p.PathPatternsAreRegExps {
-		form.Set("PathPatternsAreRegExps", "true")
+}
+
+func TestSearch_timeout(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{"a.go": "hello\n"})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if p.PathPatternsAreCaseSensitive {
-		form.Set("PathPatternsAreCaseSensitive", "true")
+	defer cleanup()
+
+	// ChangedFiles is called with the request context, so we use it to
+	// observe the deadline searcher applied.
+	var gotDeadline time.Time
+	ts := httptest.NewServer(&search.Service{
+		Store:          store,
+		DefaultTimeout: time.Minute,
+		MaxTimeout:     time.Hour,
+		ChangedFiles: func(ctx context.Context, repo gitserver.Repo, base, head string) ([]string, error) {
+			gotDeadline, _ = ctx.Deadline()
+			return []string{"a.go"}, nil
+		},
+	})
+	defer ts.Close()
+
+	cases := []struct {
+		name     string
+		deadline time.Duration
+		want     time.Duration
+	}{
+		{"default", 0, time.Minute},
+		{"requested", 30 * time.Minute, 30 * time.Minute},
+		{"max", 2 * time.Hour, time.Hour},
 	}
-	if p.PatternMatchesContent {
-		form.Set("PatternMatchesContent", "true")
+	for _, tc := range cases {
+		form := searchForm(&protocol.Request{
+			Repo:                 "foo",
+			Commit:               "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:          protocol.PatternInfo{Pattern: "hello"},
+			FetchTimeout:         "2000ms",
+			ChangedInLastCommits: 1,
+		})
+		if tc.deadline > 0 {
+			deadline, _ := time.Now().Add(tc.deadline).MarshalText()
+			form.Set("Deadline", string(deadline))
+		}
+		start := time.Now()
+		resp, err := http.PostForm(ts.URL, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readMatches(resp); err != nil {
+			t.Fatal(err)
+		}
+		if got := gotDeadline.Sub(start); got < tc.want-time.Second || got > tc.want+time.Second {
+			t.Errorf("%s: got deadline in %s, want %s", tc.name, got, tc.want)
+		}
 	}
-	if p.PatternMatchesPath {
-		form.Set("PatternMatchesPath", "true")
+}
+
+func TestSearch_wantContent(t *testing.T) {
+	files := map[string]string{
+		"a.go": "package a\n\nfunc hello() {}\n",
+		"b.go": "package b\n",
 	}
-	resp, err := http.PostForm(u, form)
+	store, cleanup, err := newStore(files)
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	req := protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "hello"},
+		FetchTimeout: "2000ms",
+		WantContent:  true,
+	}
+	m, err := doSearch(ts.URL, &req)
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("non-200 response: code=%d body=%s", resp.StatusCode, string(body))
+	if len(m) != 1 || m[0].Path != "a.go" || m[0].Content != files["a.go"] || m[0].ContentOmitted {
+		t.Errorf("unexpected matches %+v", m)
 	}
+}
 
-	var r protocol.Response
-	err = json.Unmarshal(body, &r)
+func TestSearch_query(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go":      "package a\n\nfunc hello() {}\n",
+		"a_test.go": "package a\n\nfunc TestHello() { hello() }\n",
+		"b.py":      "def hello():\n    pass\n",
+		"README.md": "say hello\n",
+	})
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
-	return r.Matches, err
-}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
 
-func newStore(files map[string]string) (*store.Store, func(), error) {
-	buf := new(bytes.Buffer)
-	w := tar.NewWriter(buf)
-	for name, body := range files {
-		hdr := &tar.Header{
-			Name: name,
-			Mode: 0600,
-			Size: int64(len(body)),
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{`{"Content": {"Pattern": "hello"}}`, `
+README.md:1:say hello
+a.go:3:func hello() {}
+a_test.go:3:func TestHello() { hello() }
+b.py:1:def hello():
+`},
+		{`{"And": [{"Content": {"Pattern": "hello"}}, {"Lang": "go"}, {"Not": {"Predicate": "test"}}]}`, `
+a.go:3:func hello() {}
+`},
+		{`{"Or": [{"Content": {"Pattern": "package"}}, {"Content": {"Pattern": "pass"}}]}`, `
+a.go:1:package a
+a_test.go:1:package a
+b.py:2:    pass
+`},
+		{`{"And": [{"Content": {"Pattern": "hello"}}, {"Not": {"Content": {"Pattern": "func"}}}]}`, `
+README.md:1:say hello
+b.py:1:def hello():
+`},
+		{`{"And": [{"Path": {"Pattern": "\\.md$", "IsRegExp": true}}, {"Not": {"Content": {"Pattern": "goodbye"}}}]}`, `
+README.md
+`},
+		{`{"And": [{"Content": {"Pattern": "hello", "IsCaseSensitive": true}}, {"Content": {"Pattern": "Test"}}]}`, `
+a_test.go:3:func TestHello() { hello() }
+`},
+	}
+	for _, c := range cases {
+		m, err := doSearch(ts.URL, &protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			Query:        c.query,
+			FetchTimeout: "2000ms",
+		})
+		if err != nil {
+			t.Errorf("%s: %s", c.query, err)
+			continue
 		}
-		if err := w.WriteHeader(hdr); err != nil {
-			return nil, nil, err
+		sort.Sort(sortByPath(m))
+		got := toString(m)
+		if got != strings.TrimPrefix(c.want, "\n") {
+			t.Errorf("%s: unexpected matches\ngot:\n%s\nwant:\n%s", c.query, got, strings.TrimPrefix(c.want, "\n"))
 		}
-		if _, err := w.Write([]byte(body)); err != nil {
-			return nil, nil, err
+	}
+
+	// Invalid queries are bad requests.
+	for _, q := range []string{
+		`{"Content": {"Pattern": "a"}, "Lang": "go"}`,
+		`{"Lang": "notalanguage"}`,
+		`{"Predicate": "unknown"}`,
+		`{"And": []}`,
+		`not json`,
+	} {
+		resp, err := http.PostForm(ts.URL, searchForm(&protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			Query:        q,
+			FetchTimeout: "2000ms",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", q, resp.StatusCode, http.StatusBadRequest)
 		}
 	}
-	// git-archive usually includes a pax header we should ignore.
-	// use a body which matches a test case. Ensures we don't return this
-	// false entry as a result.
-	if err := addpaxheader(w, "Hello world\n"); err != nil {
-		return nil, nil, err
+}
+
+func TestSearch_middleware(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go":          "package a\n",
+		"b.go":          "package b\n",
+		"secret/c.go":   "package c\n",
+		"vendor/d/d.go": "package d\n",
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer cleanup()
+
+	service := &search.Service{Store: store}
+	service.Use(search.Middleware{
+		Name: "tenant",
+		Validate: func(ctx context.Context, p *protocol.Request) error {
+			if p.Repo != "foo" {
+				return errors.New("repository not allowed")
+			}
+			return nil
+		},
+	})
+	service.Use(search.Middleware{
+		Name: "exclude-vendor",
+		Rewrite: func(ctx context.Context, p *protocol.Request) error {
+			p.ExcludePattern = "vendor/**"
+			return nil
+		},
+	})
+	service.Use(search.Middleware{
+		Name: "hide-secret",
+		PostFilter: func(ctx context.Context, p *protocol.Request, matches []protocol.FileMatch) ([]protocol.FileMatch, error) {
+			filtered := matches[:0]
+			for _, m := range matches {
+				if !strings.HasPrefix(m.Path, "secret/") {
+					filtered = append(filtered, m)
+				}
+			}
+			return filtered, nil
+		},
+	})
+	ts := httptest.NewServer(service)
+	defer ts.Close()
 
-	err := w.Close()
+	p := &protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "package"},
+		FetchTimeout: "2000ms",
+	}
+	m, err := doSearch(ts.URL, p)
 	if err != nil {
-		return nil, nil, err
+		t.Fatal(err)
 	}
-	d, err := ioutil.TempDir("", "search_test")
+	sort.Sort(sortByPath(m))
+	if got, want := toString(m), "a.go:1:package a\nb.go:1:package b\n"; got != want {
+		t.Errorf("got matches:\n%s\nwant:\n%s", got, want)
+	}
+
+	p.Repo = "bar"
+	resp, err := http.PostForm(ts.URL, searchForm(p))
 	if err != nil {
-		return nil, nil, err
+		t.Fatal(err)
 	}
-	return &store.Store{
-		FetchTar: func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
-			return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("rejected request: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestSearch_invertMatch(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go":     "// Copyright Foo\npackage a\n",
+		"b.go":     "package b\n",
+		"c/c.go":   "package c\n",
+		"d/README": "no license here\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	m, err := doSearch(ts.URL, &protocol.Request{
+		Repo:   "foo",
+		Commit: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo: protocol.PatternInfo{
+			Pattern:         "^// Copyright",
+			IsRegExp:        true,
+			IncludePatterns: []string{"**.go"},
+			InvertMatch:     true,
 		},
-		Path: d,
-	}, func() { os.RemoveAll(d) }, nil
+		FetchTimeout: "2000ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(sortByPath(m))
+	if got, want := toString(m), "b.go\nc/c.go\n"; got != want {
+		t.Errorf("got matches:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSearch_firstMatchOnly(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.txt": strings.Repeat("foo foo\n", 1000),
+		"b.txt": "bar\nfoo\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	m, err := doSearch(ts.URL, &protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "foo", FirstMatchOnly: true},
+		FetchTimeout: "2000ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(sortByPath(m))
+	if got, want := toString(m), "a.txt:1:foo foo\nb.txt:2:foo\n"; got != want {
+		t.Errorf("got matches:\n%s\nwant:\n%s", got, want)
+	}
+	for _, fm := range m {
+		if len(fm.LineMatches) != 1 || len(fm.LineMatches[0].OffsetAndLengths) != 1 {
+			t.Errorf("%s: expected a single match, got %+v", fm.Path, fm.LineMatches)
+		}
+	}
+}
+
+func TestSearch_encodings(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"utf16.txt":  "\xff\xfec\x00a\x00f\x00\xe9\x00\n\x00",
+		"latin1.txt": "caf\xe9\n",
+		"utf8.txt":   "caf\u00e9\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	m, err := doSearch(ts.URL, &protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "caf\u00e9"},
+		FetchTimeout: "2000ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(sortByPath(m))
+	if got, want := toString(m), "latin1.txt:1:caf\u00e9\nutf16.txt:1:caf\u00e9\nutf8.txt:1:caf\u00e9\n"; got != want {
+		t.Errorf("got matches:\n%s\nwant:\n%s", got, want)
+	}
+	want := map[string]string{"latin1.txt": "windows-1252", "utf16.txt": "utf-16le"}
+	for _, fm := range m {
+		if fm.Encoding != want[fm.Path] {
+			t.Errorf("%s: got encoding %q, want %q", fm.Path, fm.Encoding, want[fm.Path])
+		}
+	}
+}
+
+func TestSearch_binary(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.txt":   "foo\n",
+		"app.min": "\x00\x01foo\x00bar foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	find := func(searchBinary bool) []protocol.FileMatch {
+		m, err := doSearch(ts.URL, &protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:  protocol.PatternInfo{Pattern: "foo", SearchBinary: searchBinary},
+			FetchTimeout: "2000ms",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Sort(sortByPath(m))
+		return m
+	}
+
+	// Binary files are skipped by default.
+	if got, want := toString(find(false)), "a.txt:1:foo\n"; got != want {
+		t.Errorf("got matches:\n%s\nwant:\n%s", got, want)
+	}
+
+	// With SearchBinary they are searched, but their matches have byte
+	// offsets instead of lines.
+	m := find(true)
+	if len(m) != 2 {
+		t.Fatalf("got %d file matches, want 2: %+v", len(m), m)
+	}
+	if m[0].Binary {
+		t.Errorf("a.txt: got Binary")
+	}
+	want := protocol.FileMatch{
+		Path: "app.min",
+		LineMatches: []protocol.LineMatch{
+			{OffsetAndLengths: [][2]int{{2, 3}}},
+			{OffsetAndLengths: [][2]int{{10, 3}}},
+		},
+		Binary: true,
+	}
+	if !reflect.DeepEqual(m[1], want) {
+		t.Errorf("got %+v, want %+v", m[1], want)
+	}
+}
+
+func TestSearch_multiline(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"main.go": "func a() {\n\treturn 1\n}\n\nfunc b() {\n\tx := \"é\"; return x\n}\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	find := func(multiline bool) []protocol.FileMatch {
+		m, err := doSearch(ts.URL, &protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:  protocol.PatternInfo{Pattern: `\{.+?return`, IsRegExp: true, Multiline: multiline},
+			FetchTimeout: "2000ms",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	// Without Multiline "." doesn't match newlines.
+	if m := find(false); len(m) != 0 {
+		t.Errorf("got matches without Multiline: %+v", m)
+	}
+
+	m := find(true)
+	if len(m) != 1 {
+		t.Fatalf("got %d file matches, want 1: %+v", len(m), m)
+	}
+	if got, want := toString(m), "main.go:1:func a() {\nmain.go:2:\treturn 1\nmain.go:5:func b() {\nmain.go:6:\tx := \"é\"; return x\n"; got != want {
+		t.Errorf("got line matches:\n%s\nwant:\n%s", got, want)
+	}
+	want := []protocol.MultilineMatch{{
+		Preview: "func a() {\n\treturn 1",
+		Start:   protocol.Position{Line: 0, Column: 9, Offset: 9},
+		End:     protocol.Position{Line: 1, Column: 7, Offset: 18},
+	}, {
+		Preview: "func b() {\n\tx := \"é\"; return x",
+		Start:   protocol.Position{Line: 4, Column: 9, Offset: 33},
+		End:     protocol.Position{Line: 5, Column: 17, Offset: 53},
+	}}
+	if !reflect.DeepEqual(m[0].MultilineMatches, want) {
+		t.Errorf("got %+v, want %+v", m[0].MultilineMatches, want)
+	}
+}
+
+func TestSearch_ranges(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.txt": "héllo wörld\nnaïve wörld\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	m, err := doSearch(ts.URL, &protocol.Request{
+		Repo:          "foo",
+		Commit:        "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:   protocol.PatternInfo{Pattern: "wörld"},
+		IncludeRanges: true,
+		FetchTimeout:  "2000ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || len(m[0].LineMatches) != 2 {
+		t.Fatalf("got %+v, want 2 line matches in a.txt", m)
+	}
+	want := [][]protocol.Range{{{
+		Start: protocol.Position{Line: 0, Column: 6, Offset: 7},
+		End:   protocol.Position{Line: 0, Column: 11, Offset: 13},
+	}}, {{
+		Start: protocol.Position{Line: 1, Column: 6, Offset: 21},
+		End:   protocol.Position{Line: 1, Column: 11, Offset: 27},
+	}}}
+	for i, lm := range m[0].LineMatches {
+		if !reflect.DeepEqual(lm.Ranges, want[i]) {
+			t.Errorf("line %d: got ranges %+v, want %+v", lm.LineNumber, lm.Ranges, want[i])
+		}
+	}
+}
+
+func TestSearch_owners(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		".github/CODEOWNERS": "* @org/core\n/web/ @org/frontend # the web app\nweb/vendor/\n",
+		"main.go":            "foo",
+		"web/app.ts":         "foo",
+		"web/vendor/lib.js":  "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	cases := []struct {
+		ownedBy, notOwnedBy string
+		want                string
+	}{
+		{ownedBy: "@org/core", want: "main.go:1:foo\n"},
+		{ownedBy: "ORG/frontend", want: "web/app.ts:1:foo\n"},
+		{notOwnedBy: "@org/core", want: "web/app.ts:1:foo\nweb/vendor/lib.js:1:foo\n"},
+		{ownedBy: "@someone-else", want: ""},
+	}
+	for _, c := range cases {
+		m, err := doSearch(ts.URL, &protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:  protocol.PatternInfo{Pattern: "foo", OwnedBy: c.ownedBy, NotOwnedBy: c.notOwnedBy},
+			FetchTimeout: "2000ms",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Sort(sortByPath(m))
+		if got := toString(m); got != c.want {
+			t.Errorf("OwnedBy=%q NotOwnedBy=%q: got matches:\n%s\nwant:\n%s", c.ownedBy, c.notOwnedBy, got, c.want)
+		}
+	}
+}
+
+func TestSearch_gitattributes(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		".gitattributes":     "*.pb.go linguist-generated\nthird_party/** linguist-vendored\n",
+		"main.go":            "foo",
+		"api.pb.go":          "foo",
+		"third_party/lib.go": "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	cases := []struct {
+		generated, vendored protocol.TestFileFilter
+		want                string
+	}{
+		{want: "api.pb.go:1:foo\nmain.go:1:foo\nthird_party/lib.go:1:foo\n"},
+		{generated: protocol.TestFilesExcluded, vendored: protocol.TestFilesExcluded, want: "main.go:1:foo\n"},
+		{generated: protocol.TestFilesOnly, want: "api.pb.go:1:foo\n"},
+		{vendored: protocol.TestFilesOnly, want: "third_party/lib.go:1:foo\n"},
+	}
+	for _, c := range cases {
+		m, err := doSearch(ts.URL, &protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:  protocol.PatternInfo{Pattern: "foo", GeneratedFiles: c.generated, VendoredFiles: c.vendored},
+			FetchTimeout: "2000ms",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Sort(sortByPath(m))
+		if got := toString(m); got != c.want {
+			t.Errorf("GeneratedFiles=%q VendoredFiles=%q: got matches:\n%s\nwant:\n%s", c.generated, c.vendored, got, c.want)
+		}
+	}
+}
+
+func TestSearch_files(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go":   "foo\nbar\nfoo\nfoo\n",
+		"b.go":   "foo\n",
+		"c.go":   "foo\n",
+		"d:1.go": "foo\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	cases := []struct {
+		files []string
+		want  string
+	}{
+		{files: []string{"a.go", "b.go"}, want: "a.go:1:foo\na.go:3:foo\na.go:4:foo\nb.go:1:foo\n"},
+		{files: []string{"a.go:2-3"}, want: "a.go:3:foo\n"},
+		{files: []string{"a.go:1,4", "c.go:2"}, want: "a.go:1:foo\na.go:4:foo\n"},
+		{files: []string{"a.go:2", "a.go"}, want: "a.go:1:foo\na.go:3:foo\na.go:4:foo\n"},
+		{files: []string{"d:1.go"}, want: "d:1.go:1:foo\n"},
+	}
+	for _, c := range cases {
+		m, err := doSearch(ts.URL, &protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:  protocol.PatternInfo{Pattern: "foo", Files: c.files},
+			FetchTimeout: "2000ms",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Sort(sortByPath(m))
+		if got := toString(m); got != c.want {
+			t.Errorf("Files=%q: got matches:\n%s\nwant:\n%s", c.files, got, c.want)
+		}
+	}
+
+	_, err = doSearch(ts.URL, &protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "foo", Files: []string{"a.go:3-1"}},
+		FetchTimeout: "2000ms",
+	})
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("expected a 400 for an invalid line range, got %v", err)
+	}
+}
+
+func TestSearch_revisions(t *testing.T) {
+	const (
+		commitA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+		commitB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	)
+	tars := map[api.CommitID]map[string]string{
+		commitA: {"same.go": "foo\n", "changed.go": "foo\n", "removed.go": "foo\n"},
+		commitB: {"same.go": "foo\n", "changed.go": "bar\nfoo\n", "added.go": "foo\n"},
+	}
+	store, cleanup, err := newStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	store.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		tarball, err := newTar(tars[commit])
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(tarball)), nil
+	}
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	form := searchForm(&protocol.Request{
+		Repo:         "foo",
+		PatternInfo:  protocol.PatternInfo{Pattern: "foo"},
+		FetchTimeout: "2000ms",
+	})
+	form["Commits"] = []string{commitA, commitB}
+	resp, err := http.PostForm(ts.URL+"/revisions", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("unexpected status %d: %s", resp.StatusCode, body)
+	}
+	var got protocol.RevisionsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, m := range got.Matches {
+		lines = append(lines, fmt.Sprintf("%s:%d %v", m.Path, m.LineMatches[0].LineNumber+1, m.Commits))
+	}
+	sort.Strings(lines)
+	want := []string{
+		"added.go:1 [" + commitB + "]",
+		"changed.go:1 [" + commitA + "]",
+		"changed.go:2 [" + commitB + "]",
+		"removed.go:1 [" + commitA + "]",
+		"same.go:1 [" + commitA + " " + commitB + "]",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got matches:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+
+	form["IncludeBlame"] = []string{"true"}
+	resp, err = http.PostForm(ts.URL+"/revisions", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("IncludeBlame: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestSearch_protocolVersion(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{"a.go": "foo\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	cases := []struct {
+		name        string
+		header      string
+		patternType protocol.PatternType
+		wantCode    int
+		wantVersion string
+	}{
+		{name: "no header", patternType: "", wantCode: 200, wantVersion: "1"},
+		{name: "v1", header: "1", patternType: "", wantCode: 200, wantVersion: "1"},
+		{name: "v2", header: "2", patternType: protocol.PatternTypeLiteral, wantCode: 200, wantVersion: "2"},
+		{name: "v2 without PatternType", header: "2", patternType: "", wantCode: 400, wantVersion: "2"},
+		{name: "newer client", header: "99", patternType: protocol.PatternTypeLiteral, wantCode: 200, wantVersion: strconv.Itoa(protocol.Version)},
+		{name: "invalid", header: "abc", wantCode: 400},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			form := searchForm(&protocol.Request{
+				Repo:         "foo",
+				Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+				PatternInfo:  protocol.PatternInfo{Pattern: "foo", PatternType: c.patternType},
+				FetchTimeout: "2000ms",
+			})
+			req, err := http.NewRequest("POST", ts.URL, strings.NewReader(form.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if c.header != "" {
+				req.Header.Set(protocol.VersionHeader, c.header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != c.wantCode {
+				t.Errorf("got status %d, want %d", resp.StatusCode, c.wantCode)
+			}
+			if got := resp.Header.Get(protocol.VersionHeader); got != c.wantVersion {
+				t.Errorf("got version %q, want %q", got, c.wantVersion)
+			}
+		})
+	}
+}
+
+func TestSearch_stats(t *testing.T) {
+	files := map[string]string{"a.go": "foo\n", "b.go": "bar\nFoo\n"}
+	store, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	stats := func() protocol.Stats {
+		t.Helper()
+		resp, err := http.PostForm(ts.URL, searchForm(&protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:  protocol.PatternInfo{Pattern: "foo", IsRegExp: true},
+			FetchTimeout: "2000ms",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var r protocol.Response
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		return r.Stats
+	}
+
+	first := stats()
+	if first.GitserverBytesFetched == 0 {
+		t.Error("expected the first search to fetch the archive from gitserver")
+	}
+	if want := int64(len(files["a.go"]) + len(files["b.go"])); first.CacheBytesRead != want {
+		t.Errorf("got CacheBytesRead %d, want %d", first.CacheBytesRead, want)
+	}
+	if first.PeakBufferBytes == 0 {
+		t.Error("expected a case insensitive regexp search to use buffers")
+	}
+	if first.CPUMilliseconds < 0 {
+		t.Errorf("got negative CPUMilliseconds %d", first.CPUMilliseconds)
+	}
+
+	if second := stats(); second.GitserverBytesFetched != 0 {
+		t.Errorf("expected the cached archive to be searched, got GitserverBytesFetched %d", second.GitserverBytesFetched)
+	}
+}
+
+func TestSearch_refines(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go": "food\n",
+		"b.go": "fob\n",
+		"c.go": "bar\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	run := func(pattern, refines string) protocol.Response {
+		t.Helper()
+		resp, err := http.PostForm(ts.URL, searchForm(&protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:  protocol.PatternInfo{Pattern: pattern, PatternType: protocol.PatternTypeLiteral},
+			FetchTimeout: "2000ms",
+			Refines:      refines,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var r protocol.Response
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		sort.Sort(sortByPath(r.Matches))
+		return r
+	}
+
+	first := run("fo", "")
+	if got, want := toString(first.Matches), "a.go:1:food\nb.go:1:fob\n"; got != want {
+		t.Fatalf("got matches:\n%s\nwant:\n%s", got, want)
+	}
+	if first.RefinementToken == "" {
+		t.Fatal("expected a refinement token")
+	}
+	refined := run("foo", first.RefinementToken)
+	if got, want := toString(refined.Matches), "a.go:1:food\n"; got != want {
+		t.Errorf("got refined matches:\n%s\nwant:\n%s", got, want)
+	}
+	// A request which does not refine the previous one ignores the token.
+	if got, want := toString(run("bar", first.RefinementToken).Matches), "c.go:1:bar\n"; got != want {
+		t.Errorf("got matches for a non-refining request:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSearch_stream(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go": "foo\n",
+		"b.go": "bar\nfoo\n",
+		"c.go": "bar\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	post := func(accept string, wantContent bool) *http.Response {
+		t.Helper()
+		form := searchForm(&protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:  protocol.PatternInfo{Pattern: "foo"},
+			FetchTimeout: "2000ms",
+		})
+		if wantContent {
+			form.Set("WantContent", "true")
+		}
+		req, err := http.NewRequest("POST", ts.URL, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Get("Content-Type"); got != accept {
+			t.Fatalf("got Content-Type %q, want %q", got, accept)
+		}
+		return resp
+	}
+
+	for _, wantContent := range []bool{false, true} {
+		resp := post(protocol.StreamContentTypeNDJSON, wantContent)
+		var (
+			matches []protocol.FileMatch
+			done    *protocol.StreamDone
+		)
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var ev protocol.StreamEvent
+			if err := dec.Decode(&ev); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if done != nil {
+				t.Fatal("got an event after the done event")
+			}
+			if ev.Match != nil {
+				matches = append(matches, *ev.Match)
+			}
+			done = ev.Done
+		}
+		resp.Body.Close()
+		sort.Sort(sortByPath(matches))
+		if got, want := toString(matches), "a.go:1:foo\nb.go:2:foo\n"; got != want {
+			t.Errorf("WantContent=%v: got matches:\n%s\nwant:\n%s", wantContent, got, want)
+		}
+		if done == nil || done.LimitHit || done.DeadlineHit || done.Error != "" {
+			t.Errorf("WantContent=%v: unexpected done event %+v", wantContent, done)
+		}
+		if wantContent && len(matches) > 0 && matches[0].Content != "foo\n" {
+			t.Errorf("expected streamed matches to have content, got %q", matches[0].Content)
+		}
+	}
+
+	resp := post(protocol.StreamContentTypeSSE, false)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := strings.Split(strings.TrimSpace(string(body)), "\n\n")
+	if len(events) != 3 {
+		t.Fatalf("expected 2 match events and a done event, got:\n%s", body)
+	}
+	for i, ev := range events {
+		want := "event: match\ndata: {"
+		if i == len(events)-1 {
+			want = "event: done\ndata: {"
+		}
+		if !strings.HasPrefix(ev, want) {
+			t.Errorf("unexpected event %d:\n%s", i, ev)
+		}
+	}
+}
+
+func TestSearch_grpc(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go": "foo\n",
+		"b.go": "bar\nfoo foo\n",
+		"c.go": "bar\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	client, cleanup := newGRPCClient(t, &search.Service{Store: store})
+	defer cleanup()
+
+	req := &search.SearchRequest{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		Pattern:      "foo",
+		FetchTimeout: "2000ms",
+	}
+	stream, err := client.Search(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		got  []string
+		done *search.SearchDone
+	)
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if done != nil {
+			t.Fatal("got a message after the done message")
+		}
+		if fm := resp.GetFileMatch(); fm != nil {
+			for _, lm := range fm.LineMatches {
+				for _, r := range lm.Ranges {
+					got = append(got, fmt.Sprintf("%s:%d:%d:%d", fm.Path, lm.LineNumber+1, r.Offset, r.Length))
+				}
+			}
+		}
+		done = resp.GetDone()
+	}
+	sort.Strings(got)
+	if want := []string{"a.go:1:0:3", "b.go:2:0:3", "b.go:2:4:3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got matches %v, want %v", got, want)
+	}
+	if done == nil {
+		t.Fatal("got no done message")
+	}
+	if done.LimitHit || done.DeadlineHit || done.Error != "" {
+		t.Errorf("unexpected done message %+v", done)
+	}
+
+	// IncludeRanges returns the positions of matches in the file.
+	req.IncludeRanges = true
+	stream, err = client.Search(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if fm := resp.GetFileMatch(); fm != nil && fm.Path == "b.go" {
+			for _, lm := range fm.LineMatches {
+				for _, r := range lm.MatchRanges {
+					got = append(got, fmt.Sprintf("%d:%d:%d-%d:%d:%d", r.Start.Line, r.Start.Column, r.Start.Offset, r.End.Line, r.End.Column, r.End.Offset))
+				}
+			}
+		}
+	}
+	if want := []string{"1:0:4-1:3:7", "1:4:8-1:7:11"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got ranges %v, want %v", got, want)
+	}
+	req.IncludeRanges = false
+
+	// IncludeDiffs returns the diff of replacing the matches in each file.
+	req.IncludeDiffs, req.Replacement = true, "baz"
+	stream, err = client.Search(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var diff string
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if fm := resp.GetFileMatch(); fm != nil && fm.Path == "a.go" {
+			diff = fm.Diff
+		}
+	}
+	if want := "--- a/a.go\n+++ b/a.go\n@@ -1,1 +1,1 @@\n-foo\n+baz\n"; diff != want {
+		t.Errorf("got diff:\n%s\nwant:\n%s", diff, want)
+	}
+	req.IncludeDiffs, req.Replacement = false, ""
+
+	// Invalid requests are rejected before anything is streamed.
+	req.Commit = "HEAD"
+	stream, err = client.Search(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got error %v, want InvalidArgument", err)
+	}
+}
+
+func TestSearch_grpcUnauthorized(t *testing.T) {
+	// The service sheds every request it admits, so only requests which
+	// are authorized before admission are denied.
+	client, cleanup := newGRPCClient(t, &search.Service{
+		MaxHeapBytes: 1,
+		Authorize: func(ctx context.Context, repo api.RepoName, credentials string) (bool, error) {
+			return false, nil
+		},
+	})
+	defer cleanup()
+
+	stream, err := client.Search(context.Background(), &search.SearchRequest{
+		Repo:    "foo",
+		Commit:  "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		Pattern: "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("got error %v, want PermissionDenied", err)
+	}
+}
+
+// newGRPCClient returns a client of the gRPC API of s, served in memory.
+func newGRPCClient(t *testing.T, s *search.Service) (search.SearcherClient, func()) {
+	l := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	s.RegisterGRPC(srv)
+	go srv.Serve(l)
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return l.Dial()
+	}))
+	if err != nil {
+		srv.Stop()
+		t.Fatal(err)
+	}
+	return search.NewSearcherClient(conn), func() {
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+func TestSearch_symbols(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go":      "package a\n\nfunc ParseA() {}\n\nfunc other() {}\n",
+		"b.go":      "package b\n\nfunc parseB() {}\n",
+		"c.go":      "package c\n\nfunc unrelated() {}\n",
+		"vendor.go": "package v\n\nfunc ParseV() {}\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	var parsed int32
+	ts := httptest.NewServer(&search.Service{
+		Store: store,
+		ParseSymbols: func(ctx context.Context, path string, content []byte) ([]ctags.Entry, error) {
+			atomic.AddInt32(&parsed, 1)
+			var entries []ctags.Entry
+			for i, line := range strings.Split(string(content), "\n") {
+				if strings.HasPrefix(line, "func ") {
+					name := strings.TrimSuffix(strings.TrimPrefix(line, "func "), "() {}")
+					entries = append(entries, ctags.Entry{Name: name, Kind: "function", Language: "Go", Line: i + 1})
+				}
+			}
+			return entries, nil
+		},
+	})
+	defer ts.Close()
+
+	symbols := func(p *protocol.Request) protocol.SymbolsResponse {
+		t.Helper()
+		resp, err := http.PostForm(ts.URL+"/symbols", searchForm(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			t.Fatalf("unexpected status %d: %s", resp.StatusCode, body)
+		}
+		var r protocol.SymbolsResponse
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	// Literal patterns skip files which don't contain them.
+	got := symbols(&protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "parse", ExcludePattern: "vendor", PathPatternsAreRegExps: true},
+		FetchTimeout: "2000ms",
+	})
+	want := protocol.SymbolsResponse{Symbols: []protocol.Symbol{
+		{Name: "ParseA", Path: "a.go", Line: 2, Kind: "function", Language: "Go"},
+		{Name: "parseB", Path: "b.go", Line: 2, Kind: "function", Language: "Go"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if n := atomic.LoadInt32(&parsed); n != 2 {
+		t.Errorf("parsed %d files, want 2", n)
+	}
+
+	got = symbols(&protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "^Parse", IsRegExp: true, IsCaseSensitive: true, FileMatchLimit: 1},
+		FetchTimeout: "2000ms",
+	})
+	want = protocol.SymbolsResponse{
+		Symbols:  []protocol.Symbol{{Name: "ParseA", Path: "a.go", Line: 2, Kind: "function", Language: "Go"}},
+		LimitHit: true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestSearch_batch(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go": "foo\n",
+		"b.go": "foo\n",
+		"c.go": "bar\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	fetchTar := store.FetchTar
+	store.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		if repo.Name == "broken" {
+			return nil, errors.New("gitserver is down")
+		}
+		return fetchTar(ctx, repo, commit)
+	}
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	batch := func(limit int, repos ...string) protocol.BatchResponse {
+		t.Helper()
+		form := searchForm(&protocol.Request{
+			PatternInfo:  protocol.PatternInfo{Pattern: "foo", FileMatchLimit: limit},
+			FetchTimeout: "2000ms",
+		})
+		form.Del("Repo")
+		form.Del("Commit")
+		for _, repo := range repos {
+			form.Add("Repos", repo+"@deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+		}
+		resp, err := http.PostForm(ts.URL+"/batch", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			t.Fatalf("unexpected status %d: %s", resp.StatusCode, body)
+		}
+		var r protocol.BatchResponse
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	summary := func(r protocol.BatchResponse) []string {
+		var s []string
+		for _, m := range r.Matches {
+			s = append(s, string(m.Repo)+":"+m.Path)
+		}
+		for _, e := range r.Errors {
+			s = append(s, "error:"+string(e.Repo))
+		}
+		return s
+	}
+
+	r := batch(0, "foo", "broken", "bar")
+	got := summary(r)
+	sort.Strings(got[:2])
+	sort.Strings(got[2:4])
+	if want := []string{"foo:a.go", "foo:b.go", "bar:a.go", "bar:b.go", "error:broken"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if r.LimitHit || r.DeadlineHit {
+		t.Errorf("unexpected LimitHit=%v DeadlineHit=%v", r.LimitHit, r.DeadlineHit)
+	}
+
+	// The limit is shared by all repositories.
+	r = batch(3, "foo", "bar", "baz")
+	if len(r.Matches) != 3 || !r.LimitHit {
+		t.Errorf("got %d matches and LimitHit=%v, want 3 and true", len(r.Matches), r.LimitHit)
+	}
+}
+
+func TestSearch_trigramIndex(t *testing.T) {
+	files := map[string]string{
+		"a.go":     "func ParseConfig() {}\n",
+		"b.go":     "func parseFlags() {}\n",
+		"c.go":     "var x = 1\n",
+		"parse.md": "nothing here\n",
+	}
+	indexed, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	indexed.TrigramIndexThreshold = 1
+	plain, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	indexedServer := httptest.NewServer(&search.Service{Store: indexed})
+	defer indexedServer.Close()
+	plainServer := httptest.NewServer(&search.Service{Store: plain})
+	defer plainServer.Close()
+
+	// Files skipped by the index must not change the results.
+	for _, info := range []protocol.PatternInfo{
+		{Pattern: "parse"},
+		{Pattern: "Parse", IsCaseSensitive: true},
+		{Pattern: "parse(Config|Flags)", IsRegExp: true},
+		{Pattern: "Config|x =", IsRegExp: true},
+		{Pattern: "parse", PatternMatchesPath: true, PatternMatchesContent: true},
+		{Pattern: "x = 1", InvertMatch: true},
+		{Pattern: "nowhere"},
+	} {
+		req := &protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:  info,
+			FetchTimeout: "2000ms",
+		}
+		for i := 0; i < 2; i++ {
+			got, err := doSearch(indexedServer.URL, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := doSearch(plainServer.URL, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Sort(sortByPath(got))
+			sort.Sort(sortByPath(want))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%+v: got %v, want %v", info, toString(got), toString(want))
+			}
+		}
+	}
+}
+
+func TestSearch_contextLines(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.txt": "one\r\ntwo\nthree foo\nfour\nfive\nsix foo\n",
+		"b.txt": "foo\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	type context struct{ Before, After []string }
+	m, err := doSearch(ts.URL, &protocol.Request{
+		Repo:          "foo",
+		Commit:        "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:   protocol.PatternInfo{Pattern: "foo"},
+		FetchTimeout:  "2000ms",
+		ContextBefore: 2,
+		ContextAfter:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]context{}
+	for _, fm := range m {
+		for _, lm := range fm.LineMatches {
+			got[fm.Path] = append(got[fm.Path], context{lm.Before, lm.After})
+		}
+	}
+	want := map[string][]context{
+		"a.txt": {
+			{Before: []string{"one", "two"}, After: []string{"four"}},
+			// The trailing newline does not start another line.
+			{Before: []string{"four", "five"}},
+		},
+		"b.txt": {{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err = doSearch(ts.URL, &protocol.Request{
+		Repo:          "foo",
+		Commit:        "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:   protocol.PatternInfo{Pattern: "foo"},
+		FetchTimeout:  "2000ms",
+		ContextBefore: protocol.MaxContextLines + 1,
+	})
+	if err == nil || !strings.Contains(err.Error(), "ContextBefore and ContextAfter must be between") {
+		t.Errorf("expected too many context lines to be rejected, got err=%v", err)
+	}
+}
+
+func TestSearch_languages(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go":   "package a // foo\n",
+		"b.py":   "foo = 1\n",
+		"script": "#!/usr/bin/env python\nfoo()\n",
+		"c.txt":  "foo\n",
+		// enry detects C++ from the content, but .h is also C.
+		"d.h": "#include <iostream>\nnamespace foo {\nclass Foo {\npublic:\n  template <typename T> void foo(T t);\n};\n}\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	cases := []struct {
+		name            string
+		include         []string
+		exclude         []string
+		includePatterns []string
+		want            []string
+	}{{
+		name:    "lang",
+		include: []string{"python"},
+		want:    []string{"b.py", "script"},
+	}, {
+		name:    "several langs",
+		include: []string{"go", "python"},
+		want:    []string{"a.go", "b.py", "script"},
+	}, {
+		name:    "-lang",
+		exclude: []string{"python"},
+		want:    []string{"a.go", "c.txt", "d.h"},
+	}, {
+		name:    "-lang detected",
+		exclude: []string{"c++"},
+		want:    []string{"a.go", "b.py", "c.txt", "script"},
+	}, {
+		// The frontend sends the extension globs of lang:c too.
+		name:            "ambiguous extension",
+		include:         []string{"c"},
+		includePatterns: []string{`(?:\.c$)|(?:\.cats$)|(?:\.h$)|(?:\.idc$)`},
+		want:            []string{"d.h"},
+	}}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Search twice, the second time the languages are remembered.
+			for i := 0; i < 2; i++ {
+				m, err := doSearch(ts.URL, &protocol.Request{
+					Repo:   "foo",
+					Commit: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+					PatternInfo: protocol.PatternInfo{
+						Pattern:                "foo",
+						Languages:              tc.include,
+						ExcludeLanguages:       tc.exclude,
+						IncludePatterns:        tc.includePatterns,
+						PathPatternsAreRegExps: true,
+					},
+					FetchTimeout: "2000ms",
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, fm := range m {
+					got = append(got, fm.Path)
+				}
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("got %q, want %q", got, tc.want)
+				}
+			}
+		})
+	}
+
+	_, err = doSearch(ts.URL, &protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "foo", Languages: []string{"notalanguage"}},
+		FetchTimeout: "2000ms",
+	})
+	if err == nil || !strings.Contains(err.Error(), "unknown language") {
+		t.Errorf("expected an unknown language to be rejected, got err=%v", err)
+	}
+}
+
+func TestSearch_replacements(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go":  "return Errors.New(\"x\"), errors.New(\"yz\")\n",
+		"b.txt": "héllo foo\nfoo\nbar\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	cases := []struct {
+		name        string
+		pattern     protocol.PatternInfo
+		replacement string
+		want        map[string][][]string
+	}{{
+		name:        "captures keep their case",
+		pattern:     protocol.PatternInfo{Pattern: `(\w+)\.new\(("\w+")\)`, IsRegExp: true},
+		replacement: "${1}.Wrap(err, $2)",
+		want: map[string][][]string{
+			"a.go": {{`Errors.Wrap(err, "x")`}, {`errors.Wrap(err, "yz")`}},
+		},
+	}, {
+		name:        "literal",
+		pattern:     protocol.PatternInfo{Pattern: "foo", IsCaseSensitive: true},
+		replacement: "[$0$$]",
+		want: map[string][][]string{
+			"b.txt": {{"[foo$]"}, {"[foo$]"}},
+		},
+	}, {
+		name:        "multiline",
+		pattern:     protocol.PatternInfo{Pattern: `foo\n(\w+)`, IsRegExp: true},
+		replacement: "$1",
+		want: map[string][][]string{
+			// The match continues on the second line.
+			"b.txt": {{"foo"}, {""}},
+		},
+	}}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := doSearch(ts.URL, &protocol.Request{
+				Repo:                "foo",
+				Commit:              "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+				PatternInfo:         tc.pattern,
+				FetchTimeout:        "2000ms",
+				IncludeReplacements: true,
+				Replacement:         tc.replacement,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string][][]string{}
+			for _, fm := range m {
+				for _, lm := range fm.LineMatches {
+					got[fm.Path] = append(got[fm.Path], lm.Replacements)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSearch_diffs(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go": "package a\n\nvar _ = errors.New(\"x\")\nvar _ = errors.New(\"y\")\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	m, err := doSearch(ts.URL, &protocol.Request{
+		Repo:   "foo",
+		Commit: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		// The diff includes the matches beyond MaxLineMatchesPerFile.
+		PatternInfo:  protocol.PatternInfo{Pattern: `errors\.New\((".*")\)`, IsRegExp: true, MaxLineMatchesPerFile: 1},
+		FetchTimeout: "2000ms",
+		IncludeDiffs: true,
+		Replacement:  "fmt.Errorf($1)",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Fatalf("got %d file matches, want 1", len(m))
+	}
+	want := `--- a/a.go
++++ b/a.go
+@@ -1,4 +1,4 @@
+ package a
+ 
+-var _ = errors.New("x")
+-var _ = errors.New("y")
++var _ = fmt.Errorf("x")
++var _ = fmt.Errorf("y")
+`
+	if m[0].Diff != want {
+		t.Errorf("got diff:\n%s\nwant:\n%s", m[0].Diff, want)
+	}
+}
+
+func TestSearch_rank(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go":      "foo\n",
+		"b.go":      "foo\nfoo\nfoo\n",
+		"c.go":      "foo\nfoo\n",
+		"doc/d.md":  "foo\n",
+		"vendor/e":  "foo\nfoo\nfoo\nfoo\n",
+		"unrelated": "bar\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	cases := []struct {
+		name string
+		p    protocol.PatternInfo
+		want []string
+	}{{
+		name: "path",
+		p:    protocol.PatternInfo{Pattern: "foo", RankBy: protocol.RankPath},
+		want: []string{"a.go", "b.go", "c.go", "doc/d.md", "vendor/e"},
+	}, {
+		name: "path limited",
+		p:    protocol.PatternInfo{Pattern: "foo", RankBy: protocol.RankPath, FileMatchLimit: 2},
+		want: []string{"a.go", "b.go"},
+	}, {
+		name: "matches",
+		p:    protocol.PatternInfo{Pattern: "foo", RankBy: protocol.RankMatches},
+		want: []string{"vendor/e", "b.go", "c.go", "a.go", "doc/d.md"},
+	}, {
+		name: "priority",
+		p:    protocol.PatternInfo{Pattern: "foo", RankBy: protocol.RankPath, PriorityPatterns: []string{`\.md$`, `^c`}, PathPatternsAreRegExps: true},
+		want: []string{"doc/d.md", "c.go", "a.go", "b.go", "vendor/e"},
+	}, {
+		name: "priority limited",
+		p:    protocol.PatternInfo{Pattern: "foo", RankBy: protocol.RankPath, PriorityPatterns: []string{`^doc/`}, PathPatternsAreRegExps: true, FileMatchLimit: 2},
+		want: []string{"doc/d.md", "a.go"},
+	}}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := doSearch(ts.URL, &protocol.Request{
+				Repo:         "foo",
+				Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+				PatternInfo:  tc.p,
+				FetchTimeout: "2000ms",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, fm := range m {
+				got = append(got, fm.Path)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	_, err = doSearch(ts.URL, &protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "foo", RankBy: "size"},
+		FetchTimeout: "2000ms",
+	})
+	if err == nil {
+		t.Error("expected an error for an unknown RankBy")
+	}
+}
+
+func TestSearch_pagination(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go": "foo\n",
+		"b.go": "foo\nbar\nfoo\nfoo\n",
+		"c.go": "bar\n",
+		"d.go": "foo\n",
+		"e.go": "foo\nfoo\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	run := func(p protocol.Request) (protocol.Response, int) {
+		t.Helper()
+		p.Repo = "foo"
+		p.Commit = "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"
+		p.FetchTimeout = "2000ms"
+		resp, err := http.PostForm(ts.URL, searchForm(&p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var r protocol.Response
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return r, resp.StatusCode
+	}
+	// pages returns the matches of every page of p, as path:line.
+	pages := func(p protocol.Request) [][]string {
+		t.Helper()
+		p.Paginate = true
+		var pages [][]string
+		for {
+			r, code := run(p)
+			if code != http.StatusOK {
+				t.Fatalf("got status %d", code)
+			}
+			var page []string
+			for _, fm := range r.Matches {
+				for _, lm := range fm.LineMatches {
+					page = append(page, fmt.Sprintf("%s:%d", fm.Path, lm.LineNumber))
+				}
+			}
+			pages = append(pages, page)
+			if r.Cursor == "" {
+				return pages
+			}
+			if !r.LimitHit || len(pages) > 10 {
+				t.Fatalf("got Cursor %q with LimitHit=%v after %d pages", r.Cursor, r.LimitHit, len(pages))
+			}
+			p.Cursor = r.Cursor
+		}
+	}
+
+	got := pages(protocol.Request{PatternInfo: protocol.PatternInfo{Pattern: "foo", RankBy: protocol.RankPath, FileMatchLimit: 2}})
+	want := [][]string{{"a.go:0", "b.go:0", "b.go:2", "b.go:3"}, {"d.go:0", "e.go:0", "e.go:1"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FileMatchLimit: got %v, want %v", got, want)
+	}
+
+	// Pages stop and resume within a file.
+	got = pages(protocol.Request{PatternInfo: protocol.PatternInfo{Pattern: "foo", RankBy: protocol.RankPath, MaxMatches: 3}})
+	want = [][]string{{"a.go:0", "b.go:0", "b.go:2"}, {"b.go:3", "d.go:0", "e.go:0"}, {"e.go:1"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MaxMatches: got %v, want %v", got, want)
+	}
+
+	// Without RankBy, files are paged in the order of the archive.
+	var all []string
+	for _, page := range pages(protocol.Request{PatternInfo: protocol.PatternInfo{Pattern: "foo", FileMatchLimit: 1}}) {
+		all = append(all, page...)
+	}
+	sort.Strings(all)
+	if wantAll := []string{"a.go:0", "b.go:0", "b.go:2", "b.go:3", "d.go:0", "e.go:0", "e.go:1"}; !reflect.DeepEqual(all, wantAll) {
+		t.Errorf("archive order: got %v, want %v", all, wantAll)
+	}
+
+	for _, c := range []string{"not a cursor", "eyJjIjoiY2FmZWJhYmUiLCJmIjowLCJwIjoiYS5nbyJ9"} {
+		if _, code := run(protocol.Request{PatternInfo: protocol.PatternInfo{Pattern: "foo"}, Cursor: c}); code != http.StatusBadRequest {
+			t.Errorf("Cursor %q: got status %d, want %d", c, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestSearch_enclosingScope(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go": "package a\n\ntype T struct{}\n\nfunc (T) Foo() {\n\tfoo()\n}\n\nvar foo = func() {}\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{
+		Store: store,
+		ParseSymbols: func(ctx context.Context, path string, content []byte) ([]ctags.Entry, error) {
+			// What ctags reports for a.go (1-based lines).
+			return []ctags.Entry{
+				{Name: "a", Kind: "package", Line: 1},
+				{Name: "T", Kind: "struct", Line: 3, End: 3},
+				{Name: "Foo", Kind: "func", Line: 5, End: 7, Parent: "T"},
+				{Name: "foo", Kind: "var", Line: 9},
+			}, nil
+		},
+	})
+	defer ts.Close()
+
+	m, err := doSearch(ts.URL, &protocol.Request{
+		Repo:                  "foo",
+		Commit:                "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:           protocol.PatternInfo{Pattern: "foo", IsCaseSensitive: true},
+		FetchTimeout:          "2000ms",
+		IncludeEnclosingScope: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || len(m[0].LineMatches) != 2 {
+		t.Fatalf("unexpected matches %+v", m)
+	}
+	want := &protocol.EnclosingScope{Name: "Foo", Kind: "func", StartLine: 4, EndLine: 6}
+	if got := m[0].LineMatches[0].EnclosingScope; !reflect.DeepEqual(got, want) {
+		t.Errorf("line %d: got scope %+v, want %+v", m[0].LineMatches[0].LineNumber, got, want)
+	}
+	if got := m[0].LineMatches[1].EnclosingScope; got != nil {
+		t.Errorf("line %d: got scope %+v, want none", m[0].LineMatches[1].LineNumber, got)
+	}
+}
+
+func TestSearch_peers(t *testing.T) {
+	files := map[string]string{"a.txt": "hello world\n"}
+	req := &protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "world"},
+		FetchTimeout: "2000ms",
+	}
+
+	// peer has the archive cached.
+	peerStore, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	peer := httptest.NewServer(&search.Service{Store: peerStore})
+	defer peer.Close()
+	if _, err := doSearch(peer.URL, req); err != nil {
+		t.Fatal(err)
+	}
+
+	// empty has nothing cached.
+	emptyStore, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	empty := httptest.NewServer(&search.Service{Store: emptyStore})
+	defer empty.Close()
+
+	s, cleanup, err := newStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		return nil, errors.New("unexpected fetch from gitserver")
+	}
+	s.FetchPeerZip = (&search.Peers{Endpoints: endpoint.Static(empty.URL, peer.URL)}).FetchZip
+	ts := httptest.NewServer(&search.Service{Store: s})
+	defer ts.Close()
+
+	m, err := doSearch(ts.URL, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := toString(m), "a.txt:1:hello world\n"; got != want {
+		t.Errorf("got matches:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	store, cleanup, err := newStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	var allDown int32
+	prober := &search.GitserverProber{
+		Addrs: func(ctx context.Context) []string { return []string{"gitserver-0", "gitserver-1"} },
+		Ping: func(ctx context.Context, addr string) error {
+			if addr == "gitserver-1" || atomic.LoadInt32(&allDown) == 1 {
+				return errors.New("connection refused")
+			}
+			return nil
+		},
+		Interval: 10 * time.Millisecond,
+	}
+	ts := httptest.NewServer(&search.Service{Store: store, Gitservers: prober})
+	defer ts.Close()
+
+	ready := func() (int, protocol.Readiness) {
+		resp, err := http.Get(ts.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var r protocol.Readiness
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, r
+	}
+	waitFor := func(want protocol.GitserverHealth) protocol.Readiness {
+		for i := 0; i < 500; i++ {
+			code, r := ready()
+			if code != http.StatusOK || !r.Ready {
+				t.Fatalf("expected searcher to be ready, got %d %+v", code, r)
+			}
+			if r.Gitserver == want {
+				return r
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for gitserver health %q", want)
+		return protocol.Readiness{}
+	}
+
+	if _, r := ready(); r.Gitserver != protocol.GitserverHealthUnknown {
+		t.Errorf("got gitserver health %q before probing, want unknown", r.Gitserver)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go prober.Run(ctx)
+
+	r := waitFor(protocol.GitserverHealthDegraded)
+	if want := map[string]string{"gitserver-1": "connection refused"}; !reflect.DeepEqual(r.UnreachableGitservers, want) {
+		t.Errorf("got unreachable gitservers %v, want %v", r.UnreachableGitservers, want)
+	}
+	atomic.StoreInt32(&allDown, 1)
+	waitFor(protocol.GitserverHealthDown)
+}
+
+func TestReadyz_draining(t *testing.T) {
+	store, cleanup, err := newStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	service := &search.Service{Store: store}
+	ts := httptest.NewServer(service)
+	defer ts.Close()
+
+	service.Drain()
+	resp, err := http.Get(ts.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r protocol.Readiness
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || r.Ready || r.Reason != "shutting down" {
+		t.Fatalf("got %d %+v, want 503 shutting down", resp.StatusCode, r)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	store, cleanup, err := newStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if code, body := get("/healthz"); code != http.StatusOK || body != "ok" {
+		t.Fatalf("got %d %q, want 200 ok", code, body)
+	}
+
+	// The cache directory can't be written once a file is in its way.
+	if err := os.RemoveAll(store.Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(store.Path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(store.Path)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if code, body := get(path); code != http.StatusServiceUnavailable || !strings.Contains(body, "cache directory is not usable") {
+			t.Errorf("%s: got %d %q, want 503 with the reason", path, code, body)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{"a/b.go": "package b\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	const commit = "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"
+	get := func(query string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + "/file?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	// The archive is only served once it is cached.
+	if code, _ := get("repo=foo&commit=" + commit + "&path=a/b.go"); code != http.StatusNotFound {
+		t.Errorf("uncached archive: got status %d, want %d", code, http.StatusNotFound)
+	}
+	_, err = doSearch(ts.URL, &protocol.Request{
+		Repo:         "foo",
+		Commit:       commit,
+		PatternInfo:  protocol.PatternInfo{Pattern: "package"},
+		FetchTimeout: "2000ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		query string
+		code  int
+		body  string
+	}{
+		{"repo=foo&commit=" + commit + "&path=a/b.go", http.StatusOK, "package b\n"},
+		{"repo=foo&commit=" + commit + "&path=missing.go", http.StatusNotFound, ""},
+		{"repo=bar&commit=" + commit + "&path=a/b.go", http.StatusNotFound, ""},
+		{"repo=foo&commit=HEAD&path=a/b.go", http.StatusBadRequest, ""},
+	}
+	for _, tc := range cases {
+		code, body := get(tc.query)
+		if code != tc.code || (code == http.StatusOK && body != tc.body) {
+			t.Errorf("%s: got %d %q, want %d %q", tc.query, code, body, tc.code, tc.body)
+		}
+	}
+}
+
+func TestSearch_noFetch(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{"a.go": "package a\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	service := &search.Service{Store: store}
+	ts := httptest.NewServer(service)
+	defer ts.Close()
+
+	p := &protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "package"},
+		FetchTimeout: "2000ms",
+		NoFetch:      true,
+	}
+	resp, err := http.PostForm(ts.URL, searchForm(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("uncached: got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	// Searching without NoFetch caches the archive, after which NoFetch
+	// searches succeed.
+	p.NoFetch = false
+	if _, err := doSearch(ts.URL, p); err != nil {
+		t.Fatal(err)
+	}
+	p.NoFetch = true
+	matches, err := doSearch(ts.URL, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("got %d matches, want 1", len(matches))
+	}
+
+	// Service.NoFetch applies to every request.
+	service.NoFetch = true
+	p.NoFetch = false
+	p.Commit = "cafebabecafebabecafebabecafebabecafebabe"
+	resp, err = http.PostForm(ts.URL, searchForm(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("service NoFetch: got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestSearch_shadow(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{"a.go": "package a\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	shadowed := make(chan url.Values, 1)
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		shadowed <- r.PostForm
+	}))
+	defer canary.Close()
+
+	ts := httptest.NewServer(&search.Service{
+		Store:      store,
+		ShadowURL:  canary.URL,
+		ShadowRate: 1,
+	})
+	defer ts.Close()
+
+	_, err = doSearch(ts.URL, &protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "package"},
+		FetchTimeout: "2000ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case form := <-shadowed:
+		if got := form.Get("Pattern"); got != "package" {
+			t.Errorf("shadowed request has Pattern %q, want %q", got, "package")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not shadowed")
+	}
+}
+
+func TestAdminCache(t *testing.T) {
+	s, cleanup, err := newStore(map[string]string{"a.go": "package a\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: s, AdminToken: "secret"})
+	defer ts.Close()
+
+	commit := api.CommitID("deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+	for _, repo := range []api.RepoName{"foo", "bar"} {
+		if _, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: repo}, commit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	do := func(method, query string, v interface{}) int {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+"/admin/cache?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var entries []store.CacheEntry
+	if code := do("GET", "", &entries); code != http.StatusOK || len(entries) != 2 {
+		t.Fatalf("list: got status %d and %d entries, want 200 and 2", code, len(entries))
+	}
+
+	var infos []store.CacheEntryInfo
+	if code := do("GET", "repo=foo&commit="+string(commit), &infos); code != http.StatusOK || len(infos) != 1 {
+		t.Fatalf("inspect: got status %d and %d entries, want 200 and 1", code, len(infos))
+	}
+	if infos[0].Repo != "foo" || infos[0].Files != 1 || infos[0].Uses != 1 {
+		t.Errorf("inspect: unexpected entry %+v", infos[0])
+	}
+
+	if code := do("DELETE", "", nil); code != http.StatusBadRequest {
+		t.Errorf("purge without a repo: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := do("DELETE", "repo=foo", &entries); code != http.StatusOK || len(entries) != 1 || entries[0].Repo != "foo" {
+		t.Fatalf("purge: got status %d and entries %+v, want foo purged", code, entries)
+	}
+	if _, _, err := s.StatZip(gitserver.Repo{Name: "foo"}, commit); !os.IsNotExist(err) {
+		t.Errorf("expected foo to be purged, got err=%v", err)
+	}
+	if code := do("DELETE", "all=true", &entries); code != http.StatusOK || len(entries) != 1 || entries[0].Repo != "bar" {
+		t.Fatalf("purge all: got status %d and entries %+v, want bar purged", code, entries)
+	}
+}
+
+func TestAdminLimits(t *testing.T) {
+	store, cleanup, err := newStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	store.MaxCacheSizeBytes = 1000
+	service := &search.Service{
+		Store:          store,
+		DefaultTimeout: time.Minute,
+		MaxTimeout:     10 * time.Minute,
+	}
+	ts := httptest.NewServer(service)
+	defer ts.Close()
+
+	do := func(method, token, body string) (*protocol.Limits, int) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+"/admin/limits", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, resp.StatusCode
+		}
+		var l protocol.Limits
+		if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+			t.Fatal(err)
+		}
+		return &l, resp.StatusCode
+	}
+
+	// Disabled without a token.
+	if _, code := do("GET", "", ""); code != http.StatusNotFound {
+		t.Errorf("disabled: got status %d, want %d", code, http.StatusNotFound)
+	}
+
+	service.AdminToken = "secret"
+	if _, code := do("GET", "wrong", ""); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if _, code := do("POST", "secret", `{"MaxTimeout": "soon"}`); code != http.StatusBadRequest {
+		t.Errorf("invalid update: got status %d, want %d", code, http.StatusBadRequest)
+	}
+
+	l, code := do("POST", "secret", `{"MaxTimeout": "30s", "MaxConcurrentFetches": 3, "MaxCacheSizeBytes": 2000}`)
+	if code != http.StatusOK {
+		t.Fatalf("update: got status %d", code)
+	}
+	if *l.DefaultTimeout != "1m0s" || *l.MaxTimeout != "30s" || *l.MaxConcurrentFetches != 3 || *l.MaxCacheSizeBytes != 2000 {
+		b, _ := json.Marshal(l)
+		t.Errorf("unexpected limits after update: %s", b)
+	}
+	if got := store.GetMaxCacheSizeBytes(); got != 2000 {
+		t.Errorf("store MaxCacheSizeBytes is %d, want 2000", got)
+	}
+	if got := store.MaxConcurrentFetchTar(); got != 3 {
+		t.Errorf("store MaxConcurrentFetchTar is %d, want 3", got)
+	}
+}
+
+func TestCached(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{"a.go": "package a\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	const commit = "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"
+	head := func() *http.Response {
+		t.Helper()
+		resp, err := http.Head(ts.URL + "/cached?repo=foo&commit=" + commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := head(); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("before search: got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	_, err = doSearch(ts.URL, &protocol.Request{
+		Repo:         "foo",
+		Commit:       commit,
+		PatternInfo:  protocol.PatternInfo{Pattern: "package"},
+		FetchTimeout: "2000ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := head()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("after search: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if size, err := strconv.Atoi(resp.Header.Get("X-Archive-Size")); err != nil || size <= 0 {
+		t.Errorf("unexpected X-Archive-Size %q", resp.Header.Get("X-Archive-Size"))
+	}
+	if _, err := http.ParseTime(resp.Header.Get("Last-Modified")); err != nil {
+		t.Errorf("unexpected Last-Modified %q", resp.Header.Get("Last-Modified"))
+	}
+}
+
+func TestPrefetchJobs(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{"a.go": "package a\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	archives := []protocol.ArchiveRef{
+		{Repo: "foo", Commit: "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"},
+		{Repo: "bar", Commit: "cafebabecafebabecafebabecafebabecafebabe"},
+	}
+	body, err := json.Marshal(protocol.PrefetchJobRequest{Archives: archives})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(ts.URL+"/prefetch/jobs", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job protocol.PrefetchJob
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+	if job.Total != len(archives) || job.StatusURL == "" {
+		t.Fatalf("unexpected job %+v", job)
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); !job.Finished; {
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not finish: %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+		resp, err := http.Get(ts.URL + job.StatusURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job.Done != len(archives) || job.Failed != 0 {
+		t.Fatalf("unexpected finished job %+v", job)
+	}
+
+	for _, a := range archives {
+		resp, err := http.Head(ts.URL + "/cached?repo=" + string(a.Repo) + "&commit=" + string(a.Commit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s not cached after prefetch: got status %d", a.Repo, resp.StatusCode)
+		}
+	}
+
+	resp, err = http.Get(ts.URL + "/prefetch/jobs/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown job: got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{"a.go": "package a\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/prefetch?repo=foo&commit=deadbeef", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unresolved commit: got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	resp, err = http.Post(ts.URL+"/prefetch?repo=foo&commit=deadbeefdeadbeefdeadbeefdeadbeefdeadbeef", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var job protocol.PrefetchJob
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusAccepted || job.Total != 1 {
+		t.Fatalf("got status %d and job %+v, want %d and a job of 1 archive", resp.StatusCode, job, http.StatusAccepted)
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); !job.Finished; {
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not finish: %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+		resp, err := http.Get(ts.URL + job.StatusURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job.Done != 1 {
+		t.Fatalf("unexpected finished job %+v", job)
+	}
+	if _, _, err := store.StatZip(gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"); err != nil {
+		t.Errorf("not cached after prefetch: %v", err)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a/b.go": "package b\n",
+		"bin":    "\x00\x01\x02",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/files?repo=foo&commit=deadbeefdeadbeefdeadbeefdeadbeefdeadbeef&fetchTimeout=2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get(protocol.RoutingKeyHeader); got != "foo" {
+		t.Errorf("got routing key header %q, want %q", got, "foo")
+	}
+	var got protocol.ListFilesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(got.Files, func(i, j int) bool { return got.Files[i].Path < got.Files[j].Path })
+	want := []protocol.FileInfo{
+		{Path: "a/b.go", Size: 10, Mode: 0600},
+		{Path: "bin", Size: 3, Mode: 0600, Binary: true},
+	}
+	if !reflect.DeepEqual(got.Files, want) {
+		t.Errorf("got %+v, want %+v", got.Files, want)
+	}
+}
+
+func TestLookupHash(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.txt":     "hello\n",
+		"b/copy.md": "hello\n",
+		"c.txt":     "world\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	lookup := func(hash string) (int, []string) {
+		resp, err := http.Get(ts.URL + "/lookup-hash?repo=foo&commit=deadbeefdeadbeefdeadbeefdeadbeefdeadbeef&fetchTimeout=2s&hash=" + hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, nil
+		}
+		var got protocol.LookupHashResponse
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, got.Paths
+	}
+
+	cases := []struct {
+		name string
+		hash string
+		want []string
+	}{
+		// git hash-object of "hello\n"
+		{"blob sha1", "ce013625030ba8dba906f756967f9e9ca394464a", []string{"a.txt", "b/copy.md"}},
+		// sha256sum of "hello\n". The sidecar is used from now on.
+		{"sha256", "5891B5B522D5DF086D0FF0B110FBD9D21BB4FC7163AF34D08286A2E846F6BE03", []string{"a.txt", "b/copy.md"}},
+		{"missing", "0000000000000000000000000000000000000000", []string{}},
+	}
+	for _, tc := range cases {
+		code, got := lookup(tc.hash)
+		if code != http.StatusOK {
+			t.Fatalf("%s: got status %d", tc.name, code)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	sidecars, err := filepath.Glob(filepath.Join(store.Path, "*.hashes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sidecars) != 1 {
+		t.Errorf("got sidecars %v, want 1", sidecars)
+	}
+
+	if code, _ := lookup("nothex"); code != http.StatusBadRequest {
+		t.Errorf("invalid hash: got status %d, want 400", code)
+	}
+}
+
+func TestSearch_changedFiles(t *testing.T) {
+	files := map[string]string{
+		"a.go": "hello",
+		"b.go": "hello",
+		"c.go": "hello",
+	}
+	store, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	var gotBase, gotHead string
+	ts := httptest.NewServer(&search.Service{
+		Store: store,
+		ChangedFiles: func(ctx context.Context, repo gitserver.Repo, base, head string) ([]string, error) {
+			gotBase, gotHead = base, head
+			return []string{"b.go", "c.go", "deleted.go"}, nil
+		},
+	})
+	defer ts.Close()
+
+	req := protocol.Request{
+		Repo:                 "foo",
+		Commit:               "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:          protocol.PatternInfo{Pattern: "hello", IncludePatterns: []string{"*.go"}, ExcludePattern: "c.go"},
+		FetchTimeout:         "2000ms",
+		ChangedInLastCommits: 3,
+	}
+	m, err := doSearch(ts.URL, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := toString(m), "b.go:1:hello\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if want := "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef~3"; gotBase != want {
+		t.Errorf("got base %q, want %q", gotBase, want)
+	}
+	if gotHead != string(req.Commit) {
+		t.Errorf("got head %q, want %q", gotHead, req.Commit)
+	}
+
+	req.ChangedSinceCommit = "cafebabecafebabecafebabecafebabecafebabe"
+	if _, err := doSearch(ts.URL, &req); err != nil {
+		t.Fatal(err)
+	}
+	if gotBase != string(req.ChangedSinceCommit) {
+		t.Errorf("got base %q, want %q", gotBase, req.ChangedSinceCommit)
+	}
+}
+
+func TestSearch_changedFilesArchive(t *testing.T) {
+	files := map[string]string{
+		"a.go": "hello",
+		"b.go": "hello",
+		"c.go": "hello",
+	}
+	store, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	store.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		return nil, errors.New("unexpected fetch of the whole repository")
+	}
+	var gotPaths []string
+	store.FetchTarPaths = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID, paths []string) (io.ReadCloser, error) {
+		gotPaths = paths
+		subset := map[string]string{}
+		for _, p := range paths {
+			subset[p] = files[p]
+		}
+		tarball, err := newTar(subset)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(tarball)), nil
+	}
+
+	var changed []string
+	ts := httptest.NewServer(&search.Service{
+		Store: store,
+		ChangedFiles: func(ctx context.Context, repo gitserver.Repo, base, head string) ([]string, error) {
+			return changed, nil
+		},
+	})
+	defer ts.Close()
+
+	req := protocol.Request{
+		Repo:               "foo",
+		Commit:             "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:        protocol.PatternInfo{Pattern: "hello"},
+		FetchTimeout:       "2000ms",
+		ChangedSinceCommit: "cafebabecafebabecafebabecafebabecafebabe",
+	}
+
+	// Only the changed files are fetched.
+	changed = []string{"c.go", "b.go"}
+	m, err := doSearch(ts.URL, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(sortByPath(m))
+	if got, want := toString(m), "b.go:1:hello\nc.go:1:hello\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if want := []string{"b.go", "c.go"}; !reflect.DeepEqual(gotPaths, want) {
+		t.Errorf("got fetched paths %q, want %q", gotPaths, want)
+	}
+
+	// Nothing is fetched if no files changed.
+	changed, gotPaths = nil, nil
+	m, err = doSearch(ts.URL, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 0 || gotPaths != nil {
+		t.Errorf("got matches %q and fetched paths %q, want none", toString(m), gotPaths)
+	}
+}
+
+func TestSearch_pathSpec(t *testing.T) {
+	files := map[string]string{
+		"src/a.go":     "hello",
+		"src/b/c.go":   "hello",
+		"srcfoo/d.go":  "hello",
+		"other/e.go":   "hello",
+		"src.go":       "hello",
+		"README.md":    "hello",
+		"src/f/README": "hello",
+	}
+	store, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	store.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		return nil, errors.New("unexpected fetch of the whole repository")
+	}
+	var gotPaths []string
+	store.FetchTarPaths = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID, paths []string) (io.ReadCloser, error) {
+		gotPaths = paths
+		subtree := map[string]string{}
+		for name, body := range files {
+			if strings.HasPrefix(name, paths[0]+"/") {
+				subtree[name] = body
+			}
+		}
+		tarball, err := newTar(subtree)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(tarball)), nil
+	}
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	req := protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "hello", ExcludePattern: "**/README", PathSpec: "src"},
+		FetchTimeout: "2000ms",
+	}
+	m, err := doSearch(ts.URL, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(sortByPath(m))
+	if got, want := toString(m), "src/a.go:1:hello\nsrc/b/c.go:1:hello\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if want := []string{"src"}; !reflect.DeepEqual(gotPaths, want) {
+		t.Errorf("got fetched paths %q, want %q", gotPaths, want)
+	}
+
+	for _, pathSpec := range []string{"../src", "/src", "src/", "src/*"} {
+		req.PathSpec = pathSpec
+		if _, err := doSearch(ts.URL, &req); err == nil || !strings.Contains(err.Error(), "PathSpec") {
+			t.Errorf("expected PathSpec %q to be rejected, got err=%v", pathSpec, err)
+		}
+	}
+}
+
+func TestSearch_sparseArchive(t *testing.T) {
+	files := map[string]string{
+		"a.go":        "hello",
+		"src/b.go":    "hello",
+		"src/c.txt":   "hello",
+		"lib/d.GO":    "hello",
+		"README.md":   "hello",
+		"srcfoo/e.go": "hello",
+	}
+	store, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	fetchTar := store.FetchTar
+	fullFetches := 0
+	store.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		fullFetches++
+		return fetchTar(ctx, repo, commit)
+	}
+	var gotPaths []string
+	store.FetchTarPaths = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID, paths []string) (io.ReadCloser, error) {
+		gotPaths = paths
+		var match func(string) bool
+		switch paths[0] {
+		case ":(glob)**/*.go":
+			match = func(name string) bool { return strings.HasSuffix(name, ".go") }
+		case ":(glob,icase)**/*.go":
+			match = func(name string) bool { return strings.HasSuffix(strings.ToLower(name), ".go") }
+		case "src":
+			match = func(name string) bool { return strings.HasPrefix(name, "src/") }
+		default:
+			return nil, fmt.Errorf("pathspec %q did not match any files", paths[0])
+		}
+		sparse := map[string]string{}
+		for name, body := range files {
+			if match(name) {
+				sparse[name] = body
+			}
+		}
+		tarball, err := newTar(sparse)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(tarball)), nil
+	}
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	cases := []struct {
+		name        string
+		patternInfo protocol.PatternInfo
+		wantPaths   []string // nil if the whole repository is fetched
+		want        string
+	}{{
+		name:        "regexp extension",
+		patternInfo: protocol.PatternInfo{IncludePatterns: []string{`\.go$`}, PathPatternsAreRegExps: true, PathPatternsAreCaseSensitive: true},
+		wantPaths:   []string{":(glob)**/*.go"},
+		want:        "a.go:1:hello\nsrc/b.go:1:hello\nsrcfoo/e.go:1:hello\n",
+	}, {
+		name:        "case insensitive glob extension",
+		patternInfo: protocol.PatternInfo{IncludePatterns: []string{"**/*.go"}},
+		wantPaths:   []string{":(glob,icase)**/*.go"},
+		want:        "lib/d.GO:1:hello\nsrc/b.go:1:hello\nsrcfoo/e.go:1:hello\n",
+	}, {
+		name:        "regexp directory",
+		patternInfo: protocol.PatternInfo{IncludePatterns: []string{`^src/`, `\.txt$`}, PathPatternsAreRegExps: true, PathPatternsAreCaseSensitive: true},
+		wantPaths:   []string{"src"},
+		want:        "src/c.txt:1:hello\n",
+	}, {
+		name:        "untranslatable",
+		patternInfo: protocol.PatternInfo{IncludePatterns: []string{`^(a|README)`}, PathPatternsAreRegExps: true},
+		want:        "README.md:1:hello\na.go:1:hello\n",
+	}, {
+		name:        "no matching files",
+		patternInfo: protocol.PatternInfo{IncludePatterns: []string{`\.rs$`}, PathPatternsAreRegExps: true, PathPatternsAreCaseSensitive: true},
+		wantPaths:   []string{":(glob)**/*.rs"},
+		want:        "",
+	}}
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotPaths, fullFetches = nil, 0
+			tc.patternInfo.Pattern = "hello"
+			req := protocol.Request{
+				Repo:         "foo",
+				Commit:       api.CommitID(fmt.Sprintf("%040d", i)),
+				PatternInfo:  tc.patternInfo,
+				FetchTimeout: "2000ms",
+			}
+			m, err := doSearch(ts.URL, &req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Sort(sortByPath(m))
+			if got := toString(m); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+			if !reflect.DeepEqual(gotPaths, tc.wantPaths) {
+				t.Errorf("got fetched paths %q, want %q", gotPaths, tc.wantPaths)
+			}
+			// The whole repository is fetched if the sparse archive can't be.
+			wantFullFetches := 0
+			if tc.wantPaths == nil || tc.want == "" {
+				wantFullFetches = 1
+			}
+			if fullFetches != wantFullFetches {
+				t.Errorf("got %d fetches of the whole repository, want %d", fullFetches, wantFullFetches)
+			}
+		})
+	}
+}
+
+func TestSearch_limits(t *testing.T) {
+	files := map[string]string{
+		"a.go": "foo\nfoo\nfoo\n",
+		"b.go": "foo\n",
+		"c.go": "bar\n",
+	}
+	store, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	run := func(p protocol.PatternInfo) protocol.Response {
+		t.Helper()
+		resp, err := http.PostForm(ts.URL, searchForm(&protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:  p,
+			FetchTimeout: "2000ms",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			t.Fatalf("non-200 response: code=%d body=%s", resp.StatusCode, body)
+		}
+		var r protocol.Response
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		sort.Sort(sortByPath(r.Matches))
+		return r
+	}
+
+	cases := []struct {
+		name       string
+		p          protocol.PatternInfo
+		wantLines  int
+		wantFiles  int
+		wantReason protocol.LimitReason
+	}{
+		{name: "none", p: protocol.PatternInfo{Pattern: "foo"}, wantLines: 4, wantFiles: 2},
+		{name: "file matches", p: protocol.PatternInfo{Pattern: "foo", FileMatchLimit: 1}, wantLines: -1, wantFiles: 1, wantReason: protocol.LimitFileMatches},
+		{name: "matches", p: protocol.PatternInfo{Pattern: "foo", MaxMatches: 2}, wantLines: -1, wantFiles: -1, wantReason: protocol.LimitMatches},
+		{name: "matches not hit", p: protocol.PatternInfo{Pattern: "foo", MaxMatches: 4}, wantLines: 4, wantFiles: 2},
+		{name: "bytes scanned", p: protocol.PatternInfo{Pattern: "foo", MaxBytesScanned: 5}, wantLines: -1, wantFiles: -1, wantReason: protocol.LimitBytesScanned},
+		{name: "bytes scanned not hit", p: protocol.PatternInfo{Pattern: "foo", MaxBytesScanned: 20}, wantLines: 4, wantFiles: 2},
+		{name: "line matches per file", p: protocol.PatternInfo{Pattern: "foo", MaxLineMatchesPerFile: 2}, wantLines: 3, wantFiles: 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := run(tc.p)
+			lines := 0
+			for _, fm := range r.Matches {
+				lines += len(fm.LineMatches)
+			}
+			if tc.wantLines >= 0 && lines != tc.wantLines {
+				t.Errorf("got %d line matches, want %d", lines, tc.wantLines)
+			}
+			if tc.wantFiles >= 0 && len(r.Matches) != tc.wantFiles {
+				t.Errorf("got %d file matches, want %d", len(r.Matches), tc.wantFiles)
+			}
+			if tc.p.MaxMatches > 0 && lines > tc.p.MaxMatches {
+				t.Errorf("got %d line matches, want at most %d", lines, tc.p.MaxMatches)
+			}
+			if r.LimitHit != (tc.wantReason != "") || r.LimitHitReason != tc.wantReason {
+				t.Errorf("got LimitHit=%v LimitHitReason=%q, want reason %q", r.LimitHit, r.LimitHitReason, tc.wantReason)
+			}
+		})
+	}
+
+	// The per file limit is reported on the file.
+	r := run(protocol.PatternInfo{Pattern: "foo", MaxLineMatchesPerFile: 2})
+	if len(r.Matches) != 2 || !r.Matches[0].LimitHit || r.Matches[1].LimitHit {
+		t.Errorf("got matches %+v, want a.go with LimitHit", r.Matches)
+	}
+
+	// CountOnly counts every match in a file, without LineMatches.
+	r = run(protocol.PatternInfo{Pattern: "foo", CountOnly: true, MaxLineMatchesPerFile: 1})
+	if r.MatchCount != 4 || len(r.Matches) != 2 || r.Matches[0].MatchCount != 3 || r.Matches[1].MatchCount != 1 || len(r.Matches[0].LineMatches) != 0 {
+		t.Errorf("got MatchCount=%d and matches %+v, want 3 matches in a.go and 1 in b.go", r.MatchCount, r.Matches)
+	}
+	// MaxMatches limits the counted matches.
+	r = run(protocol.PatternInfo{Pattern: "foo", CountOnly: true, MaxMatches: 2})
+	if r.MatchCount != 2 || r.LimitHitReason != protocol.LimitMatches {
+		t.Errorf("got MatchCount=%d LimitHitReason=%q, want 2 and %q", r.MatchCount, r.LimitHitReason, protocol.LimitMatches)
+	}
+}
+
+func TestSearch_largeFiles(t *testing.T) {
+	store, cleanup, err := newStore(map[string]string{
+		"a.go":   "foo\n",
+		"b.go":   "foo bar baz\n",
+		"gen.go": strings.Repeat("foo\n", 10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	store.MaxFileSize = 20
+	ts := httptest.NewServer(&search.Service{Store: store})
+	defer ts.Close()
+
+	run := func(maxFileSize int64) protocol.Response {
+		t.Helper()
+		resp, err := http.PostForm(ts.URL, searchForm(&protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:  protocol.PatternInfo{Pattern: "foo", MaxFileSize: maxFileSize},
+			FetchTimeout: "2000ms",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			t.Fatalf("non-200 response: code=%d body=%s", resp.StatusCode, body)
+		}
+		var r protocol.Response
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		sort.Sort(sortByPath(r.Matches))
+		sort.Strings(r.Stats.LargeFilesSkippedPaths)
+		return r
+	}
+
+	cases := []struct {
+		maxFileSize int64
+		want        string
+		wantSkipped []string
+	}{
+		// gen.go is larger than the limit of the store, so its content is
+		// not even cached.
+		{0, "a.go:1:foo\nb.go:1:foo bar baz\n", []string{"gen.go"}},
+		// A request can only lower the limit.
+		{5, "a.go:1:foo\n", []string{"b.go", "gen.go"}},
+		{100, "a.go:1:foo\nb.go:1:foo bar baz\n", []string{"gen.go"}},
+	}
+	for _, tc := range cases {
+		r := run(tc.maxFileSize)
+		if got := toString(r.Matches); got != tc.want {
+			t.Errorf("MaxFileSize=%d: got matches:\n%s\nwant:\n%s", tc.maxFileSize, got, tc.want)
+		}
+		if r.Stats.LargeFilesSkipped != int64(len(tc.wantSkipped)) || !reflect.DeepEqual(r.Stats.LargeFilesSkippedPaths, tc.wantSkipped) {
+			t.Errorf("MaxFileSize=%d: got %d skipped files %v, want %v", tc.maxFileSize, r.Stats.LargeFilesSkipped, r.Stats.LargeFilesSkippedPaths, tc.wantSkipped)
+		}
+	}
+}
+
+func TestSearch_blame(t *testing.T) {
+	files := map[string]string{
+		"a.go": "hello\nworld\nhello\n",
+	}
+	store, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	alice := protocol.LineBlame{Commit: "a", AuthorName: "alice"}
+	bob := protocol.LineBlame{Commit: "b", AuthorName: "bob"}
+	ts := httptest.NewServer(&search.Service{
+		Store: store,
+		Blame: func(ctx context.Context, repo gitserver.Repo, commit api.CommitID, path string, startLine, endLine int) ([]search.BlameHunk, error) {
+			if path != "a.go" || startLine != 1 || endLine != 3 {
+				return nil, fmt.Errorf("unexpected blame of %s:%d-%d", path, startLine, endLine)
+			}
+			return []search.BlameHunk{
+				{StartLine: 1, EndLine: 2, LineBlame: alice},
+				{StartLine: 2, EndLine: 4, LineBlame: bob},
+			}, nil
+		},
+	})
+	defer ts.Close()
+
+	req := protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "hello"},
+		FetchTimeout: "2000ms",
+		IncludeBlame: true,
+	}
+	m, err := doSearch(ts.URL, &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || len(m[0].LineMatches) != 2 {
+		t.Fatalf("unexpected matches %+v", m)
+	}
+	for i, want := range []protocol.LineBlame{alice, bob} {
+		if got := m[0].LineMatches[i].Blame; got == nil || *got != want {
+			t.Errorf("line match %d: got blame %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestSearch_lfs(t *testing.T) {
+	lfsPointer := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", hex.EncodeToString(sum[:]), len(content))
+	}
+	objects := map[string]string{
+		"data.csv":    "id,name\n1,hello\n",
+		"missing.csv": "2,hello\n",
+	}
+	files := map[string]string{
+		"main.go":     "hello\n",
+		"data.csv":    lfsPointer(objects["data.csv"]),
+		"missing.csv": lfsPointer(objects["missing.csv"]),
+	}
+	store, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	fetchLFS := func(ctx context.Context, repo gitserver.Repo, commit api.CommitID, path string) ([]byte, error) {
+		if path == "missing.csv" {
+			return nil, errors.New("object not found")
+		}
+		return []byte(objects[path]), nil
+	}
+	ts := httptest.NewServer(&search.Service{Store: store, FetchLFS: fetchLFS})
+	defer ts.Close()
+
+	run := func(u, pattern string) (protocol.Response, error) {
+		resp, err := http.PostForm(u, searchForm(&protocol.Request{
+			Repo:         "foo",
+			Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+			PatternInfo:  protocol.PatternInfo{Pattern: pattern, FileMatchLimit: 1000},
+			FetchTimeout: "2000ms",
+			ResolveLFS:   true,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return protocol.Response{}, fmt.Errorf("non-200 response: code=%d body=%s", resp.StatusCode, body)
+		}
+		var r protocol.Response
+		if err := json.Unmarshal(body, &r); err != nil {
+			t.Fatal(err)
+		}
+		sort.Sort(sortByPath(r.Matches))
+		return r, nil
+	}
+
+	cases := []struct {
+		pattern string
+		want    string
+	}{
+		// Unresolved pointers are still searched.
+		{"hello", "data.csv:2:1,hello\nmain.go:1:hello\n"},
+		{"sha256", "missing.csv:2:" + strings.Split(files["missing.csv"], "\n")[1] + "\n"},
+	}
+	for _, tc := range cases {
+		r, err := run(ts.URL, tc.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := toString(r.Matches); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.pattern, got, tc.want)
+		}
+		// missing.csv was not resolved.
+		if !r.LimitHit || r.LimitHitReason != protocol.LimitLFSObjects {
+			t.Errorf("%s: got LimitHit=%v LimitHitReason=%q, want %q", tc.pattern, r.LimitHit, r.LimitHitReason, protocol.LimitLFSObjects)
+		}
+	}
+
+	// The search fails if no object can be fetched, eg if gitserver can't
+	// fetch LFS objects at all.
+	broken := httptest.NewServer(&search.Service{
+		Store: store,
+		FetchLFS: func(ctx context.Context, repo gitserver.Repo, commit api.CommitID, path string) ([]byte, error) {
+			return nil, errors.New("git-lfs: command not found")
+		},
+	})
+	defer broken.Close()
+	if _, err := run(broken.URL, "hello"); err == nil || !strings.Contains(err.Error(), "git-lfs: command not found") {
+		t.Errorf("expected the search to fail if no object can be fetched, got err=%v", err)
+	}
+}
+
+func TestSearch_lfsTooManyObjects(t *testing.T) {
+	files := map[string]string{}
+	objects := map[string]string{}
+	for i := 0; i <= 100; i++ {
+		path := fmt.Sprintf("%03d.csv", i)
+		objects[path] = fmt.Sprintf("%d,hello\n", i)
+		sum := sha256.Sum256([]byte(objects[path]))
+		files[path] = fmt.Sprintf("version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n", hex.EncodeToString(sum[:]), len(objects[path]))
+	}
+	store, cleanup, err := newStore(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	ts := httptest.NewServer(&search.Service{
+		Store: store,
+		FetchLFS: func(ctx context.Context, repo gitserver.Repo, commit api.CommitID, path string) ([]byte, error) {
+			return []byte(objects[path]), nil
+		},
+	})
+	defer ts.Close()
+
+	resp, err := http.PostForm(ts.URL, searchForm(&protocol.Request{
+		Repo:         "foo",
+		Commit:       "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef",
+		PatternInfo:  protocol.PatternInfo{Pattern: "hello", FileMatchLimit: 1000},
+		FetchTimeout: "2000ms",
+		ResolveLFS:   true,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r protocol.Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first 100 objects are resolved.
+	if len(r.Matches) != 100 {
+		t.Errorf("got %d matches, want 100", len(r.Matches))
+	}
+	if !r.LimitHit || r.LimitHitReason != protocol.LimitLFSObjects {
+		t.Errorf("got LimitHit=%v LimitHitReason=%q, want %q", r.LimitHit, r.LimitHitReason, protocol.LimitLFSObjects)
+	}
+}
+
+func TestSearch_archive(t *testing.T) {
+	tarball, err := newTar(map[string]string{
+		"README.md": "# Hello World\n\nHello world example in go",
+		"main.go":   "package main\n\nfunc main() {}\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(&search.Service{})
+	defer ts.Close()
+
+	form := searchForm(&protocol.Request{PatternInfo: protocol.PatternInfo{Pattern: "world"}})
+	resp, err := http.Post(ts.URL+"/archive?"+form.Encode(), "application/x-tar", bytes.NewReader(tarball))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := readMatches(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(sortByPath(m))
+	got := toString(m)
+	want := "README.md:1:# Hello World\nREADME.md:3:Hello world example in go\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	resp, err = http.Get(ts.URL + "/archive?" + form.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /archive: got status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func doSearch(u string, p *protocol.Request) ([]protocol.FileMatch, error) {
+	resp, err := http.PostForm(u, searchForm(p))
+	if err != nil {
+		return nil, err
+	}
+	return readMatches(resp)
+}
+
+func searchForm(p *protocol.Request) url.Values {
+	form := url.Values{
+		"Repo":            []string{string(p.Repo)},
+		"URL":             []string{string(p.URL)},
+		"Commit":          []string{string(p.Commit)},
+		"Pattern":         []string{p.Pattern},
+		"PatternType":     []string{string(p.PatternType)},
+		"FetchTimeout":    []string{p.FetchTimeout},
+		"IncludePatterns": p.IncludePatterns,
+		"ExcludePattern":  []string{p.ExcludePattern},
+	}
+	if p.IsRegExp {
+		form.Set("IsRegExp", "true")
+	}
+	if p.IsStructuralPat {
+		form.Set("IsStructuralPat", "true")
+	}
+	if p.IsWordMatch {
+		form.Set("IsWordMatch", "true")
+	}
+	if p.Multiline {
+		form.Set("Multiline", "true")
+	}
+	if p.CountOnly {
+		form.Set("CountOnly", "true")
+	}
+	if p.RankBy != "" {
+		form.Set("RankBy", string(p.RankBy))
+	}
+	if len(p.PriorityPatterns) > 0 {
+		form["PriorityPatterns"] = p.PriorityPatterns
+	}
+	if p.Paginate {
+		form.Set("Paginate", "true")
+	}
+	if p.Cursor != "" {
+		form.Set("Cursor", p.Cursor)
+	}
+	if p.Priority != "" {
+		form.Set("Priority", string(p.Priority))
+	}
+	if p.IsCaseSensitive {
+		form.Set("IsCaseSensitive", "true")
+	}
+	if p.PathPatternsAreRegExps {
+		form.Set("PathPatternsAreRegExps", "true")
+	}
+	if p.PathPatternsAreCaseSensitive {
+		form.Set("PathPatternsAreCaseSensitive", "true")
+	}
+	if p.PatternMatchesContent {
+		form.Set("PatternMatchesContent", "true")
+	}
+	if p.PatternMatchesPath {
+		form.Set("PatternMatchesPath", "true")
+	}
+	if p.ChangedSinceCommit != "" {
+		form.Set("ChangedSinceCommit", string(p.ChangedSinceCommit))
+	}
+	if p.ChangedInLastCommits > 0 {
+		form.Set("ChangedInLastCommits", strconv.Itoa(p.ChangedInLastCommits))
+	}
+	if p.IncludeBlame {
+		form.Set("IncludeBlame", "true")
+	}
+	if p.ResolveLFS {
+		form.Set("ResolveLFS", "true")
+	}
+	if p.WantContent {
+		form.Set("WantContent", "true")
+	}
+	if p.NoFetch {
+		form.Set("NoFetch", "true")
+	}
+	if p.Query != "" {
+		form.Set("Query", p.Query)
+	}
+	if p.InvertMatch {
+		form.Set("InvertMatch", "true")
+	}
+	if p.FirstMatchOnly {
+		form.Set("FirstMatchOnly", "true")
+	}
+	if p.SearchBinary {
+		form.Set("SearchBinary", "true")
+	}
+	if p.OwnedBy != "" {
+		form.Set("OwnedBy", p.OwnedBy)
+	}
+	if p.NotOwnedBy != "" {
+		form.Set("NotOwnedBy", p.NotOwnedBy)
+	}
+	if p.TestFiles != "" {
+		form.Set("TestFiles", string(p.TestFiles))
+	}
+	if p.GeneratedFiles != "" {
+		form.Set("GeneratedFiles", string(p.GeneratedFiles))
+	}
+	if p.VendoredFiles != "" {
+		form.Set("VendoredFiles", string(p.VendoredFiles))
+	}
+	if len(p.Files) > 0 {
+		form["Files"] = p.Files
+	}
+	if p.IncludeEnclosingScope {
+		form.Set("IncludeEnclosingScope", "true")
+	}
+	if p.IncludeReplacements {
+		form.Set("IncludeReplacements", "true")
+	}
+	if p.IncludeDiffs {
+		form.Set("IncludeDiffs", "true")
+	}
+	if p.Replacement != "" {
+		form.Set("Replacement", p.Replacement)
+	}
+	if p.IncludeRanges {
+		form.Set("IncludeRanges", "true")
+	}
+	if p.PathSpec != "" {
+		form.Set("PathSpec", p.PathSpec)
+	}
+	if len(p.Languages) > 0 {
+		form["Languages"] = p.Languages
+	}
+	if len(p.ExcludeLanguages) > 0 {
+		form["ExcludeLanguages"] = p.ExcludeLanguages
+	}
+	if p.ContextBefore > 0 {
+		form.Set("ContextBefore", strconv.Itoa(p.ContextBefore))
+	}
+	if p.ContextAfter > 0 {
+		form.Set("ContextAfter", strconv.Itoa(p.ContextAfter))
+	}
+	if p.Refines != "" {
+		form.Set("Refines", p.Refines)
+	}
+	if p.FileMatchLimit > 0 {
+		form.Set("FileMatchLimit", strconv.Itoa(p.FileMatchLimit))
+	}
+	if p.MaxLineMatchesPerFile > 0 {
+		form.Set("MaxLineMatchesPerFile", strconv.Itoa(p.MaxLineMatchesPerFile))
+	}
+	if p.MaxMatches > 0 {
+		form.Set("MaxMatches", strconv.Itoa(p.MaxMatches))
+	}
+	if p.MaxBytesScanned > 0 {
+		form.Set("MaxBytesScanned", strconv.FormatInt(p.MaxBytesScanned, 10))
+	}
+	if p.MaxFileSize > 0 {
+		form.Set("MaxFileSize", strconv.FormatInt(p.MaxFileSize, 10))
+	}
+	return form
+}
+
+func readMatches(resp *http.Response) ([]protocol.FileMatch, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("non-200 response: code=%d body=%s", resp.StatusCode, string(body))
+	}
+
+	var r protocol.Response
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, err
+	}
+	return r.Matches, err
+}
+
+func newStore(files map[string]string) (*store.Store, func(), error) {
+	tarball, err := newTar(files)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := ioutil.TempDir("", "search_test")
+	if err != nil {
+		return nil, nil, err
+	}
+	return &store.Store{
+		FetchTar: func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(tarball)), nil
+		},
+		Path: d,
+	}, func() { os.RemoveAll(d) }, nil
+}
+
+func newTar(files map[string]string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	for name, body := range files {
+		hdr := &tar.Header{
+			Name: name,
+			Mode: 0600,
+			Size: int64(len(body)),
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			return nil, err
+		}
+	}
+	// git-archive usually includes a pax header we should ignore.
+	// use a body which matches a test case. Ensures we don't return this
+	// false entry as a result.
+	if err := addpaxheader(w, "Hello world\n"); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func toString(m []protocol.FileMatch) string {
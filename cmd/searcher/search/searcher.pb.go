@@ -0,0 +1,1578 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: searcher.proto
+
+package search
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// SearchRequest is a search of a repository at a commit. Fields mirror
+// those of protocol.Request and protocol.PatternInfo, except Deadline which
+// is the deadline of the call, and IsRegExp and IsStructuralPat which are
+// superseded by pattern_type.
+type SearchRequest struct {
+	Repo                         string   `protobuf:"bytes,1,opt,name=repo,proto3" json:"repo,omitempty"`
+	Url                          string   `protobuf:"bytes,2,opt,name=url,proto3" json:"url,omitempty"`
+	Commit                       string   `protobuf:"bytes,3,opt,name=commit,proto3" json:"commit,omitempty"`
+	FetchTimeout                 string   `protobuf:"bytes,4,opt,name=fetch_timeout,json=fetchTimeout,proto3" json:"fetch_timeout,omitempty"`
+	NoFetch                      bool     `protobuf:"varint,5,opt,name=no_fetch,json=noFetch,proto3" json:"no_fetch,omitempty"`
+	Pattern                      string   `protobuf:"bytes,6,opt,name=pattern,proto3" json:"pattern,omitempty"`
+	PatternType                  string   `protobuf:"bytes,7,opt,name=pattern_type,json=patternType,proto3" json:"pattern_type,omitempty"`
+	Query                        string   `protobuf:"bytes,8,opt,name=query,proto3" json:"query,omitempty"`
+	IsWordMatch                  bool     `protobuf:"varint,9,opt,name=is_word_match,json=isWordMatch,proto3" json:"is_word_match,omitempty"`
+	IsCaseSensitive              bool     `protobuf:"varint,10,opt,name=is_case_sensitive,json=isCaseSensitive,proto3" json:"is_case_sensitive,omitempty"`
+	InvertMatch                  bool     `protobuf:"varint,11,opt,name=invert_match,json=invertMatch,proto3" json:"invert_match,omitempty"`
+	FirstMatchOnly               bool     `protobuf:"varint,12,opt,name=first_match_only,json=firstMatchOnly,proto3" json:"first_match_only,omitempty"`
+	PatternMatchesContent        bool     `protobuf:"varint,13,opt,name=pattern_matches_content,json=patternMatchesContent,proto3" json:"pattern_matches_content,omitempty"`
+	PatternMatchesPath           bool     `protobuf:"varint,14,opt,name=pattern_matches_path,json=patternMatchesPath,proto3" json:"pattern_matches_path,omitempty"`
+	FileMatchLimit               int32    `protobuf:"varint,15,opt,name=file_match_limit,json=fileMatchLimit,proto3" json:"file_match_limit,omitempty"`
+	IncludePatterns              []string `protobuf:"bytes,16,rep,name=include_patterns,json=includePatterns,proto3" json:"include_patterns,omitempty"`
+	ExcludePattern               string   `protobuf:"bytes,17,opt,name=exclude_pattern,json=excludePattern,proto3" json:"exclude_pattern,omitempty"`
+	PathPatternsAreRegexps       bool     `protobuf:"varint,18,opt,name=path_patterns_are_regexps,json=pathPatternsAreRegexps,proto3" json:"path_patterns_are_regexps,omitempty"`
+	PathPatternsAreCaseSensitive bool     `protobuf:"varint,19,opt,name=path_patterns_are_case_sensitive,json=pathPatternsAreCaseSensitive,proto3" json:"path_patterns_are_case_sensitive,omitempty"`
+	Languages                    []string `protobuf:"bytes,20,rep,name=languages,proto3" json:"languages,omitempty"`
+	CombyRule                    string   `protobuf:"bytes,21,opt,name=comby_rule,json=combyRule,proto3" json:"comby_rule,omitempty"`
+	TestFiles                    string   `protobuf:"bytes,22,opt,name=test_files,json=testFiles,proto3" json:"test_files,omitempty"`
+	Scope                        string   `protobuf:"bytes,23,opt,name=scope,proto3" json:"scope,omitempty"`
+	OwnedBy                      string   `protobuf:"bytes,24,opt,name=owned_by,json=ownedBy,proto3" json:"owned_by,omitempty"`
+	NotOwnedBy                   string   `protobuf:"bytes,25,opt,name=not_owned_by,json=notOwnedBy,proto3" json:"not_owned_by,omitempty"`
+	Files                        []string `protobuf:"bytes,26,rep,name=files,proto3" json:"files,omitempty"`
+	ChangedSinceCommit           string   `protobuf:"bytes,27,opt,name=changed_since_commit,json=changedSinceCommit,proto3" json:"changed_since_commit,omitempty"`
+	ChangedInLastCommits         int32    `protobuf:"varint,28,opt,name=changed_in_last_commits,json=changedInLastCommits,proto3" json:"changed_in_last_commits,omitempty"`
+	WantContent                  bool     `protobuf:"varint,29,opt,name=want_content,json=wantContent,proto3" json:"want_content,omitempty"`
+	Refines                      string   `protobuf:"bytes,30,opt,name=refines,proto3" json:"refines,omitempty"`
+	ContextBefore                int32    `protobuf:"varint,31,opt,name=context_before,json=contextBefore,proto3" json:"context_before,omitempty"`
+	ContextAfter                 int32    `protobuf:"varint,32,opt,name=context_after,json=contextAfter,proto3" json:"context_after,omitempty"`
+	ExcludeLanguages             []string `protobuf:"bytes,33,rep,name=exclude_languages,json=excludeLanguages,proto3" json:"exclude_languages,omitempty"`
+	PathSpec                     string   `protobuf:"bytes,34,opt,name=path_spec,json=pathSpec,proto3" json:"path_spec,omitempty"`
+	MaxLineMatchesPerFile        int32    `protobuf:"varint,35,opt,name=max_line_matches_per_file,json=maxLineMatchesPerFile,proto3" json:"max_line_matches_per_file,omitempty"`
+	MaxMatches                   int32    `protobuf:"varint,36,opt,name=max_matches,json=maxMatches,proto3" json:"max_matches,omitempty"`
+	MaxBytesScanned              int64    `protobuf:"varint,37,opt,name=max_bytes_scanned,json=maxBytesScanned,proto3" json:"max_bytes_scanned,omitempty"`
+	SearchBinary                 bool     `protobuf:"varint,38,opt,name=search_binary,json=searchBinary,proto3" json:"search_binary,omitempty"`
+	MaxFileSize                  int64    `protobuf:"varint,39,opt,name=max_file_size,json=maxFileSize,proto3" json:"max_file_size,omitempty"`
+	GeneratedFiles               string   `protobuf:"bytes,40,opt,name=generated_files,json=generatedFiles,proto3" json:"generated_files,omitempty"`
+	VendoredFiles                string   `protobuf:"bytes,41,opt,name=vendored_files,json=vendoredFiles,proto3" json:"vendored_files,omitempty"`
+	Multiline                    bool     `protobuf:"varint,42,opt,name=multiline,proto3" json:"multiline,omitempty"`
+	CountOnly                    bool     `protobuf:"varint,43,opt,name=count_only,json=countOnly,proto3" json:"count_only,omitempty"`
+	RankBy                       string   `protobuf:"bytes,44,opt,name=rank_by,json=rankBy,proto3" json:"rank_by,omitempty"`
+	PriorityPatterns             []string `protobuf:"bytes,45,rep,name=priority_patterns,json=priorityPatterns,proto3" json:"priority_patterns,omitempty"`
+	Paginate                     bool     `protobuf:"varint,46,opt,name=paginate,proto3" json:"paginate,omitempty"`
+	Cursor                       string   `protobuf:"bytes,47,opt,name=cursor,proto3" json:"cursor,omitempty"`
+	Priority                     string   `protobuf:"bytes,48,opt,name=priority,proto3" json:"priority,omitempty"`
+	IncludeRanges                bool     `protobuf:"varint,49,opt,name=include_ranges,json=includeRanges,proto3" json:"include_ranges,omitempty"`
+	IncludeDiffs                 bool     `protobuf:"varint,50,opt,name=include_diffs,json=includeDiffs,proto3" json:"include_diffs,omitempty"`
+	Replacement                  string   `protobuf:"bytes,51,opt,name=replacement,proto3" json:"replacement,omitempty"`
+	IncludeBlame                 bool     `protobuf:"varint,52,opt,name=include_blame,json=includeBlame,proto3" json:"include_blame,omitempty"`
+	ResolveLfs                   bool     `protobuf:"varint,53,opt,name=resolve_lfs,json=resolveLfs,proto3" json:"resolve_lfs,omitempty"`
+	IncludeEnclosingScope        bool     `protobuf:"varint,54,opt,name=include_enclosing_scope,json=includeEnclosingScope,proto3" json:"include_enclosing_scope,omitempty"`
+	IncludeReplacements          bool     `protobuf:"varint,55,opt,name=include_replacements,json=includeReplacements,proto3" json:"include_replacements,omitempty"`
+	XXX_NoUnkeyedLiteral         struct{} `json:"-"`
+	XXX_unrecognized             []byte   `json:"-"`
+	XXX_sizecache                int32    `json:"-"`
+}
+
+func (m *SearchRequest) Reset()         { *m = SearchRequest{} }
+func (m *SearchRequest) String() string { return proto.CompactTextString(m) }
+func (*SearchRequest) ProtoMessage()    {}
+func (*SearchRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_80947dc8db49d360, []int{0}
+}
+
+func (m *SearchRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SearchRequest.Unmarshal(m, b)
+}
+func (m *SearchRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SearchRequest.Marshal(b, m, deterministic)
+}
+func (m *SearchRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SearchRequest.Merge(m, src)
+}
+func (m *SearchRequest) XXX_Size() int {
+	return xxx_messageInfo_SearchRequest.Size(m)
+}
+func (m *SearchRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SearchRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SearchRequest proto.InternalMessageInfo
+
+func (m *SearchRequest) GetRepo() string {
+	if m != nil {
+		return m.Repo
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetUrl() string {
+	if m != nil {
+		return m.Url
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetCommit() string {
+	if m != nil {
+		return m.Commit
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetFetchTimeout() string {
+	if m != nil {
+		return m.FetchTimeout
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetNoFetch() bool {
+	if m != nil {
+		return m.NoFetch
+	}
+	return false
+}
+
+func (m *SearchRequest) GetPattern() string {
+	if m != nil {
+		return m.Pattern
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetPatternType() string {
+	if m != nil {
+		return m.PatternType
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetQuery() string {
+	if m != nil {
+		return m.Query
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetIsWordMatch() bool {
+	if m != nil {
+		return m.IsWordMatch
+	}
+	return false
+}
+
+func (m *SearchRequest) GetIsCaseSensitive() bool {
+	if m != nil {
+		return m.IsCaseSensitive
+	}
+	return false
+}
+
+func (m *SearchRequest) GetInvertMatch() bool {
+	if m != nil {
+		return m.InvertMatch
+	}
+	return false
+}
+
+func (m *SearchRequest) GetFirstMatchOnly() bool {
+	if m != nil {
+		return m.FirstMatchOnly
+	}
+	return false
+}
+
+func (m *SearchRequest) GetPatternMatchesContent() bool {
+	if m != nil {
+		return m.PatternMatchesContent
+	}
+	return false
+}
+
+func (m *SearchRequest) GetPatternMatchesPath() bool {
+	if m != nil {
+		return m.PatternMatchesPath
+	}
+	return false
+}
+
+func (m *SearchRequest) GetFileMatchLimit() int32 {
+	if m != nil {
+		return m.FileMatchLimit
+	}
+	return 0
+}
+
+func (m *SearchRequest) GetIncludePatterns() []string {
+	if m != nil {
+		return m.IncludePatterns
+	}
+	return nil
+}
+
+func (m *SearchRequest) GetExcludePattern() string {
+	if m != nil {
+		return m.ExcludePattern
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetPathPatternsAreRegexps() bool {
+	if m != nil {
+		return m.PathPatternsAreRegexps
+	}
+	return false
+}
+
+func (m *SearchRequest) GetPathPatternsAreCaseSensitive() bool {
+	if m != nil {
+		return m.PathPatternsAreCaseSensitive
+	}
+	return false
+}
+
+func (m *SearchRequest) GetLanguages() []string {
+	if m != nil {
+		return m.Languages
+	}
+	return nil
+}
+
+func (m *SearchRequest) GetCombyRule() string {
+	if m != nil {
+		return m.CombyRule
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetTestFiles() string {
+	if m != nil {
+		return m.TestFiles
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetScope() string {
+	if m != nil {
+		return m.Scope
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetOwnedBy() string {
+	if m != nil {
+		return m.OwnedBy
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetNotOwnedBy() string {
+	if m != nil {
+		return m.NotOwnedBy
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetFiles() []string {
+	if m != nil {
+		return m.Files
+	}
+	return nil
+}
+
+func (m *SearchRequest) GetChangedSinceCommit() string {
+	if m != nil {
+		return m.ChangedSinceCommit
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetChangedInLastCommits() int32 {
+	if m != nil {
+		return m.ChangedInLastCommits
+	}
+	return 0
+}
+
+func (m *SearchRequest) GetWantContent() bool {
+	if m != nil {
+		return m.WantContent
+	}
+	return false
+}
+
+func (m *SearchRequest) GetRefines() string {
+	if m != nil {
+		return m.Refines
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetContextBefore() int32 {
+	if m != nil {
+		return m.ContextBefore
+	}
+	return 0
+}
+
+func (m *SearchRequest) GetContextAfter() int32 {
+	if m != nil {
+		return m.ContextAfter
+	}
+	return 0
+}
+
+func (m *SearchRequest) GetExcludeLanguages() []string {
+	if m != nil {
+		return m.ExcludeLanguages
+	}
+	return nil
+}
+
+func (m *SearchRequest) GetPathSpec() string {
+	if m != nil {
+		return m.PathSpec
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetMaxLineMatchesPerFile() int32 {
+	if m != nil {
+		return m.MaxLineMatchesPerFile
+	}
+	return 0
+}
+
+func (m *SearchRequest) GetMaxMatches() int32 {
+	if m != nil {
+		return m.MaxMatches
+	}
+	return 0
+}
+
+func (m *SearchRequest) GetMaxBytesScanned() int64 {
+	if m != nil {
+		return m.MaxBytesScanned
+	}
+	return 0
+}
+
+func (m *SearchRequest) GetSearchBinary() bool {
+	if m != nil {
+		return m.SearchBinary
+	}
+	return false
+}
+
+func (m *SearchRequest) GetMaxFileSize() int64 {
+	if m != nil {
+		return m.MaxFileSize
+	}
+	return 0
+}
+
+func (m *SearchRequest) GetGeneratedFiles() string {
+	if m != nil {
+		return m.GeneratedFiles
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetVendoredFiles() string {
+	if m != nil {
+		return m.VendoredFiles
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetMultiline() bool {
+	if m != nil {
+		return m.Multiline
+	}
+	return false
+}
+
+func (m *SearchRequest) GetCountOnly() bool {
+	if m != nil {
+		return m.CountOnly
+	}
+	return false
+}
+
+func (m *SearchRequest) GetRankBy() string {
+	if m != nil {
+		return m.RankBy
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetPriorityPatterns() []string {
+	if m != nil {
+		return m.PriorityPatterns
+	}
+	return nil
+}
+
+func (m *SearchRequest) GetPaginate() bool {
+	if m != nil {
+		return m.Paginate
+	}
+	return false
+}
+
+func (m *SearchRequest) GetCursor() string {
+	if m != nil {
+		return m.Cursor
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetPriority() string {
+	if m != nil {
+		return m.Priority
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetIncludeRanges() bool {
+	if m != nil {
+		return m.IncludeRanges
+	}
+	return false
+}
+
+func (m *SearchRequest) GetIncludeDiffs() bool {
+	if m != nil {
+		return m.IncludeDiffs
+	}
+	return false
+}
+
+func (m *SearchRequest) GetReplacement() string {
+	if m != nil {
+		return m.Replacement
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetIncludeBlame() bool {
+	if m != nil {
+		return m.IncludeBlame
+	}
+	return false
+}
+
+func (m *SearchRequest) GetResolveLfs() bool {
+	if m != nil {
+		return m.ResolveLfs
+	}
+	return false
+}
+
+func (m *SearchRequest) GetIncludeEnclosingScope() bool {
+	if m != nil {
+		return m.IncludeEnclosingScope
+	}
+	return false
+}
+
+func (m *SearchRequest) GetIncludeReplacements() bool {
+	if m != nil {
+		return m.IncludeReplacements
+	}
+	return false
+}
+
+// SearchResponse is a message of the stream returned by Search.
+type SearchResponse struct {
+	// Types that are valid to be assigned to Message:
+	//	*SearchResponse_FileMatch
+	//	*SearchResponse_Done
+	Message              isSearchResponse_Message `protobuf_oneof:"message"`
+	XXX_NoUnkeyedLiteral struct{}                 `json:"-"`
+	XXX_unrecognized     []byte                   `json:"-"`
+	XXX_sizecache        int32                    `json:"-"`
+}
+
+func (m *SearchResponse) Reset()         { *m = SearchResponse{} }
+func (m *SearchResponse) String() string { return proto.CompactTextString(m) }
+func (*SearchResponse) ProtoMessage()    {}
+func (*SearchResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_80947dc8db49d360, []int{1}
+}
+
+func (m *SearchResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SearchResponse.Unmarshal(m, b)
+}
+func (m *SearchResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SearchResponse.Marshal(b, m, deterministic)
+}
+func (m *SearchResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SearchResponse.Merge(m, src)
+}
+func (m *SearchResponse) XXX_Size() int {
+	return xxx_messageInfo_SearchResponse.Size(m)
+}
+func (m *SearchResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_SearchResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SearchResponse proto.InternalMessageInfo
+
+type isSearchResponse_Message interface {
+	isSearchResponse_Message()
+}
+
+type SearchResponse_FileMatch struct {
+	FileMatch *FileMatch `protobuf:"bytes,1,opt,name=file_match,json=fileMatch,proto3,oneof"`
+}
+
+type SearchResponse_Done struct {
+	Done *SearchDone `protobuf:"bytes,2,opt,name=done,proto3,oneof"`
+}
+
+func (*SearchResponse_FileMatch) isSearchResponse_Message() {}
+
+func (*SearchResponse_Done) isSearchResponse_Message() {}
+
+func (m *SearchResponse) GetMessage() isSearchResponse_Message {
+	if m != nil {
+		return m.Message
+	}
+	return nil
+}
+
+func (m *SearchResponse) GetFileMatch() *FileMatch {
+	if x, ok := m.GetMessage().(*SearchResponse_FileMatch); ok {
+		return x.FileMatch
+	}
+	return nil
+}
+
+func (m *SearchResponse) GetDone() *SearchDone {
+	if x, ok := m.GetMessage().(*SearchResponse_Done); ok {
+		return x.Done
+	}
+	return nil
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*SearchResponse) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*SearchResponse_FileMatch)(nil),
+		(*SearchResponse_Done)(nil),
+	}
+}
+
+// FileMatch mirrors protocol.FileMatch.
+type FileMatch struct {
+	Path                 string            `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	LineMatches          []*LineMatch      `protobuf:"bytes,2,rep,name=line_matches,json=lineMatches,proto3" json:"line_matches,omitempty"`
+	LimitHit             bool              `protobuf:"varint,3,opt,name=limit_hit,json=limitHit,proto3" json:"limit_hit,omitempty"`
+	Content              string            `protobuf:"bytes,4,opt,name=content,proto3" json:"content,omitempty"`
+	ContentOmitted       bool              `protobuf:"varint,5,opt,name=content_omitted,json=contentOmitted,proto3" json:"content_omitted,omitempty"`
+	Encoding             string            `protobuf:"bytes,6,opt,name=encoding,proto3" json:"encoding,omitempty"`
+	Binary               bool              `protobuf:"varint,7,opt,name=binary,proto3" json:"binary,omitempty"`
+	MultilineMatches     []*MultilineMatch `protobuf:"bytes,8,rep,name=multiline_matches,json=multilineMatches,proto3" json:"multiline_matches,omitempty"`
+	MatchCount           int32             `protobuf:"varint,9,opt,name=match_count,json=matchCount,proto3" json:"match_count,omitempty"`
+	Diff                 string            `protobuf:"bytes,10,opt,name=diff,proto3" json:"diff,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
+func (m *FileMatch) Reset()         { *m = FileMatch{} }
+func (m *FileMatch) String() string { return proto.CompactTextString(m) }
+func (*FileMatch) ProtoMessage()    {}
+func (*FileMatch) Descriptor() ([]byte, []int) {
+	return fileDescriptor_80947dc8db49d360, []int{2}
+}
+
+func (m *FileMatch) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FileMatch.Unmarshal(m, b)
+}
+func (m *FileMatch) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FileMatch.Marshal(b, m, deterministic)
+}
+func (m *FileMatch) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FileMatch.Merge(m, src)
+}
+func (m *FileMatch) XXX_Size() int {
+	return xxx_messageInfo_FileMatch.Size(m)
+}
+func (m *FileMatch) XXX_DiscardUnknown() {
+	xxx_messageInfo_FileMatch.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FileMatch proto.InternalMessageInfo
+
+func (m *FileMatch) GetPath() string {
+	if m != nil {
+		return m.Path
+	}
+	return ""
+}
+
+func (m *FileMatch) GetLineMatches() []*LineMatch {
+	if m != nil {
+		return m.LineMatches
+	}
+	return nil
+}
+
+func (m *FileMatch) GetLimitHit() bool {
+	if m != nil {
+		return m.LimitHit
+	}
+	return false
+}
+
+func (m *FileMatch) GetContent() string {
+	if m != nil {
+		return m.Content
+	}
+	return ""
+}
+
+func (m *FileMatch) GetContentOmitted() bool {
+	if m != nil {
+		return m.ContentOmitted
+	}
+	return false
+}
+
+func (m *FileMatch) GetEncoding() string {
+	if m != nil {
+		return m.Encoding
+	}
+	return ""
+}
+
+func (m *FileMatch) GetBinary() bool {
+	if m != nil {
+		return m.Binary
+	}
+	return false
+}
+
+func (m *FileMatch) GetMultilineMatches() []*MultilineMatch {
+	if m != nil {
+		return m.MultilineMatches
+	}
+	return nil
+}
+
+func (m *FileMatch) GetMatchCount() int32 {
+	if m != nil {
+		return m.MatchCount
+	}
+	return 0
+}
+
+func (m *FileMatch) GetDiff() string {
+	if m != nil {
+		return m.Diff
+	}
+	return ""
+}
+
+// LineMatch mirrors protocol.LineMatch.
+type LineMatch struct {
+	Preview              string          `protobuf:"bytes,1,opt,name=preview,proto3" json:"preview,omitempty"`
+	LineNumber           int32           `protobuf:"varint,2,opt,name=line_number,json=lineNumber,proto3" json:"line_number,omitempty"`
+	Ranges               []*Range        `protobuf:"bytes,3,rep,name=ranges,proto3" json:"ranges,omitempty"`
+	LimitHit             bool            `protobuf:"varint,4,opt,name=limit_hit,json=limitHit,proto3" json:"limit_hit,omitempty"`
+	PreviewOffset        int32           `protobuf:"varint,5,opt,name=preview_offset,json=previewOffset,proto3" json:"preview_offset,omitempty"`
+	Before               []string        `protobuf:"bytes,6,rep,name=before,proto3" json:"before,omitempty"`
+	After                []string        `protobuf:"bytes,7,rep,name=after,proto3" json:"after,omitempty"`
+	MatchRanges          []*MatchRange   `protobuf:"bytes,8,rep,name=match_ranges,json=matchRanges,proto3" json:"match_ranges,omitempty"`
+	Blame                *LineBlame      `protobuf:"bytes,9,opt,name=blame,proto3" json:"blame,omitempty"`
+	EnclosingScope       *EnclosingScope `protobuf:"bytes,10,opt,name=enclosing_scope,json=enclosingScope,proto3" json:"enclosing_scope,omitempty"`
+	Replacements         []string        `protobuf:"bytes,11,rep,name=replacements,proto3" json:"replacements,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}        `json:"-"`
+	XXX_unrecognized     []byte          `json:"-"`
+	XXX_sizecache        int32           `json:"-"`
+}
+
+func (m *LineMatch) Reset()         { *m = LineMatch{} }
+func (m *LineMatch) String() string { return proto.CompactTextString(m) }
+func (*LineMatch) ProtoMessage()    {}
+func (*LineMatch) Descriptor() ([]byte, []int) {
+	return fileDescriptor_80947dc8db49d360, []int{3}
+}
+
+func (m *LineMatch) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_LineMatch.Unmarshal(m, b)
+}
+func (m *LineMatch) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_LineMatch.Marshal(b, m, deterministic)
+}
+func (m *LineMatch) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_LineMatch.Merge(m, src)
+}
+func (m *LineMatch) XXX_Size() int {
+	return xxx_messageInfo_LineMatch.Size(m)
+}
+func (m *LineMatch) XXX_DiscardUnknown() {
+	xxx_messageInfo_LineMatch.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_LineMatch proto.InternalMessageInfo
+
+func (m *LineMatch) GetPreview() string {
+	if m != nil {
+		return m.Preview
+	}
+	return ""
+}
+
+func (m *LineMatch) GetLineNumber() int32 {
+	if m != nil {
+		return m.LineNumber
+	}
+	return 0
+}
+
+func (m *LineMatch) GetRanges() []*Range {
+	if m != nil {
+		return m.Ranges
+	}
+	return nil
+}
+
+func (m *LineMatch) GetLimitHit() bool {
+	if m != nil {
+		return m.LimitHit
+	}
+	return false
+}
+
+func (m *LineMatch) GetPreviewOffset() int32 {
+	if m != nil {
+		return m.PreviewOffset
+	}
+	return 0
+}
+
+func (m *LineMatch) GetBefore() []string {
+	if m != nil {
+		return m.Before
+	}
+	return nil
+}
+
+func (m *LineMatch) GetAfter() []string {
+	if m != nil {
+		return m.After
+	}
+	return nil
+}
+
+func (m *LineMatch) GetMatchRanges() []*MatchRange {
+	if m != nil {
+		return m.MatchRanges
+	}
+	return nil
+}
+
+func (m *LineMatch) GetBlame() *LineBlame {
+	if m != nil {
+		return m.Blame
+	}
+	return nil
+}
+
+func (m *LineMatch) GetEnclosingScope() *EnclosingScope {
+	if m != nil {
+		return m.EnclosingScope
+	}
+	return nil
+}
+
+func (m *LineMatch) GetReplacements() []string {
+	if m != nil {
+		return m.Replacements
+	}
+	return nil
+}
+
+// LineBlame mirrors protocol.LineBlame. author_date is in RFC 3339 format.
+type LineBlame struct {
+	Commit               string   `protobuf:"bytes,1,opt,name=commit,proto3" json:"commit,omitempty"`
+	AuthorName           string   `protobuf:"bytes,2,opt,name=author_name,json=authorName,proto3" json:"author_name,omitempty"`
+	AuthorEmail          string   `protobuf:"bytes,3,opt,name=author_email,json=authorEmail,proto3" json:"author_email,omitempty"`
+	AuthorDate           string   `protobuf:"bytes,4,opt,name=author_date,json=authorDate,proto3" json:"author_date,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *LineBlame) Reset()         { *m = LineBlame{} }
+func (m *LineBlame) String() string { return proto.CompactTextString(m) }
+func (*LineBlame) ProtoMessage()    {}
+func (*LineBlame) Descriptor() ([]byte, []int) {
+	return fileDescriptor_80947dc8db49d360, []int{4}
+}
+
+func (m *LineBlame) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_LineBlame.Unmarshal(m, b)
+}
+func (m *LineBlame) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_LineBlame.Marshal(b, m, deterministic)
+}
+func (m *LineBlame) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_LineBlame.Merge(m, src)
+}
+func (m *LineBlame) XXX_Size() int {
+	return xxx_messageInfo_LineBlame.Size(m)
+}
+func (m *LineBlame) XXX_DiscardUnknown() {
+	xxx_messageInfo_LineBlame.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_LineBlame proto.InternalMessageInfo
+
+func (m *LineBlame) GetCommit() string {
+	if m != nil {
+		return m.Commit
+	}
+	return ""
+}
+
+func (m *LineBlame) GetAuthorName() string {
+	if m != nil {
+		return m.AuthorName
+	}
+	return ""
+}
+
+func (m *LineBlame) GetAuthorEmail() string {
+	if m != nil {
+		return m.AuthorEmail
+	}
+	return ""
+}
+
+func (m *LineBlame) GetAuthorDate() string {
+	if m != nil {
+		return m.AuthorDate
+	}
+	return ""
+}
+
+// EnclosingScope mirrors protocol.EnclosingScope.
+type EnclosingScope struct {
+	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Kind                 string   `protobuf:"bytes,2,opt,name=kind,proto3" json:"kind,omitempty"`
+	StartLine            int32    `protobuf:"varint,3,opt,name=start_line,json=startLine,proto3" json:"start_line,omitempty"`
+	EndLine              int32    `protobuf:"varint,4,opt,name=end_line,json=endLine,proto3" json:"end_line,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *EnclosingScope) Reset()         { *m = EnclosingScope{} }
+func (m *EnclosingScope) String() string { return proto.CompactTextString(m) }
+func (*EnclosingScope) ProtoMessage()    {}
+func (*EnclosingScope) Descriptor() ([]byte, []int) {
+	return fileDescriptor_80947dc8db49d360, []int{5}
+}
+
+func (m *EnclosingScope) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_EnclosingScope.Unmarshal(m, b)
+}
+func (m *EnclosingScope) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_EnclosingScope.Marshal(b, m, deterministic)
+}
+func (m *EnclosingScope) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_EnclosingScope.Merge(m, src)
+}
+func (m *EnclosingScope) XXX_Size() int {
+	return xxx_messageInfo_EnclosingScope.Size(m)
+}
+func (m *EnclosingScope) XXX_DiscardUnknown() {
+	xxx_messageInfo_EnclosingScope.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_EnclosingScope proto.InternalMessageInfo
+
+func (m *EnclosingScope) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *EnclosingScope) GetKind() string {
+	if m != nil {
+		return m.Kind
+	}
+	return ""
+}
+
+func (m *EnclosingScope) GetStartLine() int32 {
+	if m != nil {
+		return m.StartLine
+	}
+	return 0
+}
+
+func (m *EnclosingScope) GetEndLine() int32 {
+	if m != nil {
+		return m.EndLine
+	}
+	return 0
+}
+
+// Range is the character offset and length of a match in a line.
+type Range struct {
+	Offset               int32    `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	Length               int32    `protobuf:"varint,2,opt,name=length,proto3" json:"length,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Range) Reset()         { *m = Range{} }
+func (m *Range) String() string { return proto.CompactTextString(m) }
+func (*Range) ProtoMessage()    {}
+func (*Range) Descriptor() ([]byte, []int) {
+	return fileDescriptor_80947dc8db49d360, []int{6}
+}
+
+func (m *Range) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Range.Unmarshal(m, b)
+}
+func (m *Range) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Range.Marshal(b, m, deterministic)
+}
+func (m *Range) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Range.Merge(m, src)
+}
+func (m *Range) XXX_Size() int {
+	return xxx_messageInfo_Range.Size(m)
+}
+func (m *Range) XXX_DiscardUnknown() {
+	xxx_messageInfo_Range.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Range proto.InternalMessageInfo
+
+func (m *Range) GetOffset() int32 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+func (m *Range) GetLength() int32 {
+	if m != nil {
+		return m.Length
+	}
+	return 0
+}
+
+// MatchRange mirrors protocol.Range.
+type MatchRange struct {
+	Start                *Position `protobuf:"bytes,1,opt,name=start,proto3" json:"start,omitempty"`
+	End                  *Position `protobuf:"bytes,2,opt,name=end,proto3" json:"end,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
+func (m *MatchRange) Reset()         { *m = MatchRange{} }
+func (m *MatchRange) String() string { return proto.CompactTextString(m) }
+func (*MatchRange) ProtoMessage()    {}
+func (*MatchRange) Descriptor() ([]byte, []int) {
+	return fileDescriptor_80947dc8db49d360, []int{7}
+}
+
+func (m *MatchRange) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MatchRange.Unmarshal(m, b)
+}
+func (m *MatchRange) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MatchRange.Marshal(b, m, deterministic)
+}
+func (m *MatchRange) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MatchRange.Merge(m, src)
+}
+func (m *MatchRange) XXX_Size() int {
+	return xxx_messageInfo_MatchRange.Size(m)
+}
+func (m *MatchRange) XXX_DiscardUnknown() {
+	xxx_messageInfo_MatchRange.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MatchRange proto.InternalMessageInfo
+
+func (m *MatchRange) GetStart() *Position {
+	if m != nil {
+		return m.Start
+	}
+	return nil
+}
+
+func (m *MatchRange) GetEnd() *Position {
+	if m != nil {
+		return m.End
+	}
+	return nil
+}
+
+// MultilineMatch mirrors protocol.MultilineMatch.
+type MultilineMatch struct {
+	Preview              string    `protobuf:"bytes,1,opt,name=preview,proto3" json:"preview,omitempty"`
+	Start                *Position `protobuf:"bytes,2,opt,name=start,proto3" json:"start,omitempty"`
+	End                  *Position `protobuf:"bytes,3,opt,name=end,proto3" json:"end,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
+func (m *MultilineMatch) Reset()         { *m = MultilineMatch{} }
+func (m *MultilineMatch) String() string { return proto.CompactTextString(m) }
+func (*MultilineMatch) ProtoMessage()    {}
+func (*MultilineMatch) Descriptor() ([]byte, []int) {
+	return fileDescriptor_80947dc8db49d360, []int{8}
+}
+
+func (m *MultilineMatch) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MultilineMatch.Unmarshal(m, b)
+}
+func (m *MultilineMatch) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MultilineMatch.Marshal(b, m, deterministic)
+}
+func (m *MultilineMatch) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MultilineMatch.Merge(m, src)
+}
+func (m *MultilineMatch) XXX_Size() int {
+	return xxx_messageInfo_MultilineMatch.Size(m)
+}
+func (m *MultilineMatch) XXX_DiscardUnknown() {
+	xxx_messageInfo_MultilineMatch.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MultilineMatch proto.InternalMessageInfo
+
+func (m *MultilineMatch) GetPreview() string {
+	if m != nil {
+		return m.Preview
+	}
+	return ""
+}
+
+func (m *MultilineMatch) GetStart() *Position {
+	if m != nil {
+		return m.Start
+	}
+	return nil
+}
+
+func (m *MultilineMatch) GetEnd() *Position {
+	if m != nil {
+		return m.End
+	}
+	return nil
+}
+
+// Position mirrors protocol.Position.
+type Position struct {
+	Line                 int32    `protobuf:"varint,1,opt,name=line,proto3" json:"line,omitempty"`
+	Column               int32    `protobuf:"varint,2,opt,name=column,proto3" json:"column,omitempty"`
+	Offset               int32    `protobuf:"varint,3,opt,name=offset,proto3" json:"offset,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Position) Reset()         { *m = Position{} }
+func (m *Position) String() string { return proto.CompactTextString(m) }
+func (*Position) ProtoMessage()    {}
+func (*Position) Descriptor() ([]byte, []int) {
+	return fileDescriptor_80947dc8db49d360, []int{9}
+}
+
+func (m *Position) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Position.Unmarshal(m, b)
+}
+func (m *Position) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Position.Marshal(b, m, deterministic)
+}
+func (m *Position) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Position.Merge(m, src)
+}
+func (m *Position) XXX_Size() int {
+	return xxx_messageInfo_Position.Size(m)
+}
+func (m *Position) XXX_DiscardUnknown() {
+	xxx_messageInfo_Position.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Position proto.InternalMessageInfo
+
+func (m *Position) GetLine() int32 {
+	if m != nil {
+		return m.Line
+	}
+	return 0
+}
+
+func (m *Position) GetColumn() int32 {
+	if m != nil {
+		return m.Column
+	}
+	return 0
+}
+
+func (m *Position) GetOffset() int32 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+// SearchDone is the last message of a search. It mirrors
+// protocol.StreamDone.
+type SearchDone struct {
+	LimitHit             bool         `protobuf:"varint,1,opt,name=limit_hit,json=limitHit,proto3" json:"limit_hit,omitempty"`
+	DeadlineHit          bool         `protobuf:"varint,2,opt,name=deadline_hit,json=deadlineHit,proto3" json:"deadline_hit,omitempty"`
+	Stats                *SearchStats `protobuf:"bytes,3,opt,name=stats,proto3" json:"stats,omitempty"`
+	RefinementToken      string       `protobuf:"bytes,4,opt,name=refinement_token,json=refinementToken,proto3" json:"refinement_token,omitempty"`
+	Error                string       `protobuf:"bytes,5,opt,name=error,proto3" json:"error,omitempty"`
+	LimitHitReason       string       `protobuf:"bytes,6,opt,name=limit_hit_reason,json=limitHitReason,proto3" json:"limit_hit_reason,omitempty"`
+	MatchCount           int32        `protobuf:"varint,7,opt,name=match_count,json=matchCount,proto3" json:"match_count,omitempty"`
+	Cursor               string       `protobuf:"bytes,8,opt,name=cursor,proto3" json:"cursor,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}     `json:"-"`
+	XXX_unrecognized     []byte       `json:"-"`
+	XXX_sizecache        int32        `json:"-"`
+}
+
+func (m *SearchDone) Reset()         { *m = SearchDone{} }
+func (m *SearchDone) String() string { return proto.CompactTextString(m) }
+func (*SearchDone) ProtoMessage()    {}
+func (*SearchDone) Descriptor() ([]byte, []int) {
+	return fileDescriptor_80947dc8db49d360, []int{10}
+}
+
+func (m *SearchDone) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SearchDone.Unmarshal(m, b)
+}
+func (m *SearchDone) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SearchDone.Marshal(b, m, deterministic)
+}
+func (m *SearchDone) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SearchDone.Merge(m, src)
+}
+func (m *SearchDone) XXX_Size() int {
+	return xxx_messageInfo_SearchDone.Size(m)
+}
+func (m *SearchDone) XXX_DiscardUnknown() {
+	xxx_messageInfo_SearchDone.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SearchDone proto.InternalMessageInfo
+
+func (m *SearchDone) GetLimitHit() bool {
+	if m != nil {
+		return m.LimitHit
+	}
+	return false
+}
+
+func (m *SearchDone) GetDeadlineHit() bool {
+	if m != nil {
+		return m.DeadlineHit
+	}
+	return false
+}
+
+func (m *SearchDone) GetStats() *SearchStats {
+	if m != nil {
+		return m.Stats
+	}
+	return nil
+}
+
+func (m *SearchDone) GetRefinementToken() string {
+	if m != nil {
+		return m.RefinementToken
+	}
+	return ""
+}
+
+func (m *SearchDone) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *SearchDone) GetLimitHitReason() string {
+	if m != nil {
+		return m.LimitHitReason
+	}
+	return ""
+}
+
+func (m *SearchDone) GetMatchCount() int32 {
+	if m != nil {
+		return m.MatchCount
+	}
+	return 0
+}
+
+func (m *SearchDone) GetCursor() string {
+	if m != nil {
+		return m.Cursor
+	}
+	return ""
+}
+
+// SearchStats mirrors protocol.Stats.
+type SearchStats struct {
+	CpuMilliseconds        int64    `protobuf:"varint,1,opt,name=cpu_milliseconds,json=cpuMilliseconds,proto3" json:"cpu_milliseconds,omitempty"`
+	CacheBytesRead         int64    `protobuf:"varint,2,opt,name=cache_bytes_read,json=cacheBytesRead,proto3" json:"cache_bytes_read,omitempty"`
+	GitserverBytesFetched  int64    `protobuf:"varint,3,opt,name=gitserver_bytes_fetched,json=gitserverBytesFetched,proto3" json:"gitserver_bytes_fetched,omitempty"`
+	PeakBufferBytes        int64    `protobuf:"varint,4,opt,name=peak_buffer_bytes,json=peakBufferBytes,proto3" json:"peak_buffer_bytes,omitempty"`
+	LargeFilesSkipped      int64    `protobuf:"varint,5,opt,name=large_files_skipped,json=largeFilesSkipped,proto3" json:"large_files_skipped,omitempty"`
+	LargeFilesSkippedPaths []string `protobuf:"bytes,6,rep,name=large_files_skipped_paths,json=largeFilesSkippedPaths,proto3" json:"large_files_skipped_paths,omitempty"`
+	XXX_NoUnkeyedLiteral   struct{} `json:"-"`
+	XXX_unrecognized       []byte   `json:"-"`
+	XXX_sizecache          int32    `json:"-"`
+}
+
+func (m *SearchStats) Reset()         { *m = SearchStats{} }
+func (m *SearchStats) String() string { return proto.CompactTextString(m) }
+func (*SearchStats) ProtoMessage()    {}
+func (*SearchStats) Descriptor() ([]byte, []int) {
+	return fileDescriptor_80947dc8db49d360, []int{11}
+}
+
+func (m *SearchStats) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SearchStats.Unmarshal(m, b)
+}
+func (m *SearchStats) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SearchStats.Marshal(b, m, deterministic)
+}
+func (m *SearchStats) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SearchStats.Merge(m, src)
+}
+func (m *SearchStats) XXX_Size() int {
+	return xxx_messageInfo_SearchStats.Size(m)
+}
+func (m *SearchStats) XXX_DiscardUnknown() {
+	xxx_messageInfo_SearchStats.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SearchStats proto.InternalMessageInfo
+
+func (m *SearchStats) GetCpuMilliseconds() int64 {
+	if m != nil {
+		return m.CpuMilliseconds
+	}
+	return 0
+}
+
+func (m *SearchStats) GetCacheBytesRead() int64 {
+	if m != nil {
+		return m.CacheBytesRead
+	}
+	return 0
+}
+
+func (m *SearchStats) GetGitserverBytesFetched() int64 {
+	if m != nil {
+		return m.GitserverBytesFetched
+	}
+	return 0
+}
+
+func (m *SearchStats) GetPeakBufferBytes() int64 {
+	if m != nil {
+		return m.PeakBufferBytes
+	}
+	return 0
+}
+
+func (m *SearchStats) GetLargeFilesSkipped() int64 {
+	if m != nil {
+		return m.LargeFilesSkipped
+	}
+	return 0
+}
+
+func (m *SearchStats) GetLargeFilesSkippedPaths() []string {
+	if m != nil {
+		return m.LargeFilesSkippedPaths
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*SearchRequest)(nil), "searcher.v1.SearchRequest")
+	proto.RegisterType((*SearchResponse)(nil), "searcher.v1.SearchResponse")
+	proto.RegisterType((*FileMatch)(nil), "searcher.v1.FileMatch")
+	proto.RegisterType((*LineMatch)(nil), "searcher.v1.LineMatch")
+	proto.RegisterType((*LineBlame)(nil), "searcher.v1.LineBlame")
+	proto.RegisterType((*EnclosingScope)(nil), "searcher.v1.EnclosingScope")
+	proto.RegisterType((*Range)(nil), "searcher.v1.Range")
+	proto.RegisterType((*MatchRange)(nil), "searcher.v1.MatchRange")
+	proto.RegisterType((*MultilineMatch)(nil), "searcher.v1.MultilineMatch")
+	proto.RegisterType((*Position)(nil), "searcher.v1.Position")
+	proto.RegisterType((*SearchDone)(nil), "searcher.v1.SearchDone")
+	proto.RegisterType((*SearchStats)(nil), "searcher.v1.SearchStats")
+}
+
+func init() { proto.RegisterFile("searcher.proto", fileDescriptor_80947dc8db49d360) }
+
+var fileDescriptor_80947dc8db49d360 = []byte{
+	// 1887 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x58, 0xcd, 0x72, 0x1b, 0xc7,
+	0x11, 0x36, 0x08, 0x82, 0x00, 0x1a, 0x20, 0x40, 0x8d, 0x24, 0x72, 0xf4, 0xe3, 0x08, 0x82, 0xa3,
+	0x88, 0x96, 0x6c, 0x46, 0x92, 0x63, 0x2b, 0xce, 0xcd, 0xa4, 0xcc, 0x52, 0xaa, 0x28, 0x51, 0xb5,
+	0x50, 0x55, 0xaa, 0x72, 0xd9, 0x5a, 0xec, 0x36, 0xc0, 0x2d, 0xee, 0xce, 0xc2, 0x33, 0x03, 0x8a,
+	0xf0, 0x29, 0x55, 0xb9, 0xe4, 0x31, 0xf2, 0x0a, 0xb9, 0xe5, 0xa5, 0xf2, 0x04, 0xb9, 0xa4, 0xba,
+	0x67, 0x76, 0x01, 0x90, 0x4c, 0xe2, 0xdb, 0xf6, 0xd7, 0xdd, 0x33, 0x3d, 0xfd, 0x0f, 0x40, 0xcf,
+	0x60, 0xa4, 0xe3, 0x33, 0xd4, 0x07, 0x33, 0x5d, 0xd8, 0x42, 0x74, 0x2a, 0xfa, 0xe2, 0xe5, 0xf0,
+	0xdf, 0x7d, 0xd8, 0x1e, 0x31, 0x1d, 0xe0, 0x4f, 0x73, 0x34, 0x56, 0x08, 0xd8, 0xd4, 0x38, 0x2b,
+	0x64, 0x6d, 0x50, 0xdb, 0x6f, 0x07, 0xfc, 0x2d, 0x76, 0xa0, 0x3e, 0xd7, 0x99, 0xdc, 0x60, 0x88,
+	0x3e, 0xc5, 0x2e, 0x6c, 0xc5, 0x45, 0x9e, 0xa7, 0x56, 0xd6, 0x19, 0xf4, 0x94, 0xf8, 0x02, 0xb6,
+	0x27, 0x68, 0xe3, 0xb3, 0xd0, 0xa6, 0x39, 0x16, 0x73, 0x2b, 0x37, 0x99, 0xdd, 0x65, 0xf0, 0xa3,
+	0xc3, 0xc4, 0x3d, 0x68, 0xa9, 0x22, 0x64, 0x48, 0x36, 0x06, 0xb5, 0xfd, 0x56, 0xd0, 0x54, 0xc5,
+	0x31, 0x91, 0x42, 0x42, 0x73, 0x16, 0x59, 0x8b, 0x5a, 0xc9, 0x2d, 0xd6, 0x2c, 0x49, 0xf1, 0x18,
+	0xba, 0xfe, 0x33, 0xb4, 0x8b, 0x19, 0xca, 0x26, 0xb3, 0x3b, 0x1e, 0xfb, 0xb8, 0x98, 0xa1, 0xb8,
+	0x03, 0x8d, 0x9f, 0xe6, 0xa8, 0x17, 0xb2, 0xc5, 0x3c, 0x47, 0x88, 0x21, 0x6c, 0xa7, 0x26, 0xfc,
+	0x54, 0xe8, 0x24, 0xcc, 0x23, 0xba, 0xb2, 0xcd, 0x57, 0x76, 0x52, 0xf3, 0xa7, 0x42, 0x27, 0xef,
+	0x08, 0x12, 0xcf, 0xe0, 0x56, 0x6a, 0xc2, 0x38, 0x32, 0x18, 0x1a, 0x54, 0x26, 0xb5, 0xe9, 0x05,
+	0x4a, 0x60, 0xb9, 0x7e, 0x6a, 0x8e, 0x22, 0x83, 0xa3, 0x12, 0x26, 0x43, 0x52, 0x75, 0x81, 0xda,
+	0xfa, 0xe3, 0x3a, 0xfe, 0x38, 0xc6, 0xdc, 0x71, 0xfb, 0xb0, 0x33, 0x49, 0xb5, 0xf1, 0x12, 0x61,
+	0xa1, 0xb2, 0x85, 0xec, 0xb2, 0x58, 0x8f, 0x71, 0x96, 0x3a, 0x55, 0xd9, 0x42, 0x7c, 0x07, 0x7b,
+	0xe5, 0xab, 0x58, 0x16, 0x4d, 0x18, 0x17, 0xca, 0xa2, 0xb2, 0x72, 0x9b, 0x15, 0xee, 0x7a, 0xf6,
+	0x3b, 0xc7, 0x3d, 0x72, 0x4c, 0xf1, 0x02, 0xee, 0x5c, 0xd5, 0x9b, 0x45, 0xf6, 0x4c, 0xf6, 0x58,
+	0x49, 0xac, 0x2b, 0x7d, 0x88, 0xac, 0xb7, 0x29, 0x43, 0x6f, 0x52, 0x96, 0x52, 0xec, 0xfa, 0x83,
+	0xda, 0x7e, 0x83, 0x6c, 0xca, 0x90, 0x45, 0x4f, 0x08, 0x15, 0x5f, 0xc2, 0x4e, 0xaa, 0xe2, 0x6c,
+	0x9e, 0x60, 0xe8, 0xcf, 0x31, 0x72, 0x67, 0x50, 0xdf, 0x6f, 0x07, 0x7d, 0x8f, 0x7f, 0xf0, 0xb0,
+	0x78, 0x0a, 0x7d, 0xbc, 0x5c, 0x13, 0x95, 0xb7, 0xd8, 0xf7, 0x3d, 0xbc, 0x5c, 0x95, 0x14, 0xdf,
+	0xc3, 0x3d, 0xb2, 0xaf, 0x3a, 0x30, 0x8c, 0x34, 0x86, 0x1a, 0xa7, 0x78, 0x39, 0x33, 0x52, 0xb0,
+	0xd1, 0xbb, 0x24, 0x50, 0x9e, 0xfc, 0x83, 0xc6, 0xc0, 0x71, 0xc5, 0x31, 0x0c, 0xae, 0xab, 0x5e,
+	0x09, 0xd5, 0x6d, 0x3e, 0xe1, 0xe1, 0x95, 0x13, 0xd6, 0xe3, 0xf6, 0x10, 0xda, 0x59, 0xa4, 0xa6,
+	0xf3, 0x68, 0x8a, 0x46, 0xde, 0xe1, 0xf7, 0x2c, 0x01, 0xf1, 0x39, 0x40, 0x5c, 0xe4, 0xe3, 0x45,
+	0xa8, 0xe7, 0x19, 0xca, 0xbb, 0xfc, 0x88, 0x36, 0x23, 0xc1, 0x3c, 0x43, 0x62, 0x5b, 0x34, 0x36,
+	0x24, 0x57, 0x19, 0xb9, 0xeb, 0xd8, 0x84, 0x1c, 0x13, 0x40, 0x99, 0x67, 0xe2, 0x62, 0x86, 0x72,
+	0xcf, 0x65, 0x1e, 0x13, 0x94, 0xe7, 0xc5, 0x27, 0x85, 0x49, 0x38, 0x5e, 0x48, 0xe9, 0xb2, 0x99,
+	0xe9, 0xc3, 0x85, 0x18, 0x40, 0x57, 0x15, 0x36, 0xac, 0xd8, 0xf7, 0x98, 0x0d, 0xaa, 0xb0, 0xa7,
+	0x5e, 0xe2, 0x0e, 0x34, 0xdc, 0x65, 0xf7, 0xd9, 0x54, 0x47, 0x50, 0xdc, 0xe3, 0xb3, 0x48, 0x4d,
+	0x31, 0x09, 0x4d, 0xaa, 0x62, 0x0c, 0x7d, 0x15, 0x3e, 0x60, 0x7d, 0xe1, 0x79, 0x23, 0x62, 0x1d,
+	0x31, 0x47, 0x7c, 0x0b, 0x7b, 0xa5, 0x46, 0xaa, 0xc2, 0x2c, 0x32, 0xd6, 0xeb, 0x18, 0xf9, 0x90,
+	0xc3, 0x5f, 0x1e, 0xf8, 0x47, 0x75, 0x12, 0x19, 0xeb, 0xb4, 0x0c, 0x65, 0xf9, 0xa7, 0x48, 0xd9,
+	0x2a, 0x1b, 0x3f, 0x77, 0x59, 0x4e, 0x58, 0x99, 0x83, 0x12, 0x9a, 0x1a, 0x27, 0xa9, 0x42, 0x23,
+	0x7f, 0xe5, 0x5e, 0xe7, 0x49, 0xf1, 0x04, 0x7a, 0xac, 0x77, 0x69, 0xc3, 0x31, 0x4e, 0x0a, 0x8d,
+	0xf2, 0x11, 0x5f, 0xb5, 0xed, 0xd1, 0x43, 0x06, 0xa9, 0x59, 0x94, 0x62, 0xd1, 0xc4, 0xa2, 0x96,
+	0x03, 0x96, 0xea, 0x7a, 0xf0, 0x07, 0xc2, 0xc4, 0x73, 0xb8, 0x55, 0xa6, 0xd8, 0x32, 0x7c, 0x8f,
+	0xd9, 0x27, 0x3b, 0x9e, 0x71, 0x52, 0x45, 0xf1, 0x01, 0xb4, 0x39, 0x57, 0xcc, 0x0c, 0x63, 0x39,
+	0x64, 0xa3, 0x5a, 0x04, 0x8c, 0x66, 0x18, 0x8b, 0xdf, 0xc3, 0xbd, 0x3c, 0xba, 0x0c, 0xb3, 0x54,
+	0xe1, 0xb2, 0x68, 0x50, 0x73, 0x4c, 0xe5, 0x17, 0x7c, 0xf5, 0xdd, 0x3c, 0xba, 0x3c, 0x49, 0x15,
+	0x96, 0x85, 0x83, 0x9a, 0xe2, 0x2b, 0x1e, 0x41, 0x87, 0x34, 0xbd, 0x92, 0xfc, 0x35, 0xcb, 0x42,
+	0x1e, 0x5d, 0x7a, 0x39, 0xea, 0x1f, 0x24, 0x30, 0x5e, 0x58, 0x34, 0xa1, 0x89, 0x23, 0xa5, 0x30,
+	0x91, 0x4f, 0x06, 0xb5, 0xfd, 0x7a, 0xd0, 0xcf, 0xa3, 0xcb, 0x43, 0xc2, 0x47, 0x0e, 0xa6, 0x57,
+	0xbb, 0x0e, 0x1c, 0x8e, 0x53, 0x15, 0xe9, 0x85, 0xfc, 0x0d, 0xbb, 0xb6, 0xeb, 0xc0, 0x43, 0xc6,
+	0xa8, 0x69, 0xd1, 0x81, 0x5c, 0xb1, 0x26, 0xfd, 0x19, 0xe5, 0x53, 0x3e, 0x8c, 0xcc, 0x20, 0x8b,
+	0x46, 0xe9, 0xcf, 0x48, 0xc5, 0x37, 0x45, 0x85, 0x3a, 0xb2, 0x98, 0xf8, 0xc4, 0xdc, 0x77, 0xc5,
+	0x57, 0xc1, 0x2e, 0x3b, 0x9f, 0x40, 0xef, 0x02, 0x55, 0x52, 0xe8, 0x4a, 0xee, 0x4b, 0x96, 0xdb,
+	0x2e, 0x51, 0x27, 0xf6, 0x10, 0xda, 0xf9, 0x3c, 0xb3, 0x29, 0x39, 0x48, 0x3e, 0x63, 0xa3, 0x96,
+	0x80, 0x2b, 0x90, 0xb9, 0xb2, 0xae, 0x9b, 0x3d, 0x77, 0x6c, 0x46, 0xb8, 0x91, 0xed, 0x41, 0x53,
+	0x47, 0xea, 0x9c, 0x72, 0xf9, 0x2b, 0x37, 0x11, 0x88, 0x3c, 0x5c, 0x50, 0xfc, 0x66, 0x3a, 0x2d,
+	0x74, 0x6a, 0x17, 0xcb, 0x76, 0xf2, 0xb5, 0x8b, 0x5f, 0xc9, 0xa8, 0xfa, 0xc9, 0x7d, 0x68, 0xcd,
+	0xa2, 0x69, 0xaa, 0x22, 0x8b, 0xf2, 0x80, 0xaf, 0xa8, 0x68, 0x1e, 0x39, 0x73, 0x6d, 0x0a, 0x2d,
+	0x7f, 0xeb, 0x47, 0x0e, 0x53, 0xac, 0xe3, 0xcf, 0x91, 0x2f, 0x7c, 0xc8, 0x3d, 0x4d, 0x2f, 0x2f,
+	0x5b, 0x99, 0xa6, 0x24, 0x37, 0xf2, 0x25, 0x9f, 0xba, 0xed, 0xd1, 0x80, 0x41, 0x0a, 0x49, 0x29,
+	0x96, 0xa4, 0x93, 0x89, 0x91, 0xaf, 0x5c, 0x48, 0x3c, 0xf8, 0x86, 0x30, 0x31, 0x80, 0x8e, 0xc6,
+	0x59, 0x16, 0xc5, 0x98, 0x53, 0x41, 0x7c, 0xe3, 0xe6, 0xcf, 0x0a, 0xb4, 0x7a, 0xcc, 0x38, 0x8b,
+	0x72, 0x94, 0xbf, 0x5b, 0x3b, 0xe6, 0x90, 0x30, 0xca, 0x25, 0x8d, 0xa6, 0xc8, 0x2e, 0x30, 0xcc,
+	0x26, 0x46, 0x7e, 0xcb, 0x22, 0xe0, 0xa1, 0x93, 0x89, 0xa1, 0x91, 0x50, 0x9e, 0x82, 0x2a, 0xce,
+	0x0a, 0x93, 0xaa, 0x69, 0xe8, 0xba, 0xcb, 0x77, 0x6e, 0x24, 0x78, 0xf6, 0x8f, 0x25, 0x77, 0x44,
+	0x4c, 0xf1, 0x12, 0xee, 0x54, 0x6f, 0x5d, 0x1a, 0x65, 0xe4, 0x6b, 0x56, 0xba, 0x5d, 0xbe, 0x78,
+	0x85, 0x35, 0xfc, 0x6b, 0x0d, 0x7a, 0xe5, 0xf4, 0x37, 0xb3, 0x42, 0x19, 0x14, 0xaf, 0x01, 0x96,
+	0x63, 0x82, 0x97, 0x80, 0xce, 0xab, 0xdd, 0x83, 0x95, 0x95, 0xe1, 0xe0, 0xb8, 0x9c, 0x16, 0x6f,
+	0x3f, 0x0b, 0xda, 0xd5, 0xe8, 0x10, 0x5f, 0xc3, 0x66, 0x52, 0x28, 0xe4, 0x25, 0xa1, 0xf3, 0x6a,
+	0x6f, 0x4d, 0xc5, 0xdd, 0xf1, 0xa6, 0x50, 0xf8, 0xf6, 0xb3, 0x80, 0xc5, 0x0e, 0xdb, 0xd0, 0xcc,
+	0xd1, 0x98, 0x68, 0x8a, 0xc3, 0x7f, 0x6d, 0x40, 0xbb, 0x3a, 0x94, 0xf6, 0x0f, 0x9e, 0x64, 0x7e,
+	0xff, 0xa0, 0x6f, 0xf1, 0x3d, 0x74, 0x57, 0xab, 0x56, 0x6e, 0x0c, 0xea, 0xd7, 0xcc, 0xaa, 0xca,
+	0x36, 0xe8, 0x64, 0xcb, 0x0a, 0xa6, 0x8e, 0xc0, 0xb3, 0x2e, 0x3c, 0xf3, 0xbb, 0x4a, 0x2b, 0x68,
+	0x31, 0xf0, 0x36, 0xe5, 0x0e, 0x56, 0xf6, 0x37, 0xb7, 0xa7, 0x94, 0x24, 0xd5, 0x96, 0xff, 0x0c,
+	0x8b, 0x3c, 0xb5, 0x16, 0x13, 0xbf, 0xa9, 0xf4, 0x3c, 0x7c, 0xea, 0x50, 0xca, 0x3e, 0x54, 0x71,
+	0x91, 0xa4, 0x6a, 0xea, 0x37, 0x96, 0x8a, 0xa6, 0x8c, 0xf5, 0x25, 0xde, 0x64, 0x5d, 0x4f, 0x89,
+	0xb7, 0x70, 0xab, 0xaa, 0xab, 0xea, 0x4d, 0x2d, 0x7e, 0xd3, 0x83, 0xb5, 0x37, 0xbd, 0x2b, 0xa5,
+	0xdc, 0xc3, 0x76, 0xf2, 0x35, 0x1a, 0x8d, 0x6b, 0x4c, 0x34, 0xcf, 0xb9, 0x10, 0x65, 0xbb, 0x6c,
+	0x4c, 0x36, 0x3e, 0x3b, 0x22, 0x84, 0xbc, 0x49, 0x19, 0xcd, 0xbb, 0x4c, 0x3b, 0xe0, 0xef, 0xe1,
+	0x3f, 0xeb, 0xd0, 0xae, 0xbc, 0xc5, 0x1b, 0x97, 0xc6, 0x8b, 0x14, 0x3f, 0x79, 0x97, 0x97, 0x24,
+	0x1d, 0xce, 0x16, 0xaa, 0x79, 0x3e, 0x46, 0xcd, 0x81, 0x6d, 0x04, 0x40, 0xd0, 0x7b, 0x46, 0xc4,
+	0x33, 0xd8, 0xf2, 0x55, 0x55, 0x67, 0xe3, 0xc5, 0x9a, 0xf1, 0x5c, 0x5b, 0x81, 0x97, 0x58, 0x8f,
+	0xc3, 0xe6, 0x95, 0x38, 0x3c, 0x81, 0x9e, 0xbf, 0x34, 0x2c, 0x26, 0x13, 0x83, 0x96, 0x9d, 0xdd,
+	0x08, 0xb6, 0x3d, 0x7a, 0xca, 0x20, 0xfb, 0xd3, 0x8d, 0x93, 0x2d, 0xee, 0x1f, 0x9e, 0xa2, 0x51,
+	0xe9, 0xe6, 0x47, 0xd3, 0x8d, 0x4a, 0x26, 0xc4, 0x1f, 0xa0, 0xeb, 0x7c, 0xe3, 0x6d, 0x74, 0x0e,
+	0x5e, 0x4f, 0x4c, 0xe7, 0x57, 0x36, 0xb4, 0x93, 0x57, 0xdf, 0x46, 0x7c, 0x05, 0x0d, 0x57, 0xc1,
+	0xed, 0x1b, 0x0a, 0x80, 0x7c, 0xc7, 0xb5, 0x1c, 0x38, 0x21, 0xf1, 0x06, 0xfa, 0x57, 0x2b, 0x15,
+	0x06, 0xb5, 0x6b, 0xd1, 0x5c, 0xaf, 0xd7, 0xa0, 0x87, 0x6b, 0xb4, 0x18, 0x42, 0x77, 0xad, 0x6e,
+	0x3b, 0xfc, 0x98, 0x35, 0x6c, 0xf8, 0xb7, 0x1a, 0xb4, 0xab, 0xeb, 0x57, 0x96, 0xf0, 0xda, 0xda,
+	0x12, 0xfe, 0x08, 0x3a, 0xd1, 0xdc, 0x9e, 0x15, 0x3a, 0x54, 0xf4, 0x06, 0xb7, 0xb6, 0x83, 0x83,
+	0xde, 0x93, 0xe2, 0x63, 0xe8, 0x7a, 0x01, 0xcc, 0xa3, 0x34, 0xf3, 0x3b, 0xbc, 0x57, 0xfa, 0x91,
+	0xa0, 0x95, 0x33, 0x12, 0x6a, 0xc6, 0x9b, 0xab, 0x67, 0xbc, 0x89, 0x2c, 0x0e, 0x35, 0xf4, 0xae,
+	0x34, 0x20, 0x01, 0x9b, 0x7c, 0x9f, 0xaf, 0x5c, 0xfa, 0x26, 0xec, 0x3c, 0x55, 0x89, 0xb7, 0x81,
+	0xbf, 0x69, 0x92, 0x18, 0x1b, 0x69, 0xcb, 0x93, 0x98, 0xef, 0x6e, 0x04, 0x6d, 0x46, 0xe8, 0x69,
+	0xb4, 0x35, 0xa1, 0x4a, 0x1c, 0x73, 0x93, 0x99, 0x4d, 0x54, 0x09, 0xb1, 0x86, 0xaf, 0xa1, 0xc1,
+	0x01, 0xa2, 0x97, 0xfb, 0x44, 0xa9, 0xb1, 0x84, 0xa7, 0x08, 0xcf, 0x50, 0x4d, 0xed, 0x99, 0xcf,
+	0x56, 0x4f, 0x0d, 0xc7, 0x00, 0xcb, 0x50, 0x8b, 0xe7, 0xd0, 0xe0, 0xeb, 0x7c, 0x7b, 0xbb, 0xbb,
+	0x16, 0xa5, 0x0f, 0x05, 0xed, 0x8b, 0x85, 0x0a, 0x9c, 0x8c, 0x78, 0x0a, 0x75, 0xf4, 0x0f, 0xf8,
+	0xaf, 0xa2, 0x24, 0x31, 0xfc, 0x4b, 0x0d, 0x7a, 0xeb, 0x05, 0xfb, 0x3f, 0x6a, 0xab, 0x32, 0x61,
+	0xe3, 0x97, 0x9b, 0x50, 0xff, 0xbf, 0x26, 0xbc, 0x87, 0x56, 0x09, 0x90, 0xe7, 0xd9, 0x85, 0xce,
+	0x41, 0xfc, 0xed, 0x12, 0x26, 0x9b, 0xe7, 0xaa, 0x74, 0x8f, 0xa3, 0x56, 0xdc, 0x59, 0x5f, 0x75,
+	0xe7, 0xf0, 0xef, 0x1b, 0x00, 0xcb, 0xde, 0xbd, 0x5e, 0xc3, 0xb5, 0x2b, 0x35, 0xfc, 0x18, 0xba,
+	0x09, 0x46, 0x09, 0x77, 0x0c, 0xe2, 0x6f, 0xb8, 0x85, 0xb1, 0xc4, 0x48, 0xe4, 0x80, 0x1f, 0x6d,
+	0x8d, 0x7f, 0x89, 0xbc, 0x61, 0x46, 0x8c, 0x88, 0x1f, 0x38, 0x31, 0xfa, 0x21, 0xe2, 0x36, 0x4a,
+	0x4a, 0xfe, 0xd0, 0x16, 0xe7, 0xa8, 0x7c, 0x22, 0xf6, 0x97, 0xf8, 0x47, 0x82, 0xa9, 0x05, 0xa0,
+	0xd6, 0x85, 0xe6, 0xc6, 0xd1, 0x0e, 0x1c, 0x41, 0xbf, 0x79, 0x2a, 0x83, 0x43, 0x8d, 0x91, 0x29,
+	0xca, 0x9f, 0x95, 0xbd, 0xd2, 0xee, 0x80, 0xd1, 0xab, 0x8d, 0xb4, 0x79, 0xad, 0x91, 0x2e, 0xb7,
+	0x8f, 0xd6, 0xea, 0xf6, 0x31, 0xfc, 0xc7, 0x06, 0x74, 0x56, 0x4c, 0x27, 0x9b, 0xe3, 0xd9, 0x3c,
+	0xcc, 0xd3, 0x2c, 0x4b, 0x0d, 0xc6, 0x85, 0x4a, 0x0c, 0xbb, 0xaa, 0x1e, 0xf4, 0xe3, 0xd9, 0xfc,
+	0xdd, 0x0a, 0x4c, 0xd6, 0xc5, 0x51, 0x7c, 0x86, 0x7e, 0x6d, 0xd4, 0x18, 0xb9, 0x34, 0xab, 0x07,
+	0x3d, 0xc6, 0x79, 0x6b, 0x0c, 0x30, 0x4a, 0x68, 0x25, 0x98, 0xa6, 0xd6, 0xa0, 0xbe, 0x40, 0xed,
+	0xa5, 0xf9, 0xd7, 0x33, 0xba, 0xa4, 0xa8, 0x07, 0x77, 0x2b, 0x36, 0x2b, 0x1d, 0x3b, 0x26, 0xad,
+	0xa5, 0x33, 0x8c, 0xce, 0xc3, 0xf1, 0x7c, 0x32, 0x29, 0x35, 0xd9, 0x83, 0xf5, 0xa0, 0x4f, 0x8c,
+	0x43, 0xc6, 0x59, 0x45, 0x1c, 0xc0, 0xed, 0x2c, 0xd2, 0x53, 0x74, 0x1b, 0x62, 0x68, 0xce, 0xd3,
+	0xd9, 0xcc, 0x4f, 0xbd, 0x7a, 0x70, 0x8b, 0x59, 0xbc, 0x26, 0x8e, 0x1c, 0x83, 0x7e, 0xd1, 0xdd,
+	0x20, 0xcf, 0xbf, 0x42, 0x8d, 0xef, 0xcf, 0xbb, 0xd7, 0xb4, 0xe8, 0x97, 0xa8, 0x79, 0x75, 0x0a,
+	0xad, 0x91, 0x8f, 0xbc, 0x38, 0x82, 0x2d, 0xf7, 0x2d, 0xee, 0xdf, 0x90, 0x0e, 0xfe, 0x4f, 0x89,
+	0xfb, 0x0f, 0x6e, 0xe4, 0xb9, 0x95, 0xe5, 0x45, 0xed, 0xb0, 0xf5, 0xe7, 0x2d, 0xc7, 0x1f, 0x6f,
+	0xf1, 0x7f, 0x1c, 0xdf, 0xfc, 0x67, 0x00, 0xaa, 0x4f, 0xb2, 0x43, 0xf5, 0x10, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// SearcherClient is the client API for Searcher service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type SearcherClient interface {
+	// Search searches a repository at a commit. Matches are streamed as they
+	// are found, followed by a single SearchDone message. The deadline of the
+	// call is the deadline of the search.
+	Search(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (Searcher_SearchClient, error)
+}
+
+type searcherClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSearcherClient(cc grpc.ClientConnInterface) SearcherClient {
+	return &searcherClient{cc}
+}
+
+func (c *searcherClient) Search(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (Searcher_SearchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Searcher_serviceDesc.Streams[0], "/searcher.v1.Searcher/Search", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &searcherSearchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Searcher_SearchClient interface {
+	Recv() (*SearchResponse, error)
+	grpc.ClientStream
+}
+
+type searcherSearchClient struct {
+	grpc.ClientStream
+}
+
+func (x *searcherSearchClient) Recv() (*SearchResponse, error) {
+	m := new(SearchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SearcherServer is the server API for Searcher service.
+type SearcherServer interface {
+	// Search searches a repository at a commit. Matches are streamed as they
+	// are found, followed by a single SearchDone message. The deadline of the
+	// call is the deadline of the search.
+	Search(*SearchRequest, Searcher_SearchServer) error
+}
+
+// UnimplementedSearcherServer can be embedded to have forward compatible implementations.
+type UnimplementedSearcherServer struct {
+}
+
+func (*UnimplementedSearcherServer) Search(req *SearchRequest, srv Searcher_SearchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Search not implemented")
+}
+
+func RegisterSearcherServer(s *grpc.Server, srv SearcherServer) {
+	s.RegisterService(&_Searcher_serviceDesc, srv)
+}
+
+func _Searcher_Search_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SearchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SearcherServer).Search(m, &searcherSearchServer{stream})
+}
+
+type Searcher_SearchServer interface {
+	Send(*SearchResponse) error
+	grpc.ServerStream
+}
+
+type searcherSearchServer struct {
+	grpc.ServerStream
+}
+
+func (x *searcherSearchServer) Send(m *SearchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Searcher_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "searcher.v1.Searcher",
+	HandlerType: (*SearcherServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Search",
+			Handler:       _Searcher_Search_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "searcher.proto",
+}
@@ -0,0 +1,76 @@
+package search
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxShadowRequests is the maximum number of concurrent shadow
+	// requests. Requests sampled while at the limit are not shadowed, so
+	// a slow canary never builds up a backlog.
+	maxShadowRequests = 10
+
+	// shadowTimeout bounds the time a shadow request may take.
+	shadowTimeout = time.Minute
+)
+
+// shadow asynchronously sends a copy of the search request form to
+// ShadowURL if the request is sampled. The response is discarded.
+func (s *Service) shadow(form url.Values) {
+	if s.ShadowURL == "" || s.ShadowRate <= 0 || rand.Float64() >= s.ShadowRate {
+		return
+	}
+
+	select {
+	case s.shadowSem <- struct{}{}:
+	default:
+		shadowRequestsTotal.WithLabelValues("dropped").Inc()
+		return
+	}
+
+	body := form.Encode()
+	go func() {
+		defer func() { <-s.shadowSem }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+		defer cancel()
+		req, err := http.NewRequest("POST", s.ShadowURL, strings.NewReader(body))
+		if err != nil {
+			shadowRequestsTotal.WithLabelValues("error").Inc()
+			return
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			shadowRequestsTotal.WithLabelValues("error").Inc()
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			shadowRequestsTotal.WithLabelValues("error").Inc()
+			return
+		}
+		shadowRequestsTotal.WithLabelValues("success").Inc()
+	}()
+}
+
+var shadowRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "service",
+	Name:      "shadow_requests_total",
+	Help:      "Number of search requests mirrored to the shadow URL, by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(shadowRequestsTotal)
+}
@@ -0,0 +1,141 @@
+package search
+
+import (
+	"context"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// sparsePathSpec returns a git pathspec which matches at least every path
+// matched by p.IncludePatterns, or "" if none of them is simple enough to
+// translate. Only patterns matching a directory prefix (eg ^src/) or a
+// file extension (eg \.go$) are translated. Since a path must match every
+// include pattern, translating any one of them is enough.
+func sparsePathSpec(p *protocol.PatternInfo) string {
+	icase := !p.PathPatternsAreCaseSensitive
+	for _, pattern := range p.IncludePatterns {
+		var dir, ext string
+		if p.PathPatternsAreRegExps {
+			dir, ext, icase = regexpPathPrefixSuffix(pattern, icase)
+		} else {
+			dir, ext = globPathPrefixSuffix(pattern)
+		}
+		switch {
+		case dir != "" && validatePathSpec(dir) == nil && isPlainPath(dir):
+			if icase {
+				return ":(icase)" + dir
+			}
+			return dir
+		case ext != "" && isPlainPath(ext) && !strings.Contains(ext, "/"):
+			if icase {
+				return ":(glob,icase)**/*" + ext
+			}
+			return ":(glob)**/*" + ext
+		}
+	}
+	return ""
+}
+
+// regexpPathPrefixSuffix returns the directory every path matched by the
+// regexp pattern is in, or else the extension every such path ends with.
+// It returns two empty strings if pattern has neither. icase is updated if
+// pattern is case insensitive.
+func regexpPathPrefixSuffix(pattern string, icase bool) (dir, ext string, _ bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil || re.Op != syntax.OpConcat || len(re.Sub) < 2 {
+		return "", "", icase
+	}
+	first, second := re.Sub[0], re.Sub[1]
+	if first.Op == syntax.OpBeginText && second.Op == syntax.OpLiteral {
+		lit := string(second.Rune)
+		if i := strings.LastIndex(lit, "/"); i > 0 {
+			return lit[:i], "", icase || second.Flags&syntax.FoldCase != 0
+		}
+	}
+	last, penultimate := re.Sub[len(re.Sub)-1], re.Sub[len(re.Sub)-2]
+	if last.Op == syntax.OpEndText && penultimate.Op == syntax.OpLiteral {
+		lit := string(penultimate.Rune)
+		if i := strings.LastIndex(lit, "."); i >= 0 {
+			return "", lit[i:], icase || penultimate.Flags&syntax.FoldCase != 0
+		}
+	}
+	return "", "", icase
+}
+
+// globPathPrefixSuffix is like regexpPathPrefixSuffix for the glob pattern.
+// Globs are matched against the whole path, and * matches / too.
+func globPathPrefixSuffix(pattern string) (dir, ext string) {
+	meta := strings.IndexAny(pattern, "*?[{\\")
+	if meta < 0 {
+		return "", ""
+	}
+	if i := strings.LastIndex(pattern[:meta], "/"); i > 0 {
+		return pattern[:i], ""
+	}
+	suffix := pattern[strings.LastIndexAny(pattern, "*?]}\\")+1:]
+	if i := strings.LastIndex(suffix, "."); i >= 0 {
+		return "", suffix[i:]
+	}
+	return "", ""
+}
+
+// isPlainPath reports whether s only contains characters which have no
+// special meaning in git pathspecs.
+func isPlainPath(s string) bool {
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("/._-+", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// getSparseZipFile returns an archive of only the files of p.Commit which
+// may match p's include patterns, so that eg searching the Go files of a
+// huge repository does not fetch all of it. It returns a nil ZipFile if the
+// archive of the whole repository should be searched instead: because it
+// is cached, because no include pattern can be translated into a pathspec,
+// or because the store can't fetch archives of some paths. The returned
+// ZipFile must be closed.
+func (s *Service) getSparseZipFile(ctx context.Context, p *protocol.Request) (string, *store.ZipFile, error) {
+	// CODEOWNERS and .gitattributes must be in the archive to filter by
+	// owner and attributes.
+	if s.Store.FetchTarPaths == nil || s.NoFetch || p.NoFetch || p.OwnedBy != "" || p.NotOwnedBy != "" || p.GeneratedFiles != protocol.TestFilesIncluded || p.VendoredFiles != protocol.TestFilesIncluded {
+		return "", nil, nil
+	}
+	pathspec := sparsePathSpec(&p.PatternInfo)
+	if pathspec == "" {
+		return "", nil, nil
+	}
+	if _, _, err := s.Store.StatZip(p.GitserverRepo(), p.Commit); err == nil {
+		sparseArchives.WithLabelValues("full").Inc()
+		return "", nil, nil
+	}
+	zipPath, zf, err := s.getZipFileWith(ctx, p, func(ctx context.Context) (string, error) {
+		return s.Store.PrepareZipPaths(ctx, p.GitserverRepo(), p.Commit, []string{pathspec})
+	})
+	if err != nil && ctx.Err() == nil {
+		// git archive fails if no file matches the pathspec, so fall back
+		// to the whole repository.
+		sparseArchives.WithLabelValues("failed").Inc()
+		return "", nil, nil
+	}
+	sparseArchives.WithLabelValues("sparse").Inc()
+	return zipPath, zf, err
+}
+
+var sparseArchives = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "service",
+	Name:      "sparse_archives_total",
+	Help:      "Number of searches with include patterns translatable into a pathspec, by the archive searched: full (the whole repository, since it is cached), sparse (only the files matching the pathspec) or failed (the whole repository, since fetching the sparse archive failed).",
+}, []string{"archive"})
+
+func init() {
+	prometheus.MustRegister(sparseArchives)
+}
@@ -0,0 +1,134 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+// searchStream receives the results of a streamed search.
+type searchStream interface {
+	// match sends a match. It may be called concurrently.
+	match(protocol.FileMatch)
+
+	// done sends the final event of the search.
+	done(protocol.StreamDone)
+
+	// hasStarted reports whether anything has been sent.
+	hasStarted() bool
+
+	// matchesSent returns the number of matches sent.
+	matchesSent() int
+}
+
+// streamWriter writes a streamed search response (see
+// protocol.StreamContentTypeSSE and protocol.StreamContentTypeNDJSON). It is
+// safe for concurrent use.
+type streamWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	sse     bool
+	started bool // whether the response header has been written
+	sent    int  // number of matches written
+}
+
+// newStreamWriter returns a streamWriter for w if r accepts a streamed
+// response, otherwise nil.
+func newStreamWriter(w http.ResponseWriter, r *http.Request) *streamWriter {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case protocol.StreamContentTypeSSE:
+			return &streamWriter{w: w, sse: true}
+		case protocol.StreamContentTypeNDJSON:
+			return &streamWriter{w: w}
+		}
+	}
+	return nil
+}
+
+// match writes fm.
+func (sw *streamWriter) match(fm protocol.FileMatch) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.write("match", protocol.StreamEvent{Match: &fm})
+	sw.sent++
+}
+
+// done writes the final event of the response.
+func (sw *streamWriter) done(d protocol.StreamDone) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.write("done", protocol.StreamEvent{Done: &d})
+}
+
+// hasStarted reports whether any event has been written, after which the
+// status of the response can't be changed.
+func (sw *streamWriter) hasStarted() bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.started
+}
+
+// matchesSent returns the number of matches written.
+func (sw *streamWriter) matchesSent() int {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.sent
+}
+
+// write writes the event ev named name and flushes it to the client. Errors
+// are ignored: they mean the client went away. It must be called with
+// sw.mu held.
+func (sw *streamWriter) write(name string, ev protocol.StreamEvent) {
+	if !sw.started {
+		sw.started = true
+		if sw.sse {
+			sw.w.Header().Set("Content-Type", protocol.StreamContentTypeSSE)
+		} else {
+			sw.w.Header().Set("Content-Type", protocol.StreamContentTypeNDJSON)
+		}
+		sw.w.Header().Set("Cache-Control", "no-cache")
+		sw.w.WriteHeader(http.StatusOK)
+	}
+
+	if sw.sse {
+		var data interface{} = ev.Match
+		if ev.Done != nil {
+			data = ev.Done
+		}
+		b, err := json.Marshal(data)
+		if err != nil {
+			return
+		}
+		_, _ = fmt.Fprintf(sw.w, "event: %s\ndata: %s\n\n", name, b)
+	} else {
+		_ = json.NewEncoder(sw.w).Encode(&ev)
+	}
+	if f, ok := sw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type matchSinkKey struct{}
+
+// withMatchSink returns a context for which regexSearch calls sink with
+// every match as soon as it is found, in the order they are returned. A nil
+// sink disables this.
+func withMatchSink(ctx context.Context, sink func(protocol.FileMatch)) context.Context {
+	return context.WithValue(ctx, matchSinkKey{}, sink)
+}
+
+func matchSinkFromContext(ctx context.Context) func(protocol.FileMatch) {
+	sink, _ := ctx.Value(matchSinkKey{}).(func(protocol.FileMatch))
+	return sink
+}
@@ -0,0 +1,72 @@
+package search
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/pathmatch"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// validatePathSpec returns an error if dir is not a valid PathSpec.
+func validatePathSpec(dir string) error {
+	switch {
+	case dir == "":
+		return nil
+	case path.Clean(dir) != dir || dir == "." || path.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, "../"):
+		return errors.Errorf("PathSpec must be a clean relative path (PathSpec=%q)", dir)
+	case strings.HasPrefix(dir, ":") || strings.ContainsAny(dir, "*?[\\"):
+		// They have a special meaning in git pathspecs.
+		return errors.Errorf("PathSpec may not start with ':' or contain any of *?[\\ (PathSpec=%q)", dir)
+	}
+	return nil
+}
+
+// inSubtree reports whether name is dir or inside it.
+func inSubtree(name, dir string) bool {
+	return name == dir || (strings.HasPrefix(name, dir) && name[len(dir)] == '/')
+}
+
+// subtreeMatcher wraps a PathMatcher to additionally only match paths in
+// the subtree dir.
+type subtreeMatcher struct {
+	pathmatch.PathMatcher
+	dir string
+}
+
+func (m *subtreeMatcher) MatchPath(name string) bool {
+	return inSubtree(name, m.dir) && m.PathMatcher.MatchPath(name)
+}
+
+func (m *subtreeMatcher) String() string {
+	return m.PathMatcher.String() + " pathspec:" + m.dir
+}
+
+// getSubtreeZipFile returns an archive of only the subtree p.PathSpec of
+// p.Commit, so that searching a directory of a monorepo does not fetch the
+// whole repository. It returns a nil ZipFile if the archive of the whole
+// repository should be searched instead, because it is cached or the store
+// can't fetch archives of some paths. The returned ZipFile must be closed.
+func (s *Service) getSubtreeZipFile(ctx context.Context, p *protocol.Request) (string, *store.ZipFile, error) {
+	if s.Store.FetchTarPaths == nil || s.NoFetch || p.NoFetch {
+		if p.IsStructuralPat {
+			// comby searches every file of the archive it is given.
+			return "", nil, badRequestError{"PathSpec is not supported for structural search"}
+		}
+		return "", nil, nil
+	}
+	// comby searches every file of the archive it is given, so it always
+	// gets the subtree.
+	if !p.IsStructuralPat {
+		if _, _, err := s.Store.StatZip(p.GitserverRepo(), p.Commit); err == nil {
+			return "", nil, nil
+		}
+	}
+	return s.getZipFileWith(ctx, p, func(ctx context.Context) (string, error) {
+		return s.Store.PrepareZipPaths(ctx, p.GitserverRepo(), p.Commit, []string{p.PathSpec})
+	})
+}
@@ -0,0 +1,225 @@
+package search
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+const (
+	// symbolsConcurrency is the maximum number of files we concurrently
+	// parse with ctags for a single /symbols request.
+	symbolsConcurrency = 4
+
+	// maxSymbols is the limit on the number of symbols we return.
+	maxSymbols = 1000
+)
+
+// serveSymbols finds the symbols of a repository at a commit whose name
+// matches the pattern of the request. It accepts the same form as a search:
+//
+//	POST /symbols Repo=github.com/foo/bar&Commit=deadbeef...&Pattern=^Parse&PatternType=regexp
+//
+// The response is a JSON encoded protocol.SymbolsResponse. This gives
+// repositories which are not indexed by zoekt symbol results.
+func (s *Service) serveSymbols(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	done, retryAfter, ok := s.admit(ctx, requestClient(r), requestPriority(r))
+	if !ok {
+		writeOverloaded(w, retryAfter)
+		return
+	}
+	defer done()
+
+	p, ctx, cancel, err := s.decodeRequest(ctx, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+	if err := validateSymbolsParams(p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp protocol.SymbolsResponse
+	pprof.Do(ctx, pprof.Labels("repo", string(p.Repo), "query_type", "symbols"), func(ctx context.Context) {
+		resp, err = s.searchSymbols(ctx, p)
+	})
+	if err != nil {
+		writeSearchError(ctx, w, p, err)
+		return
+	}
+	if resp.Symbols == nil {
+		resp.Symbols = make([]protocol.Symbol, 0)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&resp)
+}
+
+func validateSymbolsParams(p *protocol.Request) error {
+	if p.Repo == "" {
+		return errors.New("Repo must be non-empty")
+	}
+	if len(p.Commit) != 40 {
+		return errors.Errorf("Commit must be resolved (Commit=%q)", p.Commit)
+	}
+	if p.PatternType != protocol.PatternTypeLiteral && p.PatternType != protocol.PatternTypeRegexp {
+		return errors.Errorf("PatternType must be %q or %q for symbol search", protocol.PatternTypeLiteral, protocol.PatternTypeRegexp)
+	}
+	if p.Query != "" || p.InvertMatch || p.ResolveLFS || changedFilesBase(p) != "" || p.OwnedBy != "" || p.NotOwnedBy != "" || p.GeneratedFiles != protocol.TestFilesIncluded || p.VendoredFiles != protocol.TestFilesIncluded || len(p.Files) > 0 || p.PathSpec != "" || p.MaxLineMatchesPerFile > 0 || p.MaxMatches > 0 || p.MaxBytesScanned > 0 {
+		return errors.New("Query, InvertMatch, ResolveLFS, ChangedSinceCommit, ChangedInLastCommits, OwnedBy, NotOwnedBy, GeneratedFiles, VendoredFiles, Files, PathSpec, MaxLineMatchesPerFile, MaxMatches and MaxBytesScanned are not supported for symbol search")
+	}
+	return nil
+}
+
+// compileSymbolPattern returns the regexp symbol names must match for p,
+// and if p is literal the pattern files containing a matching symbol must
+// contain. An empty pattern matches every symbol.
+func compileSymbolPattern(p *protocol.Request) (name, content *regexp.Regexp, err error) {
+	expr := p.Pattern
+	if !p.IsRegExp {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if p.IsWordMatch {
+		expr = "^(?:" + expr + ")$"
+	}
+	if !p.IsCaseSensitive {
+		expr = "(?i)" + expr
+	}
+	name, err = regexp.Compile(expr)
+	if err != nil {
+		return nil, nil, badRequestError{err.Error()}
+	}
+	if !p.IsRegExp && p.Pattern != "" {
+		// A symbol name is in the content of its file, so files without the
+		// literal can be skipped without running ctags. This does not hold
+		// for regexps, which may be anchored.
+		expr = regexp.QuoteMeta(p.Pattern)
+		if !p.IsCaseSensitive {
+			expr = "(?i)" + expr
+		}
+		content = regexp.MustCompile(expr)
+	}
+	return name, content, nil
+}
+
+// searchSymbols returns the symbols matching p in the archive of
+// p.Repo@p.Commit. Files which fail to parse are skipped.
+func (s *Service) searchSymbols(ctx context.Context, p *protocol.Request) (resp protocol.SymbolsResponse, err error) {
+	if s.ParseSymbols == nil {
+		return resp, badRequestError{"symbol search is not supported"}
+	}
+	matchName, matchContent, err := compileSymbolPattern(p)
+	if err != nil {
+		return resp, err
+	}
+	matchPath, err := compilePathMatcher(&p.PatternInfo)
+	if err != nil {
+		return resp, badRequestError{err.Error()}
+	}
+	limit := p.FileMatchLimit
+	if limit > maxSymbols || limit <= 0 {
+		limit = maxSymbols
+	}
+
+	_, zf, err := s.getZipFile(ctx, p)
+	if err != nil {
+		return resp, errors.Wrap(err, "failed to get archive")
+	}
+	defer zf.Close()
+
+	var (
+		mu    sync.Mutex
+		found int64 // number of symbols in resp.Symbols, read without mu
+		sem   = make(chan struct{}, symbolsConcurrency)
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	for i := range zf.Files {
+		f := &zf.Files[i]
+		if atomic.LoadInt64(&found) > int64(limit) {
+			break
+		}
+		if !matchPath.MatchPath(f.Name) {
+			continue
+		}
+		data := zf.DataFor(f)
+		if matchContent != nil && !matchContent.Match(data) || bytes.IndexByte(data, 0) >= 0 {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-gctx.Done():
+		}
+		if gctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			entries, err := s.ParseSymbols(gctx, f.Name, data)
+			if err != nil {
+				if gctx.Err() != nil {
+					return gctx.Err()
+				}
+				log.Printf("failed to parse %s with ctags: %s", f.Name, err)
+				return nil
+			}
+			var symbols []protocol.Symbol
+			for _, e := range entries {
+				if !matchName.MatchString(e.Name) {
+					continue
+				}
+				symbols = append(symbols, protocol.Symbol{
+					Name:       e.Name,
+					Path:       f.Name,
+					Line:       e.Line - 1, // ctags lines are 1-based
+					Kind:       e.Kind,
+					Language:   e.Language,
+					Parent:     e.Parent,
+					ParentKind: e.ParentKind,
+				})
+			}
+			mu.Lock()
+			resp.Symbols = append(resp.Symbols, symbols...)
+			atomic.StoreInt64(&found, int64(len(resp.Symbols)))
+			mu.Unlock()
+			return nil
+		})
+	}
+	err = g.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		resp.DeadlineHit = true
+		err = nil // the symbols found so far are returned
+	}
+	if err != nil {
+		return resp, err
+	}
+
+	sort.Slice(resp.Symbols, func(i, j int) bool {
+		a, b := resp.Symbols[i], resp.Symbols[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Name < b.Name
+	})
+	if len(resp.Symbols) > limit {
+		resp.Symbols = resp.Symbols[:limit]
+		resp.LimitHit = true
+	}
+	return resp, nil
+}
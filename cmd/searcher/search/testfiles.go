@@ -0,0 +1,79 @@
+package search
+
+import (
+	"path"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/pathmatch"
+)
+
+// testDirs are directory names which by convention only contain tests or
+// test fixtures.
+var testDirs = map[string]bool{
+	"test":      true,
+	"tests":     true,
+	"__tests__": true,
+	"spec":      true,
+	"testdata":  true,
+}
+
+// testSuffixes are file name suffixes used by test files. They are matched
+// case sensitively since most conventions depend on case (eg FooTest.java).
+var testSuffixes = []string{
+	// Go
+	"_test.go",
+	// JavaScript / TypeScript
+	".test.js", ".test.jsx", ".test.ts", ".test.tsx", ".test.mjs",
+	".spec.js", ".spec.jsx", ".spec.ts", ".spec.tsx", ".spec.mjs",
+	// Python
+	"_test.py",
+	// Ruby
+	"_spec.rb", "_test.rb",
+	// Java, Kotlin, Scala, C#, PHP
+	"Test.java", "Tests.java", "Test.kt", "Tests.kt", "Spec.scala", "Test.scala",
+	"Test.cs", "Tests.cs", "Test.php",
+	// C / C++
+	"_test.c", "_test.cc", "_test.cpp", "_unittest.cc", "_unittest.cpp",
+	// Rust, Elixir, Swift
+	"_test.rs", "_test.exs", "Tests.swift",
+}
+
+// isTestFile reports whether name looks like a test file according to common
+// per-language conventions. It is a heuristic and only looks at the path.
+func isTestFile(name string) bool {
+	dir, base := path.Split(name)
+	for _, d := range strings.Split(dir, "/") {
+		if testDirs[d] {
+			return true
+		}
+	}
+	// Python uses a prefix rather than a suffix.
+	if strings.HasPrefix(base, "test_") && strings.HasSuffix(base, ".py") {
+		return true
+	}
+	for _, suffix := range testSuffixes {
+		if strings.HasSuffix(base, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// testFileMatcher wraps a PathMatcher to additionally include only, or
+// exclude, test files.
+type testFileMatcher struct {
+	pathmatch.PathMatcher
+	filter protocol.TestFileFilter
+}
+
+func (m *testFileMatcher) MatchPath(name string) bool {
+	if (m.filter == protocol.TestFilesOnly) != isTestFile(name) {
+		return false
+	}
+	return m.PathMatcher.MatchPath(name)
+}
+
+func (m *testFileMatcher) String() string {
+	return m.PathMatcher.String() + " testfiles:" + string(m.filter)
+}
@@ -0,0 +1,79 @@
+package search
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+	"github.com/sourcegraph/sourcegraph/internal/testutil"
+)
+
+func TestIsTestFile(t *testing.T) {
+	cases := map[string]bool{
+		"main.go":                   false,
+		"main_test.go":              true,
+		"src/app.spec.ts":           true,
+		"src/app.test.tsx":          true,
+		"src/app.ts":                false,
+		"tests/integration.rs":      true,
+		"pkg/testdata/input.txt":    true,
+		"web/__tests__/index.js":    true,
+		"lib/foo_spec.rb":           true,
+		"test_parser.py":            true,
+		"parser.py":                 false,
+		"src/FooTest.java":          true,
+		"src/Contest.java":          false,
+		"attestation/attest.go":     false,
+		"docs/testing-guide.md":     false,
+		"client/src/latest/main.go": false,
+	}
+	for name, want := range cases {
+		if got := isTestFile(name); got != want {
+			t.Errorf("isTestFile(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestTestFileFilter(t *testing.T) {
+	zipData, err := testutil.CreateZip(map[string]string{
+		"main.go":         "foo",
+		"main_test.go":    "foo",
+		"tests/a.txt":     "foo",
+		"README.md":       "foo",
+		"src/app.spec.ts": "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zf, err := store.MockZipFile(zipData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[protocol.TestFileFilter][]string{
+		protocol.TestFilesIncluded: {"README.md", "main.go", "main_test.go", "src/app.spec.ts", "tests/a.txt"},
+		protocol.TestFilesOnly:     {"main_test.go", "src/app.spec.ts", "tests/a.txt"},
+		protocol.TestFilesExcluded: {"README.md", "main.go"},
+	}
+	for filter, want := range cases {
+		rg, err := compile(&protocol.PatternInfo{Pattern: "foo", TestFiles: filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileMatches, _, err := regexSearch(context.Background(), rg, zf, newSearchLimits(&protocol.PatternInfo{FileMatchLimit: 10}), true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(fileMatches))
+		for i, fm := range fileMatches {
+			got[i] = fm.Path
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("TestFiles=%q: got file matches %v, want %v", filter, got, want)
+		}
+	}
+}
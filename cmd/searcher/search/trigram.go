@@ -0,0 +1,97 @@
+package search
+
+import (
+	"regexp/syntax"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/pathmatch"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// trigramMatcher returns rg.matchPath restricted to the files of zf (the
+// archive at zipPath) which can contain a match of p according to the
+// archive's trigram index. It returns nil if the index is not built yet or
+// can't prune files for p.
+func (s *Service) trigramMatcher(zipPath string, zf *store.ZipFile, p *protocol.Request, rg *readerGrep) pathmatch.PathMatcher {
+	// Files not containing the pattern can still match by path, or be the
+	// result of an inverted search. Binary files are not indexed.
+	if p.PatternMatchesPath || rg.invert || rg.query != nil || rg.searchBinary {
+		return nil
+	}
+	re, ok := stdRegexp(rg.re)
+	if !ok {
+		return nil
+	}
+	ast, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	literals := requiredLiterals(ast.Simplify())
+	if len(literals) == 0 {
+		return nil
+	}
+
+	idx := s.Store.TrigramIndex(zipPath, zf)
+	if idx == nil {
+		return nil
+	}
+	paths, ok := idx.Candidates(literals)
+	if !ok {
+		return nil
+	}
+	trigramSkippedFiles.Add(float64(len(zf.Files) - len(paths)))
+	return &pathSetMatcher{
+		PathMatcher: rg.matchPath,
+		paths:       paths,
+		desc:        "trigrams",
+	}
+}
+
+// requiredLiterals returns literals which appear in every match of re. Like
+// longestLiteral, it does not find every such literal.
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		// The trigram index only folds ASCII case.
+		if re.Flags&syntax.FoldCase != 0 && !isASCII(re.Rune) {
+			return nil
+		}
+		return []string{string(re.Rune)}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		var literals []string
+		for _, sub := range re.Sub {
+			literals = append(literals, requiredLiterals(sub)...)
+		}
+		return literals
+	}
+	return nil
+}
+
+func isASCII(rs []rune) bool {
+	for _, r := range rs {
+		if r >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+var trigramSkippedFiles = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "service",
+	Name:      "trigram_skipped_files_total",
+	Help:      "Number of files not searched because the trigram index of their archive showed they can't match.",
+})
+
+func init() {
+	prometheus.MustRegister(trigramSkippedFiles)
+}
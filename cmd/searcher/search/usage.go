@@ -0,0 +1,196 @@
+package search
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/store"
+)
+
+// usage measures the resources used to serve a search request, which are
+// reported in the Stats of the response. It is safe for concurrent use,
+// and its methods do nothing on a nil usage.
+type usage struct {
+	cpu         int64 // nanoseconds, accessed atomically
+	bytesRead   int64 // accessed atomically
+	filesRead   int64 // accessed atomically
+	peakBuffers int64 // accessed atomically
+	fetch       store.FetchStats
+
+	limitMu sync.Mutex
+	limit   protocol.LimitReason // the first limit hit
+	stop    *cursor              // where a Paginate search stopped because of limit
+
+	largeMu           sync.Mutex
+	largeSkipped      int64
+	largeSkippedPaths []string // the first maxLargeSkippedPaths paths
+
+	phaseMu sync.Mutex
+	phases  map[string]time.Duration // time spent in each phase, see addPhase
+	traceID string
+}
+
+// maxLargeSkippedPaths is the number of paths of files skipped because they
+// are too large which are reported.
+const maxLargeSkippedPaths = 100
+
+type usageKey struct{}
+
+// withUsage returns a context which records the resources used by requests
+// served with it in u.
+func withUsage(ctx context.Context, u *usage) context.Context {
+	ctx = store.WithFetchStats(ctx, &u.fetch)
+	return context.WithValue(ctx, usageKey{}, u)
+}
+
+func usageFromContext(ctx context.Context) *usage {
+	u, _ := ctx.Value(usageKey{}).(*usage)
+	return u
+}
+
+// startWorker records the CPU time used by the calling goroutine until the
+// returned func is called. It locks the goroutine to its thread so the CPU
+// time of the thread is that of the goroutine.
+func (u *usage) startWorker() (stop func()) {
+	if u == nil {
+		return func() {}
+	}
+	runtime.LockOSThread()
+	start := threadCPUTime()
+	return func() {
+		atomic.AddInt64(&u.cpu, int64(threadCPUTime()-start))
+		runtime.UnlockOSThread()
+	}
+}
+
+// addRead records that a file of n bytes of a cached archive was read.
+func (u *usage) addRead(n int) {
+	if u != nil {
+		atomic.AddInt64(&u.bytesRead, int64(n))
+		atomic.AddInt64(&u.filesRead, 1)
+	}
+}
+
+// addPhase records that the search spent d in phase, which is one of fetch
+// (preparing the archive, fetching it if needed), extract (reading its
+// index), match, attach (see search) or serialize (writing the response).
+func (u *usage) addPhase(phase string, d time.Duration) {
+	if u == nil {
+		return
+	}
+	u.phaseMu.Lock()
+	if u.phases == nil {
+		u.phases = map[string]time.Duration{}
+	}
+	u.phases[phase] += d
+	u.phaseMu.Unlock()
+}
+
+// setTraceID records the ID of the trace of the search.
+func (u *usage) setTraceID(id string) {
+	if u == nil {
+		return
+	}
+	u.phaseMu.Lock()
+	u.traceID = id
+	u.phaseMu.Unlock()
+}
+
+// observeBuffers records that n bytes of buffers were in use at once.
+func (u *usage) observeBuffers(n int) {
+	if u == nil {
+		return
+	}
+	for {
+		peak := atomic.LoadInt64(&u.peakBuffers)
+		if int64(n) <= peak || atomic.CompareAndSwapInt64(&u.peakBuffers, peak, int64(n)) {
+			return
+		}
+	}
+}
+
+// skipLarge records that the content of the file at path was not searched
+// because it is too large.
+func (u *usage) skipLarge(path string) {
+	if u == nil {
+		return
+	}
+	u.largeMu.Lock()
+	u.largeSkipped++
+	if len(u.largeSkippedPaths) < maxLargeSkippedPaths {
+		u.largeSkippedPaths = append(u.largeSkippedPaths, path)
+	}
+	u.largeMu.Unlock()
+}
+
+// hitLimit records that the search stopped because it hit limit.
+func (u *usage) hitLimit(limit protocol.LimitReason) {
+	if u == nil {
+		return
+	}
+	u.limitMu.Lock()
+	if u.limit == "" {
+		u.limit = limit
+	}
+	u.limitMu.Unlock()
+}
+
+// stopAt records that a Paginate search stopped at c because it hit limit.
+// Only a search stopped by the first limit hit can resume.
+func (u *usage) stopAt(limit protocol.LimitReason, c cursor) {
+	if u == nil {
+		return
+	}
+	u.limitMu.Lock()
+	if u.limit == "" {
+		u.limit = limit
+		u.stop = &c
+	}
+	u.limitMu.Unlock()
+}
+
+// cursor returns the Cursor resuming the search of commit where it stopped,
+// or "" if it didn't stop at a limit it can resume from.
+func (u *usage) cursor(commit api.CommitID) string {
+	u.limitMu.Lock()
+	defer u.limitMu.Unlock()
+	if u.stop == nil {
+		return ""
+	}
+	c := *u.stop
+	c.Commit = commit
+	return c.encode()
+}
+
+// limitReason returns the limit which was hit if limitHit is true. Only
+// file match limits are applied without being recorded, eg by structural
+// search.
+func (u *usage) limitReason(limitHit bool) protocol.LimitReason {
+	if !limitHit {
+		return ""
+	}
+	u.limitMu.Lock()
+	defer u.limitMu.Unlock()
+	if u.limit == "" {
+		return protocol.LimitFileMatches
+	}
+	return u.limit
+}
+
+func (u *usage) stats() protocol.Stats {
+	u.largeMu.Lock()
+	defer u.largeMu.Unlock()
+	return protocol.Stats{
+		CPUMilliseconds:        time.Duration(atomic.LoadInt64(&u.cpu)).Milliseconds(),
+		CacheBytesRead:         atomic.LoadInt64(&u.bytesRead),
+		GitserverBytesFetched:  u.fetch.BytesFetched(),
+		PeakBufferBytes:        atomic.LoadInt64(&u.peakBuffers),
+		LargeFilesSkipped:      u.largeSkipped,
+		LargeFilesSkippedPaths: append([]string(nil), u.largeSkippedPaths...),
+	}
+}
@@ -0,0 +1,48 @@
+package search
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+type protocolVersionKey struct{}
+
+// negotiateVersion negotiates the protocol version of r (see
+// protocol.NegotiateVersion) and tells the client which version is used. It
+// returns r with the version in its context, or false if the client's
+// version is not supported, in which case an error has been written to w.
+func negotiateVersion(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	version, err := protocol.NegotiateVersion(r.Header.Get(protocol.VersionHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	w.Header().Set(protocol.VersionHeader, strconv.Itoa(version))
+	protocolVersionTotal.WithLabelValues(strconv.Itoa(version)).Inc()
+	return r.WithContext(context.WithValue(r.Context(), protocolVersionKey{}, version)), true
+}
+
+// protocolVersion returns the protocol version negotiated for the request
+// with context ctx.
+func protocolVersion(ctx context.Context) int {
+	if v, ok := ctx.Value(protocolVersionKey{}).(int); ok {
+		return v
+	}
+	return 1
+}
+
+var protocolVersionTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "service",
+	Name:      "protocol_version_total",
+	Help:      "Number of requests served by negotiated protocol version. Once a version is no longer used it can be dropped.",
+}, []string{"version"})
+
+func init() {
+	prometheus.MustRegister(protocolVersionTotal)
+}
@@ -0,0 +1,68 @@
+package search
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// wordMatcher only keeps the matches of re which are whole words (see
+// isWordAt). Unlike wrapping the pattern in \b, which RE2 only implements
+// for ASCII, this handles any letter (eg "café") and patterns which start or
+// end with a non-word character (eg "foo()").
+//
+// Matches of re which are rejected hide overlapping matches starting inside
+// them, which only matters for patterns matching repetitions of themselves.
+type wordMatcher struct {
+	re regexpMatcher
+}
+
+func (m *wordMatcher) MatchString(s string) bool {
+	return len(m.FindAllIndex([]byte(s), 1)) > 0
+}
+
+// FindAllIndex returns the byte offsets of at most n (or all if n < 0)
+// successive non-overlapping whole word matches in b.
+func (m *wordMatcher) FindAllIndex(b []byte, n int) [][]int {
+	locs := m.re.FindAllIndex(b, -1)
+	words := locs[:0]
+	for _, loc := range locs {
+		if n >= 0 && len(words) >= n {
+			break
+		}
+		if isWordAt(b, loc[0], loc[1]) {
+			words = append(words, loc)
+		}
+	}
+	return words
+}
+
+func (m *wordMatcher) String() string {
+	return m.re.String()
+}
+
+// isWordAt reports whether b[start:end] is a whole word: it doesn't
+// continue a word before start or after end. Like in editors, a match
+// starting or ending with a non-word character (eg "(foo") is a word there.
+func isWordAt(b []byte, start, end int) bool {
+	if start > 0 && start < end {
+		before, _ := utf8.DecodeLastRune(b[:start])
+		first, _ := utf8.DecodeRune(b[start:end])
+		if isWordRune(before) && isWordRune(first) {
+			return false
+		}
+	}
+	if end < len(b) && start < end {
+		last, _ := utf8.DecodeLastRune(b[start:end])
+		after, _ := utf8.DecodeRune(b[end:])
+		if isWordRune(last) && isWordRune(after) {
+			return false
+		}
+	}
+	return true
+}
+
+// isWordRune reports whether r is a word character, like \w in Unicode
+// aware regexp engines.
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
@@ -0,0 +1,76 @@
+package search
+
+import (
+	"context"
+	"runtime"
+)
+
+// workerPool bounds how many files are searched concurrently, by a request
+// and by all the requests of a Service together, so that many concurrent
+// requests don't oversubscribe the CPU.
+type workerPool struct {
+	// perRequest is the number of workers regexSearch starts.
+	perRequest int
+
+	// tokens has a value for every file being searched.
+	tokens chan struct{}
+}
+
+// newWorkerPool returns a pool starting perRequest workers per search, and
+// searching at most max files at once. Either defaults to GOMAXPROCS if it
+// isn't positive.
+func newWorkerPool(perRequest, max int) *workerPool {
+	procs := runtime.GOMAXPROCS(0)
+	if perRequest <= 0 {
+		perRequest = procs
+	}
+	if max <= 0 {
+		max = procs
+	}
+	if perRequest > max {
+		perRequest = max
+	}
+	return &workerPool{perRequest: perRequest, tokens: make(chan struct{}, max)}
+}
+
+// acquire blocks until a file may be searched. It returns false if ctx is
+// done first. Otherwise release must be called once the file was searched.
+func (p *workerPool) acquire(ctx context.Context) bool {
+	select {
+	case p.tokens <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *workerPool) release() {
+	<-p.tokens
+}
+
+// workerPool returns the pool of s, configured by WorkersPerRequest and
+// MaxWorkers.
+func (s *Service) workerPool() *workerPool {
+	s.workersOnce.Do(func() {
+		s.workers = newWorkerPool(s.WorkersPerRequest, s.MaxWorkers)
+	})
+	return s.workers
+}
+
+// defaultWorkerPool is used by searches without a Service, eg in tests.
+var defaultWorkerPool = newWorkerPool(0, 0)
+
+type workerPoolKey struct{}
+
+// withWorkerPool returns a context for which regexSearch searches files with
+// the workers of pool.
+func withWorkerPool(ctx context.Context, pool *workerPool) context.Context {
+	return context.WithValue(ctx, workerPoolKey{}, pool)
+}
+
+func workerPoolFromContext(ctx context.Context) *workerPool {
+	if pool, ok := ctx.Value(workerPoolKey{}).(*workerPool); ok {
+		return pool
+	}
+	return defaultWorkerPool
+}
@@ -0,0 +1,38 @@
+package search
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestNewWorkerPool(t *testing.T) {
+	procs := runtime.GOMAXPROCS(0)
+	if p := newWorkerPool(0, 0); p.perRequest != procs || cap(p.tokens) != procs {
+		t.Errorf("got %d workers per request and %d in total, want GOMAXPROCS (%d)", p.perRequest, cap(p.tokens), procs)
+	}
+	// A request can't have more workers than all requests together.
+	if p := newWorkerPool(16, 4); p.perRequest != 4 || cap(p.tokens) != 4 {
+		t.Errorf("got %d workers per request and %d in total, want 4 and 4", p.perRequest, cap(p.tokens))
+	}
+}
+
+func TestWorkerPool_acquire(t *testing.T) {
+	p := newWorkerPool(1, 1)
+	if !p.acquire(context.Background()) {
+		t.Fatal("expected to acquire the only worker")
+	}
+
+	// The next file waits until the first one was searched.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if p.acquire(ctx) {
+		t.Fatal("expected acquire to wait for the worker to be released")
+	}
+	p.release()
+	if !p.acquire(context.Background()) {
+		t.Fatal("expected to acquire the released worker")
+	}
+	p.release()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	log15 "gopkg.in/inconshreveable/log15.v2"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/client"
+)
+
+// serverTLSConfig returns the configuration the HTTP and gRPC APIs are served
+// over TLS with, or nil if they are served in plaintext. HTTP/2 is
+// negotiated with clients supporting it.
+//
+// If selfSigned, a self-signed certificate is generated instead of loading
+// SEARCHER_TLS_CERT_FILE. It encrypts traffic, but clients can't verify it,
+// so they must skip verification.
+//
+// With SEARCHER_TLS_CLIENT_CA_FILE, client certificates are verified if
+// given, and search.Service.RequireClientCert rejects requests without one
+// other than health checks, which probes make without a certificate.
+func serverTLSConfig(selfSigned bool) (*tls.Config, error) {
+	var (
+		cert tls.Certificate
+		err  error
+	)
+	switch {
+	case selfSigned:
+		cert, err = selfSignedCert()
+	case tlsCertFile != "" || tlsKeyFile != "":
+		cert, err = tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	case tlsClientCAFile != "":
+		return nil, errors.New("SEARCHER_TLS_CLIENT_CA_FILE requires SEARCHER_TLS_CERT_FILE and SEARCHER_TLS_KEY_FILE")
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if tlsClientCAFile != "" {
+		pool, err := client.CertPool(tlsClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// selfSignedCert returns a certificate for the hostname of this replica and
+// localhost, signed by its own newly generated key.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	hostname, _ := os.Hostname()
+	names := []string{"localhost"}
+	if hostname != "" {
+		names = append(names, hostname)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[len(names)-1]},
+		DNSNames:              names,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	log15.Warn("searcher: serving TLS with a self-signed certificate, which clients can't verify", "names", names)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// peerClient returns the client requests to other searcher replicas are made
+// with given the server TLS configuration, or nil for the default client.
+// Replicas present their own certificate to each other, and verify each
+// other's with the client CA, which must therefore have signed it, unless
+// they are selfSigned and can't be verified.
+func peerClient(server *tls.Config, selfSigned bool) *http.Client {
+	if server == nil {
+		return nil
+	}
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			Certificates:       server.Certificates,
+			RootCAs:            server.ClientCAs,
+			InsecureSkipVerify: selfSigned,
+		},
+		// A custom TLSClientConfig otherwise disables HTTP/2.
+		ForceAttemptHTTP2: true,
+	}}
+}
@@ -187,7 +187,7 @@ function buildCtagsDockerImage() {
     cp -R cmd/symbols/.ctags.d "$ctagsDockerBuildContext"
 
     echo "Building the $CTAGS_IMAGE Docker image..."
-    docker build --progress=plain --quiet -f cmd/symbols/internal/pkg/ctags/Dockerfile -t "$CTAGS_IMAGE" "$ctagsDockerBuildContext"
+    docker build --progress=plain --quiet -f internal/ctags/Dockerfile -t "$CTAGS_IMAGE" "$ctagsDockerBuildContext"
     echo "Building the $CTAGS_IMAGE Docker image... done"
 }
 
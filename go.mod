@@ -3,8 +3,10 @@ module github.com/sourcegraph/sourcegraph
 go 1.14
 
 require (
+	cloud.google.com/go v0.53.0
 	cloud.google.com/go/datastore v1.1.0 // indirect
 	cloud.google.com/go/pubsub v1.2.0
+	cloud.google.com/go/storage v1.5.0
 	github.com/DataDog/zstd v1.4.4 // indirect
 	github.com/Masterminds/semver v1.5.0
 	github.com/NYTimes/gziphandler v1.1.1
@@ -23,6 +25,7 @@ require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/daviddengcn/go-colortext v0.0.0-20180409174941-186a3d44e920
 	github.com/dghubble/gologin v2.2.0+incompatible
+	github.com/dlclark/regexp2 v1.2.0
 	github.com/dnaeon/go-vcr v1.0.1
 	github.com/docker/docker v1.4.2-0.20200213202729-31a86c4ab209
 	github.com/emersion/go-imap v1.0.3
@@ -50,6 +53,7 @@ require (
 	github.com/golang-migrate/migrate/v4 v4.9.1
 	github.com/golang/gddo v0.0.0-20200214150928-23683d71bb88
 	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e
+	github.com/golang/protobuf v1.3.4
 	github.com/golangci/gocyclo v0.0.0-20180528144436-0a533e8fa43d // indirect
 	github.com/golangci/golangci-lint v1.23.6
 	github.com/golangci/revgrep v0.0.0-20180812185044-276a5c0a1039 // indirect
@@ -89,7 +93,7 @@ require (
 	github.com/keegancsmith/sqlf v1.1.0
 	github.com/keegancsmith/tmpfriend v0.0.0-20180423180255-86e88902a513
 	github.com/kevinburke/go-bindata v3.16.0+incompatible
-	github.com/klauspost/compress v1.10.1 // indirect
+	github.com/klauspost/compress v1.10.1
 	github.com/kr/text v0.2.0
 	github.com/kylelemons/godebug v1.1.0
 	github.com/leanovate/gopter v0.2.7
@@ -104,7 +108,7 @@ require (
 	github.com/microcosm-cc/bluemonday v1.0.2
 	github.com/neelance/parallel v0.0.0-20160708114440-4de9ce63d14c
 	github.com/opentracing-contrib/go-stdlib v0.0.0-20190519235532-cf7a6c988dc9
-	github.com/opentracing/opentracing-go v1.1.0
+	github.com/opentracing/opentracing-go v1.1.1-0.20190913142402-a7454ce5950e
 	github.com/peterbourgon/ff v1.7.0
 	github.com/peterh/liner v1.2.0 // indirect
 	github.com/peterhellberg/link v1.1.0
@@ -162,6 +166,8 @@ require (
 	github.com/xeipuuv/gojsonpointer v0.0.0-20190905194746-02993c407bfb // indirect
 	github.com/xeipuuv/gojsonschema v1.2.0
 	github.com/xeonx/timeago v1.0.0-rc4
+	go.opentelemetry.io/otel v0.5.0
+	go.opentelemetry.io/otel/exporters/otlp v0.5.0
 	go.starlark.net v0.0.0-20200203144150-6677ee5c7211 // indirect
 	go.uber.org/atomic v1.5.1 // indirect
 	go.uber.org/automaxprocs v1.3.0
@@ -171,9 +177,11 @@ require (
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
 	golang.org/x/sys v0.0.0-20200219091948-cb0a6d8edb6c
+	golang.org/x/text v0.3.2
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	golang.org/x/tools v0.0.0-20200219161401-5fb17a1e7b9b
 	google.golang.org/genproto v0.0.0-20200218151345-dad8c97a84f5 // indirect
+	google.golang.org/grpc v1.27.1
 	gopkg.in/alexcesaro/statsd.v2 v2.0.0 // indirect
 	gopkg.in/go-playground/validator.v9 v9.31.0 // indirect
 	gopkg.in/inconshreveable/log15.v2 v2.0.0-20200109203555-b30bc20e4fd1
@@ -31,6 +31,10 @@ func (args Args) String() string {
 		s = append(s, "-matcher", args.Matcher)
 	}
 
+	if args.Timeout > 0 {
+		s = append(s, "-timeout", strconv.Itoa(args.Timeout))
+	}
+
 	switch i := args.Input.(type) {
 	case ZipPath:
 		s = append(s, "-zip", string(i))
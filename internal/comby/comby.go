@@ -53,6 +53,10 @@ func rawArgs(args Args) (rawArgs []string) {
 		rawArgs = append(rawArgs, "-matcher", args.Matcher)
 	}
 
+	if args.Timeout > 0 {
+		rawArgs = append(rawArgs, "-timeout", strconv.Itoa(args.Timeout))
+	}
+
 	switch i := args.Input.(type) {
 	case ZipPath:
 		rawArgs = append(rawArgs, "-zip", string(i))
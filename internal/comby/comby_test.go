@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/sourcegraph/sourcegraph/internal/testutil"
@@ -124,3 +125,11 @@ func main() {
 		}
 	}
 }
+
+func TestRawArgs_timeout(t *testing.T) {
+	args := Args{Input: ZipPath("a.zip"), MatchTemplate: "func", MatchOnly: true, Timeout: 2}
+	got := strings.Join(rawArgs(args), " ")
+	if want := "func  -json-lines -match-only -sequential -timeout 2 -zip a.zip"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
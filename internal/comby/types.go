@@ -34,6 +34,10 @@ type Args struct {
 
 	// NumWorkers is the number of worker processes to fork in parallel
 	NumWorkers int
+
+	// Timeout if positive is the number of seconds after which comby gives
+	// up matching a single file. Otherwise comby's default is used.
+	Timeout int
 }
 
 // Location is the location in a file
@@ -18,6 +18,7 @@ type Entry struct {
 	Name       string
 	Path       string
 	Line       int
+	End        int // line the definition ends on, or 0 if ctags doesn't know
 	Kind       string
 	Language   string
 	Parent     string
@@ -57,6 +58,12 @@ func GetCommand() string {
 	return ctagsCommand
 }
 
+// IsCommandAvailable returns true if the ctags command from the
+// CTAGS_COMMAND environment variable exists.
+func IsCommandAvailable() bool {
+	return isCommandAvailable(ctagsCommand)
+}
+
 func NewParser(ctagsCommand string) (Parser, error) {
 	opt := "default"
 
@@ -225,6 +232,7 @@ func (p *ctagsProcess) Parse(name string, content []byte) (entries []Entry, err
 			Name:        rep.Name,
 			Path:        rep.Path,
 			Line:        rep.Line,
+			End:         rep.End,
 			Kind:        rep.Kind,
 			Language:    rep.Language,
 			Parent:      rep.Scope,
@@ -0,0 +1,56 @@
+package ctags
+
+import "context"
+
+// Pool is a fixed size pool of Parsers which is safe for concurrent use.
+// Parsers are started when first needed, and replaced if they fail.
+type Pool struct {
+	newParser func() (Parser, error)
+
+	// parsers holds one slot per parser. A nil slot has no running parser.
+	parsers chan Parser
+}
+
+// NewPool returns a Pool of at most size parsers created by newParser.
+func NewPool(size int, newParser func() (Parser, error)) *Pool {
+	if size <= 0 {
+		size = 1
+	}
+	p := &Pool{
+		newParser: newParser,
+		parsers:   make(chan Parser, size),
+	}
+	for i := 0; i < size; i++ {
+		p.parsers <- nil
+	}
+	return p
+}
+
+// Parse parses content with a parser from the pool, waiting for one to be
+// available.
+func (p *Pool) Parse(ctx context.Context, path string, content []byte) ([]Entry, error) {
+	var parser Parser
+	select {
+	case parser = <-p.parsers:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if parser == nil {
+		var err error
+		parser, err = p.newParser()
+		if err != nil {
+			p.parsers <- nil
+			return nil, err
+		}
+	}
+
+	entries, err := parser.Parse(path, content)
+	if err != nil {
+		// The parser process may be in a bad state, so replace it.
+		parser.Close()
+		parser = nil
+	}
+	p.parsers <- parser
+	return entries, err
+}
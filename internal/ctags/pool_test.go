@@ -0,0 +1,67 @@
+package ctags
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type fakeParser struct {
+	fail   bool
+	closed bool
+}
+
+func (p *fakeParser) Parse(path string, content []byte) ([]Entry, error) {
+	if p.fail {
+		return nil, errors.New("parse failed")
+	}
+	return []Entry{{Name: string(content), Path: path}}, nil
+}
+
+func (p *fakeParser) Close() { p.closed = true }
+
+func TestPool(t *testing.T) {
+	var started []*fakeParser
+	pool := NewPool(1, func() (Parser, error) {
+		p := &fakeParser{}
+		started = append(started, p)
+		return p, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		entries, err := pool.Parse(context.Background(), "a.go", []byte("foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name != "foo" {
+			t.Fatalf("unexpected entries %+v", entries)
+		}
+	}
+	if len(started) != 1 {
+		t.Fatalf("expected the parser to be reused, started %d", len(started))
+	}
+
+	// A failing parser is closed and replaced.
+	started[0].fail = true
+	if _, err := pool.Parse(context.Background(), "a.go", []byte("foo")); err == nil {
+		t.Fatal("expected error")
+	}
+	if !started[0].closed {
+		t.Fatal("expected the failed parser to be closed")
+	}
+	if _, err := pool.Parse(context.Background(), "a.go", []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if len(started) != 2 {
+		t.Fatalf("expected a new parser to be started, started %d", len(started))
+	}
+
+	// Parse waits for a parser and respects ctx.
+	parser := <-pool.parsers
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pool.Parse(ctx, "a.go", []byte("foo")); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	pool.parsers <- parser
+}
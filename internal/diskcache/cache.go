@@ -35,6 +35,31 @@ type Store struct {
 	// BeforeEvict, when non-nil, is a function to call before evicting a file.
 	// It is passed the path to the file to be evicted.
 	BeforeEvict func(string)
+
+	// BeforePut, when non-nil, is called once a fetched file has been
+	// written to tmpPath and synced to disk, before it is renamed to path.
+	// If it returns an error the file is discarded. It can record metadata
+	// about the file which must exist before Open finds it, eg a checksum.
+	BeforePut func(tmpPath, path string) error
+
+	// Pinned, when non-nil, reports whether the file at path must not be
+	// evicted, eg because it is in use.
+	Pinned func(path string) bool
+
+	// EvictOrder, when non-nil, sorts the files considered by Evict in the
+	// order they should be evicted. By default the least recently used
+	// files are evicted first.
+	EvictOrder func([]os.FileInfo)
+
+	// MaxIdle when non-zero makes Evict also remove the files which have
+	// not been used for longer than MaxIdle, even if the cache is not too
+	// large.
+	MaxIdle time.Duration
+
+	// Sidecars are the suffixes appended to the path of a cached file to
+	// get the paths of files derived from it, eg an index. Their size counts
+	// towards the size of the cache, and Evict removes them with the file.
+	Sidecars []string
 }
 
 // File is an os.File, but includes the Path
@@ -123,7 +148,7 @@ func (s *Store) OpenWithPath(ctx context.Context, key string, fetcher FetcherWit
 			ctx, cancel = context.WithTimeout(context.Background(), s.BackgroundTimeout)
 			defer cancel()
 		}
-		f, err := doFetch(ctx, path, fetcher)
+		f, err := doFetch(ctx, path, fetcher, s.BeforePut)
 		ch <- result{f, err}
 	}(ctx)
 
@@ -138,6 +163,18 @@ func (s *Store) OpenWithPath(ctx context.Context, key string, fetcher FetcherWit
 	}
 }
 
+// Stat returns the path and FileInfo of the cache item for key, without
+// fetching it or updating its modification time. If key is not in the cache
+// the error satisfies os.IsNotExist.
+func (s *Store) Stat(key string) (string, os.FileInfo, error) {
+	path := s.path(key)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	return path, fi, nil
+}
+
 // path returns the path for key.
 func (s *Store) path(key string) string {
 	// path uses a sha256 hash of the key since we want to use it for the
@@ -146,7 +183,7 @@ func (s *Store) path(key string) string {
 	return filepath.Join(s.Dir, hex.EncodeToString(h[:])) + ".zip"
 }
 
-func doFetch(ctx context.Context, path string, fetcher FetcherWithPath) (file *File, err error) {
+func doFetch(ctx context.Context, path string, fetcher FetcherWithPath, beforePut func(tmpPath, path string) error) (file *File, err error) {
 	// We have to grab the lock for this key, so we can fetch or wait for
 	// someone else to finish fetching.
 	urlMu := urlMu(path)
@@ -195,6 +232,12 @@ func doFetch(ctx context.Context, path string, fetcher FetcherWithPath) (file *F
 		return nil, errors.Wrap(err, "failed to sync cache item to disk")
 	}
 
+	if beforePut != nil {
+		if err := beforePut(tmpPath, path); err != nil {
+			return nil, errors.Wrap(err, "failed to prepare cache item")
+		}
+	}
+
 	// Put the partially written file in the correct place and open
 	err = os.Rename(tmpPath, path)
 	if err != nil {
@@ -220,10 +263,15 @@ type EvictStats struct {
 
 	// Evicted is the number of items evicted.
 	Evicted int
+
+	// Pinned is the number of items which were not evicted because they
+	// were pinned.
+	Pinned int
 }
 
-// Evict will remove files from Store.Dir until it is smaller than
-// maxCacheSizeBytes. It evicts files with the oldest modification time first.
+// Evict will remove files, and their sidecars, from Store.Dir until it is
+// smaller than maxCacheSizeBytes. It evicts files with the oldest modification time first,
+// unless EvictOrder is set. Pinned files are never evicted.
 func (s *Store) Evict(maxCacheSizeBytes int64) (stats EvictStats, err error) {
 	isZip := func(fi os.FileInfo) bool {
 		return strings.HasSuffix(fi.Name(), ".zip")
@@ -240,33 +288,54 @@ func (s *Store) Evict(maxCacheSizeBytes int64) (stats EvictStats, err error) {
 		return stats, errors.Wrapf(err, "failed to ReadDir %s", s.Dir)
 	}
 
-	// Sum up the total size of all zips
-	var size int64
+	// Sum up the total size of all zips and their sidecars
+	sizes := make(map[string]int64, len(list))
 	for _, fi := range list {
 		if isZip(fi) {
-			size += fi.Size()
+			sizes[fi.Name()] += fi.Size()
+		}
+	}
+	for _, fi := range list {
+		for _, suffix := range s.Sidecars {
+			name := strings.TrimSuffix(fi.Name(), suffix)
+			if _, ok := sizes[name]; ok && name != fi.Name() {
+				sizes[name] += fi.Size()
+			}
 		}
 	}
+	var size int64
+	for _, n := range sizes {
+		size += n
+	}
 	stats.CacheSize = size
 
 	// Nothing to evict
-	if size <= maxCacheSizeBytes {
+	if size <= maxCacheSizeBytes && s.MaxIdle <= 0 {
 		return stats, nil
 	}
 
 	// Keep removing files until we are under the cache size. Remove the
 	// oldest first.
-	sort.Slice(list, func(i, j int) bool {
-		return list[i].ModTime().Before(list[j].ModTime())
-	})
+	if s.EvictOrder != nil {
+		s.EvictOrder(list)
+	} else {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].ModTime().Before(list[j].ModTime())
+		})
+	}
+	now := time.Now()
 	for _, fi := range list {
-		if size <= maxCacheSizeBytes {
-			break
-		}
 		if !isZip(fi) {
 			continue
 		}
+		if size <= maxCacheSizeBytes && (s.MaxIdle <= 0 || now.Sub(fi.ModTime()) <= s.MaxIdle) {
+			continue
+		}
 		path := filepath.Join(s.Dir, fi.Name())
+		if s.Pinned != nil && s.Pinned(path) {
+			stats.Pinned++
+			continue
+		}
 		if s.BeforeEvict != nil {
 			s.BeforeEvict(path)
 		}
@@ -275,8 +344,11 @@ func (s *Store) Evict(maxCacheSizeBytes int64) (stats EvictStats, err error) {
 			log.Printf("failed to remove %s: %s", path, err)
 			continue
 		}
+		for _, suffix := range s.Sidecars {
+			_ = os.Remove(path + suffix)
+		}
 		stats.Evicted++
-		size -= fi.Size()
+		size -= sizes[fi.Name()]
 	}
 
 	return stats, nil
@@ -3,10 +3,13 @@ package diskcache
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestOpen(t *testing.T) {
@@ -61,3 +64,129 @@ func TestOpen(t *testing.T) {
 		t.Fatal("Item was not properly evicted")
 	}
 }
+
+func TestStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskcache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &Store{
+		Dir:       dir,
+		Component: "test",
+	}
+
+	if _, _, err := store.Stat("key"); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error for missing key, got %v", err)
+	}
+
+	f, err := store.Open(context.Background(), "key", func(ctx context.Context) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader([]byte("foobar"))), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	path, fi, err := store.Stat("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != f.Path || fi.Size() != 6 {
+		t.Errorf("got path %q size %d, want path %q size 6", path, fi.Size(), f.Path)
+	}
+}
+
+func TestOpen_beforePut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskcache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var putErr error
+	store := &Store{
+		Dir: dir,
+		BeforePut: func(tmpPath, path string) error {
+			if b, err := ioutil.ReadFile(tmpPath); err != nil || string(b) != "foobar" {
+				t.Errorf("got content %q (err=%v) before put, want foobar", b, err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("expected %s not to exist before put, got err=%v", path, err)
+			}
+			return putErr
+		},
+	}
+	open := func() error {
+		f, err := store.Open(context.Background(), "key", func(ctx context.Context) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader([]byte("foobar"))), nil
+		})
+		if f != nil {
+			f.Close()
+		}
+		return err
+	}
+
+	putErr = errors.New("boom")
+	if err := open(); err == nil {
+		t.Fatal("expected an error when BeforePut fails")
+	}
+	if _, _, err := store.Stat("key"); !os.IsNotExist(err) {
+		t.Fatalf("expected the file to be discarded, got err=%v", err)
+	}
+
+	putErr = nil
+	if err := open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Stat("key"); err != nil {
+		t.Fatalf("expected the file to be cached: %v", err)
+	}
+}
+
+func TestEvict_sidecars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskcache_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a is older than b, and the sidecars are larger than the files.
+	now := time.Now()
+	for i, name := range []string{"a.zip", "b.zip"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, make([]byte, 10), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path+".idx", make([]byte, 100), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i-2) * time.Hour)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := &Store{Dir: dir, Sidecars: []string{".idx"}}
+	stats, err := store.Evict(150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CacheSize != 220 {
+		t.Errorf("got cache size %d, want 220", stats.CacheSize)
+	}
+	if stats.Evicted != 1 {
+		t.Errorf("expected 1 file to be evicted, got %d", stats.Evicted)
+	}
+	for _, name := range []string{"a.zip", "a.zip.idx"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got err=%v", name, err)
+		}
+	}
+	for _, name := range []string{"b.zip", "b.zip.idx"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to be kept: %v", name, err)
+		}
+	}
+}
@@ -439,6 +439,12 @@ func (c *Client) pingAll(ctx context.Context) []error {
 	return errs
 }
 
+// Ping returns an error if the gitserver at addr does not respond
+// successfully to a noop request.
+func (c *Client) Ping(ctx context.Context, addr string) error {
+	return c.ping(ctx, addr)
+}
+
 func (c *Client) ping(ctx context.Context, addr string) error {
 	req, err := http.NewRequest("GET", "http://"+addr+"/ping", nil)
 	if err != nil {
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"context"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sourcegraph/sourcegraph/internal/trace"
+)
+
+// exemplarObserver is implemented by histograms of Prometheus client
+// libraries which support exemplars (client_golang v1.9 and later). We
+// check for it rather than use prometheus.ExemplarObserver so that this
+// builds against older versions, which simply do not record exemplars.
+type exemplarObserver interface {
+	ObserveWithExemplar(value float64, exemplar prometheus.Labels)
+}
+
+// ObserveWithTrace observes v with obs. If ctx has a traced span, the ID of
+// its trace is attached to the observation as an exemplar, so that a latency
+// spike on a dashboard can be followed to the traces which caused it.
+//
+// Exemplars are only exposed by /metrics in the OpenMetrics format.
+func ObserveWithTrace(ctx context.Context, obs prometheus.Observer, v float64) {
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		if id := trace.SpanTraceID(span); id != "" {
+			if eo, ok := obs.(exemplarObserver); ok {
+				eo.ObserveWithExemplar(v, prometheus.Labels{"trace_id": id})
+				return
+			}
+		}
+	}
+	obs.Observe(v)
+}
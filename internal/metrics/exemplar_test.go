@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sourcegraph/sourcegraph/internal/trace"
+)
+
+type fakeObserver struct {
+	value    float64
+	exemplar prometheus.Labels
+}
+
+func (o *fakeObserver) Observe(v float64) { o.value = v }
+
+func (o *fakeObserver) ObserveWithExemplar(v float64, exemplar prometheus.Labels) {
+	o.value, o.exemplar = v, exemplar
+}
+
+func TestObserveWithTrace(t *testing.T) {
+	orig := trace.SpanTraceID
+	defer func() { trace.SpanTraceID = orig }()
+	trace.SpanTraceID = func(span opentracing.Span) string { return "abc123" }
+
+	var obs fakeObserver
+	ObserveWithTrace(context.Background(), &obs, 1)
+	if obs.value != 1 || obs.exemplar != nil {
+		t.Errorf("expected 1 to be observed without an exemplar, got %+v", obs)
+	}
+
+	span := mocktracer.New().StartSpan("test")
+	ctx := opentracing.ContextWithSpan(context.Background(), span)
+	ObserveWithTrace(ctx, &obs, 2)
+	if obs.value != 2 || obs.exemplar["trace_id"] != "abc123" {
+		t.Errorf("expected 2 to be observed with trace_id abc123, got %+v", obs)
+	}
+}
@@ -0,0 +1,169 @@
+// Package profiler continuously collects CPU and heap profiles of the
+// current process and pushes them to a profiling backend, so that hot spots
+// in production can be found without manual pprof sessions.
+//
+// Work which should be attributable in the profiles can be labelled with
+// runtime/pprof.Do. Both supported backends keep pprof labels.
+package profiler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"runtime/pprof"
+	"strconv"
+	"time"
+
+	cloudprofiler "cloud.google.com/go/profiler"
+	"github.com/pkg/errors"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+
+	"github.com/sourcegraph/sourcegraph/internal/env"
+	"github.com/sourcegraph/sourcegraph/internal/version"
+)
+
+var (
+	backend      = env.Get("SRC_PROFILING_BACKEND", "", "continuous profiling backend to push profiles to: pyroscope or cloud-profiler. Disabled if empty")
+	pyroscopeURL = env.Get("SRC_PROFILING_PYROSCOPE_URL", "", "URL of the Pyroscope server profiles are pushed to, eg http://pyroscope:4040")
+	interval     = env.Get("SRC_PROFILING_INTERVAL", "1m", "how long each CPU profile pushed to Pyroscope covers")
+)
+
+// Init starts pushing profiles of the process, named service, to the
+// backend configured by SRC_PROFILING_BACKEND. It does nothing if profiling
+// is not enabled.
+func Init(service string) {
+	switch backend {
+	case "":
+		return
+
+	case "cloud-profiler":
+		err := cloudprofiler.Start(cloudprofiler.Config{
+			Service:        service,
+			ServiceVersion: version.Version(),
+		})
+		if err != nil {
+			log.Printf("Could not start Cloud Profiler: %s", err)
+			return
+		}
+
+	case "pyroscope":
+		if pyroscopeURL == "" {
+			log.Println("SRC_PROFILING_PYROSCOPE_URL is required for the pyroscope profiling backend")
+			return
+		}
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			log.Printf("invalid duration %q for SRC_PROFILING_INTERVAL", interval)
+			return
+		}
+		p := &pyroscope{URL: pyroscopeURL, Name: service, Interval: d}
+		go p.run(context.Background())
+
+	default:
+		log.Printf("unknown SRC_PROFILING_BACKEND %q, continuous profiling is disabled", backend)
+		return
+	}
+	log15.Info("Continuous profiling enabled", "backend", backend)
+}
+
+// pyroscope pushes profiles to a Pyroscope server using its ingest API.
+type pyroscope struct {
+	// URL is the URL of the Pyroscope server.
+	URL string
+
+	// Name is the application name profiles are recorded under.
+	Name string
+
+	// Interval is the duration each CPU profile covers.
+	Interval time.Duration
+
+	// Client is used to push profiles. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// run profiles the process until ctx is done. Each iteration records a CPU
+// profile over Interval, followed by a heap profile.
+func (p *pyroscope) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		from := time.Now()
+		var buf bytes.Buffer
+		if err := pprof.StartCPUProfile(&buf); err != nil {
+			// Most likely someone is running a CPU profile via the debug
+			// server. Try again later.
+			log15.Warn("profiler: failed to start CPU profile", "error", err)
+			sleep(ctx, p.Interval)
+			continue
+		}
+		sleep(ctx, p.Interval)
+		pprof.StopCPUProfile()
+		until := time.Now()
+		if err := p.push(ctx, "cpu", from, until, &buf); err != nil {
+			log15.Warn("profiler: failed to push CPU profile", "error", err)
+		}
+
+		buf.Reset()
+		if err := pprof.Lookup("heap").WriteTo(&buf, 0); err != nil {
+			log15.Warn("profiler: failed to write heap profile", "error", err)
+			continue
+		}
+		if err := p.push(ctx, "heap", from, until, &buf); err != nil {
+			log15.Warn("profiler: failed to push heap profile", "error", err)
+		}
+	}
+}
+
+// push uploads the pprof encoded profile of kind (cpu or heap) covering
+// from until until.
+func (p *pyroscope) push(ctx context.Context, kind string, from, until time.Time, profile io.Reader) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("profile", kind+".pprof")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, profile); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	q := url.Values{
+		"name":       {p.Name},
+		"from":       {strconv.FormatInt(from.Unix(), 10)},
+		"until":      {strconv.FormatInt(until.Unix(), 10)},
+		"format":     {"pprof"},
+		"spyName":    {"gospy"},
+		"sampleRate": {"100"},
+	}
+	req, err := http.NewRequest("POST", p.URL+"/ingest?"+q.Encode(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "pyroscope request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("pyroscope responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
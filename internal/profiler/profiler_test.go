@@ -0,0 +1,49 @@
+package profiler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPyroscopePush(t *testing.T) {
+	var gotQuery, gotProfile string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ingest" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		gotQuery = r.URL.RawQuery
+		f, _, err := r.FormFile("profile")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(f)
+		gotProfile = string(b)
+	}))
+	defer srv.Close()
+
+	p := &pyroscope{URL: srv.URL, Name: "searcher", Interval: time.Second}
+	from := time.Unix(1000, 0)
+	if err := p.push(context.Background(), "cpu", from, from.Add(time.Minute), strings.NewReader("profile data")); err != nil {
+		t.Fatal(err)
+	}
+	if gotProfile != "profile data" {
+		t.Errorf("got profile %q", gotProfile)
+	}
+	for _, want := range []string{"name=searcher", "from=1000", "until=1060", "format=pprof"} {
+		if !strings.Contains(gotQuery, want) {
+			t.Errorf("expected query %q to contain %q", gotQuery, want)
+		}
+	}
+
+	p.URL = srv.URL + "/missing"
+	if err := p.push(context.Background(), "cpu", from, from, strings.NewReader("")); err == nil {
+		t.Error("expected an error when pyroscope does not accept the profile")
+	}
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BlobStore is a store of archives shared by searcher replicas, eg an S3,
+// GCS or MinIO bucket. Replicas upload the archives they fetch from
+// gitserver, so other replicas can download them instead of fetching the
+// same archive again.
+type BlobStore interface {
+	// Get returns the blob at key, or a nil io.ReadCloser if there is none.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Put stores the size bytes of r at key.
+	Put(ctx context.Context, key string, r io.ReadSeeker, size int64) error
+}
+
+// blobUploadTimeout bounds uploading an archive to Blobs.
+const blobUploadTimeout = 5 * time.Minute
+
+// fetchFromBlobs tries to download the archive with the cache key key from
+// Blobs to path. It reports whether it succeeded.
+func (s *Store) fetchFromBlobs(ctx context.Context, key, path string) bool {
+	if s.Blobs == nil {
+		return false
+	}
+	rc, err := s.Blobs.Get(ctx, key)
+	if err != nil {
+		log.Printf("failed to get archive %s from the blob store: %s", key, err)
+		blobFetches.WithLabelValues("error").Inc()
+		return false
+	}
+	if rc == nil {
+		blobFetches.WithLabelValues("miss").Inc()
+		return false
+	}
+	err = writeFile(path, rc)
+	if err == nil {
+		err = checkZip(path)
+	}
+	if err != nil {
+		log.Printf("failed to get archive %s from the blob store: %s", key, err)
+		blobFetches.WithLabelValues("error").Inc()
+		return false
+	}
+	blobFetches.WithLabelValues("hit").Inc()
+	return true
+}
+
+// uploadToBlobs uploads the archive at path, which was fetched from
+// gitserver, to Blobs with the cache key key. It uploads in the
+// background, since the archive can be served before it is uploaded. The
+// file is opened before returning, so the upload is unaffected by the cache
+// renaming or evicting it.
+func (s *Store) uploadToBlobs(key, path string) {
+	if s.Blobs == nil {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		blobUploads.WithLabelValues("error").Inc()
+		return
+	}
+	go func() {
+		defer f.Close()
+		fi, err := f.Stat()
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), blobUploadTimeout)
+			err = s.Blobs.Put(ctx, key, f, fi.Size())
+			cancel()
+		}
+		if err != nil {
+			log.Printf("failed to upload archive %s to the blob store: %s", key, err)
+			blobUploads.WithLabelValues("error").Inc()
+			return
+		}
+		blobUploads.WithLabelValues("success").Inc()
+	}()
+}
+
+var (
+	blobFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "blob_fetches_total",
+		Help:      "The total number of archives looked up in the shared blob store, by result (hit, miss or error).",
+	}, []string{"result"})
+	blobUploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "blob_uploads_total",
+		Help:      "The total number of archives uploaded to the shared blob store, by result (success or error).",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(blobFetches)
+	prometheus.MustRegister(blobUploads)
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver"
+)
+
+// memBlobStore is a BlobStore in memory.
+type memBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (m *memBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.blobs[key]
+	if !ok {
+		return nil, nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m *memBlobStore) Put(ctx context.Context, key string, r io.ReadSeeker, size int64) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) != size {
+		return errors.Errorf("read %d bytes, want %d", len(b), size)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[key] = b
+	return nil
+}
+
+func (m *memBlobStore) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.blobs)
+}
+
+func TestPrepareZip_blobs(t *testing.T) {
+	blobs := &memBlobStore{blobs: map[string][]byte{}}
+	repo := gitserver.Repo{Name: "foo"}
+	commit := api.CommitID("deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+
+	// The first replica fetches the archive from gitserver and uploads it.
+	s1, cleanup := tmpStore(t)
+	defer cleanup()
+	s1.Blobs = blobs
+	s1.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		return emptyTar(t), nil
+	}
+	if _, err := s1.PrepareZip(context.Background(), repo, commit); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; blobs.len() == 0; i++ {
+		if i == 500 {
+			t.Fatal("timed out waiting for the archive to be uploaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The second replica downloads it instead of fetching it.
+	s2, cleanup := tmpStore(t)
+	defer cleanup()
+	s2.Blobs = blobs
+	s2.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		return nil, errors.New("unexpected fetch from gitserver")
+	}
+	if _, err := s2.PrepareZip(context.Background(), repo, commit); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another commit is not in the blob store, so it is fetched.
+	_, err := s2.PrepareZip(context.Background(), repo, "cafebabecafebabecafebabecafebabecafebabe")
+	if err == nil || !strings.Contains(err.Error(), "unexpected fetch from gitserver") {
+		t.Fatalf("expected the archive to be fetched from gitserver, got err=%v", err)
+	}
+}
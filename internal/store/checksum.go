@@ -0,0 +1,108 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// checksumSuffix is appended to the path of an archive to get the path of
+// the sidecar recording its hex encoded SHA-256. The sidecar is written
+// before the archive is put in place, and removed when it is evicted.
+const checksumSuffix = ".sha256"
+
+// ChecksumError is returned when a cached archive doesn't match the
+// checksum recorded when it was fetched, eg because it was truncated or
+// corrupted on disk. Searching it would silently miss matches.
+type ChecksumError struct {
+	Path      string
+	Want, Got string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("archive %s is corrupt: SHA-256 is %s, want %s", e.Path, e.Got, e.Want)
+}
+
+// isCorrupt reports whether err is because a cached archive is invalid, so
+// it should be evicted and fetched again.
+func isCorrupt(err error) bool {
+	if _, ok := errors.Cause(err).(*ChecksumError); ok {
+		return true
+	}
+	return strings.Contains(err.Error(), "not a valid zip file")
+}
+
+// writeChecksum records the checksum of the archive at tmpPath, which is
+// about to be renamed to path. It is a diskcache BeforePut hook.
+func writeChecksum(tmpPath, path string) error {
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	sum, err := checksum(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it, so that a crash never leaves
+	// a partial sidecar.
+	sidecar := path + checksumSuffix
+	tmp, err := ioutil.TempFile(filepath.Dir(sidecar), filepath.Base(sidecar)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(sum)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), sidecar)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// verifyChecksum returns a *ChecksumError if f, the archive at path, doesn't
+// match its recorded checksum. Archives cached before checksums were
+// recorded have none, and are not verified.
+func verifyChecksum(path string, f io.ReaderAt, size int64) error {
+	want, err := ioutil.ReadFile(path + checksumSuffix)
+	if os.IsNotExist(err) {
+		checksumVerifications.WithLabelValues("missing").Inc()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	got, err := checksum(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return err
+	}
+	if got != string(want) {
+		checksumVerifications.WithLabelValues("mismatch").Inc()
+		return &ChecksumError{Path: path, Want: string(want), Got: got}
+	}
+	checksumVerifications.WithLabelValues("ok").Inc()
+	return nil
+}
+
+func checksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
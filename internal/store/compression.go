@@ -0,0 +1,318 @@
+package store
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// zipMethodZstd is the zip compression method of files compressed with
+// Zstandard, as assigned by the zip specification (APPNOTE 4.4.5).
+const zipMethodZstd uint16 = 93
+
+// DefaultMaxDecompressedBytes is the default of Store.MaxDecompressedBytes.
+const DefaultMaxDecompressedBytes = 1 << 30
+
+// zstdDecoder decompresses whole files. It is safe for concurrent use by
+// DecodeAll.
+var zstdDecoder *zstd.Decoder
+
+func init() {
+	var err error
+	zstdDecoder, err = zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+
+	// Let every zip.Reader read our archives, eg to list them.
+	zip.RegisterDecompressor(zipMethodZstd, func(r io.Reader) io.ReadCloser {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return errReadCloser{err}
+		}
+		return d.IOReadCloser()
+	})
+
+	prometheus.MustRegister(uncompressedArchives)
+}
+
+var uncompressedArchives = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "store",
+	Name:      "uncompressed_archives_total",
+	Help:      "The total number of archives stored uncompressed despite compression being enabled, because they are larger than the maximum size of compressed archives.",
+})
+
+type errReadCloser struct{ err error }
+
+func (r errReadCloser) Read([]byte) (int, error) { return 0, r.err }
+func (r errReadCloser) Close() error             { return nil }
+
+// zipMethod returns the compression method of the files of archives written
+// by s.
+func (s *Store) zipMethod() uint16 {
+	if s.CompressionLevel > 0 {
+		return zipMethodZstd
+	}
+	return zip.Store
+}
+
+// maxDecompressedBytes returns MaxDecompressedBytes or its default.
+func (s *Store) maxDecompressedBytes() int64 {
+	if s.MaxDecompressedBytes > 0 {
+		return s.MaxDecompressedBytes
+	}
+	return DefaultMaxDecompressedBytes
+}
+
+// registerCompressor makes zw compress files with zstd at s.CompressionLevel.
+func (s *Store) registerCompressor(zw *zip.Writer) {
+	if s.CompressionLevel <= 0 {
+		return
+	}
+	pool := zstdEncoderPool(zstd.EncoderLevelFromZstd(s.CompressionLevel))
+	zw.RegisterCompressor(zipMethodZstd, func(w io.Writer) (io.WriteCloser, error) {
+		enc := pool.Get().(*zstd.Encoder)
+		enc.Reset(w)
+		return &pooledEncoder{Encoder: enc, pool: pool}, nil
+	})
+}
+
+var (
+	zstdEncoderPoolsMu sync.Mutex
+	zstdEncoderPools   = map[zstd.EncoderLevel]*sync.Pool{}
+)
+
+// zstdEncoderPool returns a pool of encoders for level. Encoders are reused
+// since creating one costs more than compressing a typical source file.
+func zstdEncoderPool(level zstd.EncoderLevel) *sync.Pool {
+	zstdEncoderPoolsMu.Lock()
+	defer zstdEncoderPoolsMu.Unlock()
+	pool, ok := zstdEncoderPools[level]
+	if !ok {
+		pool = &sync.Pool{New: func() interface{} {
+			enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				// Only possible for invalid options.
+				panic(err)
+			}
+			return enc
+		}}
+		zstdEncoderPools[level] = pool
+	}
+	return pool
+}
+
+// pooledEncoder returns its encoder to pool once closed.
+type pooledEncoder struct {
+	*zstd.Encoder
+	pool *sync.Pool
+}
+
+func (e *pooledEncoder) Close() error {
+	err := e.Encoder.Close()
+	e.pool.Put(e.Encoder)
+	e.Encoder = nil
+	return err
+}
+
+// zipCompressed reports whether any file of r is compressed. It returns an
+// error if a file is compressed with a method other than zstd.
+func zipCompressed(r *zip.Reader) (bool, error) {
+	compressed := false
+	for _, file := range r.File {
+		switch file.Method {
+		case zip.Store:
+		case zipMethodZstd:
+			compressed = true
+		default:
+			return false, errors.Errorf("file %s stored with compression %v, want %v or %v", file.Name, file.Method, zip.Store, zipMethodZstd)
+		}
+	}
+	return compressed, nil
+}
+
+// decompressFiles reads the files of r, some of which are compressed, into
+// f.Data. Unlike archives of uncompressed files, which are mmapped, their
+// contents live on the heap.
+func (f *ZipFile) decompressFiles(r *zip.Reader) error {
+	var size uint64
+	for _, file := range r.File {
+		if file.UncompressedSize64 > 1<<31-1 {
+			return errors.Errorf("file %s has size > 2gb: %v", file.Name, file.UncompressedSize64)
+		}
+		size += file.UncompressedSize64
+	}
+
+	f.compressed = true
+	f.Data = make([]byte, 0, size)
+	f.Files = make([]SrcFile, len(r.File))
+	var raw []byte
+	for i, file := range r.File {
+		rr, err := file.OpenRaw()
+		if err != nil {
+			return err
+		}
+		if uint64(cap(raw)) < file.CompressedSize64 {
+			raw = make([]byte, file.CompressedSize64)
+		}
+		raw = raw[:file.CompressedSize64]
+		if _, err := io.ReadFull(rr, raw); err != nil {
+			return errors.Wrapf(err, "failed to read %s", file.Name)
+		}
+
+		off := len(f.Data)
+		if file.Method == zipMethodZstd {
+			f.Data, err = zstdDecoder.DecodeAll(raw, f.Data)
+			if err != nil {
+				return errors.Wrapf(err, "failed to decompress %s", file.Name)
+			}
+		} else {
+			f.Data = append(f.Data, raw...)
+		}
+		n := len(f.Data) - off
+		if uint64(n) != file.UncompressedSize64 {
+			return errors.Errorf("file %s has %d bytes, want %d", file.Name, n, file.UncompressedSize64)
+		}
+		f.Files[i] = SrcFile{Name: file.Name, Off: int64(off), Len: int32(n)}
+		if n > f.MaxLen {
+			f.MaxLen = n
+		}
+		f.addExtras(file)
+	}
+	f.dropUniformModTimes()
+	return nil
+}
+
+// beforePut prepares the archive at tmpPath, which is about to be renamed to
+// path. It is a diskcache BeforePut hook.
+func (s *Store) beforePut(tmpPath, path string) error {
+	if err := s.uncompressLarge(tmpPath); err != nil {
+		return err
+	}
+	return writeChecksum(tmpPath, path)
+}
+
+// uncompressLarge rewrites the archive at path with its files uncompressed
+// if they are compressed and larger than MaxDecompressedBytes in total.
+// Compressed archives are decompressed onto the heap when searched, so
+// large ones are mmapped uncompressed instead.
+func (s *Store) uncompressLarge(path string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	compressed, err := zipCompressed(&r.Reader)
+	if err != nil || !compressed {
+		return err
+	}
+	var size uint64
+	for _, file := range r.File {
+		size += file.UncompressedSize64
+	}
+	if size <= uint64(s.maxDecompressedBytes()) {
+		return nil
+	}
+
+	log.Printf("storing archive %s uncompressed: its files are %d bytes, more than the maximum of %d for compressed archives", path, size, s.maxDecompressedBytes())
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = copyUncompressed(tmp, &r.Reader)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to store archive uncompressed")
+	}
+	uncompressedArchives.Inc()
+	return nil
+}
+
+// copyUncompressed writes the archive r to w with its files uncompressed.
+func copyUncompressed(w io.Writer, r *zip.Reader) error {
+	zw := zip.NewWriter(w)
+	for _, file := range r.File {
+		zh := &zip.FileHeader{
+			Name:     file.Name,
+			Method:   zip.Store,
+			Extra:    ownExtras(file.Extra),
+			Modified: file.Modified,
+		}
+		zh.SetMode(file.Mode())
+		fw, err := zw.CreateHeader(zh)
+		if err != nil {
+			return err
+		}
+		fr, err := file.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, fr)
+		fr.Close()
+		if err != nil {
+			return errors.Wrapf(err, "failed to decompress %s", file.Name)
+		}
+	}
+	if err := zw.SetComment(r.Comment); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ownExtras returns the zip extra fields of extra which copySearchable
+// writes itself, leaving out those the zip package writes.
+func ownExtras(extra []byte) []byte {
+	var own []byte
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra[0:])
+		n := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+n > len(extra) {
+			break
+		}
+		switch id {
+		case sizeExtraID, encodingExtraID, binaryExtraID, tooLargeExtraID:
+			own = append(own, extra[:4+n]...)
+		}
+		extra = extra[4+n:]
+	}
+	return own
+}
+
+// WriteUncompressed writes f as a zip archive of uncompressed files to w,
+// for tools which can't read compressed archives. Binary files are written
+// empty, since those tools only search text.
+func (f *ZipFile) WriteUncompressed(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	for i := range f.Files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.Files[i].Name, Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if f.Binary[f.Files[i].Name] {
+			continue
+		}
+		if _, err := fw.Write(f.DataFor(&f.Files[i])); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver"
+)
+
+func TestPrepareZip_compression(t *testing.T) {
+	files := map[string]string{
+		"a.go":     strings.Repeat("func main() {}\n", 100),
+		"b.txt":    "hello world\n",
+		"empty.md": "",
+	}
+	fetchTar := func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		buf := new(bytes.Buffer)
+		w := tar.NewWriter(buf)
+		for name, body := range files {
+			if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(body))}); err != nil {
+				return nil, err
+			}
+			if _, err := w.Write([]byte(body)); err != nil {
+				return nil, err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(buf), nil
+	}
+	checkContents := func(s *Store, path string, wantCompressed bool) {
+		t.Helper()
+		zf, err := s.ZipCache.Get(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zf.Close()
+		if zf.Compressed() != wantCompressed {
+			t.Errorf("got Compressed() %v, want %v", zf.Compressed(), wantCompressed)
+		}
+		got := map[string]string{}
+		for i := range zf.Files {
+			got[zf.Files[i].Name] = string(zf.DataFor(&zf.Files[i]))
+		}
+		if len(got) != len(files) {
+			t.Fatalf("got %d files, want %d", len(got), len(files))
+		}
+		for name, body := range files {
+			if got[name] != body {
+				t.Errorf("got %s = %q, want %q", name, got[name], body)
+			}
+		}
+
+		// The uncompressed copy used by comby has the same contents.
+		var buf bytes.Buffer
+		if err := zf.WriteUncompressed(&buf); err != nil {
+			t.Fatal(err)
+		}
+		uzf, err := NewZipFile(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer uzf.Close()
+		for i := range uzf.Files {
+			if got := string(uzf.DataFor(&uzf.Files[i])); got != files[uzf.Files[i].Name] {
+				t.Errorf("got uncompressed %s = %q, want %q", uzf.Files[i].Name, got, files[uzf.Files[i].Name])
+			}
+		}
+	}
+
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	s.CompressionLevel = 3
+	s.FetchTar = fetchTar
+	repo := gitserver.Repo{Name: "foo"}
+	compressedPath, err := s.PrepareZip(context.Background(), repo, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(s, compressedPath, true)
+	if err := checkZip(compressedPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Turning compression off leaves existing archives readable, and the
+	// other way around.
+	s.CompressionLevel = 0
+	plainPath, err := s.PrepareZip(context.Background(), repo, "cafebabecafebabecafebabecafebabecafebabe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CompressionLevel = 5
+	s.ZipCache = ZipCache{}
+	checkContents(s, plainPath, false)
+	checkContents(s, compressedPath, true)
+
+	entries, err := s.CacheEntries("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, e := range entries {
+		got[e.Path] = e.Compression
+	}
+	if got[compressedPath] != "zstd" || got[plainPath] != "store" {
+		t.Errorf("got compression of cache entries %v", got)
+	}
+}
+
+func TestPrepareZip_compressionTooLarge(t *testing.T) {
+	files := map[string]string{
+		"a.go":  strings.Repeat("func main() {}\n", 100),
+		"b.txt": "hello world\n",
+	}
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	s.CompressionLevel = 3
+	s.MaxDecompressedBytes = 1000
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		buf := new(bytes.Buffer)
+		w := tar.NewWriter(buf)
+		for name, body := range files {
+			if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(body))}); err != nil {
+				return nil, err
+			}
+			if _, err := w.Write([]byte(body)); err != nil {
+				return nil, err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(buf), nil
+	}
+	path, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The archive is larger than MaxDecompressedBytes, so it is mmapped
+	// instead of decompressed onto the heap. Its checksum is of the
+	// uncompressed archive.
+	zf, err := s.ZipCache.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zf.Close()
+	if zf.Compressed() {
+		t.Error("expected the archive to be stored uncompressed")
+	}
+	for i := range zf.Files {
+		if got := string(zf.DataFor(&zf.Files[i])); got != files[zf.Files[i].Name] {
+			t.Errorf("got %s = %q, want %q", zf.Files[i].Name, got, files[zf.Files[i].Name])
+		}
+	}
+
+	entries, err := s.CacheEntries("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Compression != "store" || entries[0].Commit != "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef" {
+		t.Errorf("got cache entries %+v, want the uncompressed archive of foo", entries)
+	}
+	infos, err := ListZip(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range infos {
+		if fi.Size != int64(len(files[fi.Name])) || fi.Mode != 0600 {
+			t.Errorf("ListZip %s: got size %d and mode %v, want %d and 0600", fi.Name, fi.Size, fi.Mode, len(files[fi.Name]))
+		}
+	}
+}
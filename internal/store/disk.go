@@ -0,0 +1,170 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+// DiskFullError is returned by fetches of archives while the volume of the
+// cache has less than MinFreeDiskBytes free, even after evicting archives,
+// or if it filled up while the archive was written. Space on the volume can
+// be used by other files than the cache, so it is temporary.
+type DiskFullError struct {
+	// Dir is the cache directory.
+	Dir string
+
+	// Free is the free space in bytes on its volume, and Min is
+	// Store.MinFreeDiskBytes.
+	Free, Min int64
+}
+
+func (e *DiskFullError) Error() string {
+	return fmt.Sprintf("not enough free disk space to cache archives in %s: %d bytes free, want at least %d", e.Dir, e.Free, e.Min)
+}
+
+func (e *DiskFullError) Temporary() bool { return true }
+
+// checkDiskSpace returns a *DiskFullError if the volume of the cache has
+// less than s.MinFreeDiskBytes free, after evicting archives to make room.
+func (s *Store) checkDiskSpace() error {
+	if s.MinFreeDiskBytes <= 0 {
+		return nil
+	}
+	free, err := s.ensureFreeDisk()
+	if err != nil {
+		// Fetching may well succeed, and fails clearly if it doesn't.
+		log.Printf("failed to check the free disk space of %s: %s", s.Path, err)
+		return nil
+	}
+	if free < s.MinFreeDiskBytes {
+		return s.diskFull(free)
+	}
+	return nil
+}
+
+// diskFull returns the *DiskFullError of a fetch which failed because the
+// volume of the cache has free bytes free.
+func (s *Store) diskFull(free int64) error {
+	diskFullFetches.Inc()
+	return &DiskFullError{Dir: s.Path, Free: free, Min: s.MinFreeDiskBytes}
+}
+
+// noSpace returns a *DiskFullError if err is because the volume of the
+// cache is full, and otherwise err.
+func (s *Store) noSpace(err error) error {
+	cause := errors.Cause(err)
+	if pe, ok := cause.(*os.PathError); ok {
+		cause = pe.Err
+	}
+	if cause != unix.ENOSPC {
+		return err
+	}
+	free, _ := freeDiskBytes(s.Path)
+	return s.diskFull(free)
+}
+
+// ensureFreeDisk evicts archives, even if the cache is below
+// MaxCacheSizeBytes, until the volume of the cache has s.MinFreeDiskBytes
+// free or no archive can be evicted. It returns the free space.
+func (s *Store) ensureFreeDisk() (int64, error) {
+	free, err := freeDiskBytes(s.Path)
+	if err != nil || free >= s.MinFreeDiskBytes {
+		return free, err
+	}
+
+	s.evictMu.Lock()
+	defer s.evictMu.Unlock()
+	// Space may have been freed while we waited.
+	free, err = freeDiskBytes(s.Path)
+	if err != nil || free >= s.MinFreeDiskBytes {
+		return free, err
+	}
+	used, err := usedDiskBytes(s.Path)
+	if err != nil {
+		return free, err
+	}
+	target := used - (s.MinFreeDiskBytes - free)
+	if target < 0 {
+		target = 0
+	}
+	log.Printf("%d bytes free on the volume of %s, below the minimum of %d: evicting archives down to %d bytes", free, s.Path, s.MinFreeDiskBytes, target)
+	s.evictCause = evictCauseDisk
+	stats, err := s.cache.Evict(target)
+	s.evictCause = ""
+	if err != nil {
+		return free, err
+	}
+	evictions.Add(float64(stats.Evicted))
+	evictionsPinned.Add(float64(stats.Pinned))
+	return freeDiskBytes(s.Path)
+}
+
+// freeDiskBytes returns the space in bytes available to us on the volume
+// of dir.
+func freeDiskBytes(dir string) (int64, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, errors.Wrapf(err, "statfs %s", dir)
+	}
+	free := int64(st.Bavail) * int64(st.Bsize)
+	diskFreeBytes.Set(float64(free))
+	return free, nil
+}
+
+// usedDiskBytes returns the size in bytes of the archives cached in dir,
+// including their sidecars.
+func usedDiskBytes(dir string) (int64, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	archives := make(map[string]bool, len(fis))
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), ".zip") {
+			archives[fi.Name()] = true
+		}
+	}
+	var used int64
+	for _, fi := range fis {
+		if archives[fi.Name()] {
+			used += fi.Size()
+			continue
+		}
+		for _, suffix := range sidecarSuffixes {
+			if name := strings.TrimSuffix(fi.Name(), suffix); name != fi.Name() && archives[name] {
+				used += fi.Size()
+			}
+		}
+	}
+	return used, nil
+}
+
+var (
+	diskFreeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "disk_free_bytes",
+		Help:      "The space available on the volume of the cache, as last checked.",
+	})
+	diskFullFetches = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "disk_full_fetches_total",
+		Help:      "The total number of archive fetches which failed because the volume of the cache had too little free space.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(diskFreeBytes)
+	prometheus.MustRegister(diskFullFetches)
+}
@@ -0,0 +1,169 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Encodings of files which are transcoded to UTF-8 when they are cached, so
+// that they can be searched like any other file.
+const (
+	EncodingUTF16LE = "utf-16le"
+	EncodingUTF16BE = "utf-16be"
+
+	// EncodingLatin1 is Windows-1252, the superset of ISO 8859-1 which
+	// text in "Latin-1" almost always is.
+	EncodingLatin1 = "windows-1252"
+)
+
+// encodingExtraID is the ID of the zip extra field in which copySearchable
+// records the encoding of files it transcoded to UTF-8.
+const encodingExtraID = 0x4553 // "SE"
+
+// binaryExtraID is the ID of the empty zip extra field with which
+// copySearchable marks binary files. Searches skip their content unless
+// they ask for binary files to be searched.
+const binaryExtraID = 0x4253 // "SB"
+
+// tooLargeExtraID is the ID of the empty zip extra field with which
+// copySearchable marks files whose content it did not keep because they are
+// larger than Store.MaxFileSize.
+const tooLargeExtraID = 0x4c53 // "SL"
+
+// isBinary reports whether the file starting with head, which is UTF-8 or
+// binary according to sniffEncoding, is binary. Like git, we assume a file
+// is binary if its head contains a NUL.
+func isBinary(head []byte) bool {
+	return bytes.IndexByte(head, 0) >= 0
+}
+
+// sniffEncoding returns the encoding of the file starting with head, or ""
+// if it is UTF-8 (or binary). head is the file if it is short, or else its
+// first 32KiB.
+func sniffEncoding(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xff, 0xfe}):
+		return EncodingUTF16LE
+	case bytes.HasPrefix(head, []byte{0xfe, 0xff}):
+		return EncodingUTF16BE
+	case bytes.HasPrefix(head, []byte{0xef, 0xbb, 0xbf}):
+		return ""
+	}
+
+	// Mostly ASCII text in UTF-16 without a byte order mark has a NUL in
+	// every other byte.
+	sample := head
+	if len(sample) > 512 {
+		sample = sample[:512]
+	}
+	sample = sample[:len(sample)&^1]
+	if len(sample) >= 4 {
+		var evenNULs, oddNULs int
+		for i := 0; i < len(sample); i += 2 {
+			if sample[i] == 0 {
+				evenNULs++
+			}
+			if sample[i+1] == 0 {
+				oddNULs++
+			}
+		}
+		pairs := len(sample) / 2
+		switch {
+		case evenNULs == 0 && oddNULs*10 >= pairs*9:
+			return EncodingUTF16LE
+		case oddNULs == 0 && evenNULs*10 >= pairs*9:
+			return EncodingUTF16BE
+		}
+	}
+
+	// Text which is not UTF-8 is most likely Latin-1, eg from old Windows
+	// editors. Latin-1 text rarely contains a valid multibyte UTF-8
+	// sequence, so text with one is UTF-8 with a few invalid bytes, which
+	// transcoding would garble. Control characters mean it is not text at
+	// all.
+	if utf8.Valid(trimIncompleteRune(head)) || hasMultibyteRune(head) {
+		return ""
+	}
+	for _, c := range head {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f' {
+			return ""
+		}
+	}
+	return EncodingLatin1
+}
+
+// hasMultibyteRune reports whether b contains a valid UTF-8 encoding of a
+// non-ASCII character.
+func hasMultibyteRune(b []byte) bool {
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if size > 1 && r != utf8.RuneError {
+			return true
+		}
+		b = b[size:]
+	}
+	return false
+}
+
+// trimIncompleteRune returns b without the start of a UTF-8 sequence it may
+// end with, since b may be the start of a longer file.
+func trimIncompleteRune(b []byte) []byte {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i]
+			}
+			break
+		}
+	}
+	return b
+}
+
+// decoder returns the transformer of content in enc to UTF-8.
+func decoder(enc string) transform.Transformer {
+	switch enc {
+	case EncodingUTF16LE:
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewDecoder()
+	case EncodingUTF16BE:
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM).NewDecoder()
+	case EncodingLatin1:
+		return charmap.Windows1252.NewDecoder()
+	}
+	return transform.Nop
+}
+
+// encodingExtra returns a zip extra field recording enc.
+func encodingExtra(enc string) []byte {
+	b := make([]byte, 4+len(enc))
+	binary.LittleEndian.PutUint16(b[0:], encodingExtraID)
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(enc)))
+	copy(b[4:], enc)
+	return b
+}
+
+// binaryExtra returns the zip extra field marking a binary file.
+func binaryExtra() []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint16(b, binaryExtraID)
+	return b
+}
+
+// tooLargeExtra returns the zip extra field marking a file which is too
+// large.
+func tooLargeExtra() []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint16(b, tooLargeExtraID)
+	return b
+}
+
+// parseEncodingExtra returns the encoding recorded by encodingExtra in the
+// zip extra fields extra, or "" if there is none.
+func parseEncodingExtra(extra []byte) string {
+	data, _ := findExtra(extra, encodingExtraID)
+	return string(data)
+}
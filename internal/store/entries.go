@@ -0,0 +1,256 @@
+package store
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver"
+)
+
+// archiveComment is recorded as the zip comment of every archive fetched
+// by Store, so that the cache can be listed by repository and commit even
+// though archives are named by a hash.
+type archiveComment struct {
+	Repo    api.RepoName
+	Commit  api.CommitID
+	Partial bool `json:",omitempty"`
+}
+
+// setArchiveComment records repo and commit as the comment of zw. partial
+// is whether the archive only contains some paths (see PrepareZipPaths).
+func setArchiveComment(zw *zip.Writer, repo gitserver.Repo, commit api.CommitID, partial bool) error {
+	b, err := json.Marshal(archiveComment{Repo: repo.Name, Commit: commit, Partial: partial})
+	if err != nil {
+		return err
+	}
+	return zw.SetComment(string(b))
+}
+
+// CacheEntry describes an archive in the cache.
+type CacheEntry struct {
+	// Repo and Commit identify the archive. They are empty for archives
+	// cached before they were recorded.
+	Repo   api.RepoName `json:",omitempty"`
+	Commit api.CommitID `json:",omitempty"`
+
+	// Partial is true if the archive only contains some paths of the
+	// repository (see PrepareZipPaths).
+	Partial bool `json:",omitempty"`
+
+	// Path is the path of the archive on disk.
+	Path string
+
+	// Size is the size of the archive in bytes.
+	Size int64
+
+	// Compression is the zip compression method of the files in the
+	// archive, eg "store" for none. It is empty if the archive has no
+	// files.
+	Compression string `json:",omitempty"`
+
+	// LastAccess is when the archive was last used. The least recently
+	// used archives are evicted first.
+	LastAccess time.Time
+
+	// InUse is true if the archive is being searched, so it can't be
+	// evicted.
+	InUse bool `json:",omitempty"`
+}
+
+// CacheEntryInfo describes an archive in the cache in more detail than
+// CacheEntry, at the cost of reading the archive's file list.
+type CacheEntryInfo struct {
+	CacheEntry
+
+	// Files is the number of files in the archive.
+	Files int
+
+	// Uses is the number of times the archive was used since searcher
+	// started.
+	Uses int
+
+	// Indexes are the indexes built for the archive: "hash" and/or
+	// "trigram".
+	Indexes []string `json:",omitempty"`
+}
+
+// CacheEntries lists the archives in the cache, most recently used first.
+// If repo is non-empty only the archives of repo are listed.
+func (s *Store) CacheEntries(repo api.RepoName) ([]CacheEntry, error) {
+	fis, err := ioutil.ReadDir(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []CacheEntry
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), ".zip") {
+			continue
+		}
+		e := CacheEntry{
+			Path:       filepath.Join(s.Path, fi.Name()),
+			Size:       fi.Size(),
+			LastAccess: fi.ModTime(),
+		}
+		comment, method, err := readZipTrailer(e.Path)
+		if os.IsNotExist(err) {
+			// Evicted since we listed the directory.
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", e.Path)
+		}
+		var c archiveComment
+		if json.Unmarshal(comment, &c) == nil {
+			e.Repo, e.Commit, e.Partial = c.Repo, c.Commit, c.Partial
+		}
+		if repo != "" && e.Repo != repo {
+			continue
+		}
+		if method >= 0 {
+			e.Compression = compressionName(uint16(method))
+		}
+		e.InUse = s.ZipCache.inUse(e.Path)
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastAccess.After(entries[j].LastAccess) })
+	return entries, nil
+}
+
+// InspectCacheEntries describes the archives of repo at commit in the cache.
+// There may be several, eg an archive of the whole repository and archives
+// of some of its paths.
+func (s *Store) InspectCacheEntries(repo api.RepoName, commit api.CommitID) ([]CacheEntryInfo, error) {
+	entries, err := s.CacheEntries(repo)
+	if err != nil {
+		return nil, err
+	}
+	uses := s.uses.snapshot()
+	var infos []CacheEntryInfo
+	for _, e := range entries {
+		if e.Commit != commit {
+			continue
+		}
+		r, err := zip.OpenReader(e.Path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", e.Path)
+		}
+		info := CacheEntryInfo{CacheEntry: e, Files: len(r.File), Uses: uses[e.Path]}
+		r.Close()
+		if _, err := os.Stat(e.Path + hashIndexSuffix); err == nil {
+			info.Indexes = append(info.Indexes, "hash")
+		}
+		if _, err := os.Stat(e.Path + trigramIndexSuffix); err == nil {
+			info.Indexes = append(info.Indexes, "trigram")
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// PurgeCache removes the archives of repo at commit from the cache. If
+// commit is empty every archive of repo is removed, and if repo is empty
+// too every archive is. It waits for searches of the archives to finish.
+// It returns the removed archives.
+func (s *Store) PurgeCache(repo api.RepoName, commit api.CommitID) ([]CacheEntry, error) {
+	entries, err := s.CacheEntries(repo)
+	if err != nil {
+		return nil, err
+	}
+	var purged []CacheEntry
+	for _, e := range entries {
+		if commit != "" && e.Commit != commit {
+			continue
+		}
+		s.forget(e.Path, evictCausePurge)
+		if err := os.Remove(e.Path); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return purged, errors.Wrapf(err, "failed to remove %s", e.Path)
+		}
+		purged = append(purged, e)
+	}
+	return purged, nil
+}
+
+// readZipTrailer returns the comment of the zip archive at path and the
+// compression method of its first file, or -1 if it has none. Unlike
+// zip.OpenReader it does not read the whole central directory, which is
+// large for archives of big repositories.
+func readZipTrailer(path string) (comment []byte, method int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The end of central directory record is 22 bytes followed by a
+	// comment of at most 64KiB.
+	const eocdLen = 22
+	n := int64(eocdLen + 1<<16 - 1)
+	if n > fi.Size() {
+		n = fi.Size()
+	}
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, fi.Size()-n); err != nil {
+		return nil, 0, err
+	}
+	i := bytes.LastIndex(buf, []byte("PK\x05\x06"))
+	if i < 0 || len(buf)-i < eocdLen {
+		return nil, 0, zip.ErrFormat
+	}
+	eocd := buf[i:]
+	files := binary.LittleEndian.Uint16(eocd[10:])
+	dirOffset := int64(binary.LittleEndian.Uint32(eocd[16:]))
+	commentLen := int(binary.LittleEndian.Uint16(eocd[20:]))
+	if eocdLen+commentLen > len(eocd) {
+		return nil, 0, zip.ErrFormat
+	}
+	comment = eocd[eocdLen : eocdLen+commentLen]
+
+	if files == 0 {
+		return comment, -1, nil
+	}
+	// The compression method is at offset 10 of a central directory file
+	// header.
+	var hdr [12]byte
+	if _, err := f.ReadAt(hdr[:], dirOffset); err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(hdr[:4], []byte("PK\x01\x02")) {
+		return nil, 0, zip.ErrFormat
+	}
+	return comment, int(binary.LittleEndian.Uint16(hdr[10:])), nil
+}
+
+func compressionName(method uint16) string {
+	switch method {
+	case zip.Store:
+		return "store"
+	case zip.Deflate:
+		return "deflate"
+	case zipMethodZstd:
+		return "zstd"
+	default:
+		return "method " + strconv.Itoa(int(method))
+	}
+}
@@ -0,0 +1,232 @@
+package store
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Causes of an archive being removed from the cache, used in the audit log
+// and as the cause label of the eviction metrics.
+const (
+	// evictCauseSize is an eviction to keep the cache below
+	// MaxCacheSizeBytes.
+	evictCauseSize = "size"
+
+	// evictCauseCorrupt is the removal of an archive which is not a
+	// valid zip file.
+	evictCauseCorrupt = "corrupt"
+
+	// evictCauseTTL is an eviction of an archive unused for longer than
+	// CacheTTL.
+	evictCauseTTL = "ttl"
+
+	// evictCausePurge is the removal of an archive requested by an
+	// operator (see PurgeCache).
+	evictCausePurge = "purge"
+
+	// evictCauseDisk is an eviction to keep MinFreeDiskBytes free on the
+	// volume of the cache.
+	evictCauseDisk = "disk"
+)
+
+// EvictPolicy is the order archives are evicted from the cache in.
+type EvictPolicy string
+
+const (
+	// EvictLRU evicts the least recently used archives first.
+	EvictLRU EvictPolicy = "lru"
+
+	// EvictLFU evicts the least frequently used archives first, and the
+	// least recently used of those. Uses are counted since searcher
+	// started.
+	EvictLFU EvictPolicy = "lfu"
+
+	// EvictTTL is like EvictLRU, but also evicts the archives unused for
+	// longer than CacheTTL while the cache is not full.
+	EvictTTL EvictPolicy = "ttl"
+)
+
+// Valid reports whether p is a known policy. The empty policy is EvictLRU.
+func (p EvictPolicy) Valid() bool {
+	switch p {
+	case "", EvictLRU, EvictLFU, EvictTTL:
+		return true
+	}
+	return false
+}
+
+// evictOrder sorts fis, the files of the cache directory, in the order they
+// should be evicted according to s.EvictPolicy. The archives of
+// s.RetainRepos are evicted last.
+func (s *Store) evictOrder(fis []os.FileInfo) {
+	retained := make(map[string]bool)
+	if len(s.RetainRepos) > 0 {
+		for _, fi := range fis {
+			if strings.HasSuffix(fi.Name(), ".zip") && s.retain(filepath.Join(s.Path, fi.Name())) {
+				retained[fi.Name()] = true
+			}
+		}
+	}
+	var uses map[string]int
+	if s.EvictPolicy == EvictLFU {
+		uses = s.uses.snapshot()
+	}
+	sort.SliceStable(fis, func(i, j int) bool {
+		a, b := fis[i], fis[j]
+		if retained[a.Name()] != retained[b.Name()] {
+			return retained[b.Name()]
+		}
+		if uses != nil {
+			ua, ub := uses[filepath.Join(s.Path, a.Name())], uses[filepath.Join(s.Path, b.Name())]
+			if ua != ub {
+				return ua < ub
+			}
+		}
+		return a.ModTime().Before(b.ModTime())
+	})
+}
+
+// retain reports whether the archive at zipPath is of one of s.RetainRepos.
+func (s *Store) retain(zipPath string) bool {
+	comment, _, err := readZipTrailer(zipPath)
+	if err != nil {
+		return false
+	}
+	var c archiveComment
+	if json.Unmarshal(comment, &c) != nil || c.Repo == "" {
+		return false
+	}
+	for _, pattern := range s.RetainRepos {
+		if ok, _ := path.Match(pattern, string(c.Repo)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pinned reports whether the archive at path must not be evicted because
+// it is being searched.
+func (s *Store) pinned(path string) bool {
+	return s.ZipCache.inUse(path)
+}
+
+// useCounts counts the uses of archives, by path. The zero value is ready
+// to use.
+type useCounts struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+func (c *useCounts) add(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]int)
+	}
+	c.m[path]++
+}
+
+func (c *useCounts) forget(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, path)
+}
+
+func (c *useCounts) snapshot() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[string]int, len(c.m))
+	for path, n := range c.m {
+		m[path] = n
+	}
+	return m
+}
+
+// evict is called before the archive at path is evicted from the cache to
+// keep it below its maximum size or the volume from filling up, or because
+// it expired. s.evictMu is held.
+func (s *Store) evict(path string) {
+	cause := evictCauseSize
+	if s.evictCause != "" {
+		cause = s.evictCause
+	} else if fi, err := os.Stat(path); err == nil && s.EvictPolicy == EvictTTL && time.Since(fi.ModTime()) > s.CacheTTL {
+		cause = evictCauseTTL
+	}
+	s.forget(path, cause)
+}
+
+// forget is called before the archive at path is removed from the cache for
+// cause. It waits until the archive is no longer searched.
+func (s *Store) forget(path, cause string) {
+	recordEviction(path, cause)
+	s.uses.forget(path)
+	s.ZipCache.delete(path)
+	for _, suffix := range sidecarSuffixes {
+		os.Remove(path + suffix)
+	}
+	s.trigramIndexes.forget(path)
+}
+
+// sidecarSuffixes are appended to the path of an archive to get the paths
+// of the files derived from it. They count towards MaxCacheSizeBytes.
+var sidecarSuffixes = []string{hashIndexSuffix, checksumSuffix, trigramIndexSuffix}
+
+// recordEviction logs that the archive at path is about to be removed from
+// the cache for cause, and updates the eviction metrics. Frequent evictions
+// of recently used archives mean the cache is too small for the working set.
+func recordEviction(path, cause string) {
+	var (
+		size int64
+		idle time.Duration
+	)
+	if fi, err := os.Stat(path); err == nil {
+		size = fi.Size()
+		idle = time.Since(fi.ModTime())
+	}
+	var c archiveComment
+	if comment, _, err := readZipTrailer(path); err == nil {
+		_ = json.Unmarshal(comment, &c)
+	}
+
+	log.Printf("evicting archive %s (repo=%q commit=%q): cause=%s size=%d idle=%s", path, c.Repo, c.Commit, cause, size, idle.Round(time.Second))
+	evictionsByCause.WithLabelValues(cause).Inc()
+	evictedBytes.WithLabelValues(cause).Add(float64(size))
+	evictedIdleSeconds.WithLabelValues(cause).Observe(idle.Seconds())
+}
+
+var (
+	evictionsByCause = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "evictions_total",
+		Help:      "The total number of archives removed from the cache, by cause (size, disk, ttl, purge or corrupt).",
+	}, []string{"cause"})
+	evictedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "evicted_bytes_total",
+		Help:      "The total size of archives removed from the cache, by cause.",
+	}, []string{"cause"})
+	evictedIdleSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "evicted_idle_seconds",
+		Help:      "The time since archives removed from the cache were last used, by cause. Low values mean the cache is thrashing.",
+		Buckets:   []float64{60, 5 * 60, 15 * 60, 3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600},
+	}, []string{"cause"})
+)
+
+func init() {
+	prometheus.MustRegister(evictionsByCause)
+	prometheus.MustRegister(evictedBytes)
+	prometheus.MustRegister(evictedIdleSeconds)
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Faults configures failures the Store injects into its own operation. It
+// exists to exercise how searcher and its clients behave when fetching and
+// caching archives goes wrong (retries, degradation, partial results) in
+// integration and chaos tests. It must never be set in production.
+type Faults struct {
+	// FetchErrorRate is the probability (between 0 and 1) that a fetch of
+	// an archive fails before FetchTar is called.
+	FetchErrorRate float64
+
+	// ReadDelay is added to every read of a fetched archive, simulating a
+	// slow gitserver.
+	ReadDelay time.Duration
+
+	// WriteErrorRate is the probability (between 0 and 1) that writing a
+	// fetched archive to the cache fails after it has been read.
+	WriteErrorRate float64
+}
+
+// ParseFaults parses a comma separated list of faults, eg
+//
+//	fetch_error=0.1,read_delay=10ms,write_error=0.05
+//
+// An empty string returns nil.
+func ParseFaults(s string) (*Faults, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var f Faults
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid fault %q: want name=value", kv)
+		}
+		name, value := parts[0], parts[1]
+		var err error
+		switch name {
+		case "fetch_error":
+			f.FetchErrorRate, err = parseRate(value)
+		case "read_delay":
+			f.ReadDelay, err = time.ParseDuration(value)
+		case "write_error":
+			f.WriteErrorRate, err = parseRate(value)
+		default:
+			return nil, errors.Errorf("unknown fault %q", name)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value for fault %q", name)
+		}
+	}
+	return &f, nil
+}
+
+func parseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, errors.Errorf("rate %v is not between 0 and 1", rate)
+	}
+	return rate, nil
+}
+
+// fetchError returns an injected error if the fetch of an archive should
+// fail. It is temporary, like a gitserver failure would be.
+func (f *Faults) fetchError() error {
+	if f == nil || !inject(f.FetchErrorRate) {
+		return nil
+	}
+	faultsInjected.WithLabelValues("fetch_error").Inc()
+	return temporaryError{errors.New("injected fault: fetch failed")}
+}
+
+// writeError returns an injected error if writing an archive to the cache
+// should fail.
+func (f *Faults) writeError() error {
+	if f == nil || !inject(f.WriteErrorRate) {
+		return nil
+	}
+	faultsInjected.WithLabelValues("write_error").Inc()
+	return errors.New("injected fault: cache write failed")
+}
+
+// slowReader wraps r such that every read is delayed by ReadDelay.
+func (f *Faults) slowReader(r io.ReadCloser) io.ReadCloser {
+	if f == nil || f.ReadDelay <= 0 {
+		return r
+	}
+	return &slowReadCloser{ReadCloser: r, delay: f.ReadDelay}
+}
+
+type slowReadCloser struct {
+	io.ReadCloser
+	delay time.Duration
+}
+
+func (r *slowReadCloser) Read(p []byte) (int, error) {
+	faultsInjected.WithLabelValues("read_delay").Inc()
+	time.Sleep(r.delay)
+	return r.ReadCloser.Read(p)
+}
+
+func inject(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver"
+)
+
+func TestParseFaults(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *Faults
+		err  string
+	}{
+		{in: "", want: nil},
+		{in: "fetch_error=0.5", want: &Faults{FetchErrorRate: 0.5}},
+		{
+			in:   "fetch_error=1, read_delay=10ms,write_error=0.25",
+			want: &Faults{FetchErrorRate: 1, ReadDelay: 10 * time.Millisecond, WriteErrorRate: 0.25},
+		},
+		{in: "fetch_error=2", err: "not between 0 and 1"},
+		{in: "read_delay=slow", err: "invalid value"},
+		{in: "fetch_error", err: "want name=value"},
+		{in: "disk_full=1", err: "unknown fault"},
+	}
+	for _, test := range tests {
+		got, err := ParseFaults(test.in)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want error containing %q", test.in, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestPrepareZip_faults(t *testing.T) {
+	commit := api.CommitID("deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+	fetchTar := func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		return emptyTar(t), nil
+	}
+
+	t.Run("fetch_error", func(t *testing.T) {
+		s, cleanup := tmpStore(t)
+		defer cleanup()
+		s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+			t.Fatal("FetchTar should not be called")
+			return nil, nil
+		}
+		s.Faults = &Faults{FetchErrorRate: 1}
+		_, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, commit)
+		if err == nil || !strings.Contains(err.Error(), "injected fault") {
+			t.Fatalf("expected injected fetch error, got %v", err)
+		}
+		if e, ok := errors.Cause(err).(interface{ Temporary() bool }); !ok || !e.Temporary() {
+			t.Fatalf("expected a temporary error, got %v", err)
+		}
+	})
+
+	t.Run("write_error", func(t *testing.T) {
+		s, cleanup := tmpStore(t)
+		defer cleanup()
+		s.FetchTar = fetchTar
+		s.Faults = &Faults{WriteErrorRate: 1}
+		_, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, commit)
+		if err == nil || !strings.Contains(err.Error(), "injected fault") {
+			t.Fatalf("expected injected write error, got %v", err)
+		}
+	})
+
+	t.Run("read_delay", func(t *testing.T) {
+		s, cleanup := tmpStore(t)
+		defer cleanup()
+		s.FetchTar = fetchTar
+		s.Faults = &Faults{ReadDelay: 50 * time.Millisecond}
+		start := time.Now()
+		if _, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, commit); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d < 50*time.Millisecond {
+			t.Fatalf("expected reads to be delayed, PrepareZip took %s", d)
+		}
+	})
+}
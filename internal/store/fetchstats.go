@@ -0,0 +1,65 @@
+package store
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+)
+
+// FetchStats accumulates the bytes fetched from gitserver on behalf of a
+// request. Attach it to the context passed to PrepareZip with
+// WithFetchStats. It is safe for concurrent use.
+type FetchStats struct {
+	bytesFetched int64 // accessed atomically
+	cacheLookups int64 // accessed atomically
+	cacheMisses  int64 // accessed atomically
+}
+
+// BytesFetched returns the number of bytes of archives fetched from
+// gitserver so far. Archives which were already cached, or fetched from a
+// peer, are not counted.
+func (s *FetchStats) BytesFetched() int64 {
+	return atomic.LoadInt64(&s.bytesFetched)
+}
+
+// CacheLookups returns the number of archives looked up in the cache so
+// far, and how many of them were missing and had to be fetched.
+func (s *FetchStats) CacheLookups() (lookups, misses int64) {
+	return atomic.LoadInt64(&s.cacheLookups), atomic.LoadInt64(&s.cacheMisses)
+}
+
+func (s *FetchStats) addLookup(missed bool) {
+	atomic.AddInt64(&s.cacheLookups, 1)
+	if missed {
+		atomic.AddInt64(&s.cacheMisses, 1)
+	}
+}
+
+type fetchStatsKey struct{}
+
+// WithFetchStats returns a context which records the fetches done for it in
+// stats.
+func WithFetchStats(ctx context.Context, stats *FetchStats) context.Context {
+	return context.WithValue(ctx, fetchStatsKey{}, stats)
+}
+
+func fetchStatsFromContext(ctx context.Context) *FetchStats {
+	stats, _ := ctx.Value(fetchStatsKey{}).(*FetchStats)
+	return stats
+}
+
+// countingReadCloser counts the bytes read through it in stats, if non-nil,
+// and in the fetch_bytes_total metric.
+type countingReadCloser struct {
+	io.ReadCloser
+	stats *FetchStats
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.stats != nil {
+		atomic.AddInt64(&r.stats.bytesFetched, int64(n))
+	}
+	fetchBytes.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// hashIndexSuffix is appended to the path of an archive to get the path of
+// its hash index sidecar. The sidecar is removed when the archive is evicted.
+const hashIndexSuffix = ".hashes"
+
+// HashIndex records the content hashes of the files in an archive.
+type HashIndex struct {
+	Files []HashedFile
+}
+
+// HashedFile is the hashes of a single file in an archive.
+type HashedFile struct {
+	Path string
+
+	// BlobSHA1 is the hex encoded git blob SHA-1 of the file.
+	BlobSHA1 string
+
+	// SHA256 is the hex encoded SHA-256 of the file's content.
+	SHA256 string
+}
+
+// Lookup returns the paths of the files whose git blob SHA-1 or SHA-256 is
+// hash, which must be hex encoded.
+func (idx *HashIndex) Lookup(hash string) []string {
+	var paths []string
+	for _, f := range idx.Files {
+		if f.BlobSHA1 == hash || f.SHA256 == hash {
+			paths = append(paths, f.Path)
+		}
+	}
+	return paths
+}
+
+// HashIndex returns the HashIndex of zf, the archive at path. It is read
+// from the archive's sidecar if one exists, otherwise it is computed and
+// the sidecar written. Only files in the archive are indexed, so files
+// which are not searched (eg binary or large files) are not included.
+func (s *Store) HashIndex(path string, zf *ZipFile) (*HashIndex, error) {
+	sidecar := path + hashIndexSuffix
+	if b, err := ioutil.ReadFile(sidecar); err == nil {
+		var idx HashIndex
+		if err := json.Unmarshal(b, &idx); err == nil {
+			hashIndexLookups.WithLabelValues("sidecar").Inc()
+			return &idx, nil
+		}
+		// A corrupt sidecar is recomputed below.
+	}
+
+	idx := computeHashIndex(zf)
+	hashIndexLookups.WithLabelValues("computed").Inc()
+
+	// Write to a temporary file and rename it so concurrent readers never
+	// see a partial sidecar. Failing to write the sidecar only costs
+	// recomputing it next time.
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(sidecar), filepath.Base(sidecar)+".*.tmp")
+	if err != nil {
+		return idx, nil
+	}
+	_, err = tmp.Write(b)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), sidecar)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return idx, nil
+}
+
+func computeHashIndex(zf *ZipFile) *HashIndex {
+	idx := &HashIndex{Files: make([]HashedFile, len(zf.Files))}
+	for i := range zf.Files {
+		f := &zf.Files[i]
+		data := zf.DataFor(f)
+
+		blob := sha1.New()
+		blob.Write([]byte("blob " + strconv.Itoa(len(data)) + "\x00"))
+		blob.Write(data)
+		sum := sha256.Sum256(data)
+
+		idx.Files[i] = HashedFile{
+			Path:     f.Name,
+			BlobSHA1: hex.EncodeToString(blob.Sum(nil)),
+			SHA256:   hex.EncodeToString(sum[:]),
+		}
+	}
+	return idx
+}
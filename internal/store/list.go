@@ -0,0 +1,96 @@
+package store
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"os"
+)
+
+// sizeExtraID is the ID of the zip extra field in which copySearchable
+// records the size of each file in the fetched tar archive. Files which are
+// not searchable are stored empty, so their size in the zip archive is not
+// their real size.
+const sizeExtraID = 0x5347 // "SG"
+
+// FileInfo describes a file in an archive prepared by Store.
+type FileInfo struct {
+	Name string
+
+	// Size is the size of the file in the repository, which may differ
+	// from its size in the archive if it is not searchable.
+	Size int64
+
+	// Mode is the permission bits of the file.
+	Mode os.FileMode
+
+	// Encoding is the encoding of the file in the repository if it was
+	// transcoded to UTF-8 (eg EncodingUTF16LE), or "".
+	Encoding string `json:",omitempty"`
+
+	// Binary is true if the file is binary (see isBinary).
+	Binary bool `json:",omitempty"`
+}
+
+// ListZip returns the files in the zip archive at path, which must have
+// been prepared by Store.
+func ListZip(path string) ([]FileInfo, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	files := make([]FileInfo, 0, len(r.File))
+	for _, f := range r.File {
+		// Archives cached before we recorded sizes and modes have neither,
+		// so fall back to the size in the archive and a regular file mode.
+		size, ok := parseSizeExtra(f.Extra)
+		if !ok {
+			size = int64(f.UncompressedSize64)
+		}
+		mode := f.Mode().Perm()
+		if mode == 0 {
+			mode = 0644
+		}
+		_, binary := findExtra(f.Extra, binaryExtraID)
+		files = append(files, FileInfo{Name: f.Name, Size: size, Mode: mode, Encoding: parseEncodingExtra(f.Extra), Binary: binary})
+	}
+	return files, nil
+}
+
+// sizeExtra returns a zip extra field recording size.
+func sizeExtra(size int64) []byte {
+	b := make([]byte, 12)
+	binary.LittleEndian.PutUint16(b[0:], sizeExtraID)
+	binary.LittleEndian.PutUint16(b[2:], 8)
+	binary.LittleEndian.PutUint64(b[4:], uint64(size))
+	return b
+}
+
+// parseSizeExtra returns the size recorded by sizeExtra in the zip extra
+// fields extra.
+func parseSizeExtra(extra []byte) (int64, bool) {
+	data, ok := findExtra(extra, sizeExtraID)
+	if !ok || len(data) != 8 {
+		return 0, false
+	}
+	return int64(binary.LittleEndian.Uint64(data)), true
+}
+
+// findExtra returns the data of the zip extra field with the given id in
+// extra.
+func findExtra(extra []byte, id uint16) ([]byte, bool) {
+	for len(extra) >= 4 {
+		fieldID := binary.LittleEndian.Uint16(extra[0:])
+		n := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if n > len(extra) {
+			break
+		}
+		if fieldID == id {
+			return extra[:n], true
+		}
+		extra = extra[n:]
+	}
+	return nil, false
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
+
+// repoFetchLimiter limits the number of concurrent fetches of each
+// repository. The zero value is ready to use.
+type repoFetchLimiter struct {
+	mu sync.Mutex
+	// sems only contains repositories which are being fetched or waited
+	// on, so it does not grow with the number of repositories.
+	sems map[api.RepoName]*repoSem
+}
+
+type repoSem struct {
+	ch   chan struct{}
+	refs int // number of holders and waiters
+}
+
+// acquire blocks until fewer than limit fetches of repo are running, or ctx
+// is done. If limit is not positive it does not limit. The returned release
+// function must be called once the fetch is done.
+func (l *repoFetchLimiter) acquire(ctx context.Context, repo api.RepoName, limit int) (release func(), err error) {
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	if l.sems == nil {
+		l.sems = map[api.RepoName]*repoSem{}
+	}
+	sem, ok := l.sems[repo]
+	if !ok {
+		sem = &repoSem{ch: make(chan struct{}, limit)}
+		l.sems[repo] = sem
+	}
+	sem.refs++
+	l.mu.Unlock()
+
+	unref := func() {
+		l.mu.Lock()
+		sem.refs--
+		if sem.refs == 0 {
+			delete(l.sems, repo)
+		}
+		l.mu.Unlock()
+	}
+
+	select {
+	case sem.ch <- struct{}{}:
+	default:
+		repoFetchesThrottled.Inc()
+		select {
+		case sem.ch <- struct{}{}:
+		case <-ctx.Done():
+			unref()
+			return nil, ctx.Err()
+		}
+	}
+	return func() {
+		<-sem.ch
+		unref()
+	}, nil
+}
@@ -2,22 +2,22 @@ package store
 
 import (
 	"os"
-	"strings"
 )
 
 // GetZipFileWithRetry retries getting a zip file if the zip is for some reason
-// invalid.
+// invalid, or doesn't match its checksum.
 func GetZipFileWithRetry(get func() (string, *ZipFile, error)) (validPath string, zf *ZipFile, err error) {
 	var path string
 	tries := 0
 	for zf == nil {
 		path, zf, err = get()
 		if err != nil {
-			if tries < 2 && strings.Contains(err.Error(), "not a valid zip file") {
-				err = os.Remove(path)
-				if err != nil {
+			if tries < 2 && isCorrupt(err) {
+				recordEviction(path, evictCauseCorrupt)
+				if err := os.Remove(path); err != nil {
 					return "", nil, err
 				}
+				os.Remove(path + checksumSuffix)
 				tries++
 				if tries == 2 {
 					return "", nil, err
@@ -24,6 +24,11 @@ func TestGetZipFileWithRetry(t *testing.T) {
 			errs:     []error{errors.New("not a valid zip file"), nil},
 			succeeds: true,
 		},
+		{
+			name:     "checksum mismatch",
+			errs:     []error{errors.Wrap(&ChecksumError{Want: "a", Got: "b"}, "failed to read"), nil},
+			succeeds: true,
+		},
 		{
 			name:     "error that doesn't get a retry",
 			errs:     []error{errors.New("blah")},
@@ -71,6 +76,9 @@ func TestGetZipFileWithRetry(t *testing.T) {
 			if test.succeeds && zf == nil {
 				t.Error("expected a zip file; got nil")
 			}
+			if !test.succeeds && err == nil {
+				t.Error("expected an error; got nil")
+			}
 		})
 	}
 }
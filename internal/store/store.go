@@ -10,26 +10,32 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/conf"
 	"github.com/sourcegraph/sourcegraph/internal/diskcache"
 	"github.com/sourcegraph/sourcegraph/internal/gitserver"
+	"github.com/sourcegraph/sourcegraph/internal/metrics"
 	"github.com/sourcegraph/sourcegraph/internal/mutablelimiter"
 
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/text/transform"
 )
 
-// maxFileSize is the limit on file size in bytes. Only files smaller
-// than this are searched.
-const maxFileSize = 1 << 20 // 1MB; match https://sourcegraph.com/search?q=repo:%5Egithub%5C.com/sourcegraph/zoekt%24+%22-file_limit%22
+// DefaultMaxFileSize is the default limit on file size in bytes (see
+// Store.MaxFileSize).
+const DefaultMaxFileSize = 1 << 20 // 1MB; match https://sourcegraph.com/search?q=repo:%5Egithub%5C.com/sourcegraph/zoekt%24+%22-file_limit%22
 
 // Store manages the fetching and storing of git archives. Its main purpose is
 // keeping a local disk cache of the fetched archives to help speed up future
@@ -37,31 +43,101 @@ const maxFileSize = 1 << 20 // 1MB; match https://sourcegraph.com/search?q=repo:
 // responsible for filtering out files we receive from `git archive` that we
 // do not want to search.
 //
-// We use an LRU to do cache eviction:
-// * When to evict is based on the total size of *.zip on disk.
-// * What to evict uses the LRU algorithm.
+// We use an LRU to do cache eviction by default:
+// * When to evict is based on the total size of *.zip on disk, including
+//   their checksums and indexes, and on the free space of its volume (see
+//   MinFreeDiskBytes).
+// * What to evict uses the LRU algorithm (see EvictPolicy for others).
 // * We touch files when opening them, so can do LRU based on file
 //   modification times.
+// * Archives being searched are never evicted.
 //
 // Note: The store fetches tarballs but stores zips. We want to be able to
 // filter which files we cache, so we need a format that supports streaming
 // (tar). We want to be able to support random concurrent access for reading,
 // so we store as a zip.
+//
+// The central directory of the zip is the index of the archive: ZipFile.Files
+// has the offset and size of each file. Searching a cached commit again
+// doesn't parse the tarball, and files can be filtered by path before their
+// content is read.
 type Store struct {
 	// FetchTar returns an io.ReadCloser to a tar archive of a repository at the specified Git
 	// remote URL and commit ID. If the error implements "BadRequest() bool", it will be used to
 	// determine if the error is a bad request (eg invalid repo).
 	FetchTar func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error)
 
+	// FetchTarPaths if non-nil is like FetchTar, but the archive only
+	// contains the given paths. It is used by PrepareZipPaths.
+	FetchTarPaths func(ctx context.Context, repo gitserver.Repo, commit api.CommitID, paths []string) (io.ReadCloser, error)
+
+	// FetchPeerZip if non-nil is tried before FetchTar when an archive is
+	// not cached. It returns the zip archive of repo at commit from the
+	// cache of another replica, or a nil io.ReadCloser if no other replica
+	// has it cached. If it fails the archive is fetched with FetchTar.
+	FetchPeerZip func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error)
+
+	// Blobs if non-nil is a store of archives shared with other replicas.
+	// Archives missing from the cache (and from peers) are downloaded from
+	// it before being fetched from gitserver, and archives fetched from
+	// gitserver are uploaded to it.
+	Blobs BlobStore
+
 	// Path is the directory to store the cache
 	Path string
 
-	// MaxCacheSizeBytes is the maximum size of the cache in bytes. Note:
+	// MaxFileSize if positive is the size in bytes above which the content
+	// of files is not cached, so they can only be matched by their path,
+	// unless they match the SearchLargeFiles site configuration. It
+	// defaults to DefaultMaxFileSize.
+	MaxFileSize int64
+
+	// MaxCacheSizeBytes is the maximum size of the cache in bytes,
+	// including the checksums and indexes of the archives. Note:
 	// We can temporarily be larger than MaxCacheSizeBytes. When we go
 	// over MaxCacheSizeBytes we trigger delete files until we get below
 	// MaxCacheSizeBytes.
 	MaxCacheSizeBytes int64
 
+	// MaxCacheSizePercent if positive makes the Store recompute
+	// MaxCacheSizeBytes before every eviction as this percentage of the
+	// space on the cache's volume which is either free or used by the
+	// cache. So the cache shrinks as other files on the volume grow, and
+	// never uses more than its share of the space they leave.
+	MaxCacheSizePercent float64
+
+	// MinFreeDiskBytes if positive is the space in bytes the Store keeps
+	// free on the volume of the cache, which other tenants may fill. Below
+	// it archives are evicted even if the cache is smaller than
+	// MaxCacheSizeBytes, and fetches fail with a *DiskFullError if that
+	// doesn't free enough.
+	MinFreeDiskBytes int64
+
+	// evictMu serializes evictions. evictCause if non-empty is the cause
+	// of the current one. It is only accessed with evictMu held.
+	evictMu    sync.Mutex
+	evictCause string
+
+	// cacheSizePinned is non-zero once SetMaxCacheSizeBytes has been
+	// called. It is accessed atomically.
+	cacheSizePinned int32
+
+	// EvictPolicy is the order archives are evicted in. It defaults to
+	// EvictLRU.
+	EvictPolicy EvictPolicy
+
+	// CacheTTL is how long an unused archive stays in the cache with
+	// EvictTTL.
+	CacheTTL time.Duration
+
+	// RetainRepos are path.Match patterns of repositories (eg
+	// github.com/org/*) whose archives are only evicted once no other
+	// archive can be, eg hot monorepos which are expensive to fetch.
+	RetainRepos []string
+
+	// uses counts the uses of archives for EvictLFU.
+	uses useCounts
+
 	// once protects Start
 	once sync.Once
 
@@ -71,8 +147,61 @@ type Store struct {
 	// fetchLimiter limits concurrent calls to FetchTar.
 	fetchLimiter *mutablelimiter.Limiter
 
+	// preparing tracks the archives being prepared, which continue in the
+	// background after the requests for them are cancelled.
+	preparing sync.WaitGroup
+
+	// prepares coalesces concurrent prepares of the same archive.
+	prepares singleflight.Group
+
+	// fetchesWaiting is the number of fetches waiting for fetchLimiter.
+	// fetchWaitingSince is when (in unix nanoseconds) fetchesWaiting last
+	// became non-zero, and fetchAcquiredAt when a fetch last acquired
+	// fetchLimiter. They are accessed atomically.
+	fetchesWaiting    int32
+	fetchWaitingSince int64
+	fetchAcquiredAt   int64
+
+	// MaxConcurrentFetchesPerRepo if positive limits the number of
+	// concurrent calls to FetchTar for the same repository, so that many
+	// commits of one large repository can't use every fetch slot.
+	MaxConcurrentFetchesPerRepo int
+
+	// repoFetchLimiter applies MaxConcurrentFetchesPerRepo.
+	repoFetchLimiter repoFetchLimiter
+
+	// fetchLimitPinned is non-zero once PinMaxConcurrentFetchTar has been
+	// called. It is accessed atomically.
+	fetchLimitPinned int32
+
 	// ZipCache provides efficient access to repo zip files.
 	ZipCache ZipCache
+
+	// Faults if non-nil injects failures into fetching and caching
+	// archives. It is only for testing.
+	Faults *Faults
+
+	// TrigramIndexThreshold if positive is the number of times an archive
+	// is searched after which a trigram index is built for it (see
+	// TrigramIndex).
+	TrigramIndexThreshold int
+
+	// trigramIndexes tracks the state of trigram indexes.
+	trigramIndexes trigramIndexes
+
+	// CompressionLevel if positive is the zstd level the files of fetched
+	// archives are compressed with. Compressed archives use less disk but
+	// are decompressed into memory when searched, instead of being
+	// mmapped, so archives larger than MaxDecompressedBytes are stored
+	// uncompressed. Changing it doesn't rewrite cached archives: those
+	// cached with another setting are still read as they are, and are
+	// replaced with the new setting once they are evicted.
+	CompressionLevel int
+
+	// MaxDecompressedBytes is the largest total size of the files of an
+	// archive which is stored compressed. It defaults to
+	// DefaultMaxDecompressedBytes.
+	MaxDecompressedBytes int64
 }
 
 // SetMaxConcurrentFetchTar sets the maximum number of concurrent calls allowed
@@ -88,6 +217,69 @@ func (s *Store) SetMaxConcurrentFetchTar(limit int) {
 	}
 }
 
+// MaxConcurrentFetchTar returns the maximum number of concurrent calls
+// allowed to FetchTar.
+func (s *Store) MaxConcurrentFetchTar() int {
+	s.Start()
+	limit, _ := s.fetchLimiter.GetLimit()
+	return limit
+}
+
+// PinMaxConcurrentFetchTar is like SetMaxConcurrentFetchTar, but the limit is
+// no longer adjusted as gitservers are added or removed. It is safe to call
+// while serving.
+func (s *Store) PinMaxConcurrentFetchTar(limit int) {
+	s.Start()
+	atomic.StoreInt32(&s.fetchLimitPinned, 1)
+	s.fetchLimiter.SetLimit(limit)
+}
+
+// WaitPrepared waits until every archive being prepared is ready (or failed),
+// eg to stop without discarding fetches in progress. It returns ctx.Err() if
+// ctx is done first.
+func (s *Store) WaitPrepared(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.preparing.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FetchesStalled reports whether fetches have been waiting for a fetch slot
+// for longer than d, without any fetch getting one. Since fetches time out,
+// that means the store is wedged.
+func (s *Store) FetchesStalled(d time.Duration) bool {
+	if atomic.LoadInt32(&s.fetchesWaiting) == 0 {
+		return false
+	}
+	since := atomic.LoadInt64(&s.fetchWaitingSince)
+	if acquired := atomic.LoadInt64(&s.fetchAcquiredAt); acquired > since {
+		since = acquired
+	}
+	return time.Since(time.Unix(0, since)) > d
+}
+
+// SetMaxCacheSizeBytes updates MaxCacheSizeBytes, and stops it being
+// recomputed from MaxCacheSizePercent. It is safe to call while serving. It
+// has no effect if the Store was started with a MaxCacheSizeBytes and
+// MaxCacheSizePercent of 0, since eviction is then disabled.
+func (s *Store) SetMaxCacheSizeBytes(n int64) {
+	atomic.StoreInt32(&s.cacheSizePinned, 1)
+	atomic.StoreInt64(&s.MaxCacheSizeBytes, n)
+}
+
+// GetMaxCacheSizeBytes returns MaxCacheSizeBytes. It is safe to call while
+// serving.
+func (s *Store) GetMaxCacheSizeBytes() int64 {
+	return atomic.LoadInt64(&s.MaxCacheSizeBytes)
+}
+
 // Start initializes state and starts background goroutines. It can be called
 // more than once. It is optional to call, but starting it earlier avoids a
 // search request paying the cost of initializing.
@@ -100,7 +292,14 @@ func (s *Store) Start() {
 			Dir:               s.Path,
 			Component:         "store",
 			BackgroundTimeout: 2 * time.Minute,
-			BeforeEvict:       s.ZipCache.delete,
+			BeforeEvict:       s.evict,
+			BeforePut:         s.beforePut,
+			Pinned:            s.pinned,
+			EvictOrder:        s.evictOrder,
+			Sidecars:          sidecarSuffixes,
+		}
+		if s.EvictPolicy == EvictTTL {
+			s.cache.MaxIdle = s.CacheTTL
 		}
 		go s.watchAndEvict()
 	})
@@ -109,6 +308,42 @@ func (s *Store) Start() {
 // PrepareZip returns the path to a local zip archive of repo at commit.
 // It will first consult the local cache, otherwise will fetch from the network.
 func (s *Store) PrepareZip(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (path string, err error) {
+	return s.prepareZip(ctx, repo, commit, nil)
+}
+
+// Prefetch fetches the archive of repo at commit into the cache, unless it
+// is cached already. Unlike PrepareZip it doesn't count as a use of a cached
+// archive, so warming the cache doesn't skew the cache hit rate or keep
+// unused archives from being evicted. It returns whether it fetched.
+func (s *Store) Prefetch(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (fetched bool, err error) {
+	if _, _, err := s.StatZip(repo, commit); err == nil {
+		return false, nil
+	}
+	if _, err := s.prepareZip(ctx, repo, commit, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PrepareZipPaths is like PrepareZip, but the archive only contains paths,
+// which must be non-empty and exist at commit. It is much smaller than the
+// archive of the whole repository if only a few paths are needed, eg the
+// files changed since an indexed commit. It requires FetchTarPaths.
+func (s *Store) PrepareZipPaths(ctx context.Context, repo gitserver.Repo, commit api.CommitID, paths []string) (path string, err error) {
+	if s.FetchTarPaths == nil {
+		return "", errors.New("fetching archives of some paths is not supported")
+	}
+	if len(paths) == 0 {
+		return "", errors.New("no paths to fetch an archive of")
+	}
+	paths = append([]string(nil), paths...)
+	sort.Strings(paths)
+	return s.prepareZip(ctx, repo, commit, paths)
+}
+
+// prepareZip implements PrepareZip and PrepareZipPaths. paths is nil for
+// the archive of the whole repository.
+func (s *Store) prepareZip(ctx context.Context, repo gitserver.Repo, commit api.CommitID, paths []string) (path string, err error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "Store.prepareZip")
 	ext.Component.Set(span, "store")
 	defer func() {
@@ -130,10 +365,8 @@ func (s *Store) PrepareZip(ctx context.Context, repo gitserver.Repo, commit api.
 
 	largeFilePatterns := conf.Get().SearchLargeFiles
 
-	// key is a sha256 hash since we want to use it for the disk name
-	h := sha256.Sum256([]byte(fmt.Sprintf("%q %q %q", repo.Name, commit, largeFilePatterns)))
-	key := hex.EncodeToString(h[:])
-	span.LogKV("key", key)
+	key := zipKey(repo, commit, largeFilePatterns, s.maxFileSize(), paths)
+	span.LogKV("key", key, "paths", len(paths))
 
 	// Our fetch can take a long time, and the frontend aggressively cancels
 	// requests. So we open in the background to give it extra time.
@@ -142,21 +375,72 @@ func (s *Store) PrepareZip(ctx context.Context, repo gitserver.Repo, commit api.
 		err  error
 	}
 	resC := make(chan result, 1)
+	s.preparing.Add(1)
 	go func() {
+		defer s.preparing.Done()
 		// TODO: consider adding a cache method that doesn't actually bother opening the file,
 		// since we're just going to close it again immediately.
 		bgctx := opentracing.ContextWithSpan(context.Background(), opentracing.SpanFromContext(ctx))
-		f, err := s.cache.Open(bgctx, key, func(ctx context.Context) (io.ReadCloser, error) {
-			return s.fetch(ctx, repo, commit, largeFilePatterns)
+		stats := fetchStatsFromContext(ctx)
+		// Concurrent requests for the same archive share a single lookup,
+		// and so a single fetch. diskcache serializes fetches of the same
+		// key too, but every waiter would retry a failed fetch.
+		led := false
+		v, err, _ := s.prepares.Do(key, func() (interface{}, error) {
+			led = true
+			return s.openZip(bgctx, key, func(ctx context.Context, path string) error {
+				// A full volume would fail the write of the archive anyway,
+				// after fetching it.
+				if err := s.checkDiskSpace(); err != nil {
+					return err
+				}
+				// Archives of some paths are small and unlikely to be needed
+				// by other replicas, so they are not shared.
+				if paths == nil && s.fetchFromPeer(ctx, repo, commit, path) {
+					return nil
+				}
+				if paths == nil && s.fetchFromBlobs(ctx, key, path) {
+					return nil
+				}
+				// The cache fetches with a background context, so we pass on
+				// the request's stats ourselves.
+				if stats != nil {
+					ctx = WithFetchStats(ctx, stats)
+				}
+				rc, err := s.fetch(ctx, repo, commit, paths, largeFilePatterns)
+				if err != nil {
+					return err
+				}
+				err = writeFile(path, rc)
+				if isTruncated(err) {
+					// Most likely the connection to gitserver was cut. Try once
+					// more before failing the request.
+					log.Printf("refetching truncated archive of %s@%s", repo.Name, commit)
+					rc, err = s.fetch(ctx, repo, commit, paths, largeFilePatterns)
+					if err != nil {
+						return err
+					}
+					err = writeFile(path, rc)
+				}
+				if err == nil && paths == nil {
+					s.uploadToBlobs(key, path)
+				}
+				return s.noSpace(err)
+			})
 		})
-		var path string
-		if f != nil {
-			path = f.Path
-			if f.File != nil {
-				f.File.Close()
-			}
+		res := v.(prepared)
+		if stats != nil {
+			stats.addLookup(res.missed)
 		}
-		resC <- result{path, err}
+		switch {
+		case !res.missed:
+			cacheLookups.WithLabelValues("hit").Inc()
+		case led:
+			cacheLookups.WithLabelValues("miss").Inc()
+		default:
+			cacheLookups.WithLabelValues("coalesced").Inc()
+		}
+		resC <- result{res.path, err}
 	}()
 
 	select {
@@ -167,19 +451,91 @@ func (s *Store) PrepareZip(ctx context.Context, repo gitserver.Repo, commit api.
 		if res.err != nil {
 			return "", res.err
 		}
+		s.uses.add(res.path)
 		return res.path, nil
 	}
 }
 
+// prepared is the result of openZip.
+type prepared struct {
+	path   string
+	missed bool // whether fetcher was called
+}
+
+// openZip opens the archive key from the cache, calling fetcher if it is
+// missing, and closes it again.
+func (s *Store) openZip(ctx context.Context, key string, fetcher diskcache.FetcherWithPath) (interface{}, error) {
+	var res prepared
+	f, err := s.cache.OpenWithPath(ctx, key, func(ctx context.Context, path string) error {
+		res.missed = true
+		return fetcher(ctx, path)
+	})
+	if f != nil {
+		res.path = f.Path
+		if f.File != nil {
+			f.File.Close()
+		}
+	}
+	return res, err
+}
+
+// StatZip returns the path and FileInfo of the cached zip archive of repo at
+// commit. Unlike PrepareZip, it never fetches the archive. If the archive is
+// not cached the error satisfies os.IsNotExist.
+func (s *Store) StatZip(repo gitserver.Repo, commit api.CommitID) (string, os.FileInfo, error) {
+	// Ensure we have initialized
+	s.Start()
+
+	return s.cache.Stat(zipKey(repo, commit, conf.Get().SearchLargeFiles, s.maxFileSize(), nil))
+}
+
+// maxFileSize returns MaxFileSize or its default.
+func (s *Store) maxFileSize() int64 {
+	if s.MaxFileSize > 0 {
+		return s.MaxFileSize
+	}
+	return DefaultMaxFileSize
+}
+
+// zipKey returns the cache key for the zip archive of repo at commit, or of
+// only paths if paths is non-nil. Archives cached with another maxFileSize
+// have other keys, so changing it doesn't serve their stale content.
+func zipKey(repo gitserver.Repo, commit api.CommitID, largeFilePatterns []string, maxFileSize int64, paths []string) string {
+	k := fmt.Sprintf("%q %q %q", repo.Name, commit, largeFilePatterns)
+	if maxFileSize != DefaultMaxFileSize {
+		// Keys with the default limit predate it being configurable.
+		k += fmt.Sprintf(" %d", maxFileSize)
+	}
+	if paths != nil {
+		k += fmt.Sprintf(" %q", paths)
+	}
+	// key is a sha256 hash since we want to use it for the disk name
+	h := sha256.Sum256([]byte(k))
+	return hex.EncodeToString(h[:])
+}
+
 // fetch fetches an archive from the network and stores it on disk. It does
 // not populate the in-memory cache. You should probably be calling
-// prepareZip.
-func (s *Store) fetch(ctx context.Context, repo gitserver.Repo, commit api.CommitID, largeFilePatterns []string) (rc io.ReadCloser, err error) {
+// prepareZip. If paths is non-nil, the archive only contains them.
+func (s *Store) fetch(ctx context.Context, repo gitserver.Repo, commit api.CommitID, paths, largeFilePatterns []string) (rc io.ReadCloser, err error) {
 	fetchQueueSize.Inc()
+	// Acquire the per repository semaphore first, so that fetches waiting
+	// on a busy repository don't hold one of the global slots.
+	releaseRepoFetchLimiter, err := s.repoFetchLimiter.acquire(ctx, repo.Name, s.MaxConcurrentFetchesPerRepo)
+	if err != nil {
+		fetchQueueSize.Dec()
+		return nil, err // err will be a context error
+	}
+	if atomic.AddInt32(&s.fetchesWaiting, 1) == 1 {
+		atomic.StoreInt64(&s.fetchWaitingSince, time.Now().UnixNano())
+	}
 	ctx, releaseFetchLimiter, err := s.fetchLimiter.Acquire(ctx) // Acquire concurrent fetches semaphore
+	atomic.AddInt32(&s.fetchesWaiting, -1)
 	if err != nil {
+		releaseRepoFetchLimiter()
 		return nil, err // err will be a context error
 	}
+	atomic.StoreInt64(&s.fetchAcquiredAt, time.Now().UnixNano())
 	fetchQueueSize.Dec()
 
 	// We expect git archive, even for large repos, to finish relatively
@@ -187,6 +543,7 @@ func (s *Store) fetch(ctx context.Context, repo gitserver.Repo, commit api.Commi
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
 
 	fetching.Inc()
+	start := time.Now()
 	span, ctx := opentracing.StartSpanFromContext(ctx, "Store.fetch")
 	ext.Component.Set(span, "store")
 	span.SetTag("repo", repo.Name)
@@ -202,14 +559,16 @@ func (s *Store) fetch(ctx context.Context, repo gitserver.Repo, commit api.Commi
 		}
 		doneCalled = true
 
-		releaseFetchLimiter() // Release concurrent fetches semaphore
-		cancel()              // Release context resources
+		releaseFetchLimiter()     // Release concurrent fetches semaphore
+		releaseRepoFetchLimiter() // Release per repository semaphore
+		cancel()                  // Release context resources
 		if err != nil {
 			ext.Error.Set(span, true)
 			span.SetTag("err", err.Error())
 			fetchFailed.Inc()
 		}
 		fetching.Dec()
+		metrics.ObserveWithTrace(ctx, fetchDuration, time.Since(start).Seconds())
 		span.Finish()
 	}
 	defer func() {
@@ -218,10 +577,20 @@ func (s *Store) fetch(ctx context.Context, repo gitserver.Repo, commit api.Commi
 		}
 	}()
 
-	r, err := s.FetchTar(ctx, repo, commit)
+	if err := s.Faults.fetchError(); err != nil {
+		return nil, err
+	}
+	var r io.ReadCloser
+	if paths != nil {
+		r, err = s.FetchTarPaths(ctx, repo, commit, paths)
+	} else {
+		r, err = s.FetchTar(ctx, repo, commit)
+	}
 	if err != nil {
 		return nil, err
 	}
+	r = s.Faults.slowReader(r)
+	r = &countingReadCloser{ReadCloser: r, stats: fetchStatsFromContext(ctx)}
 
 	pr, pw := io.Pipe()
 
@@ -233,12 +602,24 @@ func (s *Store) fetch(ctx context.Context, repo gitserver.Repo, commit api.Commi
 	// we encounter an error.
 	go func() {
 		defer r.Close()
-		tr := tar.NewReader(r)
+		trailer := &trailerReader{r: r}
+		tr := tar.NewReader(trailer)
 		zw := zip.NewWriter(pw)
-		err := copySearchable(tr, zw, largeFilePatterns)
+		s.registerCompressor(zw)
+		err := copySearchable(tr, zw, s.zipMethod(), largeFilePatterns, s.maxFileSize())
+		if err == nil && !trailer.terminated() {
+			truncatedFetches.Inc()
+			err = truncatedError{}
+		}
+		if err == nil {
+			err = setArchiveComment(zw, repo, commit, paths != nil)
+		}
 		if err1 := zw.Close(); err == nil {
 			err = err1
 		}
+		if err == nil {
+			err = s.Faults.writeError()
+		}
 		done(err)
 		// CloseWithError is guaranteed to return a nil error
 		_ = pw.CloseWithError(errors.Wrapf(err, "failed to fetch %s@%s", repo, commit))
@@ -247,10 +628,70 @@ func (s *Store) fetch(ctx context.Context, repo gitserver.Repo, commit api.Commi
 	return pr, nil
 }
 
-// copySearchable copies searchable files from tr to zw. A searchable file is
-// any file that is a candidate for being searched (under size limit and
-// non-binary).
-func copySearchable(tr *tar.Reader, zw *zip.Writer, largeFilePatterns []string) error {
+// fetchFromPeer writes the archive of repo at commit to path if FetchPeerZip
+// finds it in the cache of another replica. It reports whether it did.
+func (s *Store) fetchFromPeer(ctx context.Context, repo gitserver.Repo, commit api.CommitID, path string) bool {
+	if s.FetchPeerZip == nil {
+		return false
+	}
+	rc, err := s.FetchPeerZip(ctx, repo, commit)
+	if err != nil {
+		log.Printf("failed to fetch %s@%s from a peer: %s", repo.Name, commit, err)
+		peerFetches.WithLabelValues("error").Inc()
+		return false
+	}
+	if rc == nil {
+		peerFetches.WithLabelValues("miss").Inc()
+		return false
+	}
+	err = writeFile(path, rc)
+	if err == nil {
+		err = checkZip(path)
+	}
+	if err != nil {
+		log.Printf("failed to fetch %s@%s from a peer: %s", repo.Name, commit, err)
+		peerFetches.WithLabelValues("error").Inc()
+		return false
+	}
+	peerFetches.WithLabelValues("hit").Inc()
+	return true
+}
+
+// writeFile truncates the file at path and copies rc to it. rc is closed.
+func writeFile(path string, rc io.ReadCloser) error {
+	defer rc.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open temporary archive cache item")
+	}
+	_, err = io.Copy(f, rc)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return errors.Wrap(err, "failed to write archive cache item")
+}
+
+// checkZip returns an error if the file at path is not a zip archive we
+// can search.
+func checkZip(path string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	compressed, err := zipCompressed(&r.Reader)
+	if err != nil || compressed {
+		// The contents of compressed files are checked when they are
+		// decompressed.
+		return err
+	}
+	return new(ZipFile).PopulateFiles(&r.Reader)
+}
+
+// copySearchable copies searchable files from tr to zw, compressed with
+// method. A searchable file is any file that is a candidate for being
+// searched (under size limit and non-binary).
+func copySearchable(tr *tar.Reader, zw *zip.Writer, method uint16, largeFilePatterns []string, maxFileSize int64) error {
 	// 32*1024 is the same size used by io.Copy
 	buf := make([]byte, 32*1024)
 	for {
@@ -274,35 +715,60 @@ func copySearchable(tr *tar.Reader, zw *zip.Writer, largeFilePatterns []string)
 			continue
 		}
 
-		// We are happy with the file, so we can write it to zw.
-		w, err := zw.CreateHeader(&zip.FileHeader{
-			Name:   hdr.Name,
-			Method: zip.Store,
-		})
-		if err != nil {
-			return err
-		}
-
-		n, err := tr.Read(buf)
-		switch err {
-		case io.EOF:
-			if n == 0 {
-				continue
-			}
-		case nil:
-		default:
+		// Read the head of the file in full, since the heuristics below
+		// are only reliable with as much of it as possible.
+		n, err := io.ReadFull(tr, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			return err
 		}
 
 		// We do not search the content of large files unless they are
 		// whitelisted.
-		if hdr.Size > maxFileSize && !ignoreSizeMax(hdr.Name, largeFilePatterns) {
+		tooLarge := hdr.Size > maxFileSize && !ignoreSizeMax(hdr.Name, largeFilePatterns)
+		searchable := n > 0 && !tooLarge
+		var (
+			enc    string
+			binary bool
+		)
+		if searchable {
+			// Files in other encodings are transcoded to UTF-8. The
+			// content of binary files is kept, but only searched if a
+			// request asks for it.
+			enc = sniffEncoding(buf[:n])
+			binary = enc == "" && isBinary(buf[:n])
+		}
+
+		// We are happy with the file, so we can write it to zw.
+		zh := &zip.FileHeader{
+			Name:     hdr.Name,
+			Method:   method,
+			Extra:    sizeExtra(hdr.Size),
+			Modified: hdr.ModTime,
+		}
+		if enc != "" {
+			zh.Extra = append(zh.Extra, encodingExtra(enc)...)
+		}
+		if binary {
+			zh.Extra = append(zh.Extra, binaryExtra()...)
+		}
+		if tooLarge {
+			zh.Extra = append(zh.Extra, tooLargeExtra()...)
+		}
+		zh.SetMode(os.FileMode(hdr.Mode).Perm())
+		w, err := zw.CreateHeader(zh)
+		if err != nil {
+			return err
+		}
+		if !searchable {
 			continue
 		}
 
-		// Heuristic: Assume file is binary if first 256 bytes contain a
-		// 0x00. Best effort, so ignore err. We only search names of binary files.
-		if n > 0 && bytes.IndexByte(buf[:n], 0x00) >= 0 {
+		if enc != "" {
+			head := append([]byte(nil), buf[:n]...)
+			r := transform.NewReader(io.MultiReader(bytes.NewReader(head), tr), decoder(enc))
+			if _, err := io.CopyBuffer(w, r, buf); err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -330,7 +796,8 @@ func (s *Store) String() string {
 // watchAndEvict is a loop which periodically checks the size of the cache and
 // evicts/deletes items if the store gets too large.
 func (s *Store) watchAndEvict() {
-	if s.MaxCacheSizeBytes == 0 {
+	limitSize := atomic.LoadInt64(&s.MaxCacheSizeBytes) != 0 || s.MaxCacheSizePercent > 0
+	if !limitSize && s.MinFreeDiskBytes <= 0 {
 		return
 	}
 
@@ -343,17 +810,55 @@ func (s *Store) watchAndEvict() {
 		addrs := len(gitserver.DefaultClient.Addrs(ctx))
 		if addrs != prevAddrs {
 			prevAddrs = addrs
-			s.SetMaxConcurrentFetchTar(10 * addrs)
+			if atomic.LoadInt32(&s.fetchLimitPinned) == 0 {
+				s.SetMaxConcurrentFetchTar(10 * addrs)
+			}
+		}
+
+		if s.MinFreeDiskBytes > 0 {
+			if _, err := s.ensureFreeDisk(); err != nil {
+				log.Printf("failed to free disk space: %s", err)
+			}
+		}
+		if !limitSize {
+			continue
+		}
+
+		if s.MaxCacheSizePercent > 0 && atomic.LoadInt32(&s.cacheSizePinned) == 0 {
+			n, err := maxCacheSizeFromPercent(s.Path, s.MaxCacheSizePercent)
+			if err != nil {
+				log.Printf("failed to compute the maximum cache size: %s", err)
+				continue
+			}
+			atomic.StoreInt64(&s.MaxCacheSizeBytes, n)
 		}
+		maxCacheSizeBytes.Set(float64(atomic.LoadInt64(&s.MaxCacheSizeBytes)))
 
-		stats, err := s.cache.Evict(s.MaxCacheSizeBytes)
+		s.evictMu.Lock()
+		stats, err := s.cache.Evict(atomic.LoadInt64(&s.MaxCacheSizeBytes))
+		s.evictMu.Unlock()
 		if err != nil {
 			log.Printf("failed to Evict: %s", err)
 			continue
 		}
 		cacheSizeBytes.Set(float64(stats.CacheSize))
 		evictions.Add(float64(stats.Evicted))
+		evictionsPinned.Add(float64(stats.Pinned))
+	}
+}
+
+// maxCacheSizeFromPercent returns percent of the space on the volume of the
+// cache directory dir which is either free or used by the cache.
+func maxCacheSizeFromPercent(dir string, percent float64) (int64, error) {
+	free, err := freeDiskBytes(dir)
+	if err != nil {
+		return 0, err
 	}
+	used, err := usedDiskBytes(dir)
+	if err != nil {
+		return 0, err
+	}
+	return int64(float64(free+used) * percent / 100), nil
 }
 
 // ignoreSizeMax determines whether the max size should be ignored. It uses
@@ -375,30 +880,97 @@ var (
 		Name:      "cache_size_bytes",
 		Help:      "The total size of items in the on disk cache.",
 	})
+	maxCacheSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "cache_max_size_bytes",
+		Help:      "The size the on disk cache is evicted down to.",
+	})
 	evictions = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "searcher",
 		Subsystem: "store",
 		Name:      "evictions",
 		Help:      "The total number of items evicted from the cache.",
 	})
+	evictionsPinned = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "evictions_pinned_total",
+		Help:      "The total number of times an archive was not evicted because it was being searched.",
+	})
 	fetching = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "searcher",
 		Subsystem: "store",
 		Name:      "fetching",
 		Help:      "The number of fetches currently running.",
 	})
+	fetchBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "fetch_bytes_total",
+		Help:      "The total number of bytes of archives fetched from gitserver.",
+	})
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "cache_lookups_total",
+		Help:      "The total number of archives looked up in the on disk cache, by result: hit, miss if it had to be fetched, or coalesced if it was fetched for a concurrent lookup.",
+	}, []string{"result"})
 	fetchQueueSize = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "searcher",
 		Subsystem: "store",
 		Name:      "fetch_queue_size",
 		Help:      "The number of fetch jobs enqueued.",
 	})
+	fetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "fetch_duration_seconds",
+		Help:      "Time spent fetching archives from gitserver, excluding time queued. Exemplars link to their traces.",
+		Buckets:   []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 120},
+	})
+	repoFetchesThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "repo_fetches_throttled_total",
+		Help:      "The total number of archive fetches which waited because too many archives of the same repository were being fetched.",
+	})
 	fetchFailed = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "searcher",
 		Subsystem: "store",
 		Name:      "fetch_failed",
 		Help:      "The total number of archive fetches that failed.",
 	})
+	faultsInjected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "faults_injected_total",
+		Help:      "The total number of faults injected for testing.",
+	}, []string{"fault"})
+	hashIndexLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "hash_index_lookups_total",
+		Help:      "The total number of archive hash indexes read from their sidecar or computed.",
+	}, []string{"source"})
+	trigramIndexLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "trigram_index_lookups_total",
+		Help:      "The total number of archive trigram indexes used from memory, read from their sidecar or computed, and of sidecars which had to be rebuilt or failed to be written.",
+	}, []string{"source"})
+	peerFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "peer_fetches_total",
+		Help:      "The total number of archives looked for in the cache of other replicas, by result (hit, miss or error).",
+	}, []string{"result"})
+	checksumVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "searcher",
+		Subsystem: "store",
+		Name:      "checksum_verifications_total",
+		Help:      "The total number of archives verified against their checksum when opened, by result (ok, mismatch or missing).",
+	}, []string{"result"})
 )
 
 // temporaryError wraps an error but adds the Temporary method. It does not
@@ -414,8 +986,39 @@ func (temporaryError) Temporary() bool {
 
 func init() {
 	prometheus.MustRegister(cacheSizeBytes)
+	prometheus.MustRegister(maxCacheSizeBytes)
 	prometheus.MustRegister(evictions)
+	prometheus.MustRegister(evictionsPinned)
 	prometheus.MustRegister(fetching)
+	prometheus.MustRegister(fetchBytes)
+	prometheus.MustRegister(cacheLookups)
 	prometheus.MustRegister(fetchQueueSize)
+	prometheus.MustRegister(fetchDuration)
+	prometheus.MustRegister(repoFetchesThrottled)
 	prometheus.MustRegister(fetchFailed)
+	prometheus.MustRegister(faultsInjected)
+	prometheus.MustRegister(hashIndexLookups)
+	prometheus.MustRegister(trigramIndexLookups)
+	prometheus.MustRegister(peerFetches)
+	prometheus.MustRegister(checksumVerifications)
+}
+
+// ReadTarArchive reads the tar archive r into an in-memory ZipFile containing
+// only its searchable files. It is used to search archives which do not come
+// from gitserver. maxFileSize is like Store.MaxFileSize. The returned ZipFile
+// must be closed.
+func ReadTarArchive(r io.Reader, largeFilePatterns []string, maxFileSize int64) (*ZipFile, error) {
+	if maxFileSize <= 0 {
+		maxFileSize = DefaultMaxFileSize
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if err := copySearchable(tar.NewReader(r), zw, zip.Store, largeFilePatterns, maxFileSize); err != nil {
+		return nil, errors.Wrap(err, "failed to read tar archive")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return NewZipFile(buf.Bytes())
 }
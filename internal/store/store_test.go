@@ -7,12 +7,17 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/diskcache"
 	"github.com/sourcegraph/sourcegraph/internal/gitserver"
 )
 
@@ -81,6 +86,46 @@ func TestPrepareZip(t *testing.T) {
 	}
 }
 
+func TestPrepareZip_maxConcurrentFetchesPerRepo(t *testing.T) {
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	s.MaxConcurrentFetchesPerRepo = 1
+
+	var running, maxRunning int64
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		n := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		for {
+			m := atomic.LoadInt64(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return emptyTar(t), nil
+	}
+
+	errs := make(chan error)
+	for _, c := range []string{"1", "2", "3"} {
+		commit := api.CommitID(strings.Repeat(c, 40))
+		go func() {
+			_, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, commit)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if maxRunning != 1 {
+		t.Errorf("expected at most 1 concurrent fetch of the repository, got %d", maxRunning)
+	}
+	if len(s.repoFetchLimiter.sems) != 0 {
+		t.Errorf("expected the per repository limiters to be cleaned up, got %v", s.repoFetchLimiter.sems)
+	}
+}
+
 func TestPrepareZip_fetchTarFail(t *testing.T) {
 	fetchErr := errors.New("test")
 	s, cleanup := tmpStore(t)
@@ -117,6 +162,687 @@ func TestPrepareZip_errHeader(t *testing.T) {
 	}
 }
 
+func TestPrepareZip_truncated(t *testing.T) {
+	// A tar archive cut off after its first entry, before the end-of-archive
+	// marker.
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	for _, name := range []string{"a.go", "b.go"} {
+		body := "package " + strings.TrimSuffix(name, ".go") + "\n"
+		if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	complete := buf.Bytes()
+	truncated := complete[:2*512]
+
+	for _, alwaysTruncated := range []bool{false, true} {
+		s, cleanup := tmpStore(t)
+		defer cleanup()
+		var fetches int
+		s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+			fetches++
+			if fetches == 1 || alwaysTruncated {
+				return ioutil.NopCloser(bytes.NewReader(truncated)), nil
+			}
+			return ioutil.NopCloser(bytes.NewReader(complete)), nil
+		}
+
+		path, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+		if fetches != 2 {
+			t.Errorf("alwaysTruncated=%v: expected the archive to be fetched twice, got %d fetches", alwaysTruncated, fetches)
+		}
+		if alwaysTruncated {
+			if !isTruncated(err) {
+				t.Errorf("expected PrepareZip to fail with a truncated error, failed with %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		zf, err := s.ZipCache.Get(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zf.Files) != 2 {
+			t.Errorf("expected the refetched archive to contain 2 files, got %d", len(zf.Files))
+		}
+		zf.Close()
+	}
+}
+
+func TestPrepareZip_badPeerZip(t *testing.T) {
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	s.FetchPeerZip = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("not a zip")), nil
+	}
+	fetched := false
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		fetched = true
+		return emptyTar(t), nil
+	}
+	path, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fetched {
+		t.Error("expected a fallback to FetchTar")
+	}
+	if err := checkZip(path); err != nil {
+		t.Errorf("cached archive is invalid: %s", err)
+	}
+}
+
+func TestPrepareZip_fetchStats(t *testing.T) {
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		return emptyTar(t), nil
+	}
+	var stats FetchStats
+	ctx := WithFetchStats(context.Background(), &stats)
+	for i := 0; i < 2; i++ {
+		if _, err := s.PrepareZip(ctx, gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lookups, misses := stats.CacheLookups(); lookups != 2 || misses != 1 {
+		t.Errorf("got %d lookups and %d misses, want 2 and 1", lookups, misses)
+	}
+}
+
+func TestPrepareZip_checksum(t *testing.T) {
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		buf := new(bytes.Buffer)
+		w := tar.NewWriter(buf)
+		if err := w.WriteHeader(&tar.Header{Name: "a.go", Mode: 0600, Size: 9}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("package a")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return ioutil.NopCloser(buf), nil
+	}
+	path, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + checksumSuffix); err != nil {
+		t.Fatalf("expected a checksum to be recorded: %v", err)
+	}
+
+	// Corrupt the content of a.go, which the zip format doesn't detect
+	// when it is stored uncompressed.
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(data, []byte("package a"))
+	if i < 0 {
+		t.Fatal("a.go not found in the archive")
+	}
+	data[i] = 'P'
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.ZipCache.Get(path)
+	if _, ok := err.(*ChecksumError); !ok {
+		t.Fatalf("got error %v, want a *ChecksumError", err)
+	}
+	if !isCorrupt(err) {
+		t.Error("expected a checksum mismatch to be retried")
+	}
+}
+
+func TestMaxCacheSizeFromPercent(t *testing.T) {
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	if err := os.MkdirAll(s.Path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.Path, "a.zip"), make([]byte, 1<<20), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := maxCacheSizeFromPercent(s.Path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all < 1<<20 {
+		t.Errorf("expected the cache to be allowed at least its current size, got %d", all)
+	}
+	half, err := maxCacheSizeFromPercent(s.Path, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Allow for other processes using the disk between the calls.
+	if diff := all/2 - half; diff < -(1<<20) || diff > 1<<20 {
+		t.Errorf("expected 50%% to be half of 100%% (%d), got %d", all, half)
+	}
+}
+
+func TestCacheEntries(t *testing.T) {
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		buf := new(bytes.Buffer)
+		w := tar.NewWriter(buf)
+		body := []byte("hello world")
+		if err := w.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0600, Size: int64(len(body))}); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(buf), nil
+	}
+
+	commit := api.CommitID("deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+	for _, repo := range []api.RepoName{"foo", "bar"} {
+		if _, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: repo}, commit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := s.CacheEntries("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("expected 2 cache entries, got %+v", all)
+	}
+
+	entries, err := s.CacheEntries("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 cache entry for foo, got %+v", entries)
+	}
+	e := entries[0]
+	if e.Repo != "foo" || e.Commit != commit {
+		t.Errorf("got repo=%q commit=%q, want foo@%s", e.Repo, e.Commit, commit)
+	}
+	if e.Compression != "store" {
+		t.Errorf("got compression %q, want store", e.Compression)
+	}
+	if fi, err := os.Stat(e.Path); err != nil {
+		t.Error(err)
+	} else if fi.Size() != e.Size {
+		t.Errorf("got size %d, want %d", e.Size, fi.Size())
+	}
+
+	if entries, err := s.CacheEntries("baz"); err != nil || len(entries) != 0 {
+		t.Errorf("expected no cache entries for baz, got %+v (err=%v)", entries, err)
+	}
+}
+
+func TestPrepareZip_encodings(t *testing.T) {
+	files := map[string][]byte{
+		"utf16.txt":   {0xff, 0xfe, 'h', 0, 'i', 0, ' ', 0, 0xe9, 0, '\n', 0},
+		"utf16be.txt": {0, 'h', 0, 'i', 0, ' ', 0, 0xe9, 0, '\n'},
+		"latin1.txt":  []byte("hi \xe9\n"),
+		"utf8.txt":    []byte("hi \u00e9\n"),
+		// A stray invalid byte doesn't make UTF-8 text Latin-1.
+		"invalid.txt": []byte("hi \u00e9 \xff\n"),
+		"binary":      {'h', 'i', 0, 0x01, 0xe9},
+	}
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		buf := new(bytes.Buffer)
+		w := tar.NewWriter(buf)
+		for name, body := range files {
+			if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(body))}); err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(body); err != nil {
+				return nil, err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(buf), nil
+	}
+
+	path, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zf, err := s.ZipCache.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zf.Close()
+
+	want := map[string]string{
+		"utf16.txt":   EncodingUTF16LE,
+		"utf16be.txt": EncodingUTF16BE,
+		"latin1.txt":  EncodingLatin1,
+	}
+	if len(zf.Encodings) != len(want) {
+		t.Errorf("got encodings %v, want %v", zf.Encodings, want)
+	}
+	for i := range zf.Files {
+		f := &zf.Files[i]
+		if got := zf.Encodings[f.Name]; got != want[f.Name] {
+			t.Errorf("%s: got encoding %q, want %q", f.Name, got, want[f.Name])
+		}
+		if f.Name == "invalid.txt" {
+			if got := zf.DataFor(f); !bytes.Equal(got, files[f.Name]) {
+				t.Errorf("%s: got content %q, want it kept as is", f.Name, got)
+			}
+			continue
+		}
+		if want[f.Name] == "" && f.Name != "utf8.txt" {
+			continue
+		}
+		if got := string(zf.DataFor(f)); got != "hi \u00e9\n" {
+			t.Errorf("%s: got content %q, want it transcoded to UTF-8", f.Name, got)
+		}
+	}
+
+	// Binary files are kept as is, but marked.
+	if !reflect.DeepEqual(zf.Binary, map[string]bool{"binary": true}) {
+		t.Errorf("got binary files %v, want only binary", zf.Binary)
+	}
+	for i := range zf.Files {
+		if f := &zf.Files[i]; f.Name == "binary" && !bytes.Equal(zf.DataFor(f), files["binary"]) {
+			t.Errorf("got binary content %q, want %q", zf.DataFor(f), files["binary"])
+		}
+	}
+
+	infos, err := ListZip(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range infos {
+		if fi.Encoding != want[fi.Name] {
+			t.Errorf("ListZip %s: got encoding %q, want %q", fi.Name, fi.Encoding, want[fi.Name])
+		}
+		if fi.Binary != (fi.Name == "binary") {
+			t.Errorf("ListZip %s: got binary %v", fi.Name, fi.Binary)
+		}
+	}
+}
+
+func TestPrepareZip_metrics(t *testing.T) {
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		return emptyTar(t), nil
+	}
+	hits := testutil.ToFloat64(cacheLookups.WithLabelValues("hit"))
+	misses := testutil.ToFloat64(cacheLookups.WithLabelValues("miss"))
+	bytes := testutil.ToFloat64(fetchBytes)
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := testutil.ToFloat64(cacheLookups.WithLabelValues("miss")) - misses; got != 1 {
+		t.Errorf("got %v cache misses, want 1", got)
+	}
+	if got := testutil.ToFloat64(cacheLookups.WithLabelValues("hit")) - hits; got != 1 {
+		t.Errorf("got %v cache hits, want 1", got)
+	}
+	if got := testutil.ToFloat64(fetchBytes) - bytes; got == 0 {
+		t.Error("expected the fetched bytes to be counted")
+	}
+}
+
+func TestPrepareZip_coalesce(t *testing.T) {
+	fetchErr := errors.New("test")
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	var fetches int32
+	unblock := make(chan struct{})
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-unblock
+		return nil, fetchErr
+	}
+	coalesced := testutil.ToFloat64(cacheLookups.WithLabelValues("coalesced"))
+
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+			errs <- err
+		}()
+	}
+	// Give every request time to wait for the first one's fetch.
+	time.Sleep(100 * time.Millisecond)
+	close(unblock)
+	for i := 0; i < n; i++ {
+		if err := <-errs; errors.Cause(err) != fetchErr {
+			t.Fatalf("expected PrepareZip to fail with %v, failed with %v", fetchErr, err)
+		}
+	}
+	if got := atomic.LoadInt32(&fetches); got != 1 {
+		t.Errorf("got %d fetches, want 1", got)
+	}
+	if got := testutil.ToFloat64(cacheLookups.WithLabelValues("coalesced")) - coalesced; got != n-1 {
+		t.Errorf("got %v coalesced lookups, want %d", got, n-1)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		return emptyTar(t), nil
+	}
+	hits := testutil.ToFloat64(cacheLookups.WithLabelValues("hit"))
+
+	for i, want := range []bool{true, false} {
+		fetched, err := s.Prefetch(context.Background(), gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fetched != want {
+			t.Errorf("prefetch %d: got fetched %v, want %v", i, fetched, want)
+		}
+	}
+	if got := testutil.ToFloat64(cacheLookups.WithLabelValues("hit")) - hits; got != 0 {
+		t.Errorf("got %v cache hits, want prefetching a cached archive not to count", got)
+	}
+}
+
+func TestFetchesStalled(t *testing.T) {
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	s.SetMaxConcurrentFetchTar(1)
+	fetching := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		fetching <- struct{}{}
+		<-unblock
+		return emptyTar(t), nil
+	}
+	if s.FetchesStalled(0) {
+		t.Fatal("expected no stalled fetches before fetching")
+	}
+
+	// The second fetch waits for the first, which hangs.
+	errs := make(chan error, 2)
+	for _, commit := range []api.CommitID{"deadbeefdeadbeefdeadbeefdeadbeefdeadbeef", "cafebabecafebabecafebabecafebabecafebabe"} {
+		go func(commit api.CommitID) {
+			_, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, commit)
+			errs <- err
+		}(commit)
+	}
+	<-fetching
+	for i := 0; !s.FetchesStalled(0); i++ {
+		if i == 500 {
+			t.Fatal("timed out waiting for the second fetch to wait")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.FetchesStalled(time.Hour) {
+		t.Error("expected fetches not to be stalled for an hour")
+	}
+
+	close(unblock)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.FetchesStalled(0) {
+		t.Error("expected no stalled fetches once every fetch finished")
+	}
+}
+
+func TestWaitPrepared(t *testing.T) {
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	fetching := make(chan struct{})
+	unblock := make(chan struct{})
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		close(fetching)
+		<-unblock
+		return emptyTar(t), nil
+	}
+
+	// The fetch continues in the background once the request is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-fetching
+		cancel()
+	}()
+	if _, err := s.PrepareZip(ctx, gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"); err != context.Canceled {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+	if err := s.WaitPrepared(timeout); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v while the fetch hangs, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(unblock)
+	if err := s.WaitPrepared(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.StatZip(gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"); err != nil {
+		t.Errorf("expected the archive to be cached once the fetch finished: %v", err)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		return emptyTar(t), nil
+	}
+	path, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The checksum of the archive counts towards the size of the cache.
+	var want int64
+	for _, p := range []string{path, path + checksumSuffix} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want += fi.Size()
+	}
+	if used, err := usedDiskBytes(s.Path); err != nil || used != want {
+		t.Errorf("got %d bytes used (err=%v), want %d", used, err, want)
+	}
+
+	before := testutil.ToFloat64(evictionsByCause.WithLabelValues(evictCauseSize))
+	stats, err := s.cache.Evict(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Evicted != 1 {
+		t.Fatalf("expected 1 archive to be evicted, got %d", stats.Evicted)
+	}
+	if stats.CacheSize != want {
+		t.Errorf("got cache size %d, want %d", stats.CacheSize, want)
+	}
+	for _, p := range []string{path, path + checksumSuffix} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got err=%v", p, err)
+		}
+	}
+	if got := testutil.ToFloat64(evictionsByCause.WithLabelValues(evictCauseSize)) - before; got != 1 {
+		t.Errorf("expected 1 size eviction to be counted, got %v", got)
+	}
+}
+
+func TestPrepareZip_diskFull(t *testing.T) {
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	fetchTar := func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		return emptyTar(t), nil
+	}
+	s.FetchTar = fetchTar
+	commit := api.CommitID("deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+	path, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// MinFreeDiskBytes is read by background goroutines once the Store is
+	// started, so stores sharing the cache are used to change it. No
+	// volume has this much space free, so every archive is evicted before
+	// the fetch fails.
+	full := &Store{Path: s.Path, FetchTar: fetchTar, MinFreeDiskBytes: 1 << 62}
+	before := testutil.ToFloat64(evictionsByCause.WithLabelValues(evictCauseDisk))
+	_, err = full.PrepareZip(context.Background(), gitserver.Repo{Name: "bar"}, commit)
+	if e, ok := errors.Cause(err).(*DiskFullError); !ok || e.Min != full.MinFreeDiskBytes || e.Dir != s.Path {
+		t.Fatalf("got error %v, want a *DiskFullError", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be evicted, got err=%v", path, err)
+	}
+	if got := testutil.ToFloat64(evictionsByCause.WithLabelValues(evictCauseDisk)) - before; got != 1 {
+		t.Errorf("expected 1 disk eviction to be counted, got %v", got)
+	}
+	if fis, err := ioutil.ReadDir(s.Path); err != nil || len(fis) != 0 {
+		t.Errorf("expected the cache to be empty, got %d files (err=%v)", len(fis), err)
+	}
+
+	enough := &Store{Path: s.Path, FetchTar: fetchTar, MinFreeDiskBytes: 1}
+	if _, err := enough.PrepareZip(context.Background(), gitserver.Repo{Name: "bar"}, commit); err != nil {
+		t.Errorf("expected the fetch to succeed once there is enough space: %v", err)
+	}
+}
+
+func TestEvictPolicy(t *testing.T) {
+	commit := api.CommitID("deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+	// prepare caches an archive of each repo, the first being the least
+	// recently used. a is used the most.
+	prepare := func(t *testing.T, s *Store) map[api.RepoName]string {
+		s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+			return emptyTar(t), nil
+		}
+		paths := map[api.RepoName]string{}
+		for i, repo := range []api.RepoName{"mono", "a", "b"} {
+			path, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: repo}, commit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mtime := time.Now().Add(time.Duration(i-3) * time.Hour)
+			if err := os.Chtimes(path, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			paths[repo] = path
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "a"}, commit); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Chtimes(paths["a"], time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		return paths
+	}
+	// evictOne evicts a single archive and returns which.
+	evictOne := func(t *testing.T, s *Store, paths map[api.RepoName]string) (api.RepoName, diskcache.EvictStats) {
+		size, err := usedDiskBytes(s.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := s.cache.Evict(size - 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var evicted []api.RepoName
+		for repo, path := range paths {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				evicted = append(evicted, repo)
+			}
+		}
+		if len(evicted) != 1 {
+			t.Fatalf("expected 1 archive to be evicted, got %v", evicted)
+		}
+		return evicted[0], stats
+	}
+
+	t.Run("lru", func(t *testing.T) {
+		s, cleanup := tmpStore(t)
+		defer cleanup()
+		s.RetainRepos = []string{"mo*"}
+		paths := prepare(t, s)
+		if got, _ := evictOne(t, s, paths); got != "a" {
+			t.Errorf("evicted %s, want a", got)
+		}
+	})
+
+	t.Run("lfu", func(t *testing.T) {
+		s, cleanup := tmpStore(t)
+		defer cleanup()
+		s.EvictPolicy = EvictLFU
+		s.RetainRepos = []string{"mono"}
+		paths := prepare(t, s)
+		if got, _ := evictOne(t, s, paths); got != "b" {
+			t.Errorf("evicted %s, want b", got)
+		}
+	})
+
+	t.Run("pinned", func(t *testing.T) {
+		s, cleanup := tmpStore(t)
+		defer cleanup()
+		paths := prepare(t, s)
+		zf, err := s.ZipCache.Get(paths["mono"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, stats := evictOne(t, s, paths)
+		zf.Close()
+		if got != "a" || stats.Pinned != 1 {
+			t.Errorf("evicted %s with %d pinned, want a with 1", got, stats.Pinned)
+		}
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		s, cleanup := tmpStore(t)
+		defer cleanup()
+		s.EvictPolicy = EvictTTL
+		s.CacheTTL = 150 * time.Minute
+		paths := prepare(t, s)
+		before := testutil.ToFloat64(evictionsByCause.WithLabelValues(evictCauseTTL))
+		if _, err := s.cache.Evict(1 << 40); err != nil {
+			t.Fatal(err)
+		}
+		for repo, path := range paths {
+			_, err := os.Stat(path)
+			if evicted := os.IsNotExist(err); evicted != (repo == "mono") {
+				t.Errorf("%s: got evicted %v, want only mono to expire", repo, evicted)
+			}
+		}
+		if got := testutil.ToFloat64(evictionsByCause.WithLabelValues(evictCauseTTL)) - before; got != 1 {
+			t.Errorf("expected 1 ttl eviction to be counted, got %v", got)
+		}
+	})
+}
+
 func TestIngoreSizeMax(t *testing.T) {
 	patterns := []string{
 		"foo",
@@ -0,0 +1,345 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// trigramIndexSuffix is appended to the path of an archive to get the
+	// path of its trigram index sidecar. The sidecar is removed when the
+	// archive is evicted.
+	trigramIndexSuffix = ".trigrams"
+
+	// trigramIndexVersion is the version of the sidecar format. Sidecars
+	// of other versions are ignored and rebuilt, so it must be bumped when
+	// the format or the trigrams indexed change.
+	trigramIndexVersion = 1
+
+	// maxLoadedTrigramIndexes bounds the number of trigram indexes kept in
+	// memory.
+	maxLoadedTrigramIndexes = 64
+)
+
+// trigramIndexMagic starts every trigram index sidecar.
+var trigramIndexMagic = []byte("SGTRGM")
+
+// TrigramIndex records which files of an archive contain each trigram
+// (sequence of three bytes) of their content. Trigrams are ASCII lower
+// cased, so the index can prune files for case sensitive and insensitive
+// searches.
+type TrigramIndex struct {
+	paths    []string
+	postings map[uint32][]uint32 // trigram -> sorted indexes into paths
+}
+
+// Candidates returns the paths of the files which may contain all of
+// literals, ie the files containing every trigram of them. Literals shorter
+// than a trigram don't restrict the result. ok is false if no literal
+// restricts it, in which case every file is a candidate.
+func (idx *TrigramIndex) Candidates(literals []string) (paths map[string]bool, ok bool) {
+	var files []uint32
+	for _, lit := range literals {
+		for _, t := range trigrams([]byte(lit)) {
+			posting := idx.postings[t]
+			if !ok {
+				files = append([]uint32(nil), posting...)
+				ok = true
+			} else {
+				files = intersect(files, posting)
+			}
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	paths = make(map[string]bool, len(files))
+	for _, i := range files {
+		paths[idx.paths[i]] = true
+	}
+	return paths, true
+}
+
+// intersect returns the elements of a which are also in b. Both must be
+// sorted. It reuses a.
+func intersect(a, b []uint32) []uint32 {
+	out := a[:0]
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// trigrams returns the distinct ASCII lower cased trigrams of b.
+func trigrams(b []byte) []uint32 {
+	if len(b) < 3 {
+		return nil
+	}
+	seen := make(map[uint32]bool, len(b))
+	var ts []uint32
+	for i := 0; i+3 <= len(b); i++ {
+		t := uint32(toLowerASCII(b[i]))<<16 | uint32(toLowerASCII(b[i+1]))<<8 | uint32(toLowerASCII(b[i+2]))
+		if !seen[t] {
+			seen[t] = true
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+func toLowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func computeTrigramIndex(zf *ZipFile) *TrigramIndex {
+	idx := &TrigramIndex{
+		paths:    make([]string, len(zf.Files)),
+		postings: map[uint32][]uint32{},
+	}
+	for i := range zf.Files {
+		f := &zf.Files[i]
+		idx.paths[i] = f.Name
+		if zf.Binary[f.Name] {
+			// Only searches asking for binary files search them, and those
+			// don't use the index.
+			continue
+		}
+		// Files are visited in order, so postings stay sorted.
+		for _, t := range trigrams(zf.DataFor(f)) {
+			idx.postings[t] = append(idx.postings[t], uint32(i))
+		}
+	}
+	return idx
+}
+
+// writeTo writes idx in the sidecar format: the magic and version, the
+// paths, then each trigram with its delta encoded posting list, all as
+// uvarints.
+func (idx *TrigramIndex) writeTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(buf, v)
+		_, _ = bw.Write(buf[:n])
+	}
+
+	_, _ = bw.Write(trigramIndexMagic)
+	putUvarint(trigramIndexVersion)
+	putUvarint(uint64(len(idx.paths)))
+	for _, p := range idx.paths {
+		putUvarint(uint64(len(p)))
+		_, _ = bw.WriteString(p)
+	}
+
+	ts := make([]uint32, 0, len(idx.postings))
+	for t := range idx.postings {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+	putUvarint(uint64(len(ts)))
+	for _, t := range ts {
+		posting := idx.postings[t]
+		putUvarint(uint64(t))
+		putUvarint(uint64(len(posting)))
+		prev := uint32(0)
+		for _, i := range posting {
+			putUvarint(uint64(i - prev))
+			prev = i
+		}
+	}
+	return bw.Flush()
+}
+
+var errTrigramIndexVersion = errors.New("trigram index has a different version")
+
+// readTrigramIndex reads a trigram index written by writeTo.
+func readTrigramIndex(b []byte) (*TrigramIndex, error) {
+	if !bytes.HasPrefix(b, trigramIndexMagic) {
+		return nil, errors.New("not a trigram index")
+	}
+	r := bytes.NewReader(b[len(trigramIndexMagic):])
+	uvarint := func() uint64 {
+		v, _ := binary.ReadUvarint(r)
+		return v
+	}
+	if v, err := binary.ReadUvarint(r); err != nil || v != trigramIndexVersion {
+		return nil, errTrigramIndexVersion
+	}
+
+	nPaths := uvarint()
+	if nPaths > uint64(r.Len()) {
+		return nil, errors.New("corrupt trigram index")
+	}
+	idx := &TrigramIndex{paths: make([]string, nPaths)}
+	for i := range idx.paths {
+		n := uvarint()
+		if n > uint64(r.Len()) {
+			return nil, errors.New("corrupt trigram index")
+		}
+		p := make([]byte, n)
+		_, _ = io.ReadFull(r, p)
+		idx.paths[i] = string(p)
+	}
+
+	nTrigrams := uvarint()
+	if nTrigrams > uint64(r.Len()) {
+		return nil, errors.New("corrupt trigram index")
+	}
+	idx.postings = make(map[uint32][]uint32, nTrigrams)
+	for ; nTrigrams > 0; nTrigrams-- {
+		t := uint32(uvarint())
+		n := uvarint()
+		if n > uint64(r.Len()) {
+			return nil, errors.New("corrupt trigram index")
+		}
+		posting := make([]uint32, n)
+		prev := uint32(0)
+		for i := range posting {
+			prev += uint32(uvarint())
+			if uint64(prev) >= nPaths {
+				return nil, errors.New("corrupt trigram index")
+			}
+			posting[i] = prev
+		}
+		idx.postings[t] = posting
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("corrupt trigram index")
+	}
+	return idx, nil
+}
+
+// trigramIndexes tracks how often archives are searched, and the trigram
+// indexes loaded into memory. The zero value is ready to use.
+type trigramIndexes struct {
+	mu       sync.Mutex
+	searches map[string]int // archive path -> searches without an index
+	loaded   map[string]*TrigramIndex
+}
+
+// forget drops the state of the archive at path.
+func (t *trigramIndexes) forget(path string) {
+	t.mu.Lock()
+	delete(t.searches, path)
+	delete(t.loaded, path)
+	t.mu.Unlock()
+}
+
+// TrigramIndex returns the trigram index of zf, the archive at path, to
+// be used by a search of it. It is read from the archive's sidecar if one
+// exists. Otherwise, once the archive has been searched
+// TrigramIndexThreshold times, it is computed and the sidecar written. It
+// returns nil if the archive has no index (yet).
+func (s *Store) TrigramIndex(path string, zf *ZipFile) *TrigramIndex {
+	if s.TrigramIndexThreshold <= 0 {
+		return nil
+	}
+	t := &s.trigramIndexes
+	t.mu.Lock()
+	if idx, ok := t.loaded[path]; ok {
+		t.mu.Unlock()
+		trigramIndexLookups.WithLabelValues("memory").Inc()
+		return idx
+	}
+	t.mu.Unlock()
+
+	sidecar := path + trigramIndexSuffix
+	idx, err := readTrigramSidecar(sidecar)
+	if err != nil {
+		// A sidecar of another version or a corrupt one is rebuilt below.
+		if err == errTrigramIndexVersion {
+			trigramIndexLookups.WithLabelValues("version_mismatch").Inc()
+		}
+		os.Remove(sidecar)
+	}
+	if idx != nil {
+		trigramIndexLookups.WithLabelValues("sidecar").Inc()
+	} else {
+		t.mu.Lock()
+		if t.searches == nil {
+			t.searches = map[string]int{}
+		}
+		t.searches[path]++
+		build := t.searches[path] >= s.TrigramIndexThreshold
+		t.mu.Unlock()
+		if !build {
+			return nil
+		}
+		idx = computeTrigramIndex(zf)
+		trigramIndexLookups.WithLabelValues("computed").Inc()
+		if err := writeTrigramSidecar(sidecar, idx); err != nil {
+			// Failing to write the sidecar only costs recomputing it once
+			// the archive is no longer in memory.
+			trigramIndexLookups.WithLabelValues("write_failed").Inc()
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.searches, path)
+	if t.loaded == nil {
+		t.loaded = map[string]*TrigramIndex{}
+	}
+	if len(t.loaded) >= maxLoadedTrigramIndexes {
+		// Drop an arbitrary index, it can be read from its sidecar again.
+		for p := range t.loaded {
+			delete(t.loaded, p)
+			break
+		}
+	}
+	t.loaded[path] = idx
+	return idx
+}
+
+// readTrigramSidecar reads the trigram index sidecar at path. It returns
+// nil if there is none.
+func readTrigramSidecar(path string) (*TrigramIndex, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return readTrigramIndex(b)
+}
+
+// writeTrigramSidecar writes idx to path. It writes to a temporary file
+// and renames it so concurrent readers never see a partial sidecar.
+func writeTrigramSidecar(path string, idx *TrigramIndex) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = idx.writeTo(tmp)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
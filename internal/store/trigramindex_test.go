@@ -0,0 +1,101 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/gitserver"
+)
+
+func TestTrigramIndex(t *testing.T) {
+	s, cleanup := tmpStore(t)
+	defer cleanup()
+	s.TrigramIndexThreshold = 2
+	s.FetchTar = func(ctx context.Context, repo gitserver.Repo, commit api.CommitID) (io.ReadCloser, error) {
+		buf := new(bytes.Buffer)
+		w := tar.NewWriter(buf)
+		for name, body := range map[string]string{
+			"a.go": "func ParseConfig() {}\n",
+			"b.go": "func parseFlags() {}\n",
+			"c.go": "var x = 1\n",
+		} {
+			if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(body))}); err != nil {
+				return nil, err
+			}
+			if _, err := w.Write([]byte(body)); err != nil {
+				return nil, err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(buf), nil
+	}
+	path, err := s.PrepareZip(context.Background(), gitserver.Repo{Name: "foo"}, "deadbeefdeadbeefdeadbeefdeadbeefdeadbeef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zf, err := s.ZipCache.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zf.Close()
+
+	// The index is only built once the archive was searched often enough.
+	if idx := s.TrigramIndex(path, zf); idx != nil {
+		t.Fatal("expected no index for the first search")
+	}
+	idx := s.TrigramIndex(path, zf)
+	if idx == nil {
+		t.Fatal("expected an index for the second search")
+	}
+	if _, err := os.Stat(path + trigramIndexSuffix); err != nil {
+		t.Fatal("expected the sidecar to be written:", err)
+	}
+
+	for _, tc := range []struct {
+		literals []string
+		want     map[string]bool
+		ok       bool
+	}{
+		{literals: []string{"parse"}, want: map[string]bool{"a.go": true, "b.go": true}, ok: true},
+		{literals: []string{"Config", "func"}, want: map[string]bool{"a.go": true}, ok: true},
+		{literals: []string{"nowhere"}, want: map[string]bool{}, ok: true},
+		{literals: []string{"x"}},
+	} {
+		got, ok := idx.Candidates(tc.literals)
+		if ok != tc.ok || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Candidates(%q) = %v, %v; want %v, %v", tc.literals, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	// Once dropped from memory the index is read from its sidecar.
+	s.trigramIndexes.forget(path)
+	if got := s.TrigramIndex(path, zf); !reflect.DeepEqual(got, idx) {
+		t.Errorf("sidecar index differs from the computed one: got %+v, want %+v", got, idx)
+	}
+
+	// Sidecars of another version are discarded.
+	s.trigramIndexes.forget(path)
+	b, err := ioutil.ReadFile(path + trigramIndexSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(trigramIndexMagic)] = trigramIndexVersion + 1
+	if err := ioutil.WriteFile(path+trigramIndexSuffix, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if idx := s.TrigramIndex(path, zf); idx != nil {
+		t.Fatal("expected a sidecar of another version to be ignored")
+	}
+	if _, err := os.Stat(path + trigramIndexSuffix); !os.IsNotExist(err) {
+		t.Errorf("expected the sidecar of another version to be removed, got err=%v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tarTrailerSize is the size of the end-of-archive marker of a tar archive:
+// two zero blocks.
+const tarTrailerSize = 2 * 512
+
+// truncatedError is returned when a tar archive fetched from gitserver ends
+// without its end-of-archive marker. tar.Reader does not notice if an
+// archive is cut off between entries, so without this check we would cache
+// an archive with files missing. It is temporary since a refetch usually
+// succeeds.
+type truncatedError struct{}
+
+func (truncatedError) Error() string   { return "archive from gitserver is truncated" }
+func (truncatedError) Temporary() bool { return true }
+
+func isTruncated(err error) bool {
+	_, ok := errors.Cause(err).(truncatedError)
+	return ok
+}
+
+// trailerReader remembers the last tarTrailerSize bytes read from r, to
+// check that a tar archive read through it was complete.
+type trailerReader struct {
+	r    io.Reader
+	tail [tarTrailerSize]byte
+	n    int // number of bytes of tail which have been read
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	b := p[:n]
+	if len(b) >= len(t.tail) {
+		t.n = copy(t.tail[:], b[len(b)-len(t.tail):])
+		return n, err
+	}
+	keep := len(t.tail) - len(b)
+	if keep > t.n {
+		keep = t.n
+	}
+	copy(t.tail[:], t.tail[t.n-keep:t.n])
+	t.n = keep + copy(t.tail[keep:], b)
+	return n, err
+}
+
+// terminated reports whether the last bytes read were the end-of-archive
+// marker. tar.Reader stops reading right after it. An archive cut off after
+// an entry whose content ends in tarTrailerSize zero bytes is not detected.
+func (t *trailerReader) terminated() bool {
+	if t.n < len(t.tail) {
+		return false
+	}
+	for _, b := range t.tail {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+var truncatedFetches = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "searcher",
+	Subsystem: "store",
+	Name:      "truncated_fetches_total",
+	Help:      "The total number of archives fetched from gitserver which were truncated.",
+})
+
+func init() {
+	prometheus.MustRegister(truncatedFetches)
+}
@@ -10,7 +10,9 @@ import (
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
@@ -53,6 +55,7 @@ func (c *ZipCache) Get(path string) (*ZipFile, error) {
 	zf, ok := shard.m[path]
 	if ok {
 		zf.wg.Add(1)
+		atomic.AddInt32(&zf.refs, 1)
 		return zf, nil
 	}
 	// Cache miss.
@@ -64,9 +67,19 @@ func (c *ZipCache) Get(path string) (*ZipFile, error) {
 	}
 	shard.m[path] = zf
 	zf.wg.Add(1)
+	atomic.AddInt32(&zf.refs, 1)
 	return zf, nil
 }
 
+// inUse reports whether the zip file at path is open.
+func (c *ZipCache) inUse(path string) bool {
+	shard := c.shardFor(path)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	zf, ok := shard.m[path]
+	return ok && atomic.LoadInt32(&zf.refs) > 0
+}
+
 func (c *ZipCache) delete(path string) {
 	shard := c.shardFor(path)
 	shard.mu.Lock()
@@ -99,9 +112,38 @@ type ZipFile struct {
 	// There are many zipFiles present during typical usage.
 	Files  []SrcFile
 	MaxLen int
-	Data   []byte
-	f      *os.File
-	wg     sync.WaitGroup // ensures underlying file is not munmap'd or closed while in use
+	// Data is the archive mmapped read-only, unless it is compressed.
+	// DataFor slices it, so files are searched in place without being
+	// copied to the heap and the OS page cache holds their content.
+	Data []byte
+	f    *os.File
+	wg   sync.WaitGroup // ensures underlying file is not munmap'd or closed while in use
+	refs int32          // number of users, accessed atomically
+
+	// compressed is whether the archive's files are compressed on disk, in
+	// which case Data holds their decompressed contents.
+	compressed bool
+
+	// Encodings is the original encoding of the files which were
+	// transcoded to UTF-8 (see sniffEncoding), by name. It is nil if there
+	// are none.
+	Encodings map[string]string
+
+	// Binary is the set of names of binary files (see isBinary). It is nil
+	// if there are none. Archives cached before binary files were kept
+	// have them empty and unmarked.
+	Binary map[string]bool
+
+	// TooLarge is the set of names of files whose content was not cached
+	// because they are larger than Store.MaxFileSize. It is nil if there
+	// are none.
+	TooLarge map[string]bool
+
+	// ModTimes is the modification time of the files in the archive they
+	// were fetched from, by name. It is nil if all files have the same
+	// time, as in archives created by git archive, which uses the time of
+	// the commit.
+	ModTimes map[string]time.Time
 }
 
 func readZipFile(path string) (*ZipFile, error) {
@@ -114,11 +156,33 @@ func readZipFile(path string) (*ZipFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Archives are only read from disk once, so verifying them here costs
+	// little compared to searching them.
+	if err := verifyChecksum(path, f, fi.Size()); err != nil {
+		f.Close()
+		return nil, err
+	}
 	r, err := zip.NewReader(f, fi.Size())
 	if err != nil {
 		return nil, err
 	}
 
+	compressed, err := zipCompressed(r)
+	if err != nil {
+		return nil, err
+	}
+	if compressed {
+		zf := new(ZipFile)
+		err := zf.decompressFiles(r)
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return nil, err
+		}
+		return zf, nil
+	}
+
 	// Create at populate ZipFile from contents.
 	zf := &ZipFile{f: f}
 	if err := zf.PopulateFiles(r); err != nil {
@@ -156,7 +220,9 @@ func (f *ZipFile) PopulateFiles(r *zip.Reader) error {
 		if size > f.MaxLen {
 			f.MaxLen = size
 		}
+		f.addExtras(file)
 	}
+	f.dropUniformModTimes()
 
 	// We want sequential reads.
 	// We wrote this zip file ourselves, in one pass,
@@ -166,14 +232,84 @@ func (f *ZipFile) PopulateFiles(r *zip.Reader) error {
 	return nil
 }
 
+// addExtras records the encoding of file in f.Encodings if it was
+// transcoded, whether it is binary or too large in f.Binary and f.TooLarge,
+// and its modification time in f.ModTimes.
+func (f *ZipFile) addExtras(file *zip.File) {
+	if f.ModTimes == nil {
+		f.ModTimes = map[string]time.Time{}
+	}
+	f.ModTimes[file.Name] = file.Modified
+	if enc := parseEncodingExtra(file.Extra); enc != "" {
+		if f.Encodings == nil {
+			f.Encodings = map[string]string{}
+		}
+		f.Encodings[file.Name] = enc
+	}
+	if _, ok := findExtra(file.Extra, binaryExtraID); ok {
+		if f.Binary == nil {
+			f.Binary = map[string]bool{}
+		}
+		f.Binary[file.Name] = true
+	}
+	if _, ok := findExtra(file.Extra, tooLargeExtraID); ok {
+		if f.TooLarge == nil {
+			f.TooLarge = map[string]bool{}
+		}
+		f.TooLarge[file.Name] = true
+	}
+}
+
+// dropUniformModTimes sets f.ModTimes to nil if all files have the same
+// modification time, since it is then useless to order them.
+func (f *ZipFile) dropUniformModTimes() {
+	var (
+		first time.Time
+		seen  bool
+	)
+	for _, t := range f.ModTimes {
+		if !seen {
+			first, seen = t, true
+		} else if !t.Equal(first) {
+			return
+		}
+	}
+	f.ModTimes = nil
+}
+
+// Compressed reports whether the files of f are compressed on disk. Tools
+// reading the archive directly may need an uncompressed copy (see
+// WriteUncompressed).
+func (f *ZipFile) Compressed() bool {
+	return f.compressed
+}
+
 // Close allows resources associated with f to be released.
 // It MUST be called exactly once for every file retrieved using get.
 // Contents from any SrcFile from within f MUST NOT be used after
 // Close has been called.
 func (f *ZipFile) Close() {
+	atomic.AddInt32(&f.refs, -1)
 	f.wg.Done()
 }
 
+// NewZipFile returns an in-memory ZipFile backed by data, which must be a zip
+// archive whose files are stored uncompressed. Unlike files retrieved from a
+// ZipCache, data is not copied or mmapped. The returned ZipFile must be
+// closed.
+func NewZipFile(data []byte) (*ZipFile, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	zf := &ZipFile{Data: data}
+	if err := zf.PopulateFiles(r); err != nil {
+		return nil, err
+	}
+	zf.wg.Add(1)
+	return zf, nil
+}
+
 func MockZipFile(data []byte) (*ZipFile, error) {
 	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
 	if err != nil {
@@ -15,6 +15,12 @@ var SpanURL = func(span opentracing.Span) string {
 	return "#tracer-not-enabled"
 }
 
+// SpanTraceID returns the ID of the trace the given span belongs to, or ""
+// if the tracer does not have trace IDs. The span must be non-nil.
+var SpanTraceID = func(span opentracing.Span) string {
+	return ""
+}
+
 // New returns a new Trace with the specified family and title.
 func New(ctx context.Context, family, title string) (*Trace, context.Context) {
 	tr := Tracer{Tracer: opentracing.GlobalTracer()}
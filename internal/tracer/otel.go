@@ -0,0 +1,79 @@
+package tracer
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/internal/env"
+	"github.com/sourcegraph/sourcegraph/internal/trace"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/propagation"
+	oteltrace "go.opentelemetry.io/otel/api/trace"
+	otelbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/sdk/resource/resourcekeys"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+var (
+	tracerType   = env.Get("SRC_TRACER", "", "if opentelemetry, spans are exported over OTLP to OTEL_EXPORTER_OTLP_ENDPOINT and propagated with W3C traceparent headers. Otherwise the tracer is configured in the site configuration (useJaeger or lightstepAccessToken)")
+	otlpEndpoint = env.Get("OTEL_EXPORTER_OTLP_ENDPOINT", "localhost:55680", "with SRC_TRACER=opentelemetry, the address of the OpenTelemetry collector spans are exported to")
+)
+
+// initOpenTelemetry makes the global opentracing tracer a bridge to an
+// OpenTelemetry tracer exporting to otlpEndpoint, so that code instrumented
+// with opentracing is traced by OpenTelemetry without changes. Trace context
+// is propagated in the W3C format, so traces continue across services using
+// other OpenTelemetry SDKs.
+func initOpenTelemetry(serviceName string) error {
+	exporter, err := otlp.NewExporter(otlp.WithInsecure(), otlp.WithAddress(otlpEndpoint))
+	if err != nil {
+		return err
+	}
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResourceAttributes(kv.String(resourcekeys.ServiceKeyName, serviceName)),
+	)
+	if err != nil {
+		return err
+	}
+
+	propagators := propagation.New(
+		propagation.WithInjectors(oteltrace.TraceContext{}),
+		propagation.WithExtractors(oteltrace.TraceContext{}),
+	)
+	global.SetPropagators(propagators)
+
+	bridge, wrapper := otelbridge.NewTracerPair(provider.Tracer(serviceName))
+	bridge.SetPropagators(propagators)
+	bridge.SetWarningHandler(func(msg string) {
+		log15.Debug("OpenTelemetry bridge", "warning", strings.TrimSpace(msg))
+	})
+	global.SetTraceProvider(wrapper)
+	opentracing.SetGlobalTracer(bridge)
+
+	trace.SpanURL = otelSpanTraceID
+	trace.SpanTraceID = otelSpanTraceID
+	return nil
+}
+
+// otelSpanTraceID returns the trace ID of a span of the OpenTelemetry
+// bridge. The bridge doesn't expose the IDs of its spans, so they are read
+// back from the traceparent header it propagates them in, which is
+// version-traceID-spanID-flags.
+func otelSpanTraceID(span opentracing.Span) string {
+	h := http.Header{}
+	if err := span.Tracer().Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h)); err != nil {
+		return ""
+	}
+	parts := strings.Split(h.Get("traceparent"), "-")
+	if len(parts) < 4 {
+		return ""
+	}
+	return parts[1]
+}
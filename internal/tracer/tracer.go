@@ -113,6 +113,8 @@ func Init(options ...Option) {
 	switch env.LogFormat {
 	case "condensed":
 		handler = log15.StreamHandler(os.Stderr, log15.FormatFunc(condensedFormat))
+	case "json":
+		handler = log15.StreamHandler(os.Stderr, log15.JsonFormat())
 	case "logfmt":
 		fallthrough
 	default:
@@ -127,6 +129,13 @@ func Init(options ...Option) {
 		handler = log15.LvlFilterHandler(lvl, handler)
 	}
 	log15.Root().SetHandler(log15.LvlFilterHandler(lvl, handler))
+	if tracerType == "opentelemetry" {
+		log15.Info("Distributed tracing enabled", "tracer", "opentelemetry", "endpoint", otlpEndpoint)
+		if err := initOpenTelemetry(opts.serviceName); err != nil {
+			log.Printf("Could not initialize OpenTelemetry tracer: %s", err.Error())
+		}
+		return
+	}
 	if conf.Get().UseJaeger {
 		log15.Info("Distributed tracing enabled", "tracer", "jaeger")
 		cfg, err := jaegercfg.FromEnv()
@@ -151,6 +160,7 @@ func Init(options ...Option) {
 			return
 		}
 		trace.SpanURL = jaegerSpanURL
+		trace.SpanTraceID = jaegerSpanTraceID
 		return
 	}
 
@@ -166,6 +176,7 @@ func Init(options ...Option) {
 			DropSpanLogs: !lightstepIncludeSensitive,
 		}))
 		trace.SpanURL = lightStepSpanURL
+		trace.SpanTraceID = lightStepSpanTraceID
 
 		// Ignore warnings from the tracer about SetTag calls with unrecognized value types. The
 		// github.com/lightstep/lightstep-tracer-go package calls fmt.Sprintf("%#v", ...) on them, which is fine.
@@ -188,7 +199,23 @@ func lightStepSpanURL(span opentracing.Span) string {
 	return fmt.Sprintf("https://app.lightstep.com/%s/trace?span_guid=%x&at_micros=%d#span-%x", conf.Get().LightstepProject, spanCtx.SpanID, t, spanCtx.SpanID)
 }
 
+func lightStepSpanTraceID(span opentracing.Span) string {
+	spanCtx, ok := span.Context().(lightstep.SpanContext)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%x", spanCtx.TraceID)
+}
+
 func jaegerSpanURL(span opentracing.Span) string {
 	spanCtx := span.Context().(jaeger.SpanContext)
 	return spanCtx.TraceID().String()
 }
+
+func jaegerSpanTraceID(span opentracing.Span) string {
+	spanCtx, ok := span.Context().(jaeger.SpanContext)
+	if !ok {
+		return ""
+	}
+	return spanCtx.TraceID().String()
+}